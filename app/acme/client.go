@@ -0,0 +1,418 @@
+// Package acme issues and renews TLS certificate with ACME protocol (RFC 8555), e.g. by Let's Encrypt.
+// Domains are validated with http-01 or tls-alpn-01 challenge, account key and certificate are kept in cache dir
+package acme
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LetsEncrypt is directory of Let's Encrypt production ACME server
+const LetsEncrypt = "https://acme-v02.api.letsencrypt.org/directory"
+
+// Status of ACME order, authorization and challenge
+const (
+	statusPending = "pending"
+	statusValid   = "valid"
+	statusInvalid = "invalid"
+	statusReady   = "ready"
+)
+
+// maxResponseSize limits body of ACME server response
+const maxResponseSize = 1 << 20
+
+// client makes requests to ACME server signed with account key
+type client struct {
+	directoryURL string
+	key          *ecdsa.PrivateKey
+	httpClient   *http.Client
+	pollInterval time.Duration
+
+	lock   sync.Mutex
+	dir    *directory
+	nonces []string
+	kid    string // account URL
+}
+
+type directory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type order struct {
+	URL            string   `json:"-"`
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+	Error          *Problem `json:"error"`
+}
+
+type authorization struct {
+	Identifier identifier  `json:"identifier"`
+	Status     string      `json:"status"`
+	Challenges []challenge `json:"challenges"`
+}
+
+type challenge struct {
+	Type   string   `json:"type"`
+	URL    string   `json:"url"`
+	Token  string   `json:"token"`
+	Status string   `json:"status"`
+	Error  *Problem `json:"error"`
+}
+
+// Problem is error reported by ACME server (RFC 7807)
+type Problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p *Problem) Error() string {
+	return fmt.Sprintf("%s: %s", p.Type, p.Detail)
+}
+
+// jwk is public part of account key, fields are in lexicographic order required by thumbprint (RFC 7638)
+type jwk struct {
+	Crv string `json:"crv"`
+	Kty string `json:"kty"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func publicJWK(key *ecdsa.PublicKey) jwk {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	return jwk{Crv: key.Curve.Params().Name, Kty: "EC", X: encode(key.X.FillBytes(make([]byte, size))),
+		Y: encode(key.Y.FillBytes(make([]byte, size)))}
+}
+
+// thumbprint is base64url encoded sha256 of account key jwk (RFC 7638)
+func thumbprint(key *ecdsa.PublicKey) string {
+	data, _ := json.Marshal(publicJWK(key))
+	sum := sha256.Sum256(data)
+	return encode(sum[:])
+}
+
+// keyAuthorization is response to challenge with token
+func keyAuthorization(key *ecdsa.PublicKey, token string) string {
+	return token + "." + thumbprint(key)
+}
+
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// register gets directory and creates account of the key, existing account of the key is reused by server
+func (c *client) register(ctx context.Context, email string) error {
+	if c.kid != "" {
+		return nil
+	}
+	if err := c.discover(ctx); err != nil {
+		return err
+	}
+	req := struct {
+		Contact              []string `json:"contact,omitempty"`
+		TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+	}{TermsOfServiceAgreed: true}
+	if email != "" {
+		req.Contact = []string{"mailto:" + email}
+	}
+	resp, err := c.post(ctx, c.dir.NewAccount, req, nil)
+	if err != nil {
+		return fmt.Errorf("can't register ACME account: %w", err)
+	}
+	_ = resp.Body.Close()
+	if c.kid = resp.Header.Get("Location"); c.kid == "" {
+		return errors.New("can't register ACME account: no account URL in response")
+	}
+	return nil
+}
+
+func (c *client) discover(ctx context.Context) error {
+	if c.dir != nil {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.directoryURL, http.NoBody)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("can't get ACME directory %s: %w", c.directoryURL, err)
+	}
+	defer resp.Body.Close() // nolint
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("can't get ACME directory %s: status %d", c.directoryURL, resp.StatusCode)
+	}
+	dir := &directory{}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(dir); err != nil {
+		return fmt.Errorf("can't decode ACME directory %s: %w", c.directoryURL, err)
+	}
+	if dir.NewNonce == "" || dir.NewAccount == "" || dir.NewOrder == "" {
+		return fmt.Errorf("ACME directory %s is incomplete", c.directoryURL)
+	}
+	c.dir = dir
+	return nil
+}
+
+// newOrder asks certificate for domains
+func (c *client) newOrder(ctx context.Context, domains []string) (*order, error) {
+	req := struct {
+		Identifiers []identifier `json:"identifiers"`
+	}{}
+	for _, d := range domains {
+		req.Identifiers = append(req.Identifiers, identifier{Type: "dns", Value: d})
+	}
+	res := &order{}
+	resp, err := c.post(ctx, c.dir.NewOrder, req, res)
+	if err != nil {
+		return nil, fmt.Errorf("can't make ACME order: %w", err)
+	}
+	res.URL = resp.Header.Get("Location")
+	return res, nil
+}
+
+// waitOrder polls order until it's not pending or processing
+func (c *client) waitOrder(ctx context.Context, o *order, statuses ...string) (*order, error) {
+	for {
+		for _, s := range statuses {
+			if o.Status == s {
+				return o, nil
+			}
+		}
+		if o.Status == statusInvalid {
+			if o.Error != nil {
+				return nil, fmt.Errorf("ACME order is invalid: %w", o.Error)
+			}
+			return nil, errors.New("ACME order is invalid")
+		}
+		if err := sleep(ctx, c.pollInterval); err != nil {
+			return nil, err
+		}
+		url := o.URL
+		o = &order{URL: url}
+		if _, err := c.post(ctx, url, nil, o); err != nil {
+			return nil, fmt.Errorf("can't get ACME order: %w", err)
+		}
+	}
+}
+
+// authorize validates domain of authorization with challenge, solve is called to publish key authorization
+// and its returned func removes it
+func (c *client) authorize(ctx context.Context, url, challengeType string,
+	solve func(domain, token, keyAuth string) func()) error {
+	authz := &authorization{}
+	if _, err := c.post(ctx, url, nil, authz); err != nil {
+		return fmt.Errorf("can't get ACME authorization: %w", err)
+	}
+	if authz.Status == statusValid {
+		return nil
+	}
+	var chal *challenge
+	for i := range authz.Challenges {
+		if authz.Challenges[i].Type == challengeType {
+			chal = &authz.Challenges[i]
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("ACME server doesn't offer %s challenge for %s", challengeType, authz.Identifier.Value)
+	}
+
+	cleanup := solve(authz.Identifier.Value, chal.Token, keyAuthorization(&c.key.PublicKey, chal.Token))
+	defer cleanup()
+	resp, err := c.post(ctx, chal.URL, struct{}{}, nil)
+	if err != nil {
+		return fmt.Errorf("can't accept ACME challenge for %s: %w", authz.Identifier.Value, err)
+	}
+	_ = resp.Body.Close()
+	for {
+		if err := sleep(ctx, c.pollInterval); err != nil {
+			return err
+		}
+		authz = &authorization{}
+		if _, err := c.post(ctx, url, nil, authz); err != nil {
+			return fmt.Errorf("can't get ACME authorization: %w", err)
+		}
+		switch authz.Status {
+		case statusPending:
+			continue
+		case statusValid:
+			return nil
+		}
+		for _, ch := range authz.Challenges {
+			if ch.Type == challengeType && ch.Error != nil {
+				return fmt.Errorf("%s challenge for %s failed: %w", challengeType, authz.Identifier.Value, ch.Error)
+			}
+		}
+		return fmt.Errorf("authorization of %s is %s", authz.Identifier.Value, authz.Status)
+	}
+}
+
+// finalize sends csr of ready order and downloads issued certificate chain in PEM
+func (c *client) finalize(ctx context.Context, o *order, csr []byte) ([]byte, error) {
+	req := struct {
+		CSR string `json:"csr"`
+	}{CSR: encode(csr)}
+	next := &order{URL: o.URL}
+	if _, err := c.post(ctx, o.Finalize, req, next); err != nil {
+		return nil, fmt.Errorf("can't finalize ACME order: %w", err)
+	}
+	next.URL = o.URL
+	o, err := c.waitOrder(ctx, next, statusValid)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.post(ctx, o.Certificate, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't download certificate: %w", err)
+	}
+	defer resp.Body.Close() // nolint
+	return io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+}
+
+// post sends payload signed with account key, nil payload makes POST-as-GET request. Json response is decoded
+// to res if it's not nil, body of returned response is not read otherwise. Request is repeated once on bad nonce
+func (c *client) post(ctx context.Context, url string, payload, res any) (*http.Response, error) {
+	resp, err := c.postOnce(ctx, url, payload)
+	var problem *Problem
+	if errors.As(err, &problem) && problem.Type == "urn:ietf:params:acme:error:badNonce" {
+		resp, err = c.postOnce(ctx, url, payload)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return resp, nil
+	}
+	defer resp.Body.Close() // nolint
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(res); err != nil {
+		return nil, fmt.Errorf("can't decode response of %s: %w", url, err)
+	}
+	return resp, nil
+}
+
+func (c *client) postOnce(ctx context.Context, url string, payload any) (*http.Response, error) {
+	nonce, err := c.nonce(ctx)
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.sign(url, nonce, payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	c.saveNonce(resp)
+	if resp.StatusCode < 400 {
+		return resp, nil
+	}
+	defer resp.Body.Close() // nolint
+	problem := &Problem{}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if json.Unmarshal(data, problem) != nil || problem.Type == "" {
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return nil, problem
+}
+
+// sign makes JWS with ES256 signature, account is identified by jwk until it's registered and by kid after
+func (c *client) sign(url, nonce string, payload any) ([]byte, error) {
+	protected := map[string]any{"alg": "ES256", "nonce": nonce, "url": url}
+	if c.kid != "" {
+		protected["kid"] = c.kid
+	} else {
+		protected["jwk"] = publicJWK(&c.key.PublicKey)
+	}
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	if payload != nil {
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+	jws := struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}{Protected: encode(header), Payload: encode(body)}
+
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return nil, fmt.Errorf("can't sign ACME request: %w", err)
+	}
+	jws.Signature = encode(append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...))
+	return json.Marshal(jws)
+}
+
+func (c *client) nonce(ctx context.Context) (string, error) {
+	c.lock.Lock()
+	if n := len(c.nonces); n > 0 {
+		res := c.nonces[n-1]
+		c.nonces = c.nonces[:n-1]
+		c.lock.Unlock()
+		return res, nil
+	}
+	c.lock.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.dir.NewNonce, http.NoBody)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("can't get ACME nonce: %w", err)
+	}
+	_ = resp.Body.Close()
+	res := resp.Header.Get("Replay-Nonce")
+	if res == "" {
+		return "", errors.New("can't get ACME nonce: no Replay-Nonce header")
+	}
+	return res, nil
+}
+
+func (c *client) saveNonce(resp *http.Response) {
+	if n := resp.Header.Get("Replay-Nonce"); n != "" {
+		c.lock.Lock()
+		c.nonces = append(c.nonces, n)
+		c.lock.Unlock()
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
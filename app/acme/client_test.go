@@ -0,0 +1,272 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeACME is ACME server stand-in, it checks signatures and nonces of requests, validates challenges with
+// validate func and issues certificates signed by its own CA
+type fakeACME struct {
+	*httptest.Server
+	t        *testing.T
+	validate func(chalType, domain, keyAuth string) error
+	lifetime time.Duration
+	backdate time.Duration // issued certificates start earlier than now
+	ca       *x509.Certificate
+	caKey    *ecdsa.PrivateKey
+
+	lock     sync.Mutex
+	seq      int
+	nonces   map[string]bool
+	accounts map[string]*ecdsa.PublicKey // account URL -> key
+	orders   map[string]*fakeOrder
+	authzs   map[string]*fakeAuthz
+	certs    map[string][]byte // certificate URL -> PEM chain
+	badNonce int               // number of requests rejected with badNonce
+	issued   int
+	requests []string // paths of requests
+}
+
+type fakeOrder struct {
+	order
+	domains []string
+	authzs  []*fakeAuthz
+}
+
+type fakeAuthz struct {
+	domain string
+	status string
+	token  string
+	err    *Problem
+}
+
+func newFakeACME(t *testing.T) *fakeACME {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "fake ACME CA"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(24 * time.Hour), IsCA: true,
+		BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	f := &fakeACME{t: t, ca: ca, caKey: caKey, lifetime: 90 * 24 * time.Hour, nonces: map[string]bool{},
+		accounts: map[string]*ecdsa.PublicKey{}, orders: map[string]*fakeOrder{}, authzs: map[string]*fakeAuthz{},
+		certs: map[string][]byte{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeACME) serve(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.requests = append(f.requests, r.URL.Path)
+	f.seq++
+	nonce := fmt.Sprintf("nonce-%d", f.seq)
+	f.nonces[nonce] = true
+	w.Header().Set("Replay-Nonce", nonce)
+
+	switch {
+	case r.URL.Path == "/directory":
+		writeJSON(w, http.StatusOK, directory{NewNonce: f.URL + "/nonce", NewAccount: f.URL + "/account",
+			NewOrder: f.URL + "/order"})
+		return
+	case r.URL.Path == "/nonce":
+		return
+	case r.Method != http.MethodPost:
+		http.NotFound(w, r)
+		return
+	}
+
+	kid, payload, problem := f.verify(r)
+	if problem != nil {
+		writeJSON(w, http.StatusBadRequest, problem)
+		return
+	}
+	id := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	switch {
+	case r.URL.Path == "/account":
+		w.Header().Set("Location", kid)
+		writeJSON(w, http.StatusCreated, map[string]string{"status": "valid"})
+	case r.URL.Path == "/order":
+		var req struct{ Identifiers []identifier }
+		require.NoError(f.t, json.Unmarshal(payload, &req))
+		o := &fakeOrder{order: order{Status: statusPending}}
+		o.URL = fmt.Sprintf("%s/order/%d", f.URL, f.seq)
+		o.Finalize = fmt.Sprintf("%s/finalize/%d", f.URL, f.seq)
+		for i, ident := range req.Identifiers {
+			a := &fakeAuthz{domain: ident.Value, status: statusPending, token: fmt.Sprintf("token-%d-%d", f.seq, i)}
+			url := fmt.Sprintf("%s/authz/%d-%d", f.URL, f.seq, i)
+			f.authzs[url] = a
+			o.domains, o.authzs = append(o.domains, ident.Value), append(o.authzs, a)
+			o.Authorizations = append(o.Authorizations, url)
+		}
+		f.orders[o.URL] = o
+		w.Header().Set("Location", o.URL)
+		writeJSON(w, http.StatusCreated, f.orderStatus(o))
+	case strings.HasPrefix(r.URL.Path, "/order/"):
+		writeJSON(w, http.StatusOK, f.orderStatus(f.orders[f.URL+r.URL.Path]))
+	case strings.HasPrefix(r.URL.Path, "/authz/"):
+		a := f.authzs[f.URL+r.URL.Path]
+		res := authorization{Identifier: identifier{Type: "dns", Value: a.domain}, Status: a.status}
+		for _, typ := range []string{ChallengeHTTP01, ChallengeTLSALPN01} {
+			res.Challenges = append(res.Challenges, challenge{Type: typ, Token: a.token, Error: a.err,
+				URL: fmt.Sprintf("%s/chal/%s/%s", f.URL, id, typ)})
+		}
+		writeJSON(w, http.StatusOK, res)
+	case strings.HasPrefix(r.URL.Path, "/chal/"):
+		parts := strings.Split(r.URL.Path, "/")
+		a := f.authzs[f.URL+"/authz/"+parts[2]]
+		a.status = statusValid
+		if err := f.validate(parts[3], a.domain, a.token+"."+thumbprint(f.accounts[kid])); err != nil {
+			a.status, a.err = statusInvalid, &Problem{Type: "urn:ietf:params:acme:error:unauthorized", Detail: err.Error()}
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": statusPending})
+	case strings.HasPrefix(r.URL.Path, "/finalize/"):
+		o := f.orders[f.URL+"/order/"+id]
+		var req struct{ CSR string }
+		require.NoError(f.t, json.Unmarshal(payload, &req))
+		der, err := base64.RawURLEncoding.DecodeString(req.CSR)
+		require.NoError(f.t, err)
+		csr, err := x509.ParseCertificateRequest(der)
+		require.NoError(f.t, err)
+		require.NoError(f.t, csr.CheckSignature())
+		assert.Equal(f.t, o.domains, csr.DNSNames)
+		tmpl := &x509.Certificate{SerialNumber: big.NewInt(int64(f.seq)), Subject: pkix.Name{CommonName: o.domains[0]},
+			DNSNames: csr.DNSNames, NotBefore: time.Now().Add(-time.Minute - f.backdate),
+			NotAfter: time.Now().Add(f.lifetime - f.backdate)}
+		der, err = x509.CreateCertificate(rand.Reader, tmpl, f.ca, csr.PublicKey, f.caKey)
+		require.NoError(f.t, err)
+		o.Certificate = fmt.Sprintf("%s/cert/%s", f.URL, id)
+		o.Status = statusValid
+		f.issued++
+		f.certs[o.Certificate] = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.ca.Raw})...)
+		writeJSON(w, http.StatusOK, f.orderStatus(o))
+	case strings.HasPrefix(r.URL.Path, "/cert/"):
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_, _ = w.Write(f.certs[f.URL+r.URL.Path])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// verify checks JWS of request, it returns account URL and payload
+func (f *fakeACME) verify(r *http.Request) (kid string, payload []byte, problem *Problem) {
+	var jws struct{ Protected, Payload, Signature string }
+	require.NoError(f.t, json.NewDecoder(r.Body).Decode(&jws))
+	var header struct {
+		Alg, Nonce, URL, Kid string
+		JWK                  *jwk
+	}
+	data, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	require.NoError(f.t, err)
+	require.NoError(f.t, json.Unmarshal(data, &header))
+	assert.Equal(f.t, "ES256", header.Alg)
+	assert.Equal(f.t, f.URL+r.URL.Path, header.URL)
+
+	if !f.nonces[header.Nonce] || f.badNonce > 0 {
+		f.badNonce--
+		return "", nil, &Problem{Type: "urn:ietf:params:acme:error:badNonce", Detail: "bad nonce"}
+	}
+	delete(f.nonces, header.Nonce)
+
+	var key *ecdsa.PublicKey
+	if header.JWK != nil {
+		require.Equal(f.t, "/account", r.URL.Path, "jwk is used to register account only")
+		x, _ := base64.RawURLEncoding.DecodeString(header.JWK.X)
+		y, _ := base64.RawURLEncoding.DecodeString(header.JWK.Y)
+		key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		kid = f.URL + "/acct/" + thumbprint(key)
+		f.accounts[kid] = key
+	} else {
+		kid, key = header.Kid, f.accounts[header.Kid]
+		require.NotNil(f.t, key, "account %s is registered", header.Kid)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	require.NoError(f.t, err)
+	require.Len(f.t, sig, 64)
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	require.True(f.t, ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])),
+		"signature of %s is valid", r.URL.Path)
+	payload, err = base64.RawURLEncoding.DecodeString(jws.Payload)
+	require.NoError(f.t, err)
+	return kid, payload, nil
+}
+
+func (f *fakeACME) orderStatus(o *fakeOrder) order {
+	if o.Status == statusPending {
+		ready := true
+		for _, a := range o.authzs {
+			ready = ready && a.status == statusValid
+		}
+		if ready {
+			o.Status = statusReady
+		}
+	}
+	return o.order
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func TestClient_Register(t *testing.T) {
+	f := newFakeACME(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	c := &client{directoryURL: f.URL + "/directory", key: key, httpClient: http.DefaultClient}
+
+	f.badNonce = 1
+	require.NoError(t, c.register(context.Background(), "admin@example.com"))
+	assert.Equal(t, f.URL+"/acct/"+thumbprint(&key.PublicKey), c.kid)
+	assert.Equal(t, []string{"/directory", "/nonce", "/account", "/account"}, f.requests,
+		"request is repeated on bad nonce with the nonce of response")
+
+	f.badNonce = 2
+	_, err = c.newOrder(context.Background(), []string{"example.com"})
+	assert.EqualError(t, err, "can't make ACME order: urn:ietf:params:acme:error:badNonce: bad nonce")
+
+	c = &client{directoryURL: f.URL + "/not-found", key: key, httpClient: http.DefaultClient}
+	err = c.register(context.Background(), "")
+	assert.EqualError(t, err, "can't get ACME directory "+f.URL+"/not-found: status 404")
+}
+
+func TestThumbprint(t *testing.T) {
+	// example of RFC 7638 uses RSA key, so the EC key is checked against thumbprint calculated independently
+	x, _ := base64.RawURLEncoding.DecodeString("gI0GAILBdu7T53akrFmMyGcsF3n5dO7MmwNBHKW5SV0")
+	y, _ := base64.RawURLEncoding.DecodeString("SLW_xSffzlPWrHEVI30DHM_4egVwt3NQqeUD7nMFpps")
+	key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	data, err := json.Marshal(publicJWK(key))
+	require.NoError(t, err)
+	assert.Equal(t, `{"crv":"P-256","kty":"EC","x":"gI0GAILBdu7T53akrFmMyGcsF3n5dO7MmwNBHKW5SV0",`+
+		`"y":"SLW_xSffzlPWrHEVI30DHM_4egVwt3NQqeUD7nMFpps"}`, string(data))
+	sum := sha256.Sum256(data)
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(sum[:]), thumbprint(key))
+	assert.Equal(t, "token."+thumbprint(key), keyAuthorization(key, "token"))
+}
@@ -0,0 +1,363 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Challenge types to validate domains
+const (
+	ChallengeHTTP01    = "http-01"
+	ChallengeTLSALPN01 = "tls-alpn-01"
+)
+
+// ALPNProto is protocol of tls-alpn-01 challenge, it should be in NextProtos of TLS server
+const ALPNProto = "acme-tls/1"
+
+// idPeAcmeIdentifier is extension of tls-alpn-01 challenge certificate (RFC 8737)
+var idPeAcmeIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+const (
+	httpChallengePath  = "/.well-known/acme-challenge/"
+	defaultRenewBefore = 30 * 24 * time.Hour
+	retryInterval      = 10 * time.Minute
+	checkInterval      = 12 * time.Hour
+)
+
+// Options of Manager, empty Directory means Let's Encrypt and zero RenewBefore means 30 days
+type Options struct {
+	Directory   string // directory URL of ACME server
+	Domains     []string
+	Email       string        // contact of ACME account, optional
+	Challenge   string        // http-01 or tls-alpn-01
+	CacheDir    string        // account key and certificate are kept there
+	RenewBefore time.Duration // certificate is renewed when it expires sooner
+	HTTPClient  *http.Client  // client of ACME server, http.DefaultClient if nil
+}
+
+// Manager keeps certificate of domains issued by ACME server. Certificate is served by GetCertificate,
+// http-01 challenge is served by HTTPHandler and tls-alpn-01 by GetCertificate, Run issues and renews it
+type Manager struct {
+	opts         Options
+	pollInterval time.Duration
+
+	lock      sync.Mutex // serializes issue of certificate
+	cert      atomic.Pointer[tls.Certificate]
+	client    *client
+	tokens    sync.Map // token of http-01 challenge -> key authorization
+	alpnCerts sync.Map // domain -> certificate of tls-alpn-01 challenge
+}
+
+// NewManager checks options and makes manager, nothing is read or requested until Run
+func NewManager(opts Options) (*Manager, error) {
+	if len(opts.Domains) == 0 {
+		return nil, errors.New("ACME domains are not set")
+	}
+	domains := make([]string, len(opts.Domains))
+	for i, d := range opts.Domains {
+		if d == "" || strings.ContainsAny(d, "/:* ") {
+			return nil, fmt.Errorf("ACME domain %q is not valid", d)
+		}
+		domains[i] = strings.ToLower(d)
+	}
+	opts.Domains = domains
+	if opts.Challenge != ChallengeHTTP01 && opts.Challenge != ChallengeTLSALPN01 {
+		return nil, fmt.Errorf("ACME challenge should be %s or %s, got %q", ChallengeHTTP01, ChallengeTLSALPN01,
+			opts.Challenge)
+	}
+	if opts.CacheDir == "" {
+		return nil, errors.New("ACME cache dir is not set")
+	}
+	if opts.Directory == "" {
+		opts.Directory = LetsEncrypt
+	}
+	if u, err := url.Parse(opts.Directory); err != nil || u.Host == "" {
+		return nil, fmt.Errorf("ACME directory %q is not valid URL", opts.Directory)
+	}
+	if opts.RenewBefore <= 0 {
+		opts.RenewBefore = defaultRenewBefore
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+	return &Manager{opts: opts, pollInterval: time.Second}, nil
+}
+
+// GetCertificate returns issued certificate or certificate of tls-alpn-01 challenge to ACME server
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if IsChallenge(hello) {
+		if cert, ok := m.alpnCerts.Load(strings.ToLower(hello.ServerName)); ok {
+			return cert.(*tls.Certificate), nil
+		}
+		return nil, fmt.Errorf("no ACME challenge for %q", hello.ServerName)
+	}
+	if cert := m.cert.Load(); cert != nil {
+		return cert, nil
+	}
+	return nil, errors.New("ACME certificate is not issued yet")
+}
+
+// IsChallenge tells if TLS connection is tls-alpn-01 challenge of ACME server, it offers ALPNProto only
+func IsChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == ALPNProto
+}
+
+// HTTPHandler serves http-01 challenge, other requests are passed to fallback or redirected to https if it's nil
+func (m *Manager) HTTPHandler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, httpChallengePath) {
+			if fallback != nil {
+				fallback.ServeHTTP(w, r)
+				return
+			}
+			host := r.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusFound)
+			return
+		}
+		keyAuth, ok := m.tokens.Load(strings.TrimPrefix(r.URL.Path, httpChallengePath))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(keyAuth.(string)))
+	})
+}
+
+// Run keeps certificate valid until ctx is done. It's loaded from cache dir or issued on start,
+// then renewed before expiration, failed attempt is repeated in 10 minutes
+func (m *Manager) Run(ctx context.Context) {
+	for {
+		wait := checkInterval
+		if err := m.Renew(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("[WARN] can not get ACME certificate for %s, retry in %s: %v",
+				strings.Join(m.opts.Domains, ", "), retryInterval, err)
+			wait = retryInterval
+		} else if until := time.Until(m.renewAt(m.cert.Load())); until < wait {
+			wait = until
+		}
+		if sleep(ctx, wait) != nil {
+			return
+		}
+	}
+}
+
+// Renew loads certificate from cache dir if it's not loaded yet and issues new one if it's missing,
+// doesn't cover all domains or is about to expire
+func (m *Manager) Renew(ctx context.Context) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	cert := m.cert.Load()
+	if cert == nil {
+		cert = m.loadCertificate()
+	}
+	if cert != nil && time.Now().Before(m.renewAt(cert)) {
+		m.cert.Store(cert)
+		return nil
+	}
+	next, err := m.issue(ctx)
+	if err != nil {
+		if cert != nil {
+			m.cert.Store(cert) // expiring certificate is still served
+		}
+		return err
+	}
+	m.cert.Store(next)
+	log.Printf("[INFO] ACME certificate for %s is issued, valid until %s", strings.Join(m.opts.Domains, ", "),
+		next.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// renewAt is time to renew certificate, RenewBefore its expiration but not later than at 2/3 of its lifetime.
+// Certificate not covering all domains is renewed right away
+func (m *Manager) renewAt(cert *tls.Certificate) time.Time {
+	if cert == nil || cert.Leaf == nil {
+		return time.Time{}
+	}
+	for _, d := range m.opts.Domains {
+		if cert.Leaf.VerifyHostname(d) != nil {
+			return time.Time{}
+		}
+	}
+	before := m.opts.RenewBefore
+	if lifetime := cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore); before > lifetime/3 {
+		before = lifetime / 3
+	}
+	return cert.Leaf.NotAfter.Add(-before)
+}
+
+// issue orders certificate of domains, validates them with challenge and saves issued certificate to cache dir
+func (m *Manager) issue(ctx context.Context) (*tls.Certificate, error) {
+	if m.client == nil {
+		key, err := m.accountKey()
+		if err != nil {
+			return nil, err
+		}
+		m.client = &client{directoryURL: m.opts.Directory, key: key, httpClient: m.opts.HTTPClient,
+			pollInterval: m.pollInterval}
+	}
+	if err := m.client.register(ctx, m.opts.Email); err != nil {
+		return nil, err
+	}
+	o, err := m.client.newOrder(ctx, m.opts.Domains)
+	if err != nil {
+		return nil, err
+	}
+	for _, authz := range o.Authorizations {
+		if err = m.client.authorize(ctx, authz, m.opts.Challenge, m.solve); err != nil {
+			return nil, err
+		}
+	}
+	if o, err = m.client.waitOrder(ctx, o, statusReady, statusValid); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("can't make certificate key: %w", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: m.opts.Domains[0]},
+		DNSNames: m.opts.Domains,
+	}, key)
+	if err != nil {
+		return nil, fmt.Errorf("can't make certificate request: %w", err)
+	}
+	chain, err := m.client.finalize(ctx, o, csr)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(chain, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("issued certificate is not valid: %w", err)
+	}
+	if err = os.WriteFile(m.cachePath(".crt"), chain, 0o600); err != nil {
+		log.Printf("[WARN] can not save ACME certificate: %v", err)
+	}
+	if err = os.WriteFile(m.cachePath(".key"), keyPEM, 0o600); err != nil {
+		log.Printf("[WARN] can not save ACME certificate key: %v", err)
+	}
+	return &cert, nil
+}
+
+// solve publishes key authorization of challenge, returned func removes it
+func (m *Manager) solve(domain, token, keyAuth string) func() {
+	if m.opts.Challenge == ChallengeHTTP01 {
+		m.tokens.Store(token, keyAuth)
+		return func() { m.tokens.Delete(token) }
+	}
+	cert, err := alpnCertificate(domain, keyAuth)
+	if err != nil {
+		log.Printf("[WARN] can not make %s certificate for %s: %v", ChallengeTLSALPN01, domain, err)
+		return func() {}
+	}
+	m.alpnCerts.Store(domain, cert)
+	return func() { m.alpnCerts.Delete(domain) }
+}
+
+// alpnCertificate makes self-signed certificate of tls-alpn-01 challenge with sha256 of key authorization
+func alpnCertificate(domain, keyAuth string) (*tls.Certificate, error) {
+	sum := sha256.Sum256([]byte(keyAuth))
+	ext, err := asn1.Marshal(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:    big.NewInt(1),
+		Subject:         pkix.Name{CommonName: domain},
+		DNSNames:        []string{domain},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: idPeAcmeIdentifier, Critical: true, Value: ext}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// accountKey reads key of ACME account from cache dir, new key is made and saved if it's missing
+func (m *Manager) accountKey() (*ecdsa.PrivateKey, error) {
+	path := filepath.Join(m.opts.CacheDir, "account.key")
+	if data, err := os.ReadFile(path); err == nil { // nolint:gosec
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("ACME account key %s is not valid PEM", path)
+		}
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse ACME account key %s: %w", path, err)
+		}
+		return key, nil
+	}
+
+	if err := os.MkdirAll(m.opts.CacheDir, 0o700); err != nil {
+		return nil, fmt.Errorf("can't make ACME cache dir: %w", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("can't make ACME account key: %w", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return nil, fmt.Errorf("can't save ACME account key: %w", err)
+	}
+	return key, nil
+}
+
+// loadCertificate reads certificate issued before from cache dir, nil if it's missing or not valid
+func (m *Manager) loadCertificate() *tls.Certificate {
+	cert, err := tls.LoadX509KeyPair(m.cachePath(".crt"), m.cachePath(".key"))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("[WARN] can not load cached ACME certificate: %v", err)
+		}
+		return nil
+	}
+	return &cert
+}
+
+// cachePath is path of certificate file in cache dir named after the first domain
+func (m *Manager) cachePath(ext string) string {
+	return filepath.Join(m.opts.CacheDir, m.opts.Domains[0]+ext)
+}
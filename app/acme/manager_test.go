@@ -0,0 +1,235 @@
+package acme
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestManager(t *testing.T, f *fakeACME, challenge string, domains ...string) *Manager {
+	m, err := NewManager(Options{Directory: f.URL + "/directory", Domains: domains, Email: "admin@example.com",
+		Challenge: challenge, CacheDir: filepath.Join(t.TempDir(), "acme")})
+	require.NoError(t, err)
+	m.pollInterval = 10 * time.Millisecond
+	return m
+}
+
+func TestManager_HTTP01(t *testing.T) {
+	f := newFakeACME(t)
+	m := newTestManager(t, f, ChallengeHTTP01, "Example.com", "www.example.com")
+	current := m // manager validated by ACME server
+	f.validate = func(chalType, domain, keyAuth string) error {
+		assert.Equal(t, ChallengeHTTP01, chalType)
+		req := httptest.NewRequest(http.MethodGet, "http://"+domain+"/.well-known/acme-challenge/"+
+			keyAuth[:len(keyAuth)-44], http.NoBody)
+		rr := httptest.NewRecorder()
+		current.HTTPHandler(nil).ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK || rr.Body.String() != keyAuth {
+			return fmt.Errorf("got %d %q", rr.Code, rr.Body.String())
+		}
+		return nil
+	}
+
+	_, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	assert.EqualError(t, err, "ACME certificate is not issued yet")
+
+	require.NoError(t, m.Renew(context.Background()))
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"example.com", "www.example.com"}, cert.Leaf.DNSNames)
+	assert.Len(t, cert.Certificate, 2, "chain with CA")
+	assert.Equal(t, 1, f.issued)
+
+	rr := httptest.NewRecorder()
+	m.HTTPHandler(nil).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/.well-known/acme-challenge/"+
+		"token-1-0", http.NoBody))
+	assert.Equal(t, http.StatusNotFound, rr.Code, "token is removed after validation")
+
+	require.NoError(t, m.Renew(context.Background()))
+	assert.Equal(t, 1, f.issued, "valid certificate is not renewed")
+
+	// another manager with the same cache dir loads issued certificate and account key
+	cached, err := NewManager(m.opts)
+	require.NoError(t, err)
+	require.NoError(t, cached.Renew(context.Background()))
+	assert.Equal(t, 1, f.issued)
+	got, err := cached.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	assert.Equal(t, cert.Certificate, got.Certificate)
+
+	// certificate is renewed when it doesn't cover domains
+	cached.opts.Domains = append(cached.opts.Domains, "api.example.com")
+	cached.pollInterval, current = 10*time.Millisecond, cached
+	require.NoError(t, cached.Renew(context.Background()))
+	assert.Equal(t, 2, f.issued)
+	got, err = cached.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	assert.Contains(t, got.Leaf.DNSNames, "api.example.com")
+	assert.Equal(t, 1, len(f.accounts), "account key is reused")
+}
+
+func TestManager_TLSALPN01(t *testing.T) {
+	f := newFakeACME(t)
+	m := newTestManager(t, f, ChallengeTLSALPN01, "example.com")
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: m.GetCertificate,
+		NextProtos: []string{"http/1.1", ALPNProto}, MinVersion: tls.VersionTLS12})
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			_ = conn.Close()
+		}
+	}()
+
+	f.validate = func(chalType, domain, keyAuth string) error {
+		assert.Equal(t, ChallengeTLSALPN01, chalType)
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: domain, NextProtos: []string{ALPNProto},
+			InsecureSkipVerify: true}) // nolint:gosec // challenge certificate is self-signed
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if conn.ConnectionState().NegotiatedProtocol != ALPNProto {
+			return errors.New("acme-tls/1 is not negotiated")
+		}
+		leaf := conn.ConnectionState().PeerCertificates[0]
+		for _, ext := range leaf.Extensions {
+			if ext.Id.Equal(idPeAcmeIdentifier) {
+				var got []byte
+				if _, err = asn1.Unmarshal(ext.Value, &got); err != nil {
+					return err
+				}
+				if want := sha256.Sum256([]byte(keyAuth)); string(got) != string(want[:]) || !ext.Critical {
+					return errors.New("wrong acmeIdentifier")
+				}
+				return leaf.VerifyHostname(domain)
+			}
+		}
+		return errors.New("no acmeIdentifier")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.Run(ctx)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool {
+		_, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: "example.com",
+		InsecureSkipVerify: true}) // nolint:gosec // certificate of fake CA
+	require.NoError(t, err)
+	assert.Equal(t, []string{"example.com"}, conn.ConnectionState().PeerCertificates[0].DNSNames,
+		"issued certificate is served after challenge")
+	require.NoError(t, conn.Close())
+
+	_, err = m.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com", SupportedProtos: []string{ALPNProto}})
+	assert.EqualError(t, err, `no ACME challenge for "example.com"`)
+}
+
+func TestManager_Failed(t *testing.T) {
+	f := newFakeACME(t)
+	f.validate = func(string, string, string) error { return errors.New("connection refused") }
+	m := newTestManager(t, f, ChallengeHTTP01, "example.com")
+	err := m.Renew(context.Background())
+	assert.EqualError(t, err, "http-01 challenge for example.com failed: "+
+		"urn:ietf:params:acme:error:unauthorized: connection refused")
+	_, err = m.GetCertificate(&tls.ClientHelloInfo{})
+	require.Error(t, err)
+	files, err := os.ReadDir(m.opts.CacheDir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "account.key", files[0].Name())
+}
+
+func TestManager_Renew(t *testing.T) {
+	f := newFakeACME(t)
+	f.validate = func(string, string, string) error { return nil }
+	f.lifetime = time.Hour
+	m := newTestManager(t, f, ChallengeHTTP01, "example.com")
+	require.NoError(t, m.Renew(context.Background()))
+	cert := m.cert.Load()
+	lifetime := cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore)
+	assert.Equal(t, cert.Leaf.NotAfter.Add(-lifetime/3), m.renewAt(cert),
+		"short lived certificate is renewed at 2/3 of its lifetime")
+
+	f.lifetime, f.backdate = 90*24*time.Hour, 80*24*time.Hour
+	m.cert.Store(nil)
+	require.NoError(t, os.Remove(filepath.Join(m.opts.CacheDir, "example.com.crt")))
+	require.NoError(t, m.Renew(context.Background()))
+	assert.Equal(t, 2, f.issued)
+	assert.True(t, m.renewAt(m.cert.Load()).Before(time.Now()), "certificate expires in 10 days")
+
+	f.backdate = 0
+	require.NoError(t, m.Renew(context.Background()))
+	assert.Equal(t, 3, f.issued, "certificate expiring sooner than RenewBefore is renewed")
+	assert.WithinDuration(t, m.cert.Load().Leaf.NotAfter.Add(-30*24*time.Hour), m.renewAt(m.cert.Load()), time.Second)
+}
+
+func TestManager_HTTPHandler(t *testing.T) {
+	m, err := NewManager(Options{Domains: []string{"example.com"}, Challenge: ChallengeHTTP01, CacheDir: "acme"})
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	m.HTTPHandler(nil).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com:80/v1/models?x=1", http.NoBody))
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, "https://example.com/v1/models?x=1", rr.Header().Get("Location"))
+
+	rr = httptest.NewRecorder()
+	m.HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "fallback")
+	})).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody))
+	assert.Equal(t, "fallback", rr.Body.String())
+}
+
+func TestNewManager(t *testing.T) {
+	tbl := []struct {
+		opts Options
+		err  string
+	}{
+		{opts: Options{Challenge: ChallengeHTTP01, CacheDir: "acme"}, err: "ACME domains are not set"},
+		{opts: Options{Domains: []string{"*.example.com"}, Challenge: ChallengeHTTP01, CacheDir: "acme"},
+			err: `ACME domain "*.example.com" is not valid`},
+		{opts: Options{Domains: []string{"example.com"}, Challenge: "dns-01", CacheDir: "acme"},
+			err: `ACME challenge should be http-01 or tls-alpn-01, got "dns-01"`},
+		{opts: Options{Domains: []string{"example.com"}, Challenge: ChallengeHTTP01}, err: "ACME cache dir is not set"},
+		{opts: Options{Domains: []string{"example.com"}, Challenge: ChallengeHTTP01, CacheDir: "acme",
+			Directory: "localhost:14000/dir"}, err: `ACME directory "localhost:14000/dir" is not valid URL`},
+	}
+	for _, tt := range tbl {
+		_, err := NewManager(tt.opts)
+		assert.EqualError(t, err, tt.err)
+	}
+
+	domains := []string{"Example.com"}
+	m, err := NewManager(Options{Domains: domains, Challenge: ChallengeTLSALPN01, CacheDir: "acme"})
+	require.NoError(t, err)
+	assert.Equal(t, LetsEncrypt, m.opts.Directory)
+	assert.Equal(t, 30*24*time.Hour, m.opts.RenewBefore)
+	assert.Equal(t, []string{"example.com"}, m.opts.Domains)
+	assert.Equal(t, []string{"Example.com"}, domains, "options are not changed")
+}
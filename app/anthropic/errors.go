@@ -0,0 +1,41 @@
+package anthropic
+
+import "net/http"
+
+// ErrorResponse is error body of Anthropic API, it's sent as error event in stream as well
+type ErrorResponse struct {
+	Type  string `json:"type"`
+	Error Error  `json:"error"`
+}
+
+// Error describes failed request, type is derived from http status
+type Error struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// NewError makes error body for http status
+func NewError(status int, message string) ErrorResponse {
+	return ErrorResponse{Type: "error", Error: Error{Type: errorType(status), Message: message}}
+}
+
+func errorType(status int) string {
+	switch status {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return "invalid_request_error"
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusForbidden:
+		return "permission_error"
+	case http.StatusNotFound:
+		return "not_found_error"
+	case http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case http.StatusServiceUnavailable:
+		return "overloaded_error"
+	default:
+		return "api_error"
+	}
+}
@@ -0,0 +1,19 @@
+package anthropic
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewError(t *testing.T) {
+	b, err := json.Marshal(NewError(http.StatusTooManyRequests, "slow down"))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type":"error","error":{"type":"rate_limit_error","message":"slow down"}}`, string(b))
+	assert.Equal(t, "not_found_error", NewError(http.StatusNotFound, "").Error.Type)
+	assert.Equal(t, "overloaded_error", NewError(http.StatusServiceUnavailable, "").Error.Type)
+	assert.Equal(t, "api_error", NewError(http.StatusBadGateway, "").Error.Type)
+}
@@ -0,0 +1,445 @@
+// Package anthropic translates Anthropic Messages API requests into Gemini requests and Gemini responses back,
+// see https://docs.anthropic.com/en/api/messages
+package anthropic
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/theshamuel/gemini-proxy/app/gemini"
+)
+
+// MessagesRequest is body of messages request, fields Gemini can't handle are ignored
+type MessagesRequest struct {
+	Model         string          `json:"model"`
+	MaxTokens     int             `json:"max_tokens"`
+	System        Blocks          `json:"system,omitempty"`
+	Messages      []Message       `json:"messages"`
+	StopSequences []string        `json:"stop_sequences,omitempty"`
+	Temperature   *float64        `json:"temperature,omitempty"`
+	TopP          *float64        `json:"top_p,omitempty"`
+	TopK          *int            `json:"top_k,omitempty"`
+	Tools         []Tool          `json:"tools,omitempty"`
+	ToolChoice    *ToolChoice     `json:"tool_choice,omitempty"`
+	Stream        bool            `json:"stream,omitempty"`
+	Metadata      json.RawMessage `json:"metadata,omitempty"`
+}
+
+// Message is turn of conversation, role is user or assistant
+type Message struct {
+	Role    string `json:"role"`
+	Content Blocks `json:"content"`
+}
+
+// Blocks is list of content blocks, plain string content is a single text block
+type Blocks []Block
+
+// Block is content block of message: text, image, tool_use or tool_result
+type Block struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text,omitempty"`
+	Source    *ImageSource    `json:"source,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Input     json.RawMessage `json:"input,omitempty"`
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   Blocks          `json:"content,omitempty"`
+	IsError   bool            `json:"is_error,omitempty"`
+}
+
+// ImageSource is base64 encoded image or image URL
+type ImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+// Tool is function the model may use, input is described by JSON schema
+type Tool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+// ToolChoice is auto, any, tool with name or none
+type ToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+}
+
+// MessagesResponse is message object generated by the model
+type MessagesResponse struct {
+	ID           string  `json:"id"`
+	Type         string  `json:"type"`
+	Role         string  `json:"role"`
+	Model        string  `json:"model"`
+	Content      []Block `json:"content"`
+	StopReason   *string `json:"stop_reason"`
+	StopSequence *string `json:"stop_sequence"`
+	Usage        Usage   `json:"usage"`
+}
+
+// Usage is token counts of request and response
+type Usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// Stop reasons of message
+const (
+	StopEndTurn   = "end_turn"
+	StopMaxTokens = "max_tokens"
+	StopToolUse   = "tool_use"
+	StopRefusal   = "refusal"
+)
+
+// UnmarshalJSON accepts string content as single text block
+func (b *Blocks) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*b = Blocks{{Type: "text", Text: text}}
+		return nil
+	}
+	var blocks []Block
+	if err := json.Unmarshal(data, &blocks); err != nil {
+		return errors.New("content should be string or list of blocks")
+	}
+	*b = blocks
+	return nil
+}
+
+// Text returns text of all text blocks
+func (b Blocks) Text() string {
+	var res strings.Builder
+	for _, block := range b {
+		if block.Type == "text" {
+			res.WriteString(block.Text)
+		}
+	}
+	return res.String()
+}
+
+// GeminiModel returns Gemini model of request, models/ prefix is removed
+func (r MessagesRequest) GeminiModel() string {
+	return strings.TrimPrefix(r.Model, "models/")
+}
+
+// ToGemini translates messages request into generateContent request. System becomes system instruction,
+// tool_use and tool_result blocks become function calls and responses
+func (r MessagesRequest) ToGemini() (gemini.GenerateContentRequest, error) {
+	if r.Model == "" {
+		return gemini.GenerateContentRequest{}, errors.New("model is required")
+	}
+	if r.MaxTokens <= 0 {
+		return gemini.GenerateContentRequest{}, errors.New("max_tokens should be positive")
+	}
+	if len(r.Messages) == 0 {
+		return gemini.GenerateContentRequest{}, errors.New("messages are required")
+	}
+
+	res := gemini.GenerateContentRequest{}
+	if text := r.System.Text(); text != "" {
+		res.SystemInstruction = &gemini.Content{Parts: []gemini.Part{{Text: text}}}
+	}
+	toolNames := map[string]string{} // tool_use id -> function name
+	for i, m := range r.Messages {
+		role := gemini.RoleUser
+		switch m.Role {
+		case "user":
+		case "assistant":
+			role = gemini.RoleModel
+		default:
+			return gemini.GenerateContentRequest{}, fmt.Errorf("message %d: role %q is not supported", i, m.Role)
+		}
+		parts := make([]gemini.Part, 0, len(m.Content))
+		for _, b := range m.Content {
+			part, ok, err := blockPart(b, toolNames)
+			if err != nil {
+				return gemini.GenerateContentRequest{}, fmt.Errorf("message %d: %w", i, err)
+			}
+			if ok {
+				parts = append(parts, part)
+			}
+		}
+		res.Contents = appendContent(res.Contents, role, parts...)
+	}
+
+	for _, t := range r.Tools {
+		if len(res.Tools) == 0 {
+			res.Tools = []gemini.Tool{{}}
+		}
+		res.Tools[0].FunctionDeclarations = append(res.Tools[0].FunctionDeclarations, gemini.FunctionDeclaration{
+			Name: t.Name, Description: t.Description, ParametersJSONSchema: t.InputSchema})
+	}
+	if tc := r.ToolChoice; tc != nil {
+		modes := map[string]string{"auto": gemini.ModeAuto, "any": gemini.ModeAny, "tool": gemini.ModeAny,
+			"none": gemini.ModeNone}
+		mode, ok := modes[tc.Type]
+		if !ok {
+			return gemini.GenerateContentRequest{}, fmt.Errorf("tool_choice %q is not supported", tc.Type)
+		}
+		res.ToolConfig = &gemini.ToolConfig{FunctionCallingConfig: &gemini.FunctionCallingConfig{Mode: mode}}
+		if tc.Type == "tool" {
+			res.ToolConfig.FunctionCallingConfig.AllowedFunctionNames = []string{tc.Name}
+		}
+	}
+
+	maxTokens := r.MaxTokens
+	res.GenerationConfig = &gemini.GenerationConfig{
+		StopSequences:   r.StopSequences,
+		MaxOutputTokens: &maxTokens,
+		Temperature:     r.Temperature,
+		TopP:            r.TopP,
+		TopK:            r.TopK,
+	}
+	return res, nil
+}
+
+// blockPart translates content block, thinking and other blocks Gemini can't take back are skipped
+func blockPart(b Block, toolNames map[string]string) (gemini.Part, bool, error) {
+	switch b.Type {
+	case "text":
+		return gemini.Part{Text: b.Text}, true, nil
+	case "image", "document":
+		if b.Source == nil {
+			return gemini.Part{}, false, fmt.Errorf("%s source is empty", b.Type)
+		}
+		switch b.Source.Type {
+		case "base64":
+			return gemini.Part{InlineData: &gemini.Blob{MimeType: b.Source.MediaType, Data: b.Source.Data}}, true, nil
+		case "url":
+			return gemini.Part{FileData: &gemini.FileData{MimeType: b.Source.MediaType, FileURI: b.Source.URL}}, true, nil
+		}
+		return gemini.Part{}, false, fmt.Errorf("%s source %q is not supported", b.Type, b.Source.Type)
+	case "tool_use":
+		args := b.Input
+		if len(args) == 0 {
+			args = json.RawMessage("{}")
+		}
+		toolNames[b.ID] = b.Name
+		return gemini.Part{FunctionCall: &gemini.FunctionCall{Name: b.Name, Args: args}}, true, nil
+	case "tool_result":
+		name, ok := toolNames[b.ToolUseID]
+		if !ok {
+			return gemini.Part{}, false, fmt.Errorf("tool_use %q is not found", b.ToolUseID)
+		}
+		key := "content"
+		if b.IsError {
+			key = "error"
+		}
+		resp, err := json.Marshal(map[string]string{key: b.Content.Text()})
+		if err != nil {
+			return gemini.Part{}, false, err
+		}
+		return gemini.Part{FunctionResponse: &gemini.FunctionResponse{Name: name, Response: resp}}, true, nil
+	case "thinking", "redacted_thinking":
+		return gemini.Part{}, false, nil
+	}
+	return gemini.Part{}, false, fmt.Errorf("content block %q is not supported", b.Type)
+}
+
+// appendContent adds parts to the last content if it has the same role, Gemini expects turns of different roles
+func appendContent(contents []gemini.Content, role string, parts ...gemini.Part) []gemini.Content {
+	if len(parts) == 0 {
+		return contents
+	}
+	if n := len(contents); n > 0 && contents[n-1].Role == role {
+		contents[n-1].Parts = append(contents[n-1].Parts, parts...)
+		return contents
+	}
+	return append(contents, gemini.Content{Role: role, Parts: parts})
+}
+
+// FromGemini translates generateContent response into message, only the first candidate is taken
+func FromGemini(resp gemini.GenerateContentResponse, model string) MessagesResponse {
+	res := MessagesResponse{ID: messageID(resp), Type: "message", Role: "assistant", Model: model, Content: []Block{},
+		Usage: usage(resp.UsageMetadata)}
+	if len(resp.Candidates) == 0 {
+		if resp.PromptFeedback != nil && resp.PromptFeedback.BlockReason != "" {
+			reason := StopRefusal
+			res.StopReason = &reason
+		}
+		return res
+	}
+	c := resp.Candidates[0]
+	for i, p := range c.Content.Parts {
+		switch {
+		case p.Thought:
+		case p.FunctionCall != nil:
+			res.Content = append(res.Content, toolUse(p.FunctionCall, i))
+		case p.Text != "":
+			if n := len(res.Content); n > 0 && res.Content[n-1].Type == "text" {
+				res.Content[n-1].Text += p.Text
+				continue
+			}
+			res.Content = append(res.Content, Block{Type: "text", Text: p.Text})
+		}
+	}
+	reason := stopReason(c.FinishReason, hasToolUse(res.Content))
+	res.StopReason = &reason
+	return res
+}
+
+// Streamer translates events of streamGenerateContent into Anthropic stream events: message_start,
+// content_block_start, content_block_delta and content_block_stop for every block, message_delta and message_stop
+type Streamer struct {
+	Model      string
+	started    bool
+	id         string
+	block      int    // index of the next block
+	open       string // type of open block, empty if no block is open
+	stopReason string
+	calls      int
+	usage      Usage
+}
+
+// Event is stream event, its type is both SSE event name and type field of data
+type Event struct {
+	Type string
+	Data any
+}
+
+// Events returns stream events for Gemini stream event, message_start is sent before the first block
+func (s *Streamer) Events(resp gemini.GenerateContentResponse) []Event {
+	if resp.UsageMetadata != nil {
+		s.usage = usage(resp.UsageMetadata)
+	}
+	var res []Event
+	if !s.started {
+		s.started = true
+		s.id = messageID(resp)
+		res = append(res, Event{Type: "message_start", Data: map[string]any{"type": "message_start",
+			"message": MessagesResponse{ID: s.id, Type: "message", Role: "assistant", Model: s.Model, Content: []Block{},
+				Usage: Usage{InputTokens: s.usage.InputTokens}}}})
+	}
+	if len(resp.Candidates) == 0 {
+		if resp.PromptFeedback != nil && resp.PromptFeedback.BlockReason != "" {
+			s.stopReason = StopRefusal
+		}
+		return res
+	}
+	c := resp.Candidates[0]
+	for _, p := range c.Content.Parts {
+		switch {
+		case p.Thought:
+		case p.FunctionCall != nil:
+			res = append(res, s.closeBlock()...)
+			block := toolUse(p.FunctionCall, s.calls)
+			s.calls++
+			input := string(block.Input)
+			block.Input = json.RawMessage("{}")
+			res = append(res, s.openBlock("tool_use", block),
+				s.delta(map[string]any{"type": "input_json_delta", "partial_json": input}))
+			res = append(res, s.closeBlock()...)
+		case p.Text != "":
+			if s.open != "text" {
+				res = append(res, s.closeBlock()...)
+				res = append(res, s.openBlock("text", Block{Type: "text", Text: ""}))
+			}
+			res = append(res, s.delta(map[string]any{"type": "text_delta", "text": p.Text}))
+		}
+	}
+	if c.FinishReason != "" {
+		s.stopReason = stopReason(c.FinishReason, s.calls > 0)
+	}
+	return res
+}
+
+// Final returns events closing the message, they are sent when Gemini stream is done
+func (s *Streamer) Final() []Event {
+	res := s.closeBlock()
+	reason := s.stopReason
+	if reason == "" {
+		reason = StopEndTurn
+	}
+	res = append(res,
+		Event{Type: "message_delta", Data: map[string]any{"type": "message_delta",
+			"delta": map[string]any{"stop_reason": reason, "stop_sequence": nil}, "usage": map[string]int{"output_tokens": s.usage.OutputTokens}}},
+		Event{Type: "message_stop", Data: map[string]any{"type": "message_stop"}})
+	return res
+}
+
+func (s *Streamer) openBlock(blockType string, block Block) Event {
+	s.open = blockType
+	return Event{Type: "content_block_start", Data: map[string]any{"type": "content_block_start", "index": s.block,
+		"content_block": contentBlockStart(block)}}
+}
+
+func (s *Streamer) delta(delta map[string]any) Event {
+	return Event{Type: "content_block_delta", Data: map[string]any{"type": "content_block_delta", "index": s.block,
+		"delta": delta}}
+}
+
+func (s *Streamer) closeBlock() []Event {
+	if s.open == "" {
+		return nil
+	}
+	res := Event{Type: "content_block_stop", Data: map[string]any{"type": "content_block_stop", "index": s.block}}
+	s.open = ""
+	s.block++
+	return []Event{res}
+}
+
+// contentBlockStart returns block of content_block_start, text block has explicit empty text
+func contentBlockStart(b Block) map[string]any {
+	if b.Type == "text" {
+		return map[string]any{"type": "text", "text": ""}
+	}
+	return map[string]any{"type": b.Type, "id": b.ID, "name": b.Name, "input": b.Input}
+}
+
+func toolUse(call *gemini.FunctionCall, n int) Block {
+	id := call.ID
+	if id == "" {
+		id = fmt.Sprintf("toolu_%d", n)
+	}
+	input := call.Args
+	if len(input) == 0 {
+		input = json.RawMessage("{}")
+	}
+	return Block{Type: "tool_use", ID: id, Name: call.Name, Input: input}
+}
+
+func hasToolUse(blocks []Block) bool {
+	for _, b := range blocks {
+		if b.Type == "tool_use" {
+			return true
+		}
+	}
+	return false
+}
+
+func stopReason(reason string, toolUse bool) string {
+	switch {
+	case toolUse:
+		return StopToolUse
+	case reason == gemini.FinishMaxTokens:
+		return StopMaxTokens
+	case reason == gemini.FinishStop, reason == "":
+		return StopEndTurn
+	default:
+		// safety, recitation, blocklist and other blocking reasons
+		return StopRefusal
+	}
+}
+
+func usage(u *gemini.UsageMetadata) Usage {
+	if u == nil {
+		return Usage{}
+	}
+	return Usage{InputTokens: u.PromptTokenCount, OutputTokens: u.TotalTokenCount - u.PromptTokenCount}
+}
+
+func messageID(resp gemini.GenerateContentResponse) string {
+	if resp.ResponseID != "" {
+		return "msg_" + resp.ResponseID
+	}
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return "msg_" + hex.EncodeToString(b)
+}
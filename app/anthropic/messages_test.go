@@ -0,0 +1,136 @@
+package anthropic
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/theshamuel/gemini-proxy/app/gemini"
+)
+
+func TestMessagesRequest_ToGemini(t *testing.T) {
+	body := `{
+		"model": "gemini-2.5-pro",
+		"max_tokens": 256,
+		"system": [{"type": "text", "text": "be brief"}],
+		"messages": [
+			{"role": "user", "content": [{"type": "text", "text": "what is it?"},
+				{"type": "image", "source": {"type": "base64", "media_type": "image/jpeg", "data": "AAAA"}}]},
+			{"role": "assistant", "content": [{"type": "thinking", "thinking": "hmm"},
+				{"type": "tool_use", "id": "toolu_1", "name": "lookup", "input": {"q": "cat"}}]},
+			{"role": "user", "content": [{"type": "tool_result", "tool_use_id": "toolu_1", "content": "a cat"}]},
+			{"role": "user", "content": "thanks"}
+		],
+		"stop_sequences": ["END"],
+		"temperature": 0.5,
+		"top_k": 40,
+		"tools": [{"name": "lookup", "description": "find", "input_schema": {"type": "object"}}],
+		"tool_choice": {"type": "tool", "name": "lookup"}
+	}`
+	var req MessagesRequest
+	require.NoError(t, json.Unmarshal([]byte(body), &req))
+	res, err := req.ToGemini()
+	require.NoError(t, err)
+	b, err := json.Marshal(res)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"systemInstruction": {"parts": [{"text": "be brief"}]},
+		"contents": [
+			{"role": "user", "parts": [{"text": "what is it?"}, {"inlineData": {"mimeType": "image/jpeg", "data": "AAAA"}}]},
+			{"role": "model", "parts": [{"functionCall": {"name": "lookup", "args": {"q": "cat"}}}]},
+			{"role": "user", "parts": [{"functionResponse": {"name": "lookup", "response": {"content": "a cat"}}},
+				{"text": "thanks"}]}
+		],
+		"tools": [{"functionDeclarations": [{"name": "lookup", "description": "find", "parametersJsonSchema": {"type": "object"}}]}],
+		"toolConfig": {"functionCallingConfig": {"mode": "ANY", "allowedFunctionNames": ["lookup"]}},
+		"generationConfig": {"maxOutputTokens": 256, "temperature": 0.5, "topK": 40, "stopSequences": ["END"]}
+	}`, string(b))
+}
+
+func TestMessagesRequest_ToGeminiErrors(t *testing.T) {
+	tbl := []struct {
+		body string
+		err  string
+	}{
+		{`{"max_tokens": 1, "messages": [{"role": "user", "content": "hi"}]}`, "model is required"},
+		{`{"model": "m", "messages": [{"role": "user", "content": "hi"}]}`, "max_tokens should be positive"},
+		{`{"model": "m", "max_tokens": 1}`, "messages are required"},
+		{`{"model": "m", "max_tokens": 1, "messages": [{"role": "system", "content": "hi"}]}`, `message 0: role "system" is not supported`},
+		{`{"model": "m", "max_tokens": 1, "messages": [{"role": "user", "content": [{"type": "tool_result", "tool_use_id": "x"}]}]}`,
+			`message 0: tool_use "x" is not found`},
+		{`{"model": "m", "max_tokens": 1, "messages": [{"role": "user", "content": [{"type": "audio"}]}]}`,
+			`message 0: content block "audio" is not supported`},
+		{`{"model": "m", "max_tokens": 1, "messages": [{"role": "user", "content": "hi"}], "tool_choice": {"type": "some"}}`,
+			`tool_choice "some" is not supported`},
+	}
+	for _, tt := range tbl {
+		var req MessagesRequest
+		require.NoError(t, json.Unmarshal([]byte(tt.body), &req))
+		_, err := req.ToGemini()
+		assert.EqualError(t, err, tt.err, tt.body)
+	}
+}
+
+func TestFromGemini(t *testing.T) {
+	resp := gemini.GenerateContentResponse{
+		ResponseID: "r1",
+		Candidates: []gemini.Candidate{{Content: gemini.Content{Role: "model", Parts: []gemini.Part{
+			{Text: "thinking", Thought: true}, {Text: "let me "}, {Text: "check"},
+			{FunctionCall: &gemini.FunctionCall{Name: "lookup", Args: json.RawMessage(`{"q":"x"}`)}}}}, FinishReason: "STOP"}},
+		UsageMetadata: &gemini.UsageMetadata{PromptTokenCount: 5, CandidatesTokenCount: 7, TotalTokenCount: 14},
+	}
+	b, err := json.Marshal(FromGemini(resp, "gemini-2.5-pro"))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"id": "msg_r1", "type": "message", "role": "assistant", "model": "gemini-2.5-pro",
+		"content": [{"type": "text", "text": "let me check"},
+			{"type": "tool_use", "id": "toolu_3", "name": "lookup", "input": {"q": "x"}}],
+		"stop_reason": "tool_use", "stop_sequence": null,
+		"usage": {"input_tokens": 5, "output_tokens": 9}}`, string(b))
+
+	res := FromGemini(gemini.GenerateContentResponse{Candidates: []gemini.Candidate{{FinishReason: "MAX_TOKENS"}}}, "m")
+	assert.Equal(t, StopMaxTokens, *res.StopReason)
+	assert.Equal(t, []Block{}, res.Content)
+	res = FromGemini(gemini.GenerateContentResponse{PromptFeedback: &gemini.PromptFeedback{BlockReason: "SAFETY"}}, "m")
+	assert.Equal(t, StopRefusal, *res.StopReason)
+}
+
+func TestStreamer(t *testing.T) {
+	s := &Streamer{Model: "gemini-2.5-pro"}
+	event := func(finish string, usage *gemini.UsageMetadata, parts ...gemini.Part) gemini.GenerateContentResponse {
+		return gemini.GenerateContentResponse{ResponseID: "r1", UsageMetadata: usage, Candidates: []gemini.Candidate{
+			{Content: gemini.Content{Role: "model", Parts: parts}, FinishReason: finish}}}
+	}
+
+	var events []Event
+	events = append(events, s.Events(event("", &gemini.UsageMetadata{PromptTokenCount: 3, TotalTokenCount: 3},
+		gemini.Part{Text: "Hel"}))...)
+	events = append(events, s.Events(event("", nil, gemini.Part{Text: "lo"}))...)
+	events = append(events, s.Events(event("STOP", &gemini.UsageMetadata{PromptTokenCount: 3, TotalTokenCount: 8},
+		gemini.Part{FunctionCall: &gemini.FunctionCall{Name: "f", Args: json.RawMessage(`{"a":1}`)}}))...)
+	events = append(events, s.Final()...)
+
+	types := make([]string, 0, len(events))
+	data := make([]string, 0, len(events))
+	for _, e := range events {
+		types = append(types, e.Type)
+		b, err := json.Marshal(e.Data)
+		require.NoError(t, err)
+		data = append(data, string(b))
+	}
+	assert.Equal(t, []string{"message_start", "content_block_start", "content_block_delta", "content_block_delta",
+		"content_block_stop", "content_block_start", "content_block_delta", "content_block_stop", "message_delta",
+		"message_stop"}, types)
+	assert.Contains(t, data[0], `"id":"msg_r1"`)
+	assert.Contains(t, data[0], `"usage":{"input_tokens":3,"output_tokens":0}`)
+	assert.JSONEq(t, `{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`, data[1])
+	assert.JSONEq(t, `{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"lo"}}`, data[3])
+	assert.JSONEq(t, `{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_0",`+
+		`"name":"f","input":{}}}`, data[5])
+	assert.JSONEq(t, `{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"a\":1}"}}`, data[6])
+	assert.JSONEq(t, `{"type":"message_delta","delta":{"stop_reason":"tool_use","stop_sequence":null},`+
+		`"usage":{"output_tokens":5}}`, data[8])
+	assert.True(t, strings.HasPrefix(data[9], `{"type":"message_stop"`))
+}
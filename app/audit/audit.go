@@ -0,0 +1,235 @@
+// Package audit writes record of every exchange with Gemini as json line: who asked, which model, request hash,
+// usage, latency and upstream status, optionally with prompt and response. Records are written asynchronously,
+// when buffer is full they are dropped and counted
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// Content modes of prompt and response in audit log
+const (
+	ContentNone      = "none"
+	ContentTruncated = "truncated"
+	ContentFull      = "full"
+)
+
+// Record is exchange with Gemini, request and response are raw json bodies.
+// Response of stream is json array of its events
+type Record struct {
+	Time             time.Time
+	Client           string
+	Model            string
+	Method           string
+	Request          []byte
+	Response         []byte
+	PromptTokens     int64
+	CandidatesTokens int64
+	TotalTokens      int64
+	Latency          time.Duration
+	Status           int    // upstream status, 0 if Gemini didn't respond
+	Error            string // error class of failed exchange
+	Cached           bool   // response is taken from response cache, status is the one of cached response
+}
+
+// Options of audit log, zero MaxText means 1024 bytes and zero BufferSize means 1000 records
+type Options struct {
+	Content    string   // none, truncated or full
+	MaxText    int      // bytes of truncated prompt and response
+	OptOut     []string // clients not audited
+	Redact     []string // json fields of prompt and response replaced with [REDACTED] at any depth, e.g. inlineData
+	BufferSize int
+}
+
+// Logger writes records to w in background
+type Logger struct {
+	opts    Options
+	w       io.WriteCloser
+	optOut  map[string]bool
+	redact  map[string]bool
+	records chan Record
+	dropped atomic.Int64
+	done    chan struct{}
+	lock    sync.RWMutex
+	closed  bool
+}
+
+// entry is json line of audit log
+type entry struct {
+	Time             time.Time `json:"time"`
+	Client           string    `json:"client"`
+	Model            string    `json:"model"`
+	Method           string    `json:"method"`
+	RequestHash      string    `json:"request_hash"`
+	Prompt           any       `json:"prompt,omitempty"`
+	Response         any       `json:"response,omitempty"`
+	PromptTokens     int64     `json:"prompt_tokens"`
+	CandidatesTokens int64     `json:"candidates_tokens"`
+	TotalTokens      int64     `json:"total_tokens"`
+	LatencyMs        int64     `json:"latency_ms"`
+	Status           int       `json:"upstream_status"`
+	Error            string    `json:"error,omitempty"`
+	Cached           bool      `json:"cached,omitempty"`
+}
+
+// New makes logger writing to w and starts its writer, Close should be called to flush buffered records
+func New(w io.WriteCloser, opts Options) *Logger {
+	if opts.Content == "" {
+		opts.Content = ContentNone
+	}
+	if opts.MaxText <= 0 {
+		opts.MaxText = 1024
+	}
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = 1000
+	}
+	res := &Logger{opts: opts, w: w, optOut: map[string]bool{}, redact: map[string]bool{},
+		records: make(chan Record, opts.BufferSize), done: make(chan struct{})}
+	for _, c := range opts.OptOut {
+		res.optOut[c] = true
+	}
+	for _, f := range opts.Redact {
+		res.redact[f] = true
+	}
+	go res.run()
+	return res
+}
+
+// Enabled tells if exchanges of client are audited, it's false for nil logger
+func (l *Logger) Enabled(client string) bool {
+	return l != nil && !l.optOut[client]
+}
+
+// Content tells if prompt and response are written, caller could skip collecting them otherwise
+func (l *Logger) Content() bool {
+	return l != nil && l.opts.Content != ContentNone
+}
+
+// Log queues record without waiting, record is dropped if buffer is full
+func (l *Logger) Log(rec Record) {
+	if !l.Enabled(rec.Client) {
+		return
+	}
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if l.closed {
+		l.dropped.Add(1)
+		return
+	}
+	select {
+	case l.records <- rec:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+// Dropped returns number of records dropped because of full buffer or closed logger
+func (l *Logger) Dropped() int64 {
+	if l == nil {
+		return 0
+	}
+	return l.dropped.Load()
+}
+
+// Close writes buffered records and closes destination, records logged after Close are dropped
+func (l *Logger) Close() error {
+	l.lock.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.records)
+	}
+	l.lock.Unlock()
+	<-l.done
+	return l.w.Close()
+}
+
+func (l *Logger) run() {
+	defer close(l.done)
+	for rec := range l.records {
+		line, err := json.Marshal(l.entry(rec))
+		if err != nil {
+			log.Printf("[WARN] can not encode audit record: %v", err)
+			continue
+		}
+		if _, err = l.w.Write(append(line, '\n')); err != nil {
+			log.Printf("[WARN] can not write audit record: %v", err)
+		}
+	}
+}
+
+func (l *Logger) entry(rec Record) entry {
+	hash := sha256.Sum256(rec.Request)
+	res := entry{
+		Time:             rec.Time.UTC(),
+		Client:           rec.Client,
+		Model:            rec.Model,
+		Method:           rec.Method,
+		RequestHash:      "sha256:" + hex.EncodeToString(hash[:]),
+		PromptTokens:     rec.PromptTokens,
+		CandidatesTokens: rec.CandidatesTokens,
+		TotalTokens:      rec.TotalTokens,
+		LatencyMs:        rec.Latency.Milliseconds(),
+		Status:           rec.Status,
+		Error:            rec.Error,
+		Cached:           rec.Cached,
+	}
+	if l.opts.Content != ContentNone {
+		res.Prompt, res.Response = l.content(rec.Request), l.content(rec.Response)
+	}
+	return res
+}
+
+// content returns redacted json body, truncated one is returned as string
+func (l *Logger) content(body []byte) any {
+	if len(body) == 0 {
+		return nil
+	}
+	if len(l.redact) > 0 {
+		var v any
+		if err := json.Unmarshal(body, &v); err == nil {
+			if b, err := json.Marshal(l.redactValue(v)); err == nil {
+				body = b
+			}
+		}
+	}
+	if l.opts.Content == ContentTruncated {
+		if n := l.opts.MaxText; len(body) > n {
+			// cut on rune boundary to keep text valid utf-8
+			for n > 0 && !utf8.RuneStart(body[n]) {
+				n--
+			}
+			return string(body[:n]) + "..."
+		}
+		return string(body)
+	}
+	if !json.Valid(body) {
+		return string(body)
+	}
+	return json.RawMessage(body)
+}
+
+func (l *Logger) redactValue(v any) any {
+	switch val := v.(type) {
+	case map[string]any:
+		for k, child := range val {
+			if l.redact[k] {
+				val[k] = "[REDACTED]"
+				continue
+			}
+			val[k] = l.redactValue(child)
+		}
+	case []any:
+		for i, child := range val {
+			val[i] = l.redactValue(child)
+		}
+	}
+	return v
+}
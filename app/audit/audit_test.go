@@ -0,0 +1,133 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type bufCloser struct {
+	bytes.Buffer
+	closed bool
+	block  chan struct{}
+	lock   sync.Mutex
+}
+
+func (b *bufCloser) Write(p []byte) (int, error) {
+	if b.block != nil {
+		<-b.block
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func (b *bufCloser) Close() error {
+	b.closed = true
+	return nil
+}
+
+func (b *bufCloser) lines(t *testing.T) []map[string]any {
+	var res []map[string]any
+	for _, l := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		var m map[string]any
+		require.NoError(t, json.Unmarshal([]byte(l), &m))
+		res = append(res, m)
+	}
+	return res
+}
+
+var testRecord = Record{
+	Time:             time.Date(2025, 3, 1, 10, 0, 0, 0, time.FixedZone("CET", 3600)),
+	Client:           "web",
+	Model:            "gemini-2.5-pro",
+	Method:           "generateContent",
+	Request:          []byte(`{"contents":[{"parts":[{"text":"hi"},{"inlineData":{"mimeType":"image/png","data":"aGk="}}]}]}`),
+	Response:         []byte(`{"candidates":[{"content":{"parts":[{"text":"hello"}]}}]}`),
+	PromptTokens:     3,
+	CandidatesTokens: 5,
+	TotalTokens:      8,
+	Latency:          1500 * time.Millisecond,
+	Status:           200,
+}
+
+func TestLogger(t *testing.T) {
+	w := &bufCloser{}
+	l := New(w, Options{OptOut: []string{"bot"}})
+	assert.True(t, l.Enabled("web"))
+	assert.False(t, l.Enabled("bot"))
+	assert.False(t, l.Content())
+
+	l.Log(testRecord)
+	rec := testRecord
+	rec.Client, rec.Status, rec.Error = "bot", 429, "rate_limit"
+	l.Log(rec)
+	rec.Client = ""
+	l.Log(rec)
+	require.NoError(t, l.Close())
+	assert.True(t, w.closed)
+
+	hash := sha256.Sum256(testRecord.Request)
+	assert.Equal(t, `{"time":"2025-03-01T09:00:00Z","client":"web","model":"gemini-2.5-pro","method":"generateContent",`+
+		`"request_hash":"sha256:`+hex.EncodeToString(hash[:])+`","prompt_tokens":3,"candidates_tokens":5,"total_tokens":8,`+
+		`"latency_ms":1500,"upstream_status":200}`, strings.Split(w.String(), "\n")[0])
+	lines := w.lines(t)
+	require.Len(t, lines, 2, "opted out client is not logged")
+	assert.Equal(t, "", lines[1]["client"])
+	assert.Equal(t, "rate_limit", lines[1]["error"])
+	assert.EqualValues(t, 429, lines[1]["upstream_status"])
+
+	l.Log(testRecord)
+	assert.Equal(t, int64(1), l.Dropped(), "record after close is dropped")
+
+	var nilLogger *Logger
+	assert.False(t, nilLogger.Enabled("web"))
+	nilLogger.Log(testRecord)
+	assert.Equal(t, int64(0), nilLogger.Dropped())
+}
+
+func TestLogger_Content(t *testing.T) {
+	w := &bufCloser{}
+	l := New(w, Options{Content: ContentFull, Redact: []string{"inlineData"}})
+	assert.True(t, l.Content())
+	l.Log(testRecord)
+	require.NoError(t, l.Close())
+	line := w.lines(t)[0]
+	b, err := json.Marshal(line["prompt"])
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"contents":[{"parts":[{"text":"hi"},{"inlineData":"[REDACTED]"}]}]}`, string(b))
+	b, err = json.Marshal(line["response"])
+	require.NoError(t, err)
+	assert.JSONEq(t, string(testRecord.Response), string(b))
+
+	w = &bufCloser{}
+	l = New(w, Options{Content: ContentTruncated, MaxText: 20})
+	rec := testRecord
+	rec.Response = []byte(`"привет"`)
+	l.Log(rec)
+	require.NoError(t, l.Close())
+	line = w.lines(t)[0]
+	assert.Equal(t, `{"contents":[{"parts...`, line["prompt"])
+	assert.Equal(t, `"привет"`, line["response"], "short content is not truncated")
+}
+
+func TestLogger_Dropped(t *testing.T) {
+	w := &bufCloser{block: make(chan struct{})}
+	l := New(w, Options{BufferSize: 2})
+	for i := 0; i < 10; i++ {
+		l.Log(testRecord)
+	}
+	// writer holds one record and buffer holds two of them
+	assert.GreaterOrEqual(t, l.Dropped(), int64(7))
+	close(w.block)
+	require.NoError(t, l.Close())
+	assert.Equal(t, int64(10), l.Dropped()+int64(len(w.lines(t))))
+}
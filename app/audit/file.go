@@ -0,0 +1,120 @@
+package audit
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RotatingFile is append-only file rotated when it grows over MaxSize or gets older than MaxAge.
+// Rotated file gets suffix with rotation time, e.g. audit.jsonl-2025-01-02T15-04-05.000, only MaxBackups
+// latest rotated files are kept. Zero limits disable rotation by size or age and removal of backups.
+// Age is counted from the moment the file is opened by proxy
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64
+	MaxAge     time.Duration
+	MaxBackups int
+
+	lock   sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+	now    func() time.Time
+}
+
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// NewRotatingFile opens file at path for append, directory of the file is created if missing
+func NewRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*RotatingFile, error) {
+	res := &RotatingFile{Path: path, MaxSize: maxSize, MaxAge: maxAge, MaxBackups: maxBackups, now: time.Now}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("can not make directory of %s: %w", path, err)
+	}
+	if err := res.open(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Write appends p to the file, the file is rotated before the write if p doesn't fit into MaxSize or file is too old
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	tooBig := f.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.MaxSize
+	tooOld := f.MaxAge > 0 && f.now().Sub(f.opened) >= f.MaxAge
+	if tooBig || tooOld {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes the file
+func (f *RotatingFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("can not open %s: %w", f.Path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("can not stat %s: %w", f.Path, err)
+	}
+	f.file, f.size, f.opened = file, info.Size(), f.now()
+	return nil
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("can not close %s: %w", f.Path, err)
+	}
+	f.file = nil
+	backup := f.Path + "-" + f.now().UTC().Format(backupTimeFormat)
+	if err := os.Rename(f.Path, backup); err != nil {
+		return fmt.Errorf("can not rotate %s: %w", f.Path, err)
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.removeBackups()
+	return nil
+}
+
+// removeBackups removes the oldest rotated files over MaxBackups, names of backups sort by rotation time
+func (f *RotatingFile) removeBackups() {
+	if f.MaxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(f.Path + "-*")
+	if err != nil || len(backups) <= f.MaxBackups {
+		return
+	}
+	sort.Strings(backups)
+	for _, b := range backups[:len(backups)-f.MaxBackups] {
+		if err := os.Remove(b); err != nil {
+			log.Printf("[WARN] can not remove audit backup %s: %v", b, err)
+		}
+	}
+}
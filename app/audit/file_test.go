@@ -0,0 +1,66 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "audit.jsonl")
+	f, err := NewRotatingFile(path, 10, time.Hour, 2)
+	require.NoError(t, err)
+	now := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+	f.now = func() time.Time { return now }
+	f.opened = now
+
+	write := func(s string) {
+		_, err := f.Write([]byte(s))
+		require.NoError(t, err)
+	}
+	backups := func() []string {
+		res, err := filepath.Glob(path + "-*")
+		require.NoError(t, err)
+		sort.Strings(res)
+		for i, r := range res {
+			res[i] = filepath.Base(r)
+		}
+		return res
+	}
+
+	write("1234\n")
+	write("1234\n")
+	assert.Empty(t, backups(), "file is not over the size yet")
+	write("1\n")
+	assert.Equal(t, []string{"audit.jsonl-2025-03-01T10-00-00.000"}, backups(), "rotated by size")
+
+	now = now.Add(time.Hour)
+	write("2\n")
+	assert.Equal(t, []string{"audit.jsonl-2025-03-01T10-00-00.000", "audit.jsonl-2025-03-01T11-00-00.000"}, backups(),
+		"rotated by age")
+	data, err := os.ReadFile(path + "-2025-03-01T11-00-00.000")
+	require.NoError(t, err)
+	assert.Equal(t, "1\n", string(data))
+
+	now = now.Add(time.Hour)
+	write("3\n")
+	assert.Equal(t, []string{"audit.jsonl-2025-03-01T11-00-00.000", "audit.jsonl-2025-03-01T12-00-00.000"}, backups(),
+		"the oldest backup is removed")
+
+	require.NoError(t, f.Close())
+	data, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "3\n", string(data))
+	_, err = f.Write([]byte("4\n"))
+	assert.ErrorIs(t, err, os.ErrClosed)
+
+	f, err = NewRotatingFile(path, 10, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), f.size, "size of existing file is counted")
+	require.NoError(t, f.Close())
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/theshamuel/gemini-proxy/app/config"
+	"github.com/theshamuel/gemini-proxy/app/rest/api"
+)
+
+// ConfigCheckCmd validates config file the way server does on start and prints effective options,
+// i.e. config file merged with defaults, env and flags, secrets are redacted
+type ConfigCheckCmd struct {
+	Config *config.Config `no-flag:"true"`
+	out    io.Writer
+}
+
+// Execute is the entry point for config check command
+func (cc ConfigCheckCmd) Execute(_ []string) error {
+	if cc.out == nil {
+		cc.out = os.Stdout
+	}
+	co, err := cc.Config.GetCommon()
+	if err != nil {
+		return err
+	}
+	warnings := cc.Config.Warnings
+	if co.GeminiAPIKey == "" && len(co.GeminiAPIKeys) == 0 {
+		warnings = append(warnings, "Gemini API key is not set")
+	}
+	for _, w := range warnings {
+		if _, err = fmt.Fprintf(cc.out, "warning: %s\n", w); err != nil {
+			return err
+		}
+	}
+	if err = (ServerCmd{CommonOpts: *co}).validate(); err != nil {
+		return fmt.Errorf("config %s is not valid: %w", cc.Config.FileName, err)
+	}
+	if _, err = fmt.Fprintf(cc.out, "config %s is valid, effective options:\n", cc.Config.FileName); err != nil {
+		return err
+	}
+	return cc.Config.Print(cc.out, co)
+}
+
+// validate checks options by making parts of application which don't open files or start anything,
+// secret references are resolved, all problems are returned
+func (sc ServerCmd) validate() error {
+	var errs []error
+	check := func(_ any, err error) {
+		errs = append(errs, err)
+	}
+	errs = append(errs, config.ResolveSecrets(context.Background(), &sc.CommonOpts))
+	check(sc.makeAuth())
+	check(sc.makeCORS())
+	check(sc.makeRouteLimits())
+	if sc.AdminKeyHash != "" {
+		if _, err := api.NewAuth([]api.Client{{Name: "admin", KeyHash: sc.AdminKeyHash}}); err != nil {
+			errs = append(errs, fmt.Errorf("can not configure admin key: %w", err))
+		}
+	}
+	check(sc.makeQuota())
+	check(sc.makeKeys())
+	check(sc.makeCatalog())
+	check(sc.makePolicies())
+	check(sc.makeFilters())
+	if sc.Audit.Enabled {
+		check(sc.auditOptions())
+	}
+	_, _, err := sc.tlsOptions()
+	errs = append(errs, err)
+	switch {
+	case sc.TLS.Enabled && sc.TLS.ACME.Enabled:
+		check(sc.makeACME())
+	case sc.TLS.Enabled:
+		check(api.LoadCertificate(sc.TLS.CertPath, sc.TLS.PrivateKeyPath))
+	}
+	check(sc.makeClientAuth())
+	return errors.Join(errs...)
+}
@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/theshamuel/gemini-proxy/app/config"
+)
+
+func TestConfigCheckCmd_Execute(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "gemini-proxy.yml")
+	require.NoError(t, os.WriteFile(file, []byte("gemini-api-key: secret-key\ncahce: {}\n"+
+		"clients:\n  - name: web\n    key-hash: sha256:2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b\n"), 0o600))
+
+	out := bytes.Buffer{}
+	cnf := &config.Config{FileName: file}
+	require.NoError(t, ConfigCheckCmd{Config: cnf, out: &out}.Execute(nil))
+	assert.Contains(t, out.String(), "warning: line 2: unknown key cahce\nconfig "+file+" is valid, effective options:\n")
+	assert.Contains(t, out.String(), "gemini-api-key: ***** (file)\n")
+	assert.NotContains(t, out.String(), "secret-key")
+
+	require.NoError(t, os.WriteFile(file, []byte("clients:\n  - name: web\n    key-hash: wrong\n"+
+		"policies:\n  - name: p\n    system-instruction: {mode: append}\naudit: {enabled: true, content: all}\n"), 0o600))
+	out.Reset()
+	err := ConfigCheckCmd{Config: cnf, out: &out}.Execute(nil)
+	require.Error(t, err)
+	assert.Equal(t, "config "+file+" is not valid: can not configure clients: key hash of client web should start with sha256:\n"+
+		"system instruction mode of prompt policy p should be prepend or replace\n"+
+		`audit content should be none, truncated or full, got "all"`, err.Error())
+	assert.Equal(t, "warning: Gemini API key is not set\n", out.String())
+
+	require.NoError(t, os.WriteFile(file, []byte("cache: [1]\n"), 0o600))
+	err = ConfigCheckCmd{Config: cnf, out: &out}.Execute(nil)
+	assert.EqualError(t, err, "can't parse "+file+": line 1: cache should be mapping, got list")
+}
@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/theshamuel/gemini-proxy/app/rest/api"
+)
+
+// HashKeyCmd prints hash of proxy key to put into clients section of config, new key is generated if it's not set
+type HashKeyCmd struct {
+	Key string `long:"key" env:"PROXY_KEY" description:"proxy key to hash, random key is generated if empty"`
+	out io.Writer
+}
+
+// Execute is the entry point for hash-key command
+func (hc HashKeyCmd) Execute(_ []string) error {
+	if hc.out == nil {
+		hc.out = os.Stdout
+	}
+	key := hc.Key
+	if key == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return fmt.Errorf("can not generate key: %w", err)
+		}
+		key = base64.RawURLEncoding.EncodeToString(b)
+		if _, err := fmt.Fprintf(hc.out, "key: %s\n", key); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(hc.out, "key-hash: %s\n", api.HashKey(key))
+	return err
+}
@@ -0,0 +1,25 @@
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/theshamuel/gemini-proxy/app/rest/api"
+)
+
+func TestHashKeyCmd_Execute(t *testing.T) {
+	out := bytes.Buffer{}
+	require.NoError(t, HashKeyCmd{Key: "secret", out: &out}.Execute(nil))
+	assert.Equal(t, "key-hash: "+api.HashKey("secret")+"\n", out.String())
+
+	out.Reset()
+	require.NoError(t, HashKeyCmd{out: &out}.Execute(nil))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	key := strings.TrimPrefix(lines[0], "key: ")
+	assert.Len(t, key, 43)
+	assert.Equal(t, "key-hash: "+api.HashKey(key), lines[1])
+}
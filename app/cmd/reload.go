@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+
+	"github.com/theshamuel/gemini-proxy/app/config"
+	"github.com/theshamuel/gemini-proxy/app/rest/api"
+	"github.com/theshamuel/gemini-proxy/app/service"
+)
+
+// watchConfig reloads config on SIGHUP and on change of config file if ConfigWatch is set, until ctx is done
+func (app *application) watchConfig(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	changed := make(chan struct{}, 1)
+	if app.ConfigWatch > 0 {
+		go app.Config.Watch(ctx, app.ConfigWatch, func() {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		})
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Printf("[INFO] SIGHUP is received, reload config %s", app.Config.FileName)
+		case <-changed:
+			log.Printf("[INFO] config %s is changed, reload it", app.Config.FileName)
+		}
+		if err := app.reload(); err != nil {
+			log.Printf("[ERROR] can not reload config, the old one is kept: %v", err)
+		}
+	}
+}
+
+// reload reads config file again and replaces clients, CORS policies, Gemini API keys, allowlists, limits, quotas,
+// scheduler and route limits, retry policy, prompt policies, content filter and TLS certificate at once.
+// Nothing is replaced if any of them is not valid. Keys kept in the pool keep their state, e.g. cooldown
+func (app *application) reload() error {
+	app.reloadLock.Lock()
+	defer app.reloadLock.Unlock()
+
+	co, err := app.Config.GetCommon()
+	if err != nil {
+		return err
+	}
+	for _, w := range app.Config.Warnings {
+		log.Printf("[WARN] config %s, %s", app.Config.FileName, w)
+	}
+	next := app.ServerCmd
+	next.CommonOpts = *co
+
+	var errs []error
+	// secrets are read again, so rotated key in file or secret store is picked up
+	errs = append(errs, config.ResolveSecrets(context.Background(), &next.CommonOpts))
+	auth, err := next.makeAuth()
+	errs = append(errs, err)
+	corsPolicies, err := next.makeCORS()
+	errs = append(errs, err)
+	keys, err := next.makeKeys()
+	errs = append(errs, err)
+	policies, err := next.makePolicies()
+	errs = append(errs, err)
+	filters, err := next.makeFilters()
+	errs = append(errs, err)
+	quotaLimits, err := next.makeQuotaLimits()
+	errs = append(errs, err)
+	routes, err := next.makeRouteLimits()
+	errs = append(errs, err)
+	var cert *api.Certificate
+	if app.TLS.Enabled && !app.TLS.ACME.Enabled {
+		cert, err = api.LoadCertificate(next.TLS.CertPath, next.TLS.PrivateKeyPath)
+		errs = append(errs, err)
+	}
+	if err = errors.Join(errs...); err != nil {
+		return err
+	}
+
+	keys.Inherit(app.proxy.Settings().Keys)
+	scheduler := next.makeScheduler()
+	app.proxy.Scheduler.SetLimits(scheduler.RPM, scheduler.TPM, scheduler.MaxInFlight, scheduler.MaxQueue,
+		scheduler.QueueTimeout)
+	switch {
+	case app.rest.Quota != nil:
+		app.rest.Quota.SetLimits(quotaLimits)
+	case len(quotaLimits) > 0:
+		log.Printf("[WARN] clients quota is set in config, it's applied after restart only")
+	}
+
+	app.proxy.Reload(service.Settings{
+		APIKey:         next.GeminiAPIKey.Reveal(),
+		Keys:           keys,
+		AllowedModels:  next.AllowedModels,
+		AllowedMethods: next.AllowedMethods,
+		Retry: &service.RetryPolicy{
+			MaxAttempts: next.Retry.MaxAttempts,
+			BaseBackoff: next.Retry.BaseBackoff,
+			MaxBackoff:  next.Retry.MaxBackoff,
+			Jitter:      next.Retry.Jitter,
+			Statuses:    next.Retry.Statuses,
+		},
+		Policies:      policies,
+		Filters:       filters,
+		ModelTimeouts: routes.timeouts,
+	})
+	app.rest.Reload(api.Settings{Auth: auth, Keys: keys, Limits: next.makeLimits(), CORS: corsPolicies,
+		Certificate: cert, RouteLimits: routes.groups, ModelLimits: routes.models})
+	for _, name := range restartRequired(app.CommonOpts, next.CommonOpts) {
+		log.Printf("[WARN] %s is changed in config, it's applied after restart only", name)
+	}
+	log.Printf("[INFO] config %s is reloaded", app.Config.FileName)
+	return nil
+}
+
+// restartRequired returns config sections changed between running and reloaded options which can't be reloaded
+func restartRequired(running, next config.CommonOpts) []string {
+	sections := []struct {
+		name          string
+		running, next any
+	}{
+		{"gemini-base-url", running.GeminiBaseURL, next.GeminiBaseURL},
+		{"admin-key-hash", running.AdminKeyHash, next.AdminKeyHash},
+		{"relay-upstream-errors", running.RelayErrors, next.RelayErrors},
+		{"quota", running.Quota, next.Quota},
+		{"server.read-header-timeout", running.Server.ReadHeaderTimeout, next.Server.ReadHeaderTimeout},
+		{"server.write-timeout", running.Server.WriteTimeout, next.Server.WriteTimeout},
+		{"server.idle-timeout", running.Server.IdleTimeout, next.Server.IdleTimeout},
+		{"server.throttle", running.Server.Throttle, next.Server.Throttle},
+		{"server.upstream-timeout", running.Server.UpstreamTimeout, next.Server.UpstreamTimeout},
+		{"cache", running.Cache, next.Cache},
+		{"models", running.Models, next.Models},
+		{"metrics", running.Metrics, next.Metrics},
+		{"audit", running.Audit, next.Audit},
+		{"tls.enabled", running.TLS.Enabled, next.TLS.Enabled},
+		{"tls.min-version", running.TLS.MinVersion, next.TLS.MinVersion},
+		{"tls.ciphers", running.TLS.Ciphers, next.TLS.Ciphers},
+		{"tls.watch", running.TLS.Watch, next.TLS.Watch},
+		{"tls.client-ca", running.TLS.ClientCA, next.TLS.ClientCA},
+		{"tls.client-auth", running.TLS.ClientAuth, next.TLS.ClientAuth},
+		{"tls.crl", running.TLS.CRL, next.TLS.CRL},
+		{"tls.acme", running.TLS.ACME, next.TLS.ACME},
+		{"debug", running.Debug, next.Debug},
+	}
+	var res []string
+	for _, s := range sections {
+		if !reflect.DeepEqual(s.running, s.next) {
+			res = append(res, s.name)
+		}
+	}
+	return res
+}
@@ -2,13 +2,24 @@ package cmd
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/theshamuel/gemini-proxy/app/acme"
+	"github.com/theshamuel/gemini-proxy/app/audit"
 	"github.com/theshamuel/gemini-proxy/app/config"
+	"github.com/theshamuel/gemini-proxy/app/gemini"
+	"github.com/theshamuel/gemini-proxy/app/metrics"
+	"github.com/theshamuel/gemini-proxy/app/quota"
 	"github.com/theshamuel/gemini-proxy/app/rest/api"
 	"github.com/theshamuel/gemini-proxy/app/service"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -20,13 +31,18 @@ type ServerCommand interface {
 // ServerCmd represent arguments that can be used to start server (application)
 type ServerCmd struct {
 	config.CommonOpts
-	Port    int `long:"port" env:"SERVER_PORT" default:"9443" description:"application port"`
-	Version string
+	Port        int `long:"port" env:"SERVER_PORT" default:"9443" description:"application port"`
+	Version     string
+	Config      *config.Config `no-flag:"true"` // config file reloaded on SIGHUP, nil if options aren't read from config
+	ConfigWatch time.Duration  // interval of config file check, 0 disables reload on change of the file
 }
 
 type application struct {
 	ServerCmd
 	rest       *api.Rest
+	proxy      *service.GeminiProxy
+	audit      *audit.Logger
+	reloadLock sync.Mutex
 	terminated chan struct{}
 }
 
@@ -37,8 +53,11 @@ func (sc ServerCmd) Execute(_ []string) error {
 		"                     port: %d;\n"+
 		"                     TLS enabled: %t;\n"+
 		"                         Cert path: %s;\n"+
-		"                         Pribate key path: %s;\n",
-		sc.Port, sc.TLS.Enabled, sc.TLS.CertPath, sc.TLS.PrivateKeyPath)
+		"                         Pribate key path: %s;\n"+
+		"                     Gemini base URL: %s;\n"+
+		"                     allowed models: %v;\n"+
+		"                     allowed methods: %v;\n",
+		sc.Port, sc.TLS.Enabled, sc.TLS.CertPath, sc.TLS.PrivateKeyPath, sc.GeminiBaseURL, sc.AllowedModels, sc.AllowedMethods)
 
 	log.Printf("[DEBUG] common options: %+v", sc.CommonOpts)
 
@@ -50,7 +69,11 @@ func (sc ServerCmd) Execute(_ []string) error {
 		log.Printf("[WARN] Get interrupt signal")
 		cancel()
 	}()
-	app := sc.bootstrapApp()
+	app, err := sc.bootstrapApp()
+	if err != nil {
+		log.Printf("[ERROR] can not bootstrap application: %v", err)
+		return err
+	}
 	log.Printf("[INFO] Starting Gemini Proxy:[version: %s] ...\n", sc.Version)
 	if err := app.run(ctx); err != nil {
 		log.Printf("[ERROR] Server terminated with error %v", err)
@@ -68,32 +91,639 @@ func (app *application) run(ctx context.Context) error {
 		log.Print("[INFO] shutdown is completed")
 	}()
 
+	if app.Config != nil {
+		go app.watchConfig(ctx)
+	}
+
+	if app.Models.Refresh > 0 {
+		go app.proxy.RefreshModels(ctx, app.Models.Refresh)
+	}
+
+	if app.rest.ACME != nil {
+		go app.rest.ACME.Run(ctx)
+	}
+	if app.TLS.Enabled && app.TLS.Watch > 0 && (app.rest.ACME == nil || app.rest.ClientAuth != nil) {
+		go app.rest.WatchTLS(ctx, app.TLS.Watch)
+	}
+
+	var usageFile *quota.FileStore
+	if app.rest.Quota != nil {
+		usageFile, _ = app.rest.Quota.Store.(*quota.FileStore)
+	}
+	if usageFile != nil && app.Quota.FlushInterval > 0 {
+		go usageFile.Run(ctx, app.Quota.FlushInterval)
+	}
+
 	app.rest.Run(app.Port)
+	if usageFile != nil {
+		if err := usageFile.Flush(); err != nil {
+			log.Printf("[WARN] can not write usage: %v", err)
+		}
+	}
+	if app.audit != nil {
+		if err := app.audit.Close(); err != nil {
+			log.Printf("[WARN] can not close audit log: %v", err)
+		}
+	}
 	close(app.terminated)
 	return nil
 }
 
-func (sc ServerCmd) bootstrapApp() *application {
+func (sc ServerCmd) bootstrapApp() (*application, error) {
+	if err := config.ResolveSecrets(context.Background(), &sc.CommonOpts); err != nil {
+		return nil, err
+	}
+
+	var adminAuth *api.Auth
+	auth, err := sc.makeAuth()
+	if err != nil {
+		return nil, err
+	}
+
+	if sc.AdminKeyHash != "" {
+		if adminAuth, err = api.NewAuth([]api.Client{{Name: "admin", KeyHash: sc.AdminKeyHash}}); err != nil {
+			return nil, fmt.Errorf("can not configure admin key: %w", err)
+		}
+	}
+
+	corsPolicies, err := sc.makeCORS()
+	if err != nil {
+		return nil, err
+	}
+
+	quotaManager, err := sc.makeQuota()
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := sc.makeKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	catalog, err := sc.makeCatalog()
+	if err != nil {
+		return nil, err
+	}
+	policies, err := sc.makePolicies()
+	if err != nil {
+		return nil, err
+	}
+	filters, err := sc.makeFilters()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsVersion, cipherSuites, err := sc.tlsOptions()
+	if err != nil {
+		return nil, err
+	}
+	acmeManager, err := sc.makeACME()
+	if err != nil {
+		return nil, err
+	}
+	clientAuth, err := sc.makeClientAuth()
+	if err != nil {
+		return nil, err
+	}
+	routes, err := sc.makeRouteLimits()
+	if err != nil {
+		return nil, err
+	}
+
+	auditLog, err := sc.makeAudit()
+	if err != nil {
+		return nil, err
+	}
+
+	var proxy *service.GeminiProxy
+	scheduler, cache := sc.makeScheduler(), sc.makeCache()
+	proxyMetrics := sc.makeMetrics(scheduler, cache, func() service.Settings { return proxy.Settings() }, auditLog)
+	proxy = &service.GeminiProxy{
+		BaseURL: sc.GeminiBaseURL,
+		Client: http.Client{
+			Timeout: sc.Server.UpstreamTimeout,
+		},
+		ModelTimeouts:  routes.timeouts,
+		Cache:          cache,
+		APIKey:         sc.GeminiAPIKey.Reveal(),
+		Keys:           keys,
+		AllowedModels:  sc.AllowedModels,
+		AllowedMethods: sc.AllowedMethods,
+		Scheduler:      scheduler,
+		Metrics:        proxyMetrics,
+		Catalog:        catalog,
+		Policies:       policies,
+		Filters:        filters,
+		Audit:          auditLog,
+		Retry: &service.RetryPolicy{
+			MaxAttempts: sc.Retry.MaxAttempts,
+			BaseBackoff: sc.Retry.BaseBackoff,
+			MaxBackoff:  sc.Retry.MaxBackoff,
+			Jitter:      sc.Retry.Jitter,
+			Statuses:    sc.Retry.Statuses,
+		},
+	}
+
 	rest := &api.Rest{
-		Version:       sc.Version,
-		DelayRequests: sc.DelayRequests,
-		Service: &service.GeminiProxy{
-			OriginURL: "https://generativelanguage.googleapis.com/v1beta/models/gemini-2.0-flash:generateContent?key=",
-			Client: http.Client{
-				Timeout: 20 * time.Second,
-			},
-			APIKey: sc.GeminiAPIKey,
+		Auth:                auth,
+		AdminAuth:           adminAuth,
+		Quota:               quotaManager,
+		Keys:                keys,
+		Cache:               cache,
+		Limits:              sc.makeLimits(),
+		CORS:                corsPolicies,
+		Metrics:             proxyMetrics,
+		MetricsListen:       sc.Metrics.Listen,
+		Version:             sc.Version,
+		RelayUpstreamErrors: sc.RelayErrors,
+		Service:             proxy,
+		TLSEnabled:          sc.TLS.Enabled,
+		CertPath:            sc.TLS.CertPath,
+		PrivateKeyPath:      sc.TLS.PrivateKeyPath,
+		TLSMinVersion:       tlsVersion,
+		TLSCipherSuites:     cipherSuites,
+		ACME:                acmeManager,
+		ClientAuth:          clientAuth,
+		Server: api.ServerOptions{
+			ReadHeaderTimeout: sc.Server.ReadHeaderTimeout,
+			WriteTimeout:      sc.Server.WriteTimeout,
+			IdleTimeout:       sc.Server.IdleTimeout,
+			Throttle:          sc.Server.Throttle,
 		},
-		TLSEnabled:     sc.TLS.Enabled,
-		CertPath:       sc.TLS.CertPath,
-		PrivateKeyPath: sc.TLS.PrivateKeyPath,
+		RouteLimits: routes.groups,
+		ModelLimits: routes.models,
+	}
+	if acmeManager != nil && sc.TLS.ACME.Challenge == acme.ChallengeHTTP01 {
+		rest.ACMEListen = fmt.Sprintf(":%d", sc.TLS.ACME.HTTPPort)
 	}
 
 	return &application{
 		ServerCmd:  sc,
 		rest:       rest,
+		proxy:      proxy,
+		audit:      auditLog,
 		terminated: make(chan struct{}),
+	}, nil
+}
+
+// makeAuth makes auth of clients calling /api/ and /v1/, nil if no clients are configured
+func (sc ServerCmd) makeAuth() (*api.Auth, error) {
+	if len(sc.Clients) == 0 {
+		log.Printf("[WARN] no clients are configured, /api/ is open for everyone")
+		return nil, nil
+	}
+	clients := make([]api.Client, 0, len(sc.Clients))
+	for _, c := range sc.Clients {
+		clients = append(clients, api.Client{Name: c.Name, KeyHash: c.KeyHash, CertIdentities: c.CertIdentities,
+			Origins: c.Origins})
+	}
+	res, err := api.NewAuth(clients)
+	if err != nil {
+		return nil, fmt.Errorf("can not configure clients: %w", err)
+	}
+	log.Printf("[INFO] %d clients are allowed to call /api/", len(clients))
+	return res, nil
+}
+
+// makeCORS makes CORS policies of route groups, nil if no policies are configured.
+// Groups without allowed origins get origins of all clients
+func (sc ServerCmd) makeCORS() (*api.CORS, error) {
+	if len(sc.CORS) == 0 {
+		return nil, nil
+	}
+	var clientOrigins []string
+	for _, c := range sc.Clients {
+		clientOrigins = append(clientOrigins, c.Origins...)
+	}
+	policies := map[string]api.CORSPolicy{}
+	for i, p := range sc.CORS {
+		if len(p.Groups) == 0 {
+			return nil, fmt.Errorf("CORS policy %d has no groups", i)
+		}
+		for _, group := range p.Groups {
+			if _, ok := policies[group]; ok {
+				return nil, fmt.Errorf("CORS group %s is in more than one policy", group)
+			}
+			policies[group] = api.CORSPolicy{
+				AllowedOrigins:   p.AllowedOrigins,
+				AllowedMethods:   p.AllowedMethods,
+				AllowedHeaders:   p.AllowedHeaders,
+				ExposedHeaders:   p.ExposedHeaders,
+				AllowCredentials: p.AllowCredentials,
+				MaxAge:           p.MaxAge,
+			}
+		}
+	}
+	res, err := api.NewCORS(policies, clientOrigins)
+	if err != nil {
+		return nil, fmt.Errorf("can not configure CORS: %w", err)
+	}
+	log.Printf("[INFO] cross-origin requests are allowed to %d route groups", len(policies))
+	return res, nil
+}
+
+// routeLimits are limits of route groups and models with timeouts of Gemini calls to models
+type routeLimits struct {
+	groups   map[string]api.RouteLimits
+	models   []api.ModelLimits
+	timeouts []service.ModelTimeout
+}
+
+// makeRouteLimits makes limits of route groups from server options. Routes without models override limits of
+// their groups, routes with models override limits of requests to the models
+func (sc ServerCmd) makeRouteLimits() (routeLimits, error) {
+	res := routeLimits{groups: map[string]api.RouteLimits{}}
+	for group, limits := range api.DefaultRouteLimits {
+		res.groups[group] = limits
+	}
+	for _, group := range []string{api.GroupAPI, api.GroupV1} {
+		res.groups[group] = api.RouteLimits{Timeout: sc.Server.Timeout, StreamTimeout: sc.Server.StreamTimeout,
+			RateLimit: sc.Server.RateLimit, Burst: sc.Server.Burst}
+	}
+	for i, r := range sc.Server.Routes {
+		if len(r.Models) == 0 {
+			if len(r.Groups) == 0 {
+				return routeLimits{}, fmt.Errorf("server route %d has no groups and models", i)
+			}
+			if r.UpstreamTimeout != nil {
+				return routeLimits{}, fmt.Errorf("server route %d sets upstream-timeout without models", i)
+			}
+			for _, group := range r.Groups {
+				limits := res.groups[group]
+				override(&limits.Timeout, r.Timeout)
+				override(&limits.StreamTimeout, r.StreamTimeout)
+				override(&limits.RateLimit, r.RateLimit)
+				override(&limits.Burst, r.Burst)
+				res.groups[group] = limits
+			}
+			continue
+		}
+		if r.UpstreamTimeout != nil {
+			res.timeouts = append(res.timeouts, service.ModelTimeout{Models: r.Models, Timeout: *r.UpstreamTimeout})
+		}
+		if r.Timeout != nil || r.StreamTimeout != nil || r.RateLimit != nil || r.Burst != nil {
+			res.models = append(res.models, api.ModelLimits{Groups: r.Groups, Models: r.Models, Timeout: r.Timeout,
+				StreamTimeout: r.StreamTimeout, RateLimit: r.RateLimit, Burst: r.Burst})
+		}
+	}
+	if err := api.ValidateLimits(res.groups, res.models); err != nil {
+		return routeLimits{}, fmt.Errorf("can not configure server routes: %w", err)
+	}
+	return res, nil
+}
+
+// override sets dst to value if it's set
+func override[T any](dst *T, value *T) {
+	if value != nil {
+		*dst = *value
+	}
+}
+
+// makeKeys makes pool of Gemini API keys, nil if the single key is configured
+func (sc ServerCmd) makeKeys() (*service.KeyPool, error) {
+	if len(sc.GeminiAPIKeys) == 0 {
+		return nil, nil
+	}
+	keys := []string{sc.GeminiAPIKey.Reveal()}
+	for _, k := range sc.GeminiAPIKeys {
+		keys = append(keys, k.Reveal())
+	}
+	res, err := service.NewKeyPool(keys,
+		service.KeyStrategy(sc.KeyPool.Strategy), sc.KeyPool.Cooldown)
+	if err != nil {
+		return nil, fmt.Errorf("can not make Gemini API key pool: %w", err)
+	}
+	log.Printf("[INFO] %d Gemini API keys are used with %s strategy", res.Size(), res.Strategy)
+	return res, nil
+}
+
+// makeLimits makes limits of proxied requests
+func (sc ServerCmd) makeLimits() gemini.Limits {
+	return gemini.Limits{MaxBodySize: sc.Limits.MaxBodySize, MaxParts: sc.Limits.MaxParts,
+		MaxInlineData: sc.Limits.MaxInlineData}
+}
+
+// makeQuota makes quota manager for clients with budgets, nil if no client has quota
+func (sc ServerCmd) makeQuota() (*quota.Manager, error) {
+	limits, err := sc.makeQuotaLimits()
+	if err != nil || len(limits) == 0 {
+		return nil, err
+	}
+
+	var store quota.Store = quota.NewMemStore()
+	if sc.Quota.Store == "file" {
+		fileStore, err := quota.NewFileStore(sc.Quota.File)
+		if err != nil {
+			return nil, fmt.Errorf("can not make quota store: %w", err)
+		}
+		store = fileStore
+	}
+	log.Printf("[INFO] quota is set for %d clients, usage is kept in %s store", len(limits), sc.Quota.Store)
+	return &quota.Manager{Store: store, Limits: limits}, nil
+}
+
+// makeQuotaLimits makes quota limits of clients with budgets
+func (sc ServerCmd) makeQuotaLimits() (map[string]quota.Limits, error) {
+	limits := map[string]quota.Limits{}
+	for _, c := range sc.Clients {
+		if c.Quota == nil {
+			continue
+		}
+		period := quota.Period(c.Quota.Period)
+		if period == "" {
+			period = quota.Day
+		}
+		if period != quota.Day && period != quota.Month {
+			return nil, fmt.Errorf("quota period of client %s should be day or month, got %q", c.Name, c.Quota.Period)
+		}
+		limits[c.Name] = quota.Limits{
+			Period:          period,
+			Requests:        c.Quota.Requests,
+			PromptTokens:    c.Quota.PromptTokens,
+			CandidateTokens: c.Quota.CandidateTokens,
+		}
+	}
+	return limits, nil
+}
+
+// makeCatalog makes catalog of model aliases, nil if there are no aliases and models aren't refreshed from Gemini
+func (sc ServerCmd) makeCatalog() (*service.ModelCatalog, error) {
+	if len(sc.Models.Aliases) == 0 && sc.Models.Refresh <= 0 {
+		return nil, nil
+	}
+	aliases := make([]service.ModelAlias, 0, len(sc.Models.Aliases))
+	for _, a := range sc.Models.Aliases {
+		alias := service.ModelAlias{Name: a.Name, Model: a.Model, Description: a.Description}
+		if len(a.Defaults) > 0 {
+			defaults, err := json.Marshal(a.Defaults)
+			if err != nil {
+				return nil, fmt.Errorf("can not encode defaults of model alias %s: %w", a.Name, err)
+			}
+			alias.Defaults = defaults
+		}
+		aliases = append(aliases, alias)
+	}
+	res, err := service.NewModelCatalog(aliases)
+	if err != nil {
+		return nil, fmt.Errorf("can not configure models: %w", err)
+	}
+	log.Printf("[INFO] %d model aliases are configured", len(aliases))
+	return res, nil
+}
+
+// makePolicies makes prompt policies, nil if there are no policies
+func (sc ServerCmd) makePolicies() (*service.PolicySet, error) {
+	if len(sc.Policies) == 0 {
+		return nil, nil
+	}
+	policies := make([]service.PromptPolicy, 0, len(sc.Policies))
+	for _, p := range sc.Policies {
+		policy := service.PromptPolicy{
+			Name:              p.Name,
+			Clients:           p.Clients,
+			Models:            p.Models,
+			SystemInstruction: p.SystemInstruction.Text,
+			MaxTemperature:    p.GenerationConfig.MaxTemperature,
+			MaxTopP:           p.GenerationConfig.MaxTopP,
+			MaxOutputTokens:   p.GenerationConfig.MaxOutputTokens,
+			Strip:             p.Strip,
+		}
+		switch p.SystemInstruction.Mode {
+		case "", "prepend":
+		case "replace":
+			policy.ReplaceSystem = true
+		default:
+			return nil, fmt.Errorf("system instruction mode of prompt policy %s should be prepend or replace", p.Name)
+		}
+		if len(p.SafetySettings) > 0 {
+			policy.SafetySettings = make(map[string]string, len(p.SafetySettings))
+			for _, s := range p.SafetySettings {
+				policy.SafetySettings[s.Category] = s.Threshold
+			}
+		}
+		policies = append(policies, policy)
+	}
+	res, err := service.NewPolicySet(policies)
+	if err != nil {
+		return nil, fmt.Errorf("can not configure prompt policies: %w", err)
+	}
+	log.Printf("[INFO] %d prompt policies are configured", len(policies))
+	return res, nil
+}
+
+// makeFilters makes content filters of prompts and responses, nil if there are no filter rules
+func (sc ServerCmd) makeFilters() ([]service.ContentFilter, error) {
+	if len(sc.ContentFilter.Rules) == 0 {
+		return nil, nil
+	}
+	rules := make([]service.FilterRule, 0, len(sc.ContentFilter.Rules))
+	for _, r := range sc.ContentFilter.Rules {
+		pattern, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("can not compile pattern of filter rule %s: %w", r.Name, err)
+		}
+		rules = append(rules, service.FilterRule{Name: r.Name, Pattern: pattern, Action: r.Action, Mask: r.Mask,
+			Responses: r.Responses})
+	}
+	filter, err := service.NewRegexFilter(rules, sc.ContentFilter.Restore)
+	if err != nil {
+		return nil, fmt.Errorf("can not configure content filter: %w", err)
+	}
+	log.Printf("[INFO] content filter has %d rules, restore of tokenized values %v", len(rules), sc.ContentFilter.Restore)
+	return []service.ContentFilter{filter}, nil
+}
+
+// makeAudit makes audit log of Gemini exchanges written to rotating file, nil if it's disabled
+func (sc ServerCmd) makeAudit() (*audit.Logger, error) {
+	if !sc.Audit.Enabled {
+		return nil, nil
+	}
+	opts, err := sc.auditOptions()
+	if err != nil {
+		return nil, err
+	}
+	file, err := audit.NewRotatingFile(sc.Audit.File, sc.Audit.MaxSize, sc.Audit.MaxAge, sc.Audit.MaxBackups)
+	if err != nil {
+		return nil, fmt.Errorf("can not open audit log: %w", err)
+	}
+	log.Printf("[INFO] audit log is written to %s, content: %s, opted out clients: %v", sc.Audit.File,
+		sc.Audit.Content, sc.Audit.OptOut)
+	return audit.New(file, opts), nil
+}
+
+// auditOptions makes options of audit log
+func (sc ServerCmd) auditOptions() (audit.Options, error) {
+	switch sc.Audit.Content {
+	case "", audit.ContentNone, audit.ContentTruncated, audit.ContentFull:
+	default:
+		return audit.Options{}, fmt.Errorf("audit content should be none, truncated or full, got %q", sc.Audit.Content)
+	}
+	return audit.Options{Content: sc.Audit.Content, MaxText: sc.Audit.MaxText, OptOut: sc.Audit.OptOut,
+		Redact: sc.Audit.Redact, BufferSize: sc.Audit.Buffer}, nil
+}
+
+// tlsOptions makes minimal TLS version and cipher suites of https server
+func (sc ServerCmd) tlsOptions() (version uint16, ciphers []uint16, err error) {
+	if version, err = api.ParseTLSVersion(sc.TLS.MinVersion); err != nil {
+		return 0, nil, err
+	}
+	if ciphers, err = api.ParseCipherSuites(sc.TLS.Ciphers); err != nil {
+		return 0, nil, err
+	}
+	return version, ciphers, nil
+}
+
+// makeACME makes manager of certificate issued by ACME server, nil if TLS or ACME is disabled
+func (sc ServerCmd) makeACME() (*acme.Manager, error) {
+	if !sc.TLS.Enabled || !sc.TLS.ACME.Enabled {
+		return nil, nil
+	}
+	opts := acme.Options{
+		Directory:   sc.TLS.ACME.Directory,
+		Domains:     sc.TLS.ACME.Domains,
+		Email:       sc.TLS.ACME.Email,
+		Challenge:   sc.TLS.ACME.Challenge,
+		CacheDir:    sc.TLS.ACME.CacheDir,
+		RenewBefore: sc.TLS.ACME.RenewBefore,
+	}
+	if sc.TLS.ACME.CACert != "" {
+		data, err := os.ReadFile(sc.TLS.ACME.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("can not read CA of ACME server: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in CA of ACME server %s", sc.TLS.ACME.CACert)
+		}
+		opts.HTTPClient = &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+			},
+		}
+	}
+	res, err := acme.NewManager(opts)
+	if err != nil {
+		return nil, fmt.Errorf("can not configure ACME: %w", err)
+	}
+	log.Printf("[INFO] TLS certificate of %v is issued by %s with %s challenge", opts.Domains, opts.Directory,
+		opts.Challenge)
+	return res, nil
+}
+
+// makeClientAuth makes verification of TLS client certificates, nil if TLS or client auth is disabled
+func (sc ServerCmd) makeClientAuth() (*api.ClientAuth, error) {
+	if !sc.TLS.Enabled {
+		return nil, nil
+	}
+	mode, err := api.ParseClientAuth(sc.TLS.ClientAuth)
+	if err != nil || mode == tls.NoClientCert {
+		return nil, err
+	}
+	if sc.TLS.ClientCA == "" {
+		return nil, fmt.Errorf("client CA is required for TLS client auth %s", sc.TLS.ClientAuth)
+	}
+	res := &api.ClientAuth{Mode: mode}
+	if res.CAs, err = api.LoadCertificates(sc.TLS.ClientCA); err != nil {
+		return nil, fmt.Errorf("can not load client CA: %w", err)
+	}
+	if sc.TLS.CRL != "" {
+		if res.CRL, err = api.LoadRevocationList(sc.TLS.CRL, res.CAs); err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("[INFO] client certificates are verified with %s, client auth %s", sc.TLS.ClientCA, sc.TLS.ClientAuth)
+	return res, nil
+}
+
+// makeScheduler makes scheduler of Gemini calls. It's made without limits too, so limits could be set on reload
+func (sc ServerCmd) makeScheduler() *service.Scheduler {
+	res := &service.Scheduler{
+		RPM:          sc.Scheduler.RPM,
+		TPM:          sc.Scheduler.TPM,
+		MaxInFlight:  sc.Scheduler.MaxInFlight,
+		MaxQueue:     sc.Scheduler.MaxQueue,
+		QueueTimeout: sc.Scheduler.QueueTimeout,
+	}
+	if sc.DelayRequests > 0 && res.MaxInFlight == 0 {
+		log.Printf("[WARN] delay-requests is deprecated, requests are serialized with scheduler.max-in-flight=1")
+		res.MaxInFlight = 1
+	}
+	if res.RPM == 0 && res.TPM == 0 && res.MaxInFlight == 0 {
+		return res
+	}
+	log.Printf("[INFO] Gemini calls are limited to rpm: %d, tpm: %d, in flight: %d, queue: %d, queue timeout: %v",
+		res.RPM, res.TPM, res.MaxInFlight, res.MaxQueue, res.QueueTimeout)
+	return res
+}
+
+// makeCache makes response cache, nil if it's disabled
+func (sc ServerCmd) makeCache() *service.ResponseCache {
+	if !sc.Cache.Enabled {
+		return nil
+	}
+	ttl := sc.Cache.TTL
+	if ttl <= 0 {
+		ttl = 10 * time.Minute
+	}
+	log.Printf("[INFO] responses are cached for %v, max entries: %d, max bytes: %d", ttl, sc.Cache.MaxEntries,
+		sc.Cache.MaxBytes)
+	return service.NewResponseCache(ttl, sc.Cache.MaxEntries, sc.Cache.MaxBytes, sc.Cache.AnyTemperature)
+}
+
+// makeMetrics makes proxy metrics with state of scheduler, cache, current key pool and audit log taken on scrape,
+// nil if metrics are disabled
+func (sc ServerCmd) makeMetrics(scheduler *service.Scheduler, cache *service.ResponseCache,
+	settings func() service.Settings, auditLog *audit.Logger) *metrics.Metrics {
+	if !sc.Metrics.Enabled {
+		return nil
+	}
+	res := metrics.New()
+	if scheduler != nil {
+		res.NewGaugeFunc("gemini_proxy_scheduler_in_flight", "Gemini calls in flight.",
+			func() float64 { return float64(scheduler.Stats().InFlight) })
+		res.NewGaugeFunc("gemini_proxy_scheduler_queued", "Requests waiting for their turn to call Gemini.",
+			func() float64 { return float64(scheduler.Stats().Queued) })
+	}
+	if cache != nil {
+		res.NewCounterFunc("gemini_proxy_cache_hits_total", "Responses taken from cache.",
+			func() float64 { return float64(cache.Stats().Hits) })
+		res.NewCounterFunc("gemini_proxy_cache_misses_total", "Cacheable requests not found in cache.",
+			func() float64 { return float64(cache.Stats().Misses) })
+		res.NewGaugeFunc("gemini_proxy_cache_entries", "Cached responses.",
+			func() float64 { return float64(cache.Stats().Entries) })
+		res.NewGaugeFunc("gemini_proxy_cache_bytes", "Total size of cached responses.",
+			func() float64 { return float64(cache.Stats().Bytes) })
+	}
+	res.NewGaugeFunc("gemini_proxy_keys_available", "Gemini API keys not in cooldown.", func() float64 {
+		current := settings()
+		if current.Keys == nil {
+			// single key is never put in cooldown
+			if current.APIKey != "" {
+				return 1
+			}
+			return 0
+		}
+		available := 0
+		for _, k := range current.Keys.Health() {
+			if k.Available {
+				available++
+			}
+		}
+		return float64(available)
+	})
+	if auditLog != nil {
+		res.NewCounterFunc("gemini_proxy_audit_dropped_total", "Audit records dropped because of full buffer.",
+			func() float64 { return float64(auditLog.Dropped()) })
+	}
+	where := "main port"
+	if sc.Metrics.Listen != "" {
+		where = sc.Metrics.Listen
 	}
+	log.Printf("[INFO] metrics are exposed on /metrics of %s", where)
+	return res
 }
 
 // Wait for application completion (termination)
@@ -2,15 +2,22 @@ package cmd
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/jessevdk/go-flags"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/theshamuel/gemini-proxy/app/config"
+	"github.com/theshamuel/gemini-proxy/app/quota"
+	"github.com/theshamuel/gemini-proxy/app/rest/api"
+	"github.com/theshamuel/gemini-proxy/app/service"
 	"go.uber.org/goleak"
 	"io"
 	"math/rand"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -36,7 +43,8 @@ func TestServerApp(t *testing.T) {
 }
 
 func createAppFromCmd(t *testing.T, cmd ServerCmd) (*application, context.Context, context.CancelFunc) {
-	app := cmd.bootstrapApp()
+	app, err := cmd.bootstrapApp()
+	require.NoError(t, err)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	rand.New(rand.NewSource(time.Now().UnixNano()))
@@ -67,3 +75,261 @@ func TestMain(m *testing.M) {
 	//Unknown reasons
 	goleak.VerifyTestMain(m, goleak.IgnoreTopFunction("net/http.(*Server).Shutdown"))
 }
+
+func TestServerApp_Audit(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit", "audit.jsonl")
+	app, ctx, cancel := buildListCmdOpts(t, func(s ServerCmd) ServerCmd {
+		s.Port = 4357
+		s.Audit.Enabled = true
+		s.Audit.File = file
+		return s
+	})
+	require.NotNil(t, app.audit)
+	assert.Same(t, app.audit, app.proxy.Audit)
+	assert.FileExists(t, file)
+
+	go func() { _ = app.run(ctx) }()
+	waitHTTPServer(app.Port)
+	cancel()
+	app.Wait()
+
+	cmd := ServerCmd{}
+	cmd.Audit.Enabled = true
+	cmd.Audit.Content = "everything"
+	_, err := cmd.bootstrapApp()
+	assert.EqualError(t, err, `audit content should be none, truncated or full, got "everything"`)
+}
+
+func TestServerApp_Reload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "gemini-proxy.yml")
+	mtime := time.Now()
+	writeConfig := func(s string) {
+		require.NoError(t, os.WriteFile(file, []byte(s), 0o600))
+		// modification time is moved forward, so quick rewrite is noticed by watcher
+		mtime = mtime.Add(time.Second)
+		require.NoError(t, os.Chtimes(file, mtime, mtime))
+	}
+	writeConfig("gemini-api-key: k1\nallowed-models: [gemini-2.5-pro]\n")
+	cnf := &config.Config{FileName: file}
+	co, err := cnf.GetCommon()
+	require.NoError(t, err)
+
+	app, ctx, cancel := buildListCmdOpts(t, func(s ServerCmd) ServerCmd {
+		s.Port = 4358
+		s.CommonOpts = *co
+		s.Config = cnf
+		s.ConfigWatch = 10 * time.Millisecond
+		return s
+	})
+
+	writeConfig("gemini-api-key: k2\npolicies:\n  - name: p\n    system-instruction: {mode: append, text: x}\n" +
+		"clients:\n  - name: web\n    key-hash: wrong\n")
+	err = app.reload()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can not configure clients")
+	assert.Contains(t, err.Error(), "system instruction mode of prompt policy p should be prepend or replace")
+	assert.Equal(t, "k1", app.proxy.Settings().APIKey, "old config is kept")
+
+	writeConfig("gemini-api-key: k2\nallowed-models: [gemini-2.5-flash]\n")
+	require.NoError(t, app.reload())
+	assert.Equal(t, "k2", app.proxy.Settings().APIKey)
+	assert.Equal(t, []string{"gemini-2.5-flash"}, app.proxy.Settings().AllowedModels)
+
+	go func() { _ = app.run(ctx) }()
+	waitHTTPServer(app.Port)
+	writeConfig("gemini-api-key: k3\n")
+	assert.Eventually(t, func() bool { return app.proxy.Settings().APIKey == "k3" }, 5*time.Second,
+		10*time.Millisecond, "changed file is reloaded")
+	assert.Empty(t, app.proxy.Settings().AllowedModels)
+
+	cancel()
+	app.Wait()
+}
+
+func TestServerApp_ReloadSecret(t *testing.T) {
+	dir := t.TempDir()
+	secret, file := filepath.Join(dir, "gemini"), filepath.Join(dir, "gemini-proxy.yml")
+	require.NoError(t, os.WriteFile(secret, []byte("k1\n"), 0o600))
+	require.NoError(t, os.WriteFile(file, []byte("gemini-api-key: file:"+secret+"\n"), 0o600))
+	cnf := &config.Config{FileName: file}
+	co, err := cnf.GetCommon()
+	require.NoError(t, err)
+
+	sc := ServerCmd{CommonOpts: *co, Config: cnf}
+	app, err := sc.bootstrapApp()
+	require.NoError(t, err)
+	assert.Equal(t, "k1", app.proxy.Settings().APIKey)
+	assert.Equal(t, config.Secret("k1"), app.GeminiAPIKey)
+
+	require.NoError(t, os.WriteFile(secret, []byte("k2\n"), 0o600))
+	require.NoError(t, app.reload())
+	assert.Equal(t, "k2", app.proxy.Settings().APIKey, "rotated secret is read on reload")
+
+	require.NoError(t, os.Remove(secret))
+	err = app.reload()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "gemini-api-key: can't resolve secret file:"+secret)
+	assert.Equal(t, "k2", app.proxy.Settings().APIKey, "old key is kept")
+
+	sc.GeminiAPIKey = "env:TEST_GEMINI_NOT_SET"
+	_, err = sc.bootstrapApp()
+	assert.EqualError(t, err, "gemini-api-key: can't resolve secret env:TEST_GEMINI_NOT_SET: env TEST_GEMINI_NOT_SET is not set")
+}
+
+func TestServerApp_ReloadLimits(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "gemini-proxy.yml")
+	clients := "clients:\n  - name: web\n    key-hash: " + api.HashKey("secret") + "\n"
+	require.NoError(t, os.WriteFile(file, []byte("gemini-api-keys: [k1, k2]\n"+clients+
+		"    quota: {period: day, requests: 10}\n"), 0o600))
+	cnf := &config.Config{FileName: file}
+	co, err := cnf.GetCommon()
+	require.NoError(t, err)
+	sc := ServerCmd{CommonOpts: *co, Config: cnf}
+	app, err := sc.bootstrapApp()
+	require.NoError(t, err)
+	require.NotNil(t, app.rest.Quota)
+	app.proxy.Settings().Keys.Report("k1", &service.UpstreamError{StatusCode: http.StatusTooManyRequests})
+
+	require.NoError(t, os.WriteFile(file, []byte("gemini-api-keys: [k1, k3]\nscheduler: {rpm: 60, max-in-flight: 2}\n"+
+		clients+"    quota: {period: day, requests: 20}\n"), 0o600))
+	require.NoError(t, app.reload())
+	assert.Equal(t, quota.Limits{Period: quota.Day, Requests: 20}, app.rest.Quota.Limits["web"])
+	assert.Equal(t, 60, app.proxy.Scheduler.RPM)
+	assert.Equal(t, 2, app.proxy.Scheduler.MaxInFlight)
+	health := app.proxy.Settings().Keys.Health()
+	require.Len(t, health, 2)
+	assert.False(t, health[0].CooldownUntil.IsZero(), "cooldown of k1 is kept")
+	assert.True(t, health[1].CooldownUntil.IsZero())
+}
+
+func TestServerApp_TLSOptions(t *testing.T) {
+	cmd := ServerCmd{}
+	cmd.TLS.Ciphers = []string{"TLS_RSA_WITH_RC4_128_SHA"}
+	_, err := cmd.bootstrapApp()
+	assert.EqualError(t, err, "cipher suite TLS_RSA_WITH_RC4_128_SHA is insecure")
+
+	cmd = ServerCmd{}
+	cmd.TLS.Enabled, cmd.TLS.MinVersion = true, "1.3"
+	cmd.TLS.ACME = config.ACME{Enabled: true, Domains: []string{"example.com"}, Challenge: "http-01", HTTPPort: 8080,
+		CacheDir: t.TempDir()}
+	app, err := cmd.bootstrapApp()
+	require.NoError(t, err)
+	assert.NotNil(t, app.rest.ACME)
+	assert.Equal(t, ":8080", app.rest.ACMEListen)
+	assert.Equal(t, uint16(tls.VersionTLS13), app.rest.TLSMinVersion)
+
+	cmd.TLS.ACME.CACert = "no-such-ca.pem"
+	_, err = cmd.bootstrapApp()
+	assert.EqualError(t, err, "can not read CA of ACME server: open no-such-ca.pem: no such file or directory")
+	cmd.TLS.ACME.CACert, cmd.TLS.ACME.Domains = "", nil
+	_, err = cmd.bootstrapApp()
+	assert.EqualError(t, err, "can not configure ACME: ACME domains are not set")
+}
+
+func TestServerApp_CORS(t *testing.T) {
+	cmd := ServerCmd{}
+	res, err := cmd.makeCORS()
+	require.NoError(t, err)
+	assert.Nil(t, res, "cross-origin requests are not allowed by default")
+
+	cmd.Clients = []config.Client{{Name: "web", KeyHash: "h1", Origins: []string{"https://app.example.com"}}}
+	cmd.CORS = []config.CORSPolicy{{Groups: []string{"api", "v1"}},
+		{Groups: []string{"root"}, AllowedOrigins: []string{"*"}}}
+	res, err = cmd.makeCORS()
+	require.NoError(t, err)
+	assert.NotNil(t, res)
+
+	cmd.CORS = append(cmd.CORS, config.CORSPolicy{Groups: []string{"v1"}, AllowedOrigins: []string{"*"}})
+	_, err = cmd.makeCORS()
+	assert.EqualError(t, err, "CORS group v1 is in more than one policy")
+
+	cmd.CORS = []config.CORSPolicy{{AllowedOrigins: []string{"*"}}}
+	_, err = cmd.makeCORS()
+	assert.EqualError(t, err, "CORS policy 0 has no groups")
+
+	cmd.CORS = []config.CORSPolicy{{Groups: []string{"api"}}}
+	cmd.Clients = nil
+	_, err = cmd.bootstrapApp()
+	assert.EqualError(t, err, "can not configure CORS: CORS policy of api group has no allowed origins and clients "+
+		"have no origins")
+}
+
+func TestServerApp_RouteLimits(t *testing.T) {
+	cmd := ServerCmd{}
+	cmd.Server.Timeout, cmd.Server.RateLimit, cmd.Server.UpstreamTimeout = time.Minute, 10, 20*time.Second
+	rate, timeout, upstream := 1.0, 5*time.Minute, 290*time.Second
+	cmd.Server.Routes = []config.RouteLimits{
+		{Groups: []string{"root", "admin"}, RateLimit: &rate},
+		{Models: []string{"gemini-2.5-pro*"}, Timeout: &timeout, UpstreamTimeout: &upstream},
+		{Models: []string{"gemini-2.5-flash*"}, UpstreamTimeout: &upstream},
+	}
+	app, err := cmd.bootstrapApp()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]api.RouteLimits{"root": {RateLimit: 1}, "admin": {RateLimit: 1},
+		"api": {Timeout: time.Minute, RateLimit: 10}, "v1": {Timeout: time.Minute, RateLimit: 10}}, app.rest.RouteLimits)
+	assert.Equal(t, []api.ModelLimits{{Models: []string{"gemini-2.5-pro*"}, Timeout: &timeout}}, app.rest.ModelLimits,
+		"route with upstream timeout only doesn't change limits")
+	assert.Equal(t, []service.ModelTimeout{{Models: []string{"gemini-2.5-pro*"}, Timeout: upstream},
+		{Models: []string{"gemini-2.5-flash*"}, Timeout: upstream}}, app.proxy.ModelTimeouts)
+	assert.Equal(t, 20*time.Second, app.proxy.Client.Timeout)
+
+	cmd.Server.Routes = []config.RouteLimits{{RateLimit: &rate}}
+	_, err = cmd.makeRouteLimits()
+	assert.EqualError(t, err, "server route 0 has no groups and models")
+
+	cmd.Server.Routes = []config.RouteLimits{{Groups: []string{"api"}, UpstreamTimeout: &upstream}}
+	_, err = cmd.makeRouteLimits()
+	assert.EqualError(t, err, "server route 0 sets upstream-timeout without models")
+
+	cmd.Server.Routes = []config.RouteLimits{{Groups: []string{"web"}, RateLimit: &rate}}
+	_, err = cmd.makeRouteLimits()
+	assert.EqualError(t, err, `can not configure server routes: route group should be one of root, api, v1, admin, `+
+		`got "web"`)
+}
+
+func TestServerApp_ClientAuth(t *testing.T) {
+	cmd := ServerCmd{}
+	cmd.TLS.ClientAuth = "require"
+	res, err := cmd.makeClientAuth()
+	require.NoError(t, err)
+	assert.Nil(t, res, "client auth is disabled without TLS")
+
+	cmd.TLS.Enabled = true
+	_, err = cmd.makeClientAuth()
+	assert.EqualError(t, err, "client CA is required for TLS client auth require")
+
+	cmd.TLS.ClientCA = "no-such-ca.pem"
+	_, err = cmd.makeClientAuth()
+	assert.EqualError(t, err, "can not load client CA: can not read certificates: open no-such-ca.pem: "+
+		"no such file or directory")
+
+	cmd.TLS.ClientAuth = "none"
+	res, err = cmd.makeClientAuth()
+	require.NoError(t, err)
+	assert.Nil(t, res)
+
+	cmd.TLS.ClientAuth = "sometimes"
+	_, err = cmd.makeClientAuth()
+	assert.EqualError(t, err, `TLS client auth should be none, optional or require, got "sometimes"`)
+}
+
+func TestRestartRequired(t *testing.T) {
+	running := config.CommonOpts{Clients: []config.Client{{Name: "web", KeyHash: "h1"}}}
+	next := running
+	next.Clients = []config.Client{{Name: "web", KeyHash: "h2"}}
+	next.GeminiAPIKey = "k2"
+	assert.Empty(t, restartRequired(running, next), "keys of clients are reloaded")
+
+	next.Clients = []config.Client{{Name: "web", KeyHash: "h2", Quota: &config.ClientQuota{Period: "day", Requests: 10}}}
+	next.Scheduler.RPM = 60
+	next.Server.Timeout = time.Minute
+	assert.Empty(t, restartRequired(running, next), "quota, scheduler and route limits are reloaded")
+
+	next.Server.Throttle = 100
+	next.Cache.Enabled = true
+	next.TLS.Enabled = true
+	next.TLS.ClientAuth = "require"
+	next.TLS.ACME.Domains = []string{"example.com"}
+	assert.Equal(t, []string{"server.throttle", "cache", "tls.enabled", "tls.client-auth", "tls.acme"},
+		restartRequired(running, next))
+}
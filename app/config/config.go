@@ -1,67 +1,502 @@
 package config
 
 import (
-	"fmt"
-	"gopkg.in/yaml.v3"
-	"os"
 	"sync"
+	"time"
 )
 
+// Config is config file merged with options from defaults, env and flags
 type Config struct {
 	FileName string
+	Base     CommonOpts        // options with defaults, env and flags applied
+	Explicit map[string]Source // options set by env or flags, e.g. cache.ttl
 	sync.Mutex
-	File *File
+	File     *File
+	Warnings []string // problems of the file which don't prevent its use, e.g. unknown keys
+	sources  map[string]Source
 }
 
+// DefaultGeminiBaseURL is Gemini API base URL used when it's not set in config
+const DefaultGeminiBaseURL = "https://generativelanguage.googleapis.com/v1beta/"
+
+// DefaultAllowedMethods is list of Gemini model methods proxied when it's not set in config
+var DefaultAllowedMethods = []string{"generateContent", "streamGenerateContent", "countTokens", "embedContent",
+	"batchEmbedContents"}
+
+// DefaultMaxBodySize is request body limit used when it's not set in config, it's Gemini limit of inline request
+const DefaultMaxBodySize = 20 << 20
+
 type File struct {
-	GeminiAPIKey  string `yaml:"gemini-api-key"`
-	DelayRequests int    `yaml:"delay-requests"`
-	TLS           struct {
-		Enabled        bool   `yaml:"enabled,omitempty"`
-		CertPath       string `yaml:"cert-path,omitempty"`
-		PrivateKeyPath string `yaml:"private-key-path,omitempty"`
+	GeminiAPIKey  Secret   `yaml:"gemini-api-key"`
+	GeminiAPIKeys []Secret `yaml:"gemini-api-keys,omitempty"`
+	KeyPool       struct {
+		Strategy string        `yaml:"strategy,omitempty"`
+		Cooldown time.Duration `yaml:"cooldown,omitempty"`
+	} `yaml:"key-pool,omitempty"`
+	GeminiBaseURL  string       `yaml:"gemini-base-url,omitempty"`
+	AllowedModels  []string     `yaml:"allowed-models,omitempty"`
+	AllowedMethods []string     `yaml:"allowed-methods,omitempty"`
+	DelayRequests  int          `yaml:"delay-requests"`
+	RelayErrors    bool         `yaml:"relay-upstream-errors,omitempty"`
+	Clients        []Client     `yaml:"clients,omitempty"`
+	Policies       []Policy     `yaml:"policies,omitempty"`
+	CORS           []CORSPolicy `yaml:"cors,omitempty"`
+	AdminKeyHash   string       `yaml:"admin-key-hash,omitempty"`
+	Quota          struct {
+		Store         string        `yaml:"store,omitempty"`
+		File          string        `yaml:"file,omitempty"`
+		FlushInterval time.Duration `yaml:"flush-interval,omitempty"`
+	} `yaml:"quota,omitempty"`
+	Scheduler struct {
+		RPM          int           `yaml:"rpm,omitempty"`
+		TPM          int64         `yaml:"tpm,omitempty"`
+		MaxInFlight  int           `yaml:"max-in-flight,omitempty"`
+		MaxQueue     int           `yaml:"max-queue,omitempty"`
+		QueueTimeout time.Duration `yaml:"queue-timeout,omitempty"`
+	} `yaml:"scheduler,omitempty"`
+	Cache struct {
+		Enabled        bool          `yaml:"enabled,omitempty"`
+		TTL            time.Duration `yaml:"ttl,omitempty"`
+		MaxEntries     int           `yaml:"max-entries,omitempty"`
+		MaxBytes       int64         `yaml:"max-bytes,omitempty"`
+		AnyTemperature bool          `yaml:"any-temperature,omitempty"`
+	} `yaml:"cache,omitempty"`
+	Models struct {
+		Refresh time.Duration `yaml:"refresh,omitempty"`
+		Aliases []ModelAlias  `yaml:"aliases,omitempty"`
+	} `yaml:"models,omitempty"`
+	ContentFilter struct {
+		Restore bool         `yaml:"restore,omitempty"`
+		Rules   []FilterRule `yaml:"rules,omitempty"`
+	} `yaml:"content-filter,omitempty"`
+	Limits struct {
+		MaxBodySize   int64 `yaml:"max-body-size,omitempty"`
+		MaxParts      int   `yaml:"max-parts,omitempty"`
+		MaxInlineData int64 `yaml:"max-inline-data,omitempty"`
+	} `yaml:"limits,omitempty"`
+	Audit struct {
+		Enabled    bool          `yaml:"enabled,omitempty"`
+		File       string        `yaml:"file,omitempty"`
+		MaxSize    int64         `yaml:"max-size,omitempty"`
+		MaxAge     time.Duration `yaml:"max-age,omitempty"`
+		MaxBackups int           `yaml:"max-backups,omitempty"`
+		Content    string        `yaml:"content,omitempty"`
+		MaxText    int           `yaml:"max-text,omitempty"`
+		Buffer     int           `yaml:"buffer,omitempty"`
+		OptOut     []string      `yaml:"opt-out,omitempty"`
+		Redact     []string      `yaml:"redact,omitempty"`
+	} `yaml:"audit,omitempty"`
+	Metrics struct {
+		Enabled bool   `yaml:"enabled,omitempty"`
+		Listen  string `yaml:"listen,omitempty"`
+	} `yaml:"metrics,omitempty"`
+	Server struct {
+		ReadHeaderTimeout time.Duration `yaml:"read-header-timeout,omitempty"`
+		WriteTimeout      time.Duration `yaml:"write-timeout,omitempty"`
+		IdleTimeout       time.Duration `yaml:"idle-timeout,omitempty"`
+		Throttle          int           `yaml:"throttle,omitempty"`
+		UpstreamTimeout   time.Duration `yaml:"upstream-timeout,omitempty"`
+		Timeout           time.Duration `yaml:"timeout,omitempty"`
+		StreamTimeout     time.Duration `yaml:"stream-timeout,omitempty"`
+		RateLimit         float64       `yaml:"rate-limit,omitempty"`
+		Burst             int           `yaml:"burst,omitempty"`
+		Routes            []RouteLimits `yaml:"routes,omitempty"`
+	} `yaml:"server,omitempty"`
+	Retry struct {
+		MaxAttempts int           `yaml:"max-attempts,omitempty"`
+		BaseBackoff time.Duration `yaml:"base-backoff,omitempty"`
+		MaxBackoff  time.Duration `yaml:"max-backoff,omitempty"`
+		Jitter      float64       `yaml:"jitter,omitempty"`
+		Statuses    []int         `yaml:"statuses,omitempty"`
+	} `yaml:"retry,omitempty"`
+	TLS struct {
+		Enabled        bool          `yaml:"enabled,omitempty"`
+		CertPath       string        `yaml:"cert-path,omitempty"`
+		PrivateKeyPath string        `yaml:"private-key-path,omitempty"`
+		Watch          time.Duration `yaml:"watch,omitempty"`
+		MinVersion     string        `yaml:"min-version,omitempty"`
+		Ciphers        []string      `yaml:"ciphers,omitempty"`
+		ClientCA       string        `yaml:"client-ca,omitempty"`
+		ClientAuth     string        `yaml:"client-auth,omitempty"`
+		CRL            string        `yaml:"crl,omitempty"`
+		ACME           struct {
+			Enabled     bool          `yaml:"enabled,omitempty"`
+			Directory   string        `yaml:"directory,omitempty"`
+			Domains     []string      `yaml:"domains,omitempty"`
+			Email       string        `yaml:"email,omitempty"`
+			Challenge   string        `yaml:"challenge,omitempty"`
+			HTTPPort    int           `yaml:"http-port,omitempty"`
+			CacheDir    string        `yaml:"cache-dir,omitempty"`
+			RenewBefore time.Duration `yaml:"renew-before,omitempty"`
+			CACert      string        `yaml:"ca-cert,omitempty"`
+		} `yaml:"acme,omitempty"`
 	} `yaml:"tls,omitempty"`
 	Debug bool `yaml:"debug,omitempty"`
 }
 
+// Client is API consumer allowed to call proxy, key is stored as hash in format sha256:{hex}.
+// Client can be identified by TLS client certificate instead of key, e.g. by cn:{common name} or dns:{SAN}
+type Client struct {
+	Name           string       `yaml:"name"`
+	KeyHash        string       `yaml:"key-hash,omitempty"`
+	CertIdentities []string     `yaml:"cert-identities,omitempty"`
+	Origins        []string     `yaml:"origins,omitempty"` // browser origins the key works from, any if empty
+	Quota          *ClientQuota `yaml:"quota,omitempty"`
+}
+
+// ModelAlias is friendly name of Gemini model, defaults are merged into generation requests to the alias
+type ModelAlias struct {
+	Name        string                 `yaml:"name"`
+	Model       string                 `yaml:"model"`
+	Description string                 `yaml:"description,omitempty"`
+	Defaults    map[string]interface{} `yaml:"defaults,omitempty"`
+}
+
+// Policy is server side rule of generation requests of clients and models, empty lists match all
+type Policy struct {
+	Name              string   `yaml:"name"`
+	Clients           []string `yaml:"clients,omitempty"`
+	Models            []string `yaml:"models,omitempty"`
+	SystemInstruction struct {
+		Mode string `yaml:"mode,omitempty"` // prepend or replace
+		Text string `yaml:"text,omitempty"`
+	} `yaml:"system-instruction,omitempty"`
+	GenerationConfig struct {
+		MaxTemperature  *float64 `yaml:"max-temperature,omitempty"`
+		MaxTopP         *float64 `yaml:"max-top-p,omitempty"`
+		MaxOutputTokens int      `yaml:"max-output-tokens,omitempty"`
+	} `yaml:"generation-config,omitempty"`
+	SafetySettings []struct {
+		Category  string `yaml:"category"`
+		Threshold string `yaml:"threshold"`
+	} `yaml:"safety-settings,omitempty"`
+	Strip []string `yaml:"strip,omitempty"`
+}
+
+// CORSPolicy allows cross-origin requests of browsers to route groups: root, api, v1 and admin.
+// Origins registered by clients are allowed if AllowedOrigins is empty
+type CORSPolicy struct {
+	Groups           []string      `yaml:"groups"`
+	AllowedOrigins   []string      `yaml:"allowed-origins,omitempty"`
+	AllowedMethods   []string      `yaml:"allowed-methods,omitempty"`
+	AllowedHeaders   []string      `yaml:"allowed-headers,omitempty"`
+	ExposedHeaders   []string      `yaml:"exposed-headers,omitempty"`
+	AllowCredentials bool          `yaml:"allow-credentials,omitempty"`
+	MaxAge           time.Duration `yaml:"max-age,omitempty"`
+}
+
+// RouteLimits override limits of route groups (root, api, v1 and admin) or of requests to models in api and v1
+// groups, e.g. longer timeout of gemini-2.5-pro*. Unset limits are kept, the first route matching model is applied
+type RouteLimits struct {
+	Groups          []string       `yaml:"groups,omitempty"`
+	Models          []string       `yaml:"models,omitempty"`
+	Timeout         *time.Duration `yaml:"timeout,omitempty"`
+	StreamTimeout   *time.Duration `yaml:"stream-timeout,omitempty"`
+	UpstreamTimeout *time.Duration `yaml:"upstream-timeout,omitempty"` // models only
+	RateLimit       *float64       `yaml:"rate-limit,omitempty"`
+	Burst           *int           `yaml:"burst,omitempty"`
+}
+
+// FilterRule is regex detector of sensitive text in requests, action is mask, reject or tokenize
+type FilterRule struct {
+	Name      string `yaml:"name"`
+	Pattern   string `yaml:"pattern"`
+	Action    string `yaml:"action"`
+	Mask      string `yaml:"mask,omitempty"`
+	Responses bool   `yaml:"responses,omitempty"`
+}
+
+// ClientQuota is client budget per period (day or month), zero limit means unlimited
+type ClientQuota struct {
+	Period          string `yaml:"period"`
+	Requests        int64  `yaml:"requests,omitempty"`
+	PromptTokens    int64  `yaml:"prompt-tokens,omitempty"`
+	CandidateTokens int64  `yaml:"candidate-tokens,omitempty"`
+}
+
 type CommonOpts struct {
-	GeminiAPIKey  string `long:"geminiAPIKey" env:"GEMINI_API_KEY" description:"the key to access Gemini API"`
-	DelayRequests int    `long:"delayRequests" env:"DELAY_REQUESTS" default:"0" description:"the delay between requests if 0 no delay"`
-	TLS           TLS    `group:"tls" namespace:"tls" env-namespace:"TLS"`
-	Debug         bool   `long:"debug" env:"DEBUG" description:"debug mode"`
+	GeminiAPIKey   Secret        `long:"geminiAPIKey" env:"GEMINI_API_KEY" description:"the key to access Gemini API"`
+	GeminiAPIKeys  []Secret      `long:"geminiAPIKeys" env:"GEMINI_API_KEYS" env-delim:"," description:"pool of keys to access Gemini API"`
+	KeyPool        KeyPool       `group:"key-pool" namespace:"key-pool" env-namespace:"KEY_POOL"`
+	GeminiBaseURL  string        `long:"geminiBaseURL" env:"GEMINI_BASE_URL" default:"https://generativelanguage.googleapis.com/v1beta/" description:"Gemini API base URL"`
+	AllowedModels  []string      `long:"allowedModel" env:"ALLOWED_MODELS" env-delim:"," description:"allowed Gemini model, glob patterns supported, if empty all models are allowed"`
+	AllowedMethods []string      `long:"allowedMethod" env:"ALLOWED_METHODS" env-delim:"," default:"generateContent" default:"streamGenerateContent" default:"countTokens" default:"embedContent" default:"batchEmbedContents" description:"allowed Gemini model method"`
+	DelayRequests  int           `long:"delayRequests" env:"DELAY_REQUESTS" default:"0" description:"deprecated, use scheduler.max-in-flight=1 to serialize requests"`
+	TLS            TLS           `group:"tls" namespace:"tls" env-namespace:"TLS"`
+	Debug          bool          `long:"debug" env:"DEBUG" description:"debug mode"`
+	RelayErrors    bool          `long:"relayUpstreamErrors" env:"RELAY_UPSTREAM_ERRORS" description:"respond with original Gemini error body"`
+	Clients        []Client      `no-flag:"true"`
+	Policies       []Policy      `no-flag:"true"`
+	CORS           []CORSPolicy  `no-flag:"true"`
+	AdminKeyHash   string        `long:"adminKeyHash" env:"ADMIN_KEY_HASH" description:"hash of admin key to access /admin/, admin api is disabled if empty"`
+	Quota          Quota         `group:"quota" namespace:"quota" env-namespace:"QUOTA"`
+	Server         Server        `group:"server" namespace:"server" env-namespace:"SERVER"`
+	Retry          Retry         `group:"retry" namespace:"retry" env-namespace:"RETRY"`
+	Scheduler      Scheduler     `group:"scheduler" namespace:"scheduler" env-namespace:"SCHEDULER"`
+	Cache          Cache         `group:"cache" namespace:"cache" env-namespace:"CACHE"`
+	Metrics        Metrics       `group:"metrics" namespace:"metrics" env-namespace:"METRICS"`
+	Models         Models        `group:"models" namespace:"models" env-namespace:"MODELS"`
+	Limits         Limits        `group:"limits" namespace:"limits" env-namespace:"LIMITS"`
+	ContentFilter  ContentFilter `group:"content-filter" namespace:"content-filter" env-namespace:"CONTENT_FILTER"`
+	Audit          Audit         `group:"audit" namespace:"audit" env-namespace:"AUDIT"`
+}
+
+type Audit struct {
+	Enabled    bool          `long:"enabled" env:"ENABLED" description:"write audit log of Gemini exchanges"`
+	File       string        `long:"file" env:"FILE" default:"audit.jsonl" description:"audit log file"`
+	MaxSize    int64         `long:"max-size" env:"MAX_SIZE" default:"104857600" description:"size of audit log file to rotate it, 0 disables rotation by size"`
+	MaxAge     time.Duration `long:"max-age" env:"MAX_AGE" default:"24h" description:"age of audit log file to rotate it, 0 disables rotation by age"`
+	MaxBackups int           `long:"max-backups" env:"MAX_BACKUPS" default:"7" description:"rotated audit log files to keep, 0 keeps all of them"`
+	Content    string        `long:"content" env:"CONTENT" choice:"none" choice:"truncated" choice:"full" default:"none" description:"prompt and response in audit log"`
+	MaxText    int           `long:"max-text" env:"MAX_TEXT" default:"1024" description:"bytes of truncated prompt and response"`
+	Buffer     int           `long:"buffer" env:"BUFFER" default:"1000" description:"records waiting to be written, new records are dropped when it's full"`
+	OptOut     []string      `long:"opt-out" env:"OPT_OUT" env-delim:"," description:"client not audited"`
+	Redact     []string      `long:"redact" env:"REDACT" env-delim:"," description:"json field of prompt and response replaced with [REDACTED]"`
+}
+
+type ContentFilter struct {
+	Restore bool         `long:"restore" env:"RESTORE" description:"restore tokenized values in responses"`
+	Rules   []FilterRule `no-flag:"true"`
+}
+
+type Limits struct {
+	MaxBodySize   int64 `long:"max-body-size" env:"MAX_BODY_SIZE" default:"20971520" description:"maximum size of request body in bytes, 0 is unlimited"`
+	MaxParts      int   `long:"max-parts" env:"MAX_PARTS" default:"0" description:"maximum number of content parts in request, 0 is unlimited"`
+	MaxInlineData int64 `long:"max-inline-data" env:"MAX_INLINE_DATA" default:"0" description:"maximum decoded size of inline data in request, 0 is unlimited"`
+}
+
+type Models struct {
+	Refresh time.Duration `long:"refresh" env:"REFRESH" default:"0s" description:"interval of models refresh from Gemini models.list, 0 disables it"`
+	Aliases []ModelAlias  `no-flag:"true"`
+}
+
+type Metrics struct {
+	Enabled bool   `long:"enabled" env:"ENABLED" description:"expose Prometheus metrics on /metrics"`
+	Listen  string `long:"listen" env:"LISTEN" description:"separate address of /metrics, e.g. :9090, main port is used if empty"`
+}
+
+type Cache struct {
+	Enabled        bool          `long:"enabled" env:"ENABLED" description:"cache responses of identical deterministic requests"`
+	TTL            time.Duration `long:"ttl" env:"TTL" default:"10m" description:"time to keep cached response"`
+	MaxEntries     int           `long:"max-entries" env:"MAX_ENTRIES" default:"1000" description:"maximum number of cached responses"`
+	MaxBytes       int64         `long:"max-bytes" env:"MAX_BYTES" default:"104857600" description:"maximum total size of cached responses"`
+	AnyTemperature bool          `long:"any-temperature" env:"ANY_TEMPERATURE" description:"cache generation requests with any temperature, not only 0"`
+}
+
+type Scheduler struct {
+	RPM          int           `long:"rpm" env:"RPM" default:"0" description:"Gemini requests per minute, 0 is unlimited"`
+	TPM          int64         `long:"tpm" env:"TPM" default:"0" description:"Gemini tokens per minute, 0 is unlimited"`
+	MaxInFlight  int           `long:"max-in-flight" env:"MAX_IN_FLIGHT" default:"0" description:"Gemini calls at the same time, 0 is unlimited"`
+	MaxQueue     int           `long:"max-queue" env:"MAX_QUEUE" default:"100" description:"requests waiting for their turn"`
+	QueueTimeout time.Duration `long:"queue-timeout" env:"QUEUE_TIMEOUT" default:"30s" description:"maximum waiting time in queue"`
+}
+
+type Server struct {
+	ReadHeaderTimeout time.Duration `long:"read-header-timeout" env:"READ_HEADER_TIMEOUT" default:"5s" description:"time to read request headers, 0 is unlimited"`
+	WriteTimeout      time.Duration `long:"write-timeout" env:"WRITE_TIMEOUT" default:"120s" description:"time to write response of request without timeout, 0 is unlimited"`
+	IdleTimeout       time.Duration `long:"idle-timeout" env:"IDLE_TIMEOUT" default:"30s" description:"time to keep idle connection, 0 is unlimited"`
+	Throttle          int           `long:"throttle" env:"THROTTLE" default:"1000" description:"requests handled at once, 0 is unlimited"`
+	UpstreamTimeout   time.Duration `long:"upstream-timeout" env:"UPSTREAM_TIMEOUT" default:"20s" description:"timeout of non-streaming call to Gemini, 0 is unlimited"`
+	Timeout           time.Duration `long:"timeout" env:"TIMEOUT" default:"30s" description:"timeout of non-streaming request to /api/ and /v1/, 0 is unlimited"`
+	StreamTimeout     time.Duration `long:"stream-timeout" env:"STREAM_TIMEOUT" default:"0s" description:"timeout of streaming request to /api/ and /v1/, 0 is unlimited"`
+	RateLimit         float64       `long:"rate-limit" env:"RATE_LIMIT" default:"50" description:"requests per second of every client to /api/ and /v1/, 0 is unlimited"`
+	Burst             int           `long:"burst" env:"BURST" default:"0" description:"requests over rate limit allowed at once"`
+	Routes            []RouteLimits `no-flag:"true"`
+}
+
+type Retry struct {
+	MaxAttempts int           `long:"max-attempts" env:"MAX_ATTEMPTS" default:"1" description:"attempts to call Gemini including the first one, 1 disables retries"`
+	BaseBackoff time.Duration `long:"base-backoff" env:"BASE_BACKOFF" default:"500ms" description:"delay before the first retry, doubled on every next one"`
+	MaxBackoff  time.Duration `long:"max-backoff" env:"MAX_BACKOFF" default:"10s" description:"maximum delay between retries"`
+	Jitter      float64       `long:"jitter" env:"JITTER" default:"0.2" description:"random part of delay, 0.2 means +-20%"`
+	Statuses    []int         `long:"status" env:"STATUSES" env-delim:"," description:"retryable Gemini response status, 429 and 5xx if empty"`
+}
+
+type KeyPool struct {
+	Strategy string        `long:"strategy" env:"STRATEGY" choice:"round-robin" choice:"least-throttled" default:"round-robin" description:"selection of the next Gemini API key"`
+	Cooldown time.Duration `long:"cooldown" env:"COOLDOWN" default:"1m" description:"rest time of key throttled by Gemini"`
+}
+
+type Quota struct {
+	Store         string        `long:"store" env:"STORE" choice:"memory" choice:"file" default:"memory" description:"store of clients usage"`
+	File          string        `long:"file" env:"FILE" default:"usage.json" description:"usage file for file store"`
+	FlushInterval time.Duration `long:"flush-interval" env:"FLUSH_INTERVAL" default:"10s" description:"interval to write changed usage to file, 0 writes it on shutdown only"`
 }
 
 type TLS struct {
-	Enabled        bool   `long:"enabled" env:"ENABLED" description:"Enable TLS support."`
-	CertPath       string `long:"cert" env:"CERT" default:"domain.crt" description:"Set certificate path for TLS support"`
-	PrivateKeyPath string `long:"private-key" env:"PRIVATE_KEY" default:"default.key" description:"Set private key path for TLS support"`
+	Enabled        bool          `long:"enabled" env:"ENABLED" description:"Enable TLS support."`
+	CertPath       string        `long:"cert" env:"CERT" default:"domain.crt" description:"Set certificate path for TLS support"`
+	PrivateKeyPath string        `long:"private-key" env:"PRIVATE_KEY" default:"default.key" description:"Set private key path for TLS support"`
+	Watch          time.Duration `long:"watch" env:"WATCH" default:"1m" description:"interval to check certificate and private key files, changed ones are reloaded, 0 disables it"`
+	MinVersion     string        `long:"min-version" env:"MIN_VERSION" choice:"1.0" choice:"1.1" choice:"1.2" choice:"1.3" default:"1.2" description:"minimal TLS version"`
+	Ciphers        []string      `long:"cipher" env:"CIPHERS" env-delim:"," description:"allowed cipher suite of TLS 1.2 and older, e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, Go defaults if empty"`
+	ClientCA       string        `long:"client-ca" env:"CLIENT_CA" description:"PEM bundle of CA to verify client certificates"`
+	ClientAuth     string        `long:"client-auth" env:"CLIENT_AUTH" choice:"none" choice:"optional" choice:"require" default:"none" description:"verification of client certificates, optional allows clients with keys too"`
+	CRL            string        `long:"crl" env:"CRL" description:"CRL file of revoked client certificates, reloaded when it's changed"`
+	ACME           ACME          `group:"acme" namespace:"acme" env-namespace:"ACME"`
+}
+
+type ACME struct {
+	Enabled     bool          `long:"enabled" env:"ENABLED" description:"issue certificate with ACME, e.g. by Let's Encrypt, instead of cert and private-key files"`
+	Directory   string        `long:"directory" env:"DIRECTORY" default:"https://acme-v02.api.letsencrypt.org/directory" description:"directory URL of ACME server"`
+	Domains     []string      `long:"domain" env:"DOMAINS" env-delim:"," description:"domain of certificate"`
+	Email       string        `long:"email" env:"EMAIL" description:"contact email of ACME account"`
+	Challenge   string        `long:"challenge" env:"CHALLENGE" choice:"http-01" choice:"tls-alpn-01" default:"tls-alpn-01" description:"challenge to validate domains"`
+	HTTPPort    int           `long:"http-port" env:"HTTP_PORT" default:"80" description:"port of http-01 challenge, other requests to it are redirected to https"`
+	CacheDir    string        `long:"cache-dir" env:"CACHE_DIR" default:"acme" description:"directory of account key and issued certificate"`
+	RenewBefore time.Duration `long:"renew-before" env:"RENEW_BEFORE" default:"720h" description:"certificate is renewed when it expires sooner"`
+	CACert      string        `long:"ca-cert" env:"CA_CERT" description:"PEM file of CA trusted to connect to ACME server, e.g. of local pebble"`
 }
 
+// GetCommon reads config file and resolves options in order of precedence: defaults < file < env < flags.
+// Defaults, env and flags are taken from Base, options set by env or flags are listed in Explicit.
+// Parsed file and its warnings are kept on success only
 func (s *Config) GetCommon() (*CommonOpts, error) {
 	s.Lock()
 	defer s.Unlock()
-	f, err := os.Open(s.FileName)
+	file, keys, warnings, err := s.read()
 	if err != nil {
-		return nil, fmt.Errorf("can't open %s: %w", s.FileName, err)
+		return nil, err
+	}
+	s.File, s.Warnings = file, warnings
+
+	res := s.Base
+	s.sources = resolve(&res, file.commonOpts(), keys, s.Explicit)
+
+	if res.GeminiBaseURL == "" {
+		res.GeminiBaseURL = DefaultGeminiBaseURL
+	}
+	if res.Quota.Store == "" {
+		res.Quota.Store = "memory"
+	}
+	if len(res.AllowedMethods) == 0 {
+		res.AllowedMethods = DefaultAllowedMethods
+	}
+	if res.Audit.File == "" {
+		res.Audit.File = "audit.jsonl"
+	}
+	if res.Limits.MaxBodySize == 0 {
+		res.Limits.MaxBodySize = DefaultMaxBodySize
 	}
-	defer func(f *os.File) {
-		err := f.Close()
-		if err != nil {
-			fmt.Printf("can't close config file %s: %v\n", s.FileName, err)
-		}
-	}(f)
-	if err = yaml.NewDecoder(f).Decode(&s.File); err != nil {
-		return nil, fmt.Errorf("can't parse %s: %w", s.FileName, err)
+	if res.TLS.ClientAuth == "" {
+		res.TLS.ClientAuth = "none"
 	}
+	if res.TLS.ACME.Challenge == "" {
+		res.TLS.ACME.Challenge = "tls-alpn-01"
+	}
+	if res.TLS.ACME.CacheDir == "" {
+		res.TLS.ACME.CacheDir = "acme"
+	}
+	return &res, nil
+}
 
-	return &CommonOpts{
-		GeminiAPIKey:  s.File.GeminiAPIKey,
-		DelayRequests: s.File.DelayRequests,
+// commonOpts maps file to options, values missing in the file are zero
+func (f *File) commonOpts() CommonOpts {
+	return CommonOpts{
+		GeminiAPIKey:  f.GeminiAPIKey,
+		GeminiAPIKeys: f.GeminiAPIKeys,
+		KeyPool: KeyPool{
+			Strategy: f.KeyPool.Strategy,
+			Cooldown: f.KeyPool.Cooldown,
+		},
+		GeminiBaseURL:  f.GeminiBaseURL,
+		AllowedModels:  f.AllowedModels,
+		AllowedMethods: f.AllowedMethods,
+		DelayRequests:  f.DelayRequests,
+		RelayErrors:    f.RelayErrors,
+		Clients:        f.Clients,
+		Policies:       f.Policies,
+		CORS:           f.CORS,
+		AdminKeyHash:   f.AdminKeyHash,
+		Quota: Quota{
+			Store:         f.Quota.Store,
+			File:          f.Quota.File,
+			FlushInterval: f.Quota.FlushInterval,
+		},
+		Scheduler: Scheduler{
+			RPM:          f.Scheduler.RPM,
+			TPM:          f.Scheduler.TPM,
+			MaxInFlight:  f.Scheduler.MaxInFlight,
+			MaxQueue:     f.Scheduler.MaxQueue,
+			QueueTimeout: f.Scheduler.QueueTimeout,
+		},
+		Cache: Cache{
+			Enabled:        f.Cache.Enabled,
+			TTL:            f.Cache.TTL,
+			MaxEntries:     f.Cache.MaxEntries,
+			MaxBytes:       f.Cache.MaxBytes,
+			AnyTemperature: f.Cache.AnyTemperature,
+		},
+		Models: Models{
+			Refresh: f.Models.Refresh,
+			Aliases: f.Models.Aliases,
+		},
+		ContentFilter: ContentFilter{
+			Restore: f.ContentFilter.Restore,
+			Rules:   f.ContentFilter.Rules,
+		},
+		Limits: Limits{
+			MaxBodySize:   f.Limits.MaxBodySize,
+			MaxParts:      f.Limits.MaxParts,
+			MaxInlineData: f.Limits.MaxInlineData,
+		},
+		Audit: Audit{
+			Enabled:    f.Audit.Enabled,
+			File:       f.Audit.File,
+			MaxSize:    f.Audit.MaxSize,
+			MaxAge:     f.Audit.MaxAge,
+			MaxBackups: f.Audit.MaxBackups,
+			Content:    f.Audit.Content,
+			MaxText:    f.Audit.MaxText,
+			Buffer:     f.Audit.Buffer,
+			OptOut:     f.Audit.OptOut,
+			Redact:     f.Audit.Redact,
+		},
+		Metrics: Metrics{
+			Enabled: f.Metrics.Enabled,
+			Listen:  f.Metrics.Listen,
+		},
+		Server: Server{
+			ReadHeaderTimeout: f.Server.ReadHeaderTimeout,
+			WriteTimeout:      f.Server.WriteTimeout,
+			IdleTimeout:       f.Server.IdleTimeout,
+			Throttle:          f.Server.Throttle,
+			UpstreamTimeout:   f.Server.UpstreamTimeout,
+			Timeout:           f.Server.Timeout,
+			StreamTimeout:     f.Server.StreamTimeout,
+			RateLimit:         f.Server.RateLimit,
+			Burst:             f.Server.Burst,
+			Routes:            f.Server.Routes,
+		},
+		Retry: Retry{
+			MaxAttempts: f.Retry.MaxAttempts,
+			BaseBackoff: f.Retry.BaseBackoff,
+			MaxBackoff:  f.Retry.MaxBackoff,
+			Jitter:      f.Retry.Jitter,
+			Statuses:    f.Retry.Statuses,
+		},
 		TLS: TLS{
-			Enabled:        s.File.TLS.Enabled,
-			CertPath:       s.File.TLS.CertPath,
-			PrivateKeyPath: s.File.TLS.PrivateKeyPath,
+			Enabled:        f.TLS.Enabled,
+			CertPath:       f.TLS.CertPath,
+			PrivateKeyPath: f.TLS.PrivateKeyPath,
+			Watch:          f.TLS.Watch,
+			MinVersion:     f.TLS.MinVersion,
+			Ciphers:        f.TLS.Ciphers,
+			ClientCA:       f.TLS.ClientCA,
+			ClientAuth:     f.TLS.ClientAuth,
+			CRL:            f.TLS.CRL,
+			ACME: ACME{
+				Enabled:     f.TLS.ACME.Enabled,
+				Directory:   f.TLS.ACME.Directory,
+				Domains:     f.TLS.ACME.Domains,
+				Email:       f.TLS.ACME.Email,
+				Challenge:   f.TLS.ACME.Challenge,
+				HTTPPort:    f.TLS.ACME.HTTPPort,
+				CacheDir:    f.TLS.ACME.CacheDir,
+				RenewBefore: f.TLS.ACME.RenewBefore,
+				CACert:      f.TLS.ACME.CACert,
+			},
 		},
-		Debug: s.File.Debug,
-	}, nil
+		Debug: f.Debug,
+	}
 }
@@ -0,0 +1,31 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_GetCommonReload(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "gemini-proxy.yml")
+	require.NoError(t, os.WriteFile(name, []byte("gemini-api-key: k1\nallowed-models: [gemini-2.5-pro]\n"), 0o600))
+	cnf := &Config{FileName: name}
+	co, err := cnf.GetCommon()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"gemini-2.5-pro"}, co.AllowedModels)
+	assert.Equal(t, DefaultAllowedMethods, co.AllowedMethods)
+
+	require.NoError(t, os.WriteFile(name, []byte("gemini-api-key: k2\n"), 0o600))
+	co, err = cnf.GetCommon()
+	require.NoError(t, err)
+	assert.Equal(t, Secret("k2"), co.GeminiAPIKey)
+	assert.Empty(t, co.AllowedModels, "removed value is not kept")
+
+	require.NoError(t, os.WriteFile(name, []byte("gemini-api-key: [\n"), 0o600))
+	_, err = cnf.GetCommon()
+	require.Error(t, err)
+	assert.Equal(t, Secret("k2"), cnf.File.GeminiAPIKey, "parsed file is kept on error")
+}
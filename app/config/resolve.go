@@ -0,0 +1,255 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Source tells where value of option comes from
+type Source string
+
+// Sources of option values in order of precedence
+const (
+	SourceDefault Source = "default"
+	SourceFile    Source = "file"
+	SourceEnv     Source = "env"
+	SourceFlag    Source = "flag"
+)
+
+// fileKeys maps names of options to keys of config file where they differ
+var fileKeys = map[string]string{
+	"geminiAPIKey":        "gemini-api-key",
+	"geminiAPIKeys":       "gemini-api-keys",
+	"geminiBaseURL":       "gemini-base-url",
+	"allowedModel":        "allowed-models",
+	"allowedMethod":       "allowed-methods",
+	"delayRequests":       "delay-requests",
+	"relayUpstreamErrors": "relay-upstream-errors",
+	"adminKeyHash":        "admin-key-hash",
+	"retry.status":        "retry.statuses",
+	"tls.cert":            "tls.cert-path",
+	"tls.private-key":     "tls.private-key-path",
+	"tls.cipher":          "tls.ciphers",
+	"tls.acme.domain":     "tls.acme.domains",
+}
+
+var (
+	unknownKeyRe = regexp.MustCompile(`^line (\d+): field (\S+) not found in type .+$`)
+	typeErrRe    = regexp.MustCompile("^line (\\d+): cannot unmarshal !!(\\w+)( `.*`)? into (.+)$")
+)
+
+// yamlTypes are readable names of yaml tags and Go types in decoding errors
+var yamlTypes = map[string]string{
+	"str": "string", "int": "integer", "float": "number", "bool": "boolean", "seq": "list", "map": "mapping",
+	"string": "string", "int64": "integer", "float64": "number", "time.Duration": "duration",
+}
+
+// read parses config file, returns it with keys present in the file, e.g. cache.ttl, and warnings.
+// Errors and warnings refer to lines of the file
+func (s *Config) read() (file *File, keys map[string]bool, warnings []string, err error) {
+	data, err := os.ReadFile(s.FileName)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("can't open %s: %w", s.FileName, err)
+	}
+
+	var root yaml.Node
+	if err = yaml.Unmarshal(data, &root); err != nil {
+		return nil, nil, nil, fmt.Errorf("can't parse %s: %s", s.FileName, strings.TrimPrefix(err.Error(), "yaml: "))
+	}
+	keys, lines := map[string]bool{}, map[int]string{}
+	if len(root.Content) > 0 {
+		collectKeys(root.Content[0], "", keys, lines)
+	}
+
+	// file is parsed into new struct, so values removed from the file are not kept on reload
+	file = &File{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err = dec.Decode(file)
+	var typeErr *yaml.TypeError
+	switch {
+	case errors.Is(err, io.EOF):
+		return file, keys, nil, nil // empty file
+	case errors.As(err, &typeErr):
+		// unknown keys are reported as warnings, the rest of the file is decoded anyway
+		var problems []string
+		for _, e := range typeErr.Errors {
+			if m := unknownKeyRe.FindStringSubmatch(e); m != nil {
+				key := m[2]
+				if line, _ := strconv.Atoi(m[1]); strings.HasSuffix(lines[line], "."+key) {
+					key = lines[line]
+				}
+				warnings = append(warnings, fmt.Sprintf("line %s: unknown key %s", m[1], key))
+				continue
+			}
+			problems = append(problems, typeProblem(e, lines))
+		}
+		if len(problems) > 0 {
+			return nil, nil, nil, fmt.Errorf("can't parse %s: %s", s.FileName, strings.Join(problems, "; "))
+		}
+	case err != nil:
+		return nil, nil, nil, fmt.Errorf("can't parse %s: %s", s.FileName, strings.TrimPrefix(err.Error(), "yaml: "))
+	}
+	return file, keys, warnings, nil
+}
+
+// typeProblem makes readable message of yaml type error, e.g. "line 3: cache.ttl should be duration, got string `1x`"
+func typeProblem(e string, lines map[int]string) string {
+	m := typeErrRe.FindStringSubmatch(e)
+	if m == nil {
+		return e
+	}
+	want := "mapping"
+	if t, ok := yamlTypes[m[4]]; ok {
+		want = t
+	} else if strings.HasPrefix(m[4], "[]") {
+		want = "list"
+	} else if !strings.HasPrefix(m[4], "struct") && !strings.HasPrefix(m[4], "map[") && !strings.HasPrefix(m[4], "config.") {
+		want = m[4]
+	}
+	got := m[2]
+	if t, ok := yamlTypes[got]; ok {
+		got = t
+	}
+	line, _ := strconv.Atoi(m[1])
+	key := lines[line]
+	if key == "" {
+		key = "value"
+	}
+	return fmt.Sprintf("line %d: %s should be %s, got %s%s", line, key, want, got, m[3])
+}
+
+// collectKeys adds keys of yaml mapping and its nested mappings with prefix of parent key,
+// line of every value is mapped to the deepest key of the line
+func collectKeys(node *yaml.Node, prefix string, keys map[string]bool, lines map[int]string) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := prefix + node.Content[i].Value
+			keys[key] = true
+			lines[node.Content[i+1].Line] = key // nested key on the same line overrides its parent
+			collectKeys(node.Content[i+1], key+".", keys, lines)
+		}
+	case yaml.SequenceNode:
+		// keys of list items are reported in error messages only, e.g. clients[1].name
+		for i, item := range node.Content {
+			itemKeys := map[string]bool{}
+			collectKeys(item, fmt.Sprintf("%s[%d].", strings.TrimSuffix(prefix, "."), i), itemKeys, lines)
+		}
+	}
+}
+
+// option is field of CommonOpts with value, name is long flag with namespace, e.g. cache.ttl,
+// fields without flag are named after the field, e.g. models.aliases
+type option struct {
+	name  string
+	value reflect.Value
+}
+
+func options(v reflect.Value, prefix string) []option {
+	var res []option
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if ns := field.Tag.Get("namespace"); ns != "" {
+			res = append(res, options(v.Field(i), prefix+ns+".")...)
+			continue
+		}
+		name := field.Tag.Get("long")
+		if field.Tag.Get("no-flag") != "" {
+			name = strings.ToLower(field.Name)
+		}
+		if name == "" {
+			continue
+		}
+		res = append(res, option{name: prefix + name, value: v.Field(i)})
+	}
+	return res
+}
+
+// fileKey returns key of option in config file
+func fileKey(name string) string {
+	if key, ok := fileKeys[name]; ok {
+		return key
+	}
+	return name
+}
+
+// resolve sets options present in the file unless they are set by env or flags, returns source of every option
+func resolve(res *CommonOpts, file CommonOpts, keys map[string]bool, explicit map[string]Source) map[string]Source {
+	dst, src := options(reflect.ValueOf(res).Elem(), ""), options(reflect.ValueOf(&file).Elem(), "")
+	sources := make(map[string]Source, len(dst))
+	for i, o := range dst {
+		switch {
+		case explicit[o.name] != "":
+			sources[o.name] = explicit[o.name]
+		case keys[fileKey(o.name)]:
+			o.value.Set(src[i].value)
+			sources[o.name] = SourceFile
+		default:
+			sources[o.name] = SourceDefault
+		}
+	}
+	return sources
+}
+
+// Print writes effective options with their sources, secrets are redacted. Options without flags,
+// like clients and policies, are written as yaml
+func (s *Config) Print(w io.Writer, opts *CommonOpts) error {
+	s.Lock()
+	defer s.Unlock()
+	sections := map[string]interface{}{}
+	for _, o := range options(reflect.ValueOf(opts).Elem(), "") {
+		key := fileKey(o.name)
+		if isSection(o.value) {
+			if !o.value.IsZero() {
+				sections[key] = o.value.Interface()
+			}
+			continue
+		}
+		source := s.sources[o.name]
+		if source == "" {
+			source = SourceDefault
+		}
+		if _, err := fmt.Fprintf(w, "%s: %s (%s)\n", key, formatValue(o.value), source); err != nil {
+			return err
+		}
+	}
+	if len(sections) == 0 {
+		return nil
+	}
+	data, err := yaml.Marshal(sections)
+	if err != nil {
+		return fmt.Errorf("can't encode config sections: %w", err)
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// isSection tells if value is list of structs, e.g. clients, it's printed as yaml
+func isSection(v reflect.Value) bool {
+	return v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct
+}
+
+// formatValue prints value with fmt, so secrets are redacted by Secret.String
+func formatValue(v reflect.Value) string {
+	if v.Kind() == reflect.Slice {
+		items := make([]string, v.Len())
+		for i := range items {
+			items[i] = formatValue(v.Index(i))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+	if v.Kind() == reflect.String && v.String() == "" {
+		return `""`
+	}
+	return fmt.Sprintf("%v", v.Interface())
+}
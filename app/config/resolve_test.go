@@ -0,0 +1,135 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, content string) string {
+	name := filepath.Join(t.TempDir(), "gemini-proxy.yml")
+	require.NoError(t, os.WriteFile(name, []byte(content), 0o600))
+	return name
+}
+
+func TestConfig_GetCommonLayers(t *testing.T) {
+	base := CommonOpts{GeminiAPIKey: "flag-key", AllowedMethods: []string{"generateContent"}}
+	base.Cache.TTL = 5 * time.Minute
+	base.Cache.MaxEntries = 1000
+	base.Retry.Jitter = 0.2
+	base.Retry.MaxAttempts = 1
+	base.TLS.CertPath = "domain.crt"
+
+	cnf := &Config{
+		FileName: writeFile(t, `
+gemini-api-key: file-key
+allowed-models: [gemini-2.5-pro]
+cache:
+  ttl: 1m
+  max-entries: 10
+retry:
+  jitter: 0
+tls:
+  cert-path: file.crt
+clients:
+  - name: web
+    key-hash: sha256:abc
+`),
+		Base:     base,
+		Explicit: map[string]Source{"geminiAPIKey": SourceFlag, "cache.ttl": SourceEnv},
+	}
+	co, err := cnf.GetCommon()
+	require.NoError(t, err)
+	assert.Equal(t, Secret("flag-key"), co.GeminiAPIKey, "flag overrides file")
+	assert.Equal(t, 5*time.Minute, co.Cache.TTL, "env overrides file")
+	assert.Equal(t, 10, co.Cache.MaxEntries, "file overrides default")
+	assert.Equal(t, 0.0, co.Retry.Jitter, "zero value of file overrides default")
+	assert.Equal(t, 1, co.Retry.MaxAttempts, "default is kept if file doesn't set it")
+	assert.Equal(t, "file.crt", co.TLS.CertPath)
+	assert.Equal(t, []string{"gemini-2.5-pro"}, co.AllowedModels)
+	assert.Equal(t, []string{"generateContent"}, co.AllowedMethods)
+	assert.Equal(t, []Client{{Name: "web", KeyHash: "sha256:abc"}}, co.Clients)
+	assert.Equal(t, DefaultGeminiBaseURL, co.GeminiBaseURL, "zero value is replaced with config default")
+	assert.Equal(t, 5*time.Minute, cnf.Base.Cache.TTL, "base is not changed")
+
+	out := bytes.Buffer{}
+	require.NoError(t, cnf.Print(&out, co))
+	assert.Contains(t, out.String(), "gemini-api-key: ***** (flag)\n")
+	assert.Contains(t, out.String(), "allowed-models: [gemini-2.5-pro] (file)\n")
+	assert.Contains(t, out.String(), "cache.ttl: 5m0s (env)\n")
+	assert.Contains(t, out.String(), "retry.max-attempts: 1 (default)\n")
+	assert.Contains(t, out.String(), "tls.cert-path: file.crt (file)\n")
+	assert.Contains(t, out.String(), "clients:\n    - name: web\n      key-hash: sha256:abc\n")
+	assert.NotContains(t, out.String(), "-key\n")
+}
+
+func TestConfig_GetCommonServer(t *testing.T) {
+	base := CommonOpts{}
+	base.Server.Timeout = 30 * time.Second
+	base.Server.RateLimit = 50
+	cnf := &Config{FileName: writeFile(t, `
+server:
+  timeout: 0s
+  routes:
+    - groups: [root]
+      rate-limit: 1
+    - models: [gemini-2.5-pro*]
+      timeout: 5m
+      upstream-timeout: 290s
+`), Base: base}
+	co, err := cnf.GetCommon()
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), co.Server.Timeout, "zero timeout of file disables it")
+	assert.Equal(t, 50.0, co.Server.RateLimit)
+	rate, timeout, upstream := 1.0, 5*time.Minute, 290*time.Second
+	assert.Equal(t, []RouteLimits{{Groups: []string{"root"}, RateLimit: &rate},
+		{Models: []string{"gemini-2.5-pro*"}, Timeout: &timeout, UpstreamTimeout: &upstream}}, co.Server.Routes)
+
+	out := bytes.Buffer{}
+	require.NoError(t, cnf.Print(&out, co))
+	assert.Contains(t, out.String(), "server.timeout: 0s (file)\n")
+	assert.Contains(t, out.String(), "server.routes:\n    - groups:\n        - root\n      rate-limit: 1\n")
+}
+
+func TestConfig_GetCommonErrors(t *testing.T) {
+	tbl := []struct {
+		name, content, err string
+	}{
+		{"syntax", "cache:\n  ttl: [\n", "line 2: did not find expected node content"},
+		{"types", "cache:\n  ttl: 1x\nretry: [1]\nclients:\n  - name: web\n    quota: {period: day, requests: x}\n",
+			"line 2: cache.ttl should be duration, got string `1x`; line 3: retry should be mapping, got list; " +
+				"line 6: clients[0].quota.requests should be integer, got string `x`"},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			cnf := &Config{FileName: writeFile(t, tt.content)}
+			_, err := cnf.GetCommon()
+			require.Error(t, err)
+			assert.Equal(t, "can't parse "+cnf.FileName+": "+tt.err, err.Error())
+			assert.Nil(t, cnf.File)
+		})
+	}
+
+	_, err := (&Config{FileName: "/no/such/file.yml"}).GetCommon()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can't open /no/such/file.yml")
+}
+
+func TestConfig_GetCommonWarnings(t *testing.T) {
+	cnf := &Config{FileName: writeFile(t, "debug: true\ncahce:\n  ttl: 1m\ncache:\n  tll: 1m\n")}
+	co, err := cnf.GetCommon()
+	require.NoError(t, err)
+	assert.True(t, co.Debug)
+	assert.Equal(t, []string{"line 2: unknown key cahce", "line 5: unknown key cache.tll"}, cnf.Warnings)
+
+	cnf = &Config{FileName: writeFile(t, "")}
+	co, err = cnf.GetCommon()
+	require.NoError(t, err, "empty file is valid")
+	assert.Empty(t, cnf.Warnings)
+	assert.Equal(t, DefaultAllowedMethods, co.AllowedMethods)
+}
@@ -0,0 +1,177 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Secret is value like Gemini API key or reference to it, e.g. file:/run/secrets/gemini. Secret value is redacted
+// in logs and fmt output, references are printed as is. Use Reveal to get the value itself
+type Secret string
+
+const redacted = "*****"
+
+// String returns reference as is and redacted value
+func (s Secret) String() string {
+	if s == "" || s.isRef() {
+		return string(s)
+	}
+	return redacted
+}
+
+// GoString redacts secret in %#v output
+func (s Secret) GoString() string {
+	return fmt.Sprintf("%q", s.String())
+}
+
+// MarshalText redacts secret in json and yaml output
+func (s Secret) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Reveal returns secret value
+func (s Secret) Reveal() string {
+	return string(s)
+}
+
+// Resolve returns value of secret reference from its provider, secret which is not reference is returned as is
+func (s Secret) Resolve(ctx context.Context) (Secret, error) {
+	scheme, ref, ok := strings.Cut(string(s), ":")
+	if !ok {
+		return s, nil
+	}
+	p, ok := secretProvider(scheme)
+	if !ok {
+		return s, nil
+	}
+	val, err := p.Secret(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("can't resolve secret %s: %w", s, err)
+	}
+	if val == "" {
+		return "", fmt.Errorf("secret %s is empty", s)
+	}
+	return Secret(val), nil
+}
+
+func (s Secret) isRef() bool {
+	scheme, _, ok := strings.Cut(string(s), ":")
+	if !ok {
+		return false
+	}
+	_, ok = secretProvider(scheme)
+	return ok
+}
+
+// SecretProvider returns secret by reference, reference is part of secret after scheme of the provider,
+// e.g. /run/secrets/gemini of file:/run/secrets/gemini
+type SecretProvider interface {
+	Secret(ctx context.Context, ref string) (string, error)
+}
+
+var secretProviders = struct {
+	sync.RWMutex
+	byScheme map[string]SecretProvider
+}{byScheme: map[string]SecretProvider{
+	"file": FileSecret{},
+	"env":  EnvSecret{},
+	"exec": ExecSecret{Timeout: 10 * time.Second},
+}}
+
+// RegisterSecretProvider makes secrets with scheme, e.g. vault:secret/gemini, resolved by provider.
+// Provider of the scheme registered before is replaced
+func RegisterSecretProvider(scheme string, p SecretProvider) {
+	secretProviders.Lock()
+	defer secretProviders.Unlock()
+	secretProviders.byScheme[scheme] = p
+}
+
+func secretProvider(scheme string) (SecretProvider, bool) {
+	secretProviders.RLock()
+	defer secretProviders.RUnlock()
+	p, ok := secretProviders.byScheme[scheme]
+	return p, ok
+}
+
+// FileSecret reads secret from file, e.g. docker or kubernetes secret, surrounding spaces are trimmed
+type FileSecret struct{}
+
+// Secret returns content of file at path ref
+func (FileSecret) Secret(_ context.Context, ref string) (string, error) {
+	data, err := os.ReadFile(ref) // nolint:gosec
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// EnvSecret takes secret from env variable
+type EnvSecret struct{}
+
+// Secret returns value of env variable ref
+func (EnvSecret) Secret(_ context.Context, ref string) (string, error) {
+	val, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", fmt.Errorf("env %s is not set", ref)
+	}
+	return strings.TrimSpace(val), nil
+}
+
+// ExecSecret runs helper command and takes secret from its output, e.g. exec:vault kv get -field=key secret/gemini.
+// Command is split by spaces and run without shell
+type ExecSecret struct {
+	Timeout time.Duration
+}
+
+// Secret runs command ref and returns its trimmed stdout
+func (e ExecSecret) Secret(ctx context.Context, ref string) (string, error) {
+	args := strings.Fields(ref)
+	if len(args) == 0 {
+		return "", errors.New("command is empty")
+	}
+	if e.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.Timeout)
+		defer cancel()
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...) // nolint:gosec
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%w: %s", err, msg)
+		}
+		return "", err
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// ResolveSecrets replaces references of Gemini API keys with their values
+func ResolveSecrets(ctx context.Context, opts *CommonOpts) error {
+	var errs []error
+	key, err := opts.GeminiAPIKey.Resolve(ctx)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("gemini-api-key: %w", err))
+	}
+	keys := make([]Secret, len(opts.GeminiAPIKeys))
+	for i, k := range opts.GeminiAPIKeys {
+		if keys[i], err = k.Resolve(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("gemini-api-keys[%d]: %w", i, err))
+		}
+	}
+	if err = errors.Join(errs...); err != nil {
+		return err
+	}
+	if len(opts.GeminiAPIKeys) == 0 {
+		keys = opts.GeminiAPIKeys
+	}
+	opts.GeminiAPIKey, opts.GeminiAPIKeys = key, keys
+	return nil
+}
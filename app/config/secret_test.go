@@ -0,0 +1,96 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestSecret_Redacted(t *testing.T) {
+	opts := CommonOpts{GeminiAPIKey: "AIza-secret", GeminiAPIKeys: []Secret{"AIza-other", "file:/run/secrets/gemini"}}
+	for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+		out := fmt.Sprintf(format, opts)
+		assert.NotContains(t, out, "AIza", format)
+		assert.Contains(t, out, "file:/run/secrets/gemini", "reference is printed as is, %s", format)
+	}
+
+	data, err := json.Marshal(opts.GeminiAPIKeys)
+	require.NoError(t, err)
+	assert.Equal(t, `["*****","file:/run/secrets/gemini"]`, string(data))
+	data, err = yaml.Marshal(File{GeminiAPIKey: "AIza-secret"})
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "gemini-api-key: '*****'")
+	assert.Equal(t, "AIza-secret", opts.GeminiAPIKey.Reveal())
+	assert.Equal(t, "", Secret("").String())
+}
+
+func TestSecret_Resolve(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "gemini")
+	require.NoError(t, os.WriteFile(file, []byte("from-file\n"), 0o600))
+	t.Setenv("TEST_GEMINI_KEY", "from-env")
+	script := filepath.Join(t.TempDir(), "denied.sh")
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\necho access denied >&2\nexit 3\n"), 0o700)) // nolint:gosec
+
+	tbl := []struct {
+		secret Secret
+		res    string
+		err    string
+	}{
+		{secret: "plain-key", res: "plain-key"},
+		{secret: "unknown:scheme", res: "unknown:scheme"},
+		{secret: Secret("file:" + file), res: "from-file"},
+		{secret: "file:/not/found", err: "can't resolve secret file:/not/found: open /not/found: no such file or directory"},
+		{secret: "env:TEST_GEMINI_KEY", res: "from-env"},
+		{secret: "env:TEST_GEMINI_NOT_SET", err: "can't resolve secret env:TEST_GEMINI_NOT_SET: env TEST_GEMINI_NOT_SET is not set"},
+		{secret: "exec:echo from-exec", res: "from-exec"},
+		{secret: "exec:sh -c exit", err: "secret exec:sh -c exit is empty"},
+		{secret: Secret("exec:" + script), err: "can't resolve secret exec:" + script + ": exit status 3: access denied"},
+		{secret: "exec:", err: "can't resolve secret exec:: command is empty"},
+	}
+	for _, tt := range tbl {
+		t.Run(string(tt.secret), func(t *testing.T) {
+			res, err := tt.secret.Resolve(context.Background())
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, res.Reveal())
+		})
+	}
+}
+
+type testProvider map[string]string
+
+func (p testProvider) Secret(_ context.Context, ref string) (string, error) {
+	if v, ok := p[ref]; ok {
+		return v, nil
+	}
+	return "", errors.New("not found")
+}
+
+func TestResolveSecrets(t *testing.T) {
+	RegisterSecretProvider("test", testProvider{"gemini/k1": "v1", "gemini/k2": "v2"})
+
+	opts := CommonOpts{GeminiAPIKey: "test:gemini/k1", GeminiAPIKeys: []Secret{"test:gemini/k2", "plain"}}
+	require.NoError(t, ResolveSecrets(context.Background(), &opts))
+	assert.Equal(t, Secret("v1"), opts.GeminiAPIKey)
+	assert.Equal(t, []Secret{"v2", "plain"}, opts.GeminiAPIKeys)
+
+	opts = CommonOpts{GeminiAPIKey: "test:gemini/k1", GeminiAPIKeys: []Secret{"test:gemini/k3"}}
+	err := ResolveSecrets(context.Background(), &opts)
+	assert.EqualError(t, err, "gemini-api-keys[0]: can't resolve secret test:gemini/k3: not found")
+	assert.Equal(t, Secret("test:gemini/k1"), opts.GeminiAPIKey, "options are kept on error")
+
+	opts = CommonOpts{}
+	require.NoError(t, ResolveSecrets(context.Background(), &opts))
+	assert.Nil(t, opts.GeminiAPIKeys)
+}
@@ -0,0 +1,33 @@
+package config
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+)
+
+// Watch checks config file every interval and calls changed when modification time or size of the file
+// is changed, it returns when ctx is done
+func (s *Config) Watch(ctx context.Context, interval time.Duration, changed func()) {
+	last, _ := os.Stat(s.FileName)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(s.FileName)
+		if err != nil {
+			log.Printf("[WARN] can't check config file %s: %v", s.FileName, err)
+			continue
+		}
+		if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+			continue
+		}
+		last = info
+		changed()
+	}
+}
@@ -0,0 +1,36 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_Watch(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "gemini-proxy.yml")
+	require.NoError(t, os.WriteFile(name, []byte("debug: false\n"), 0o600))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	var calls atomic.Int32
+	go func() {
+		(&Config{FileName: name}).Watch(ctx, 10*time.Millisecond, func() { calls.Add(1) })
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(0), calls.Load(), "unchanged file")
+	require.NoError(t, os.WriteFile(name, []byte("debug: true\n"), 0o600))
+	require.NoError(t, os.Chtimes(name, time.Now(), time.Now().Add(time.Minute)))
+	assert.Eventually(t, func() bool { return calls.Load() == 1 }, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(1), calls.Load(), "change is reported once")
+
+	cancel()
+	<-done
+}
@@ -0,0 +1,208 @@
+// Package gemini defines request and response bodies of Gemini API used by translation layers of the proxy,
+// see https://ai.google.dev/api/generate-content
+package gemini
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Roles of content
+const (
+	RoleUser  = "user"
+	RoleModel = "model"
+)
+
+// Finish reasons of candidate, the list isn't complete
+const (
+	FinishStop       = "STOP"
+	FinishMaxTokens  = "MAX_TOKENS"
+	FinishSafety     = "SAFETY"
+	FinishRecitation = "RECITATION"
+)
+
+// GenerateContentRequest is body of generateContent and streamGenerateContent methods
+type GenerateContentRequest struct {
+	Contents          []Content         `json:"contents"`
+	SystemInstruction *Content          `json:"systemInstruction,omitempty"`
+	Tools             []Tool            `json:"tools,omitempty"`
+	ToolConfig        *ToolConfig       `json:"toolConfig,omitempty"`
+	SafetySettings    []SafetySetting   `json:"safetySettings,omitempty"`
+	GenerationConfig  *GenerationConfig `json:"generationConfig,omitempty"`
+	CachedContent     string            `json:"cachedContent,omitempty"`
+}
+
+// Content is message of conversation, role is user or model
+type Content struct {
+	Role  string `json:"role,omitempty"`
+	Parts []Part `json:"parts"`
+}
+
+// Part is piece of content, only one of the fields is set
+type Part struct {
+	Text             string            `json:"text,omitempty"`
+	Thought          bool              `json:"thought,omitempty"`
+	InlineData       *Blob             `json:"inlineData,omitempty"`
+	FileData         *FileData         `json:"fileData,omitempty"`
+	FunctionCall     *FunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *FunctionResponse `json:"functionResponse,omitempty"`
+}
+
+// Blob is inline media, data is base64 encoded
+type Blob struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+// FileData is media referenced by URI
+type FileData struct {
+	MimeType string `json:"mimeType,omitempty"`
+	FileURI  string `json:"fileUri"`
+}
+
+// FunctionCall is call of declared function predicted by model, args is json object
+type FunctionCall struct {
+	ID   string          `json:"id,omitempty"`
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+// FunctionResponse is result of function call passed back to model, response is json object
+type FunctionResponse struct {
+	ID       string          `json:"id,omitempty"`
+	Name     string          `json:"name"`
+	Response json.RawMessage `json:"response"`
+}
+
+// Tool is set of functions model may call
+type Tool struct {
+	FunctionDeclarations []FunctionDeclaration `json:"functionDeclarations,omitempty"`
+}
+
+// FunctionDeclaration describes function, parameters are given as JSON schema
+type FunctionDeclaration struct {
+	Name                 string          `json:"name"`
+	Description          string          `json:"description,omitempty"`
+	ParametersJSONSchema json.RawMessage `json:"parametersJsonSchema,omitempty"`
+}
+
+// Function calling modes
+const (
+	ModeAuto = "AUTO"
+	ModeAny  = "ANY"
+	ModeNone = "NONE"
+)
+
+// ToolConfig controls function calling
+type ToolConfig struct {
+	FunctionCallingConfig *FunctionCallingConfig `json:"functionCallingConfig,omitempty"`
+}
+
+// FunctionCallingConfig sets mode of function calling and functions allowed in ANY mode
+type FunctionCallingConfig struct {
+	Mode                 string   `json:"mode,omitempty"`
+	AllowedFunctionNames []string `json:"allowedFunctionNames,omitempty"`
+}
+
+// SafetySetting sets blocking threshold of harm category
+type SafetySetting struct {
+	Category  string `json:"category"`
+	Threshold string `json:"threshold"`
+}
+
+// GenerationConfig is generation options, nil fields are left to model defaults
+type GenerationConfig struct {
+	StopSequences      []string        `json:"stopSequences,omitempty"`
+	ResponseMimeType   string          `json:"responseMimeType,omitempty"`
+	ResponseJSONSchema json.RawMessage `json:"responseJsonSchema,omitempty"`
+	CandidateCount     *int            `json:"candidateCount,omitempty"`
+	MaxOutputTokens    *int            `json:"maxOutputTokens,omitempty"`
+	Temperature        *float64        `json:"temperature,omitempty"`
+	TopP               *float64        `json:"topP,omitempty"`
+	TopK               *int            `json:"topK,omitempty"`
+	Seed               *int            `json:"seed,omitempty"`
+	PresencePenalty    *float64        `json:"presencePenalty,omitempty"`
+	FrequencyPenalty   *float64        `json:"frequencyPenalty,omitempty"`
+}
+
+// GenerateContentResponse is response of generateContent and every event of streamGenerateContent
+type GenerateContentResponse struct {
+	Candidates     []Candidate     `json:"candidates,omitempty"`
+	PromptFeedback *PromptFeedback `json:"promptFeedback,omitempty"`
+	UsageMetadata  *UsageMetadata  `json:"usageMetadata,omitempty"`
+	ModelVersion   string          `json:"modelVersion,omitempty"`
+	ResponseID     string          `json:"responseId,omitempty"`
+}
+
+// Candidate is generated response, finish reason is set on the last event of stream
+type Candidate struct {
+	Content      Content `json:"content"`
+	FinishReason string  `json:"finishReason,omitempty"`
+	Index        int     `json:"index"`
+}
+
+// PromptFeedback tells if prompt is blocked
+type PromptFeedback struct {
+	BlockReason string `json:"blockReason,omitempty"`
+}
+
+// UsageMetadata is token counts of request and response
+type UsageMetadata struct {
+	PromptTokenCount     int `json:"promptTokenCount"`
+	CandidatesTokenCount int `json:"candidatesTokenCount"`
+	TotalTokenCount      int `json:"totalTokenCount"`
+}
+
+// Text returns text of content without thoughts
+func (c Content) Text() string {
+	res := ""
+	for _, p := range c.Parts {
+		if !p.Thought {
+			res += p.Text
+		}
+	}
+	return res
+}
+
+// ParseEvent parses "data:" line of streamGenerateContent SSE stream, it returns false for other lines
+func ParseEvent(line []byte) (GenerateContentResponse, bool) {
+	data, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:"))
+	if !ok {
+		return GenerateContentResponse{}, false
+	}
+	var resp GenerateContentResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return GenerateContentResponse{}, false
+	}
+	return resp, true
+}
+
+// EmbedContentRequest is body of embedContent method and item of batchEmbedContents, model is required in batch only
+type EmbedContentRequest struct {
+	Model                string  `json:"model,omitempty"`
+	Content              Content `json:"content"`
+	TaskType             string  `json:"taskType,omitempty"`
+	OutputDimensionality *int    `json:"outputDimensionality,omitempty"`
+}
+
+// BatchEmbedContentsRequest is body of batchEmbedContents method
+type BatchEmbedContentsRequest struct {
+	Requests []EmbedContentRequest `json:"requests"`
+}
+
+// ContentEmbedding is embedding vector of content
+type ContentEmbedding struct {
+	Values []float64 `json:"values"`
+}
+
+// EmbedContentResponse is response of embedContent method
+type EmbedContentResponse struct {
+	Embedding     ContentEmbedding `json:"embedding"`
+	UsageMetadata *UsageMetadata   `json:"usageMetadata,omitempty"`
+}
+
+// BatchEmbedContentsResponse is response of batchEmbedContents method, embeddings are in order of requests
+type BatchEmbedContentsResponse struct {
+	Embeddings    []ContentEmbedding `json:"embeddings"`
+	UsageMetadata *UsageMetadata     `json:"usageMetadata,omitempty"`
+}
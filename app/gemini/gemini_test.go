@@ -0,0 +1,28 @@
+package gemini
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseEvent(t *testing.T) {
+	resp, ok := ParseEvent([]byte(`data: {"candidates":[{"content":{"role":"model","parts":[{"text":"hi"}]},` +
+		`"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":1,"candidatesTokenCount":2,"totalTokenCount":3}}` + "\r\n"))
+	require.True(t, ok)
+	require.Len(t, resp.Candidates, 1)
+	assert.Equal(t, "hi", resp.Candidates[0].Content.Text())
+	assert.Equal(t, FinishStop, resp.Candidates[0].FinishReason)
+	assert.Equal(t, &UsageMetadata{PromptTokenCount: 1, CandidatesTokenCount: 2, TotalTokenCount: 3}, resp.UsageMetadata)
+
+	_, ok = ParseEvent([]byte("\r\n"))
+	assert.False(t, ok)
+	_, ok = ParseEvent([]byte("data: [DONE]\n"))
+	assert.False(t, ok)
+}
+
+func TestContent_Text(t *testing.T) {
+	c := Content{Parts: []Part{{Text: "thinking", Thought: true}, {Text: "a"}, {FunctionCall: &FunctionCall{Name: "f"}}, {Text: "b"}}}
+	assert.Equal(t, "ab", c.Text())
+}
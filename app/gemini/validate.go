@@ -0,0 +1,181 @@
+package gemini
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// Limits restricts size of request, zero value means no limit
+type Limits struct {
+	MaxBodySize   int64 // bytes of request body
+	MaxParts      int   // parts of all contents including system instruction
+	MaxInlineData int64 // decoded bytes of all inline data
+}
+
+// FieldError is problem of request field, field is json path like contents[0].parts[1].inlineData
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError is list of field problems of request
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	res := make([]string, 0, len(e))
+	for _, f := range e {
+		res = append(res, f.Field+": "+f.Message)
+	}
+	return strings.Join(res, "; ")
+}
+
+// harm block thresholds accepted by Gemini
+var thresholds = map[string]bool{"HARM_BLOCK_THRESHOLD_UNSPECIFIED": true, "BLOCK_LOW_AND_ABOVE": true,
+	"BLOCK_MEDIUM_AND_ABOVE": true, "BLOCK_ONLY_HIGH": true, "BLOCK_NONE": true, "OFF": true}
+
+// validator collects field errors and counts parts and inline data against limits
+type validator struct {
+	limits     Limits
+	errs       ValidationError
+	parts      int
+	inlineData int64
+}
+
+func (v *validator) add(field, format string, args ...any) {
+	v.errs = append(v.errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) result() error {
+	if v.limits.MaxParts > 0 && v.parts > v.limits.MaxParts {
+		v.add("contents", "has %d parts, limit is %d", v.parts, v.limits.MaxParts)
+	}
+	if v.limits.MaxInlineData > 0 && v.inlineData > v.limits.MaxInlineData {
+		v.add("contents", "has %d bytes of inline data, limit is %d", v.inlineData, v.limits.MaxInlineData)
+	}
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+// Validate checks required fields and ranges of generation options, it returns ValidationError
+func (r GenerateContentRequest) Validate(limits Limits) error {
+	v := &validator{limits: limits}
+	if len(r.Contents) == 0 {
+		v.add("contents", "is required")
+	}
+	for i, c := range r.Contents {
+		v.content(fmt.Sprintf("contents[%d]", i), c)
+	}
+	if r.SystemInstruction != nil {
+		v.content("systemInstruction", *r.SystemInstruction)
+	}
+	for i, t := range r.Tools {
+		for j, f := range t.FunctionDeclarations {
+			if f.Name == "" {
+				v.add(fmt.Sprintf("tools[%d].functionDeclarations[%d].name", i, j), "is required")
+			}
+		}
+	}
+	for i, s := range r.SafetySettings {
+		field := fmt.Sprintf("safetySettings[%d]", i)
+		if !strings.HasPrefix(s.Category, "HARM_CATEGORY_") {
+			v.add(field+".category", "should be harm category, got %q", s.Category)
+		}
+		if !thresholds[s.Threshold] {
+			v.add(field+".threshold", "should be harm block threshold, got %q", s.Threshold)
+		}
+	}
+	if r.GenerationConfig != nil {
+		v.generationConfig(*r.GenerationConfig)
+	}
+	return v.result()
+}
+
+// Validate checks content of embedContent request, it returns ValidationError
+func (r EmbedContentRequest) Validate(limits Limits) error {
+	v := &validator{limits: limits}
+	v.content("content", r.Content)
+	v.dimensionality("outputDimensionality", r.OutputDimensionality)
+	return v.result()
+}
+
+// Validate checks every request of batchEmbedContents, limits apply to all requests together
+func (r BatchEmbedContentsRequest) Validate(limits Limits) error {
+	v := &validator{limits: limits}
+	if len(r.Requests) == 0 {
+		v.add("requests", "is required")
+	}
+	for i, req := range r.Requests {
+		field := fmt.Sprintf("requests[%d]", i)
+		if req.Model == "" {
+			v.add(field+".model", "is required")
+		}
+		v.content(field+".content", req.Content)
+		v.dimensionality(field+".outputDimensionality", req.OutputDimensionality)
+	}
+	return v.result()
+}
+
+func (v *validator) content(field string, c Content) {
+	if c.Role != "" && c.Role != RoleUser && c.Role != RoleModel {
+		v.add(field+".role", "should be %s or %s, got %q", RoleUser, RoleModel, c.Role)
+	}
+	if len(c.Parts) == 0 {
+		v.add(field+".parts", "is required")
+	}
+	v.parts += len(c.Parts)
+	for i, p := range c.Parts {
+		v.part(fmt.Sprintf("%s.parts[%d]", field, i), p)
+	}
+}
+
+func (v *validator) part(field string, p Part) {
+	if p.InlineData != nil {
+		if p.InlineData.MimeType == "" {
+			v.add(field+".inlineData.mimeType", "is required")
+		}
+		data, err := base64.StdEncoding.DecodeString(p.InlineData.Data)
+		if err != nil {
+			v.add(field+".inlineData.data", "should be base64 encoded")
+		}
+		v.inlineData += int64(len(data))
+	}
+	if p.FileData != nil && p.FileData.FileURI == "" {
+		v.add(field+".fileData.fileUri", "is required")
+	}
+	if p.FunctionCall != nil && p.FunctionCall.Name == "" {
+		v.add(field+".functionCall.name", "is required")
+	}
+	if p.FunctionResponse != nil && p.FunctionResponse.Name == "" {
+		v.add(field+".functionResponse.name", "is required")
+	}
+}
+
+func (v *validator) generationConfig(c GenerationConfig) {
+	if c.Temperature != nil && (*c.Temperature < 0 || *c.Temperature > 2) {
+		v.add("generationConfig.temperature", "should be between 0 and 2, got %v", *c.Temperature)
+	}
+	if c.TopP != nil && (*c.TopP < 0 || *c.TopP > 1) {
+		v.add("generationConfig.topP", "should be between 0 and 1, got %v", *c.TopP)
+	}
+	if c.TopK != nil && *c.TopK < 1 {
+		v.add("generationConfig.topK", "should be positive, got %d", *c.TopK)
+	}
+	if c.CandidateCount != nil && *c.CandidateCount < 1 {
+		v.add("generationConfig.candidateCount", "should be positive, got %d", *c.CandidateCount)
+	}
+	if c.MaxOutputTokens != nil && *c.MaxOutputTokens < 1 {
+		v.add("generationConfig.maxOutputTokens", "should be positive, got %d", *c.MaxOutputTokens)
+	}
+	if len(c.StopSequences) > 5 {
+		v.add("generationConfig.stopSequences", "should have up to 5 sequences, got %d", len(c.StopSequences))
+	}
+}
+
+func (v *validator) dimensionality(field string, d *int) {
+	if d != nil && *d < 1 {
+		v.add(field, "should be positive, got %d", *d)
+	}
+}
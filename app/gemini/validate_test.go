@@ -0,0 +1,92 @@
+package gemini
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateContentRequest_Validate(t *testing.T) {
+	tbl := []struct {
+		name   string
+		body   string
+		limits Limits
+		errs   ValidationError
+	}{
+		{name: "valid", body: `{"contents":[{"role":"user","parts":[{"text":"hi"},{"inlineData":{"mimeType":"image/png","data":"aGVsbG8="}}]}],
+			"systemInstruction":{"parts":[{"text":"be brief"}]},"safetySettings":[{"category":"HARM_CATEGORY_HARASSMENT","threshold":"BLOCK_NONE"}],
+			"tools":[{"functionDeclarations":[{"name":"f"}]}],"generationConfig":{"temperature":0.5,"topP":1,"maxOutputTokens":10}}`},
+		{name: "no contents", body: `{}`, errs: ValidationError{{Field: "contents", Message: "is required"}}},
+		{name: "bad content", body: `{"contents":[{"role":"system","parts":[]},{"parts":[{"inlineData":{"data":"!"}},
+			{"fileData":{}},{"functionCall":{}},{"functionResponse":{"response":{}}}]}]}`,
+			errs: ValidationError{
+				{Field: "contents[0].role", Message: `should be user or model, got "system"`},
+				{Field: "contents[0].parts", Message: "is required"},
+				{Field: "contents[1].parts[0].inlineData.mimeType", Message: "is required"},
+				{Field: "contents[1].parts[0].inlineData.data", Message: "should be base64 encoded"},
+				{Field: "contents[1].parts[1].fileData.fileUri", Message: "is required"},
+				{Field: "contents[1].parts[2].functionCall.name", Message: "is required"},
+				{Field: "contents[1].parts[3].functionResponse.name", Message: "is required"},
+			}},
+		{name: "bad options", body: `{"contents":[{"parts":[{"text":"hi"}]}],"tools":[{"functionDeclarations":[{"description":"d"}]}],
+			"safetySettings":[{"category":"VIOLENCE","threshold":"BLOCK_SOME"}],
+			"generationConfig":{"temperature":2.5,"topP":-1,"topK":0,"candidateCount":0,"maxOutputTokens":0,"stopSequences":["1","2","3","4","5","6"]}}`,
+			errs: ValidationError{
+				{Field: "tools[0].functionDeclarations[0].name", Message: "is required"},
+				{Field: "safetySettings[0].category", Message: `should be harm category, got "VIOLENCE"`},
+				{Field: "safetySettings[0].threshold", Message: `should be harm block threshold, got "BLOCK_SOME"`},
+				{Field: "generationConfig.temperature", Message: "should be between 0 and 2, got 2.5"},
+				{Field: "generationConfig.topP", Message: "should be between 0 and 1, got -1"},
+				{Field: "generationConfig.topK", Message: "should be positive, got 0"},
+				{Field: "generationConfig.candidateCount", Message: "should be positive, got 0"},
+				{Field: "generationConfig.maxOutputTokens", Message: "should be positive, got 0"},
+				{Field: "generationConfig.stopSequences", Message: "should have up to 5 sequences, got 6"},
+			}},
+		{name: "over limits", body: `{"contents":[{"parts":[{"text":"a"},{"inlineData":{"mimeType":"text/plain","data":"aGVsbG8="}}]}],
+			"systemInstruction":{"parts":[{"text":"b"}]}}`, limits: Limits{MaxParts: 2, MaxInlineData: 4},
+			errs: ValidationError{
+				{Field: "contents", Message: "has 3 parts, limit is 2"},
+				{Field: "contents", Message: "has 5 bytes of inline data, limit is 4"},
+			}},
+		{name: "within limits", body: `{"contents":[{"parts":[{"text":"a"},{"inlineData":{"mimeType":"text/plain","data":"aGVsbG8="}}]}]}`,
+			limits: Limits{MaxParts: 2, MaxInlineData: 5}},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			var req GenerateContentRequest
+			require.NoError(t, json.Unmarshal([]byte(tt.body), &req))
+			err := req.Validate(tt.limits)
+			if tt.errs == nil {
+				assert.NoError(t, err)
+				return
+			}
+			var ve ValidationError
+			require.ErrorAs(t, err, &ve)
+			assert.Equal(t, tt.errs, ve)
+		})
+	}
+}
+
+func TestEmbedContentRequest_Validate(t *testing.T) {
+	dim := 0
+	err := EmbedContentRequest{OutputDimensionality: &dim}.Validate(Limits{})
+	assert.EqualError(t, err, "content.parts: is required; outputDimensionality: should be positive, got 0")
+
+	err = EmbedContentRequest{Content: Content{Parts: []Part{{Text: "a"}}}}.Validate(Limits{})
+	assert.NoError(t, err)
+}
+
+func TestBatchEmbedContentsRequest_Validate(t *testing.T) {
+	err := BatchEmbedContentsRequest{}.Validate(Limits{})
+	assert.EqualError(t, err, "requests: is required")
+
+	req := BatchEmbedContentsRequest{Requests: []EmbedContentRequest{
+		{Model: "models/text-embedding-004", Content: Content{Parts: []Part{{Text: "a"}}}},
+		{Content: Content{Parts: []Part{{Text: "b"}}}},
+	}}
+	assert.EqualError(t, req.Validate(Limits{}), "requests[1].model: is required")
+	assert.EqualError(t, req.Validate(Limits{MaxParts: 1}), "requests[1].model: is required; contents: has 2 parts, limit is 1")
+}
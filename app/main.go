@@ -8,6 +8,7 @@ import (
 	"os/signal"
 	"runtime"
 	"syscall"
+	"time"
 
 	"github.com/hashicorp/logutils"
 	"github.com/jessevdk/go-flags"
@@ -18,10 +19,15 @@ var version = "unknown"
 
 // Opts structure represent options to start application
 type Opts struct {
-	ServerCmd cmd.ServerCmd `command:"server"`
-	Config    struct {
-		Enabled  bool   `long:"enabled" env:"ENABLED" description:"enable getting parameters from config. In that case all parameters will be read only form config"`
-		FileName string `long:"file-name" env:"FILE_NAME" default:"gemini-proxy.yml" description:"config file name"`
+	ServerCmd  cmd.ServerCmd  `command:"server"`
+	HashKeyCmd cmd.HashKeyCmd `command:"hash-key" description:"print hash of proxy key for clients section of config"`
+	ConfigCmd  struct {
+		Check cmd.ConfigCheckCmd `command:"check" description:"validate config file and print effective options"`
+	} `command:"config" description:"config file tools"`
+	Config struct {
+		Enabled  bool          `long:"enabled" env:"ENABLED" description:"enable getting parameters from config, env and flags take precedence over config"`
+		FileName string        `long:"file-name" env:"FILE_NAME" default:"gemini-proxy.yml" description:"config file name"`
+		Watch    time.Duration `long:"watch" env:"WATCH" default:"0s" description:"interval of config file check, changed file is reloaded, 0 disables it. SIGHUP reloads config anyway"`
 	} `group:"config" namespace:"config" env-namespace:"CONFIG"`
 }
 
@@ -37,27 +43,23 @@ func parseFlags() {
 	p.CommandHandler = func(command flags.Commander, args []string) error {
 		c := command.(cmd.ServerCommand)
 
-		var cnf *config.Config
-		if opts.Config.Enabled {
-			cnf = &config.Config{
-				FileName: opts.Config.FileName,
-			}
+		if check, ok := command.(*cmd.ConfigCheckCmd); ok {
+			check.Config = newConfig(p)
 		}
 
 		if opts.Config.Enabled {
-			var err error
-			var co *config.CommonOpts
-
-			if co, err = cnf.GetCommon(); err != nil {
-				panic(fmt.Errorf("[ERROR] can not read config file, %w", err))
+			cnf := newConfig(p)
+			co, err := cnf.GetCommon()
+			if err != nil {
+				return fmt.Errorf("can not read config file: %w", err)
+			}
+			for _, w := range cnf.Warnings {
+				log.Printf("[WARN] config %s, %s", cnf.FileName, w)
 			}
-			opts.ServerCmd.GeminiAPIKey = co.GeminiAPIKey
-			opts.ServerCmd.DelayRequests = co.DelayRequests
-			opts.ServerCmd.TLS.Enabled = co.TLS.Enabled
-			opts.ServerCmd.TLS.CertPath = co.TLS.CertPath
-			opts.ServerCmd.TLS.PrivateKeyPath = co.TLS.PrivateKeyPath
-			opts.ServerCmd.Debug = co.Debug
+			opts.ServerCmd.CommonOpts = *co
 			opts.ServerCmd.Version = version
+			opts.ServerCmd.Config = cnf
+			opts.ServerCmd.ConfigWatch = opts.Config.Watch
 		}
 
 		setupLogLevel(opts.ServerCmd.Debug)
@@ -76,6 +78,40 @@ func parseFlags() {
 	}
 }
 
+// newConfig makes config file resolved over options of server command parsed from defaults, env and flags
+func newConfig(p *flags.Parser) *config.Config {
+	return &config.Config{
+		FileName: opts.Config.FileName,
+		Base:     opts.ServerCmd.CommonOpts,
+		Explicit: explicitOptions(p.Find("server")),
+	}
+}
+
+// explicitOptions returns options of command set by flags or env, by name with namespace, e.g. cache.ttl
+func explicitOptions(c *flags.Command) map[string]config.Source {
+	res := map[string]config.Source{}
+	var walk func(g *flags.Group)
+	walk = func(g *flags.Group) {
+		for _, o := range g.Options() {
+			// defaults and env values are set as defaults by go-flags
+			if o.IsSet() && !o.IsSetDefault() {
+				res[o.LongNameWithNamespace()] = config.SourceFlag
+				continue
+			}
+			if key := o.EnvKeyWithNamespace(); key != "" {
+				if _, ok := os.LookupEnv(key); ok {
+					res[o.LongNameWithNamespace()] = config.SourceEnv
+				}
+			}
+		}
+		for _, sub := range g.Groups() {
+			walk(sub)
+		}
+	}
+	walk(c.Group)
+	return res
+}
+
 func setupLogLevel(debug bool) {
 	filter := &logutils.LevelFilter{
 		Levels:   []logutils.LogLevel{"DEBUG", "INFO", "WARN", "ERROR"},
@@ -102,7 +138,7 @@ func getStackTrace() string {
 }
 
 func init() {
-	sigChan := make(chan os.Signal)
+	sigChan := make(chan os.Signal, 1)
 	go func() {
 		for range sigChan {
 			log.Printf("[INFO] Singal QUITE is cought , stacktrace [\n%s", getStackTrace())
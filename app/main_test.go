@@ -3,8 +3,10 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"github.com/jessevdk/go-flags"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/theshamuel/gemini-proxy/app/config"
 	"go.uber.org/goleak"
 	"io/ioutil"
 	"log"
@@ -102,3 +104,18 @@ func captureStdout(f func()) string {
 	f()
 	return buf.String()
 }
+
+func TestExplicitOptions(t *testing.T) {
+	t.Setenv("CACHE_MAX_ENTRIES", "5")
+	var o Opts
+	p := flags.NewParser(&o, flags.Default)
+	p.CommandHandler = func(flags.Commander, []string) error { return nil }
+	_, err := p.ParseArgs([]string{"server", "--cache.ttl=1m", "--geminiAPIKey=key"})
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]config.Source{
+		"cache.ttl":         config.SourceFlag,
+		"geminiAPIKey":      config.SourceFlag,
+		"cache.max-entries": config.SourceEnv,
+	}, explicitOptions(p.Find("server")))
+}
@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+)
+
+// durationBuckets are upper bounds in seconds, Gemini calls take from fraction of second to minutes
+var durationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120}
+
+// Metrics is set of proxy and upstream metrics, all methods are no-op on nil Metrics
+type Metrics struct {
+	*Registry
+	requests         *Counter
+	requestDuration  *Histogram
+	inFlight         *Gauge
+	upstreamDuration *Histogram
+	upstreamErrors   *Counter
+	retries          *Counter
+	tokens           *Counter
+}
+
+// New makes Metrics with all proxy metrics registered
+func New() *Metrics {
+	r := NewRegistry()
+	return &Metrics{
+		Registry: r,
+		requests: r.NewCounter("gemini_proxy_requests_total",
+			"Requests handled by proxy.", "route", "model", "client", "status"),
+		requestDuration: r.NewHistogram("gemini_proxy_request_duration_seconds",
+			"Time to handle request by proxy.", durationBuckets, "route", "model", "client", "status"),
+		inFlight: r.NewGauge("gemini_proxy_requests_in_flight",
+			"Requests being handled by proxy."),
+		upstreamDuration: r.NewHistogram("gemini_proxy_upstream_duration_seconds",
+			"Time of single call to Gemini until response headers.", durationBuckets, "model", "method", "status"),
+		upstreamErrors: r.NewCounter("gemini_proxy_upstream_errors_total",
+			"Failed calls to Gemini by error class.", "model", "method", "class"),
+		retries: r.NewCounter("gemini_proxy_upstream_retries_total",
+			"Repeated calls to Gemini by reason.", "model", "reason"),
+		tokens: r.NewCounter("gemini_proxy_tokens_total",
+			"Tokens reported by Gemini in usageMetadata.", "model", "client", "type"),
+	}
+}
+
+// RequestStarted counts request in flight, returned function should be called when request is done
+func (m *Metrics) RequestStarted() func() {
+	if m == nil {
+		return func() {}
+	}
+	m.inFlight.Add(1)
+	return func() { m.inFlight.Add(-1) }
+}
+
+// ObserveRequest records handled request
+func (m *Metrics) ObserveRequest(route, model, client string, status int, d time.Duration) {
+	if m == nil {
+		return
+	}
+	code := strconv.Itoa(status)
+	m.requests.Inc(route, model, clientName(client), code)
+	m.requestDuration.Observe(d.Seconds(), route, model, clientName(client), code)
+}
+
+// ObserveUpstream records single call to Gemini, status is zero when no response came
+// and class is empty for successful call
+func (m *Metrics) ObserveUpstream(model, method string, status int, class string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	code := "none"
+	if status > 0 {
+		code = strconv.Itoa(status)
+	}
+	m.upstreamDuration.Observe(d.Seconds(), model, method, code)
+	if class != "" {
+		m.upstreamErrors.Inc(model, method, class)
+	}
+}
+
+// Retry records repeated call to Gemini
+func (m *Metrics) Retry(model, reason string) {
+	if m == nil {
+		return
+	}
+	m.retries.Inc(model, reason)
+}
+
+// Tokens records usage reported by Gemini
+func (m *Metrics) Tokens(model, client string, prompt, candidates int64) {
+	if m == nil {
+		return
+	}
+	m.tokens.Add(float64(prompt), model, clientName(client), "prompt")
+	m.tokens.Add(float64(candidates), model, clientName(client), "candidates")
+}
+
+// clientName labels requests without authenticated client as anonymous
+func clientName(client string) string {
+	if client == "" {
+		return "anonymous"
+	}
+	return client
+}
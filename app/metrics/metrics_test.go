@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	m := New()
+	done := m.RequestStarted()
+	m.ObserveRequest("/api/*", "gemini-2.5-pro", "", 200, 300*time.Millisecond)
+	m.ObserveUpstream("gemini-2.5-pro", "generateContent", 429, "rate_limit", 100*time.Millisecond)
+	m.ObserveUpstream("gemini-2.5-pro", "generateContent", 0, "network", time.Second)
+	m.Retry("gemini-2.5-pro", "rate_limit")
+	m.Tokens("gemini-2.5-pro", "alice", 10, 20)
+
+	var buf bytes.Buffer
+	require.NoError(t, m.Expose(&buf))
+	out := buf.String()
+	assert.Contains(t, out, `gemini_proxy_requests_total{route="/api/*",model="gemini-2.5-pro",client="anonymous",status="200"} 1`)
+	assert.Contains(t, out, `gemini_proxy_request_duration_seconds_bucket{route="/api/*",model="gemini-2.5-pro",client="anonymous",status="200",le="0.5"} 1`)
+	assert.Contains(t, out, "gemini_proxy_requests_in_flight 1\n")
+	assert.Contains(t, out, `gemini_proxy_upstream_duration_seconds_count{model="gemini-2.5-pro",method="generateContent",status="429"} 1`)
+	assert.Contains(t, out, `gemini_proxy_upstream_duration_seconds_count{model="gemini-2.5-pro",method="generateContent",status="none"} 1`)
+	assert.Contains(t, out, `gemini_proxy_upstream_errors_total{model="gemini-2.5-pro",method="generateContent",class="network"} 1`)
+	assert.Contains(t, out, `gemini_proxy_upstream_retries_total{model="gemini-2.5-pro",reason="rate_limit"} 1`)
+	assert.Contains(t, out, `gemini_proxy_tokens_total{model="gemini-2.5-pro",client="alice",type="prompt"} 10`)
+	assert.Contains(t, out, `gemini_proxy_tokens_total{model="gemini-2.5-pro",client="alice",type="candidates"} 20`)
+
+	done()
+	buf.Reset()
+	require.NoError(t, m.Expose(&buf))
+	assert.Contains(t, buf.String(), "gemini_proxy_requests_in_flight 0\n")
+}
+
+func TestMetrics_Nil(t *testing.T) {
+	var m *Metrics
+	assert.NotPanics(t, func() {
+		m.RequestStarted()()
+		m.ObserveRequest("/api/*", "", "", 200, time.Second)
+		m.ObserveUpstream("m", "generateContent", 200, "", time.Second)
+		m.Retry("m", "network")
+		m.Tokens("m", "", 1, 1)
+	})
+}
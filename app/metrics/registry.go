@@ -0,0 +1,259 @@
+// Package metrics implements counters, gauges and histograms exposed in Prometheus text format,
+// see https://prometheus.io/docs/instrumenting/exposition_formats/#text-based-format
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry keeps metrics and writes them in Prometheus text format
+type Registry struct {
+	lock    sync.Mutex
+	metrics []metric
+	names   map[string]bool
+}
+
+type metric interface {
+	write(w io.Writer) error
+}
+
+// series is one combination of label values of metric
+type series struct {
+	labels []string
+	value  float64
+	counts []uint64 // histogram buckets
+	sum    float64  // histogram sum
+	count  uint64   // histogram observations
+}
+
+// vec is metric with labels
+type vec struct {
+	name, help, kind string
+	labels           []string
+	buckets          []float64
+	lock             sync.Mutex
+	series           map[string]*series
+}
+
+// Counter is monotonically increasing metric
+type Counter struct{ vec }
+
+// Gauge is metric which can go up and down
+type Gauge struct{ vec }
+
+// Histogram counts observations in buckets
+type Histogram struct{ vec }
+
+// valueFunc is metric without labels which value is taken on every scrape
+type valueFunc struct {
+	name, help, kind string
+	fn               func() float64
+}
+
+// NewRegistry makes empty registry
+func NewRegistry() *Registry {
+	return &Registry{names: map[string]bool{}}
+}
+
+// NewCounter registers counter with label names
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{vec: newVec(name, help, "counter", labels, nil)}
+	r.register(name, c)
+	return c
+}
+
+// NewGauge registers gauge with label names
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{vec: newVec(name, help, "gauge", labels, nil)}
+	r.register(name, g)
+	return g
+}
+
+// NewHistogram registers histogram with upper bounds of buckets and label names
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	b := append([]float64{}, buckets...)
+	sort.Float64s(b)
+	h := &Histogram{vec: newVec(name, help, "histogram", labels, b)}
+	r.register(name, h)
+	return h
+}
+
+// NewGaugeFunc registers gauge without labels which value is returned by fn on every scrape
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(name, &valueFunc{name: name, help: help, kind: "gauge", fn: fn})
+}
+
+// NewCounterFunc registers counter without labels which value is returned by fn on every scrape,
+// it's for counters kept by other components
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	r.register(name, &valueFunc{name: name, help: help, kind: "counter", fn: fn})
+}
+
+// ServeHTTP writes all metrics in Prometheus text format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := r.Expose(w); err != nil {
+		log.Printf("[WARN] can not write metrics: %v", err)
+	}
+}
+
+// Expose writes all metrics in Prometheus text format
+func (r *Registry) Expose(w io.Writer) error {
+	r.lock.Lock()
+	metrics := append([]metric{}, r.metrics...)
+	r.lock.Unlock()
+	for _, m := range metrics {
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Registry) register(name string, m metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metric %s is already registered", name))
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// Add increases counter by v, negative values are ignored
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		return
+	}
+	c.with(labelValues, func(s *series) { s.value += v })
+}
+
+// Inc increases counter by 1
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Set sets gauge value
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.with(labelValues, func(s *series) { s.value = v })
+}
+
+// Add changes gauge by v
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.with(labelValues, func(s *series) { s.value += v })
+}
+
+// Observe adds observation to histogram
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.with(labelValues, func(s *series) {
+		for i, b := range h.buckets {
+			if v <= b {
+				s.counts[i]++
+			}
+		}
+		s.sum += v
+		s.count++
+	})
+}
+
+func newVec(name, help, kind string, labels []string, buckets []float64) vec {
+	return vec{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: map[string]*series{}}
+}
+
+func (v *vec) with(labelValues []string, fn func(s *series)) {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", v.name, len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labels: append([]string{}, labelValues...), counts: make([]uint64, len(v.buckets))}
+		v.series[key] = s
+	}
+	fn(s)
+}
+
+func (v *vec) write(w io.Writer) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, escapeHelp(v.help), v.name, v.kind); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := v.series[k]
+		if v.kind != "histogram" {
+			if _, err := fmt.Fprintf(w, "%s%s %s\n", v.name, v.labelPairs(s.labels, ""), formatFloat(s.value)); err != nil {
+				return err
+			}
+			continue
+		}
+		for i, b := range v.buckets {
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.labelPairs(s.labels, formatFloat(b)), s.counts[i]); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			v.name, v.labelPairs(s.labels, "+Inf"), s.count,
+			v.name, v.labelPairs(s.labels, ""), formatFloat(s.sum),
+			v.name, v.labelPairs(s.labels, ""), s.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// labelPairs formats labels as {name="value",...}, le is added for histogram buckets
+func (v *vec) labelPairs(values []string, le string) string {
+	pairs := make([]string, 0, len(values)+1)
+	for i, l := range v.labels {
+		pairs = append(pairs, l+`="`+escapeLabel(values[i])+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (f *valueFunc) write(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", f.name, escapeHelp(f.help), f.name, f.kind, f.name,
+		formatFloat(f.fn()))
+	return err
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry_Expose(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_requests_total", "Requests.", "route", "status")
+	g := r.NewGauge("test_in_flight", "In flight.")
+	h := r.NewHistogram("test_duration_seconds", "Duration.", []float64{1, 0.5}, "route")
+	r.NewGaugeFunc("test_queued", "Queued.", func() float64 { return 3 })
+	r.NewCounterFunc("test_hits_total", "Hits.", func() float64 { return 7 })
+
+	c.Inc("/api/*", "200")
+	c.Add(2, "/api/*", "200")
+	c.Add(-1, "/api/*", "200")
+	c.Inc(`/a"b\c`, "500")
+	g.Add(2)
+	g.Add(-1)
+	h.Observe(0.3, "/api/*")
+	h.Observe(0.7, "/api/*")
+	h.Observe(5, "/api/*")
+
+	var buf bytes.Buffer
+	require.NoError(t, r.Expose(&buf))
+	assert.Equal(t, `# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{route="/a\"b\\c",status="500"} 1
+test_requests_total{route="/api/*",status="200"} 3
+# HELP test_in_flight In flight.
+# TYPE test_in_flight gauge
+test_in_flight 1
+# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{route="/api/*",le="0.5"} 1
+test_duration_seconds_bucket{route="/api/*",le="1"} 2
+test_duration_seconds_bucket{route="/api/*",le="+Inf"} 3
+test_duration_seconds_sum{route="/api/*"} 6
+test_duration_seconds_count{route="/api/*"} 3
+# HELP test_queued Queued.
+# TYPE test_queued gauge
+test_queued 3
+# HELP test_hits_total Hits.
+# TYPE test_hits_total counter
+test_hits_total 7
+`, buf.String())
+}
+
+func TestRegistry_Misuse(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "Test.", "label")
+	assert.Panics(t, func() { c.Inc() }, "label value is missing")
+	assert.Panics(t, func() { r.NewGauge("test_total", "Test.") }, "name is taken")
+}
+
+func TestRegistry_ServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "Test.").Inc()
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), "test_total 1\n")
+}
@@ -0,0 +1,554 @@
+// Package openai translates OpenAI API requests into Gemini requests and Gemini responses back,
+// see https://platform.openai.com/docs/api-reference/chat
+package openai
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/theshamuel/gemini-proxy/app/gemini"
+)
+
+// ChatRequest is body of chat/completions request, fields Gemini can't handle are ignored
+type ChatRequest struct {
+	Model               string          `json:"model"`
+	Messages            []Message       `json:"messages"`
+	Temperature         *float64        `json:"temperature,omitempty"`
+	TopP                *float64        `json:"top_p,omitempty"`
+	N                   *int            `json:"n,omitempty"`
+	MaxTokens           *int            `json:"max_tokens,omitempty"`
+	MaxCompletionTokens *int            `json:"max_completion_tokens,omitempty"`
+	Stop                StringList      `json:"stop,omitempty"`
+	Seed                *int            `json:"seed,omitempty"`
+	PresencePenalty     *float64        `json:"presence_penalty,omitempty"`
+	FrequencyPenalty    *float64        `json:"frequency_penalty,omitempty"`
+	Tools               []Tool          `json:"tools,omitempty"`
+	ToolChoice          json.RawMessage `json:"tool_choice,omitempty"`
+	ResponseFormat      *ResponseFormat `json:"response_format,omitempty"`
+	Stream              bool            `json:"stream,omitempty"`
+	StreamOptions       *StreamOptions  `json:"stream_options,omitempty"`
+}
+
+// Message is chat message, content is string or list of parts
+type Message struct {
+	Role       string         `json:"role"`
+	Content    MessageContent `json:"content"`
+	Name       string         `json:"name,omitempty"`
+	ToolCalls  []ToolCall     `json:"tool_calls,omitempty"`
+	ToolCallID string         `json:"tool_call_id,omitempty"`
+}
+
+// MessageContent is list of content parts, plain string content is a single text part
+type MessageContent []ContentPart
+
+// ContentPart is text or image part of message
+type ContentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+// ImageURL is image given by URL or data URL with base64 data
+type ImageURL struct {
+	URL string `json:"url"`
+}
+
+// StringList is list of strings which accepts single string as well
+type StringList []string
+
+// Tool is function the model may call
+type Tool struct {
+	Type     string   `json:"type"`
+	Function Function `json:"function"`
+}
+
+// Function is declaration of function with parameters in JSON schema
+type Function struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// ToolCall is call of function made by the model, arguments are JSON encoded object
+type ToolCall struct {
+	Index    *int         `json:"index,omitempty"`
+	ID       string       `json:"id,omitempty"`
+	Type     string       `json:"type,omitempty"`
+	Function FunctionCall `json:"function"`
+}
+
+// FunctionCall is name and arguments of called function
+type FunctionCall struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+// ResponseFormat requests json output, optionally with JSON schema
+type ResponseFormat struct {
+	Type       string      `json:"type"`
+	JSONSchema *JSONSchema `json:"json_schema,omitempty"`
+}
+
+// JSONSchema is named schema of json output
+type JSONSchema struct {
+	Name   string          `json:"name,omitempty"`
+	Schema json.RawMessage `json:"schema,omitempty"`
+}
+
+// StreamOptions asks to send usage in the last chunk of stream
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// ChatResponse is chat.completion object
+type ChatResponse struct {
+	ID      string   `json:"id"`
+	Object  string   `json:"object"`
+	Created int64    `json:"created"`
+	Model   string   `json:"model"`
+	Choices []Choice `json:"choices"`
+	Usage   *Usage   `json:"usage,omitempty"`
+}
+
+// Choice is one of generated messages
+type Choice struct {
+	Index        int             `json:"index"`
+	Message      ResponseMessage `json:"message"`
+	FinishReason string          `json:"finish_reason"`
+}
+
+// ResponseMessage is message generated by the model, content is null if the model only calls tools
+type ResponseMessage struct {
+	Role      string     `json:"role,omitempty"`
+	Content   *string    `json:"content,omitempty"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+}
+
+// ChatChunk is chat.completion.chunk object of stream
+type ChatChunk struct {
+	ID      string        `json:"id"`
+	Object  string        `json:"object"`
+	Created int64         `json:"created"`
+	Model   string        `json:"model"`
+	Choices []ChunkChoice `json:"choices"`
+	Usage   *Usage        `json:"usage,omitempty"`
+}
+
+// ChunkChoice is delta of generated message, finish reason is set in the last chunk of the choice
+type ChunkChoice struct {
+	Index        int             `json:"index"`
+	Delta        ResponseMessage `json:"delta"`
+	FinishReason *string         `json:"finish_reason"`
+}
+
+// Usage is token counts of request and response
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// Finish reasons of choice
+const (
+	FinishStop          = "stop"
+	FinishLength        = "length"
+	FinishToolCalls     = "tool_calls"
+	FinishContentFilter = "content_filter"
+)
+
+// UnmarshalJSON accepts string content as single text part and null content as no parts
+func (c *MessageContent) UnmarshalJSON(data []byte) error {
+	var text *string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = nil
+		if text != nil {
+			*c = MessageContent{{Type: "text", Text: *text}}
+		}
+		return nil
+	}
+	var parts []ContentPart
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return errors.New("message content should be string or list of parts")
+	}
+	*c = parts
+	return nil
+}
+
+// UnmarshalJSON accepts single string as list of one string
+func (l *StringList) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*l = StringList{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.New("should be string or list of strings")
+	}
+	*l = list
+	return nil
+}
+
+// Text returns text of all text parts
+func (c MessageContent) Text() string {
+	var res strings.Builder
+	for _, p := range c {
+		if p.Type == "text" {
+			res.WriteString(p.Text)
+		}
+	}
+	return res.String()
+}
+
+// GeminiModel returns Gemini model of request, models/ prefix is removed
+func (r ChatRequest) GeminiModel() string {
+	return strings.TrimPrefix(r.Model, "models/")
+}
+
+// ToGemini translates chat request into generateContent request. System and developer messages become
+// system instruction, tool calls and results become function calls and responses
+func (r ChatRequest) ToGemini() (gemini.GenerateContentRequest, error) {
+	if r.Model == "" {
+		return gemini.GenerateContentRequest{}, errors.New("model is required")
+	}
+	if len(r.Messages) == 0 {
+		return gemini.GenerateContentRequest{}, errors.New("messages are required")
+	}
+
+	res := gemini.GenerateContentRequest{}
+	toolNames := map[string]string{} // tool call id -> function name
+	for i, m := range r.Messages {
+		switch m.Role {
+		case "system", "developer":
+			if res.SystemInstruction == nil {
+				res.SystemInstruction = &gemini.Content{}
+			}
+			res.SystemInstruction.Parts = append(res.SystemInstruction.Parts, gemini.Part{Text: m.Content.Text()})
+		case "user":
+			parts, err := userParts(m.Content)
+			if err != nil {
+				return gemini.GenerateContentRequest{}, fmt.Errorf("message %d: %w", i, err)
+			}
+			res.Contents = appendContent(res.Contents, gemini.RoleUser, parts...)
+		case "assistant":
+			var parts []gemini.Part
+			if text := m.Content.Text(); text != "" {
+				parts = append(parts, gemini.Part{Text: text})
+			}
+			for _, tc := range m.ToolCalls {
+				args := json.RawMessage(tc.Function.Arguments)
+				if len(args) == 0 {
+					args = json.RawMessage("{}")
+				}
+				if !json.Valid(args) {
+					return gemini.GenerateContentRequest{}, fmt.Errorf("message %d: arguments of tool call %s is not valid json", i, tc.ID)
+				}
+				toolNames[tc.ID] = tc.Function.Name
+				parts = append(parts, gemini.Part{FunctionCall: &gemini.FunctionCall{Name: tc.Function.Name, Args: args}})
+			}
+			res.Contents = appendContent(res.Contents, gemini.RoleModel, parts...)
+		case "tool":
+			name, ok := toolNames[m.ToolCallID]
+			if !ok {
+				return gemini.GenerateContentRequest{}, fmt.Errorf("message %d: tool call %q is not found", i, m.ToolCallID)
+			}
+			res.Contents = appendContent(res.Contents, gemini.RoleUser, gemini.Part{FunctionResponse: &gemini.FunctionResponse{
+				Name: name, Response: toolResult(m.Content.Text())}})
+		default:
+			return gemini.GenerateContentRequest{}, fmt.Errorf("message %d: role %q is not supported", i, m.Role)
+		}
+	}
+
+	for _, t := range r.Tools {
+		if t.Type != "function" {
+			return gemini.GenerateContentRequest{}, fmt.Errorf("tool type %q is not supported", t.Type)
+		}
+		if len(res.Tools) == 0 {
+			res.Tools = []gemini.Tool{{}}
+		}
+		res.Tools[0].FunctionDeclarations = append(res.Tools[0].FunctionDeclarations, gemini.FunctionDeclaration{
+			Name: t.Function.Name, Description: t.Function.Description, ParametersJSONSchema: t.Function.Parameters})
+	}
+	toolConfig, err := toolChoice(r.ToolChoice)
+	if err != nil {
+		return gemini.GenerateContentRequest{}, err
+	}
+	res.ToolConfig = toolConfig
+
+	cfg, err := r.generationConfig()
+	if err != nil {
+		return gemini.GenerateContentRequest{}, err
+	}
+	res.GenerationConfig = cfg
+	return res, nil
+}
+
+func (r ChatRequest) generationConfig() (*gemini.GenerationConfig, error) {
+	cfg := gemini.GenerationConfig{
+		StopSequences:    r.Stop,
+		CandidateCount:   r.N,
+		MaxOutputTokens:  r.MaxTokens,
+		Temperature:      r.Temperature,
+		TopP:             r.TopP,
+		Seed:             r.Seed,
+		PresencePenalty:  r.PresencePenalty,
+		FrequencyPenalty: r.FrequencyPenalty,
+	}
+	if r.MaxCompletionTokens != nil {
+		cfg.MaxOutputTokens = r.MaxCompletionTokens
+	}
+	if rf := r.ResponseFormat; rf != nil {
+		switch rf.Type {
+		case "text":
+		case "json_object":
+			cfg.ResponseMimeType = "application/json"
+		case "json_schema":
+			if rf.JSONSchema == nil || len(rf.JSONSchema.Schema) == 0 {
+				return nil, errors.New("response_format json_schema requires schema")
+			}
+			cfg.ResponseMimeType = "application/json"
+			cfg.ResponseJSONSchema = rf.JSONSchema.Schema
+		default:
+			return nil, fmt.Errorf("response_format %q is not supported", rf.Type)
+		}
+	}
+	if cfg.StopSequences == nil && cfg.CandidateCount == nil && cfg.MaxOutputTokens == nil && cfg.Temperature == nil &&
+		cfg.TopP == nil && cfg.Seed == nil && cfg.PresencePenalty == nil && cfg.FrequencyPenalty == nil &&
+		cfg.ResponseMimeType == "" {
+		return nil, nil
+	}
+	return &cfg, nil
+}
+
+// toolChoice maps tool_choice to function calling config, it's either string mode or specific function
+func toolChoice(choice json.RawMessage) (*gemini.ToolConfig, error) {
+	if len(choice) == 0 || string(choice) == "null" {
+		return nil, nil
+	}
+	var mode string
+	if err := json.Unmarshal(choice, &mode); err == nil {
+		modes := map[string]string{"auto": gemini.ModeAuto, "required": gemini.ModeAny, "none": gemini.ModeNone}
+		m, ok := modes[mode]
+		if !ok {
+			return nil, fmt.Errorf("tool_choice %q is not supported", mode)
+		}
+		return &gemini.ToolConfig{FunctionCallingConfig: &gemini.FunctionCallingConfig{Mode: m}}, nil
+	}
+	var tool Tool
+	if err := json.Unmarshal(choice, &tool); err != nil || tool.Function.Name == "" {
+		return nil, errors.New("tool_choice should be mode or function")
+	}
+	return &gemini.ToolConfig{FunctionCallingConfig: &gemini.FunctionCallingConfig{Mode: gemini.ModeAny,
+		AllowedFunctionNames: []string{tool.Function.Name}}}, nil
+}
+
+// userParts translates text and image parts, images should be base64 data URLs, Gemini doesn't fetch http URLs
+func userParts(content MessageContent) ([]gemini.Part, error) {
+	res := make([]gemini.Part, 0, len(content))
+	for _, p := range content {
+		switch p.Type {
+		case "text":
+			res = append(res, gemini.Part{Text: p.Text})
+		case "image_url":
+			if p.ImageURL == nil || p.ImageURL.URL == "" {
+				return nil, errors.New("image_url is empty")
+			}
+			part, err := imagePart(p.ImageURL.URL)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, part)
+		default:
+			return nil, fmt.Errorf("content part %q is not supported", p.Type)
+		}
+	}
+	return res, nil
+}
+
+// imagePart makes inline data of data URL data:{mime type};base64,{data}
+func imagePart(url string) (gemini.Part, error) {
+	meta, data, ok := strings.Cut(strings.TrimPrefix(url, "data:"), ",")
+	mimeType, base64, _ := strings.Cut(meta, ";")
+	if !ok || !strings.HasPrefix(url, "data:") || mimeType == "" || base64 != "base64" || data == "" {
+		return gemini.Part{}, errors.New("image_url should be base64 data URL, e.g. data:image/png;base64,{data}, " +
+			"http URLs are not supported")
+	}
+	return gemini.Part{InlineData: &gemini.Blob{MimeType: mimeType, Data: data}}, nil
+}
+
+// toolResult makes function response object, Gemini requires json object so other results are wrapped
+func toolResult(text string) json.RawMessage {
+	if trimmed := strings.TrimSpace(text); strings.HasPrefix(trimmed, "{") && json.Valid([]byte(trimmed)) {
+		return json.RawMessage(trimmed)
+	}
+	res, _ := json.Marshal(map[string]string{"content": text}) // nolint:errchkjson // map of strings can't fail
+	return res
+}
+
+// appendContent adds parts to the last content if it has the same role, Gemini expects turns of different roles
+func appendContent(contents []gemini.Content, role string, parts ...gemini.Part) []gemini.Content {
+	if len(parts) == 0 {
+		return contents
+	}
+	if n := len(contents); n > 0 && contents[n-1].Role == role {
+		contents[n-1].Parts = append(contents[n-1].Parts, parts...)
+		return contents
+	}
+	return append(contents, gemini.Content{Role: role, Parts: parts})
+}
+
+// FromGemini translates generateContent response into chat.completion object
+func FromGemini(resp gemini.GenerateContentResponse, model string) ChatResponse {
+	res := ChatResponse{
+		ID:      responseID(resp),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: []Choice{},
+		Usage:   usage(resp.UsageMetadata),
+	}
+	for _, c := range resp.Candidates {
+		msg, toolCalls := message(c.Content, 0)
+		msg.Role = "assistant"
+		if msg.Content == nil && len(toolCalls) == 0 {
+			empty := ""
+			msg.Content = &empty
+		}
+		msg.ToolCalls = toolCalls
+		res.Choices = append(res.Choices, Choice{Index: c.Index, Message: msg,
+			FinishReason: finishReason(c.FinishReason, len(toolCalls) > 0)})
+	}
+	if len(res.Choices) == 0 && resp.PromptFeedback != nil && resp.PromptFeedback.BlockReason != "" {
+		empty := ""
+		res.Choices = append(res.Choices, Choice{Message: ResponseMessage{Role: "assistant", Content: &empty},
+			FinishReason: FinishContentFilter})
+	}
+	return res
+}
+
+// ChunkWriter translates events of streamGenerateContent into chat.completion.chunk objects
+type ChunkWriter struct {
+	Model        string
+	IncludeUsage bool
+	id           string
+	created      int64
+	started      map[int]bool // choices with role sent
+	toolCalls    map[int]int  // choice -> tool calls sent
+	usage        *Usage
+}
+
+// Chunks returns chunks of Gemini stream event, the first chunk of every choice carries the role
+func (cw *ChunkWriter) Chunks(resp gemini.GenerateContentResponse) []ChatChunk {
+	if cw.id == "" {
+		cw.id = responseID(resp)
+		cw.created = time.Now().Unix()
+		cw.started = map[int]bool{}
+		cw.toolCalls = map[int]int{}
+	}
+	if resp.UsageMetadata != nil {
+		cw.usage = usage(resp.UsageMetadata)
+	}
+
+	res := []ChatChunk{}
+	for _, c := range resp.Candidates {
+		delta, toolCalls := message(c.Content, cw.toolCalls[c.Index])
+		for i := range toolCalls {
+			idx := cw.toolCalls[c.Index] + i
+			toolCalls[i].Index = &idx
+		}
+		cw.toolCalls[c.Index] += len(toolCalls)
+		delta.ToolCalls = toolCalls
+		if !cw.started[c.Index] {
+			cw.started[c.Index] = true
+			delta.Role = "assistant"
+		}
+		var finish *string
+		if c.FinishReason != "" {
+			reason := finishReason(c.FinishReason, cw.toolCalls[c.Index] > 0)
+			finish = &reason
+		}
+		if delta.Role == "" && delta.Content == nil && len(delta.ToolCalls) == 0 && finish == nil {
+			continue
+		}
+		res = append(res, cw.chunk(ChunkChoice{Index: c.Index, Delta: delta, FinishReason: finish}))
+	}
+	return res
+}
+
+// Final returns usage chunk sent before [DONE] if client asked for usage
+func (cw *ChunkWriter) Final() (ChatChunk, bool) {
+	if !cw.IncludeUsage || cw.usage == nil {
+		return ChatChunk{}, false
+	}
+	res := cw.chunk()
+	res.Usage = cw.usage
+	return res, true
+}
+
+func (cw *ChunkWriter) chunk(choices ...ChunkChoice) ChatChunk {
+	if choices == nil {
+		choices = []ChunkChoice{}
+	}
+	return ChatChunk{ID: cw.id, Object: "chat.completion.chunk", Created: cw.created, Model: cw.Model, Choices: choices}
+}
+
+// message collects text and function calls of content, call ids are numbered from firstCall
+func message(content gemini.Content, firstCall int) (ResponseMessage, []ToolCall) {
+	res := ResponseMessage{}
+	var toolCalls []ToolCall
+	if text := content.Text(); text != "" {
+		res.Content = &text
+	}
+	for _, p := range content.Parts {
+		if p.FunctionCall == nil {
+			continue
+		}
+		id := p.FunctionCall.ID
+		if id == "" {
+			id = fmt.Sprintf("call_%d", firstCall+len(toolCalls))
+		}
+		args := string(p.FunctionCall.Args)
+		if args == "" {
+			args = "{}"
+		}
+		toolCalls = append(toolCalls, ToolCall{ID: id, Type: "function",
+			Function: FunctionCall{Name: p.FunctionCall.Name, Arguments: args}})
+	}
+	return res, toolCalls
+}
+
+func finishReason(reason string, toolCalls bool) string {
+	switch {
+	case toolCalls:
+		return FinishToolCalls
+	case reason == gemini.FinishMaxTokens:
+		return FinishLength
+	case reason == gemini.FinishStop, reason == "":
+		return FinishStop
+	default:
+		// safety, recitation, blocklist and other blocking reasons
+		return FinishContentFilter
+	}
+}
+
+func usage(u *gemini.UsageMetadata) *Usage {
+	if u == nil {
+		return nil
+	}
+	return &Usage{PromptTokens: u.PromptTokenCount, CompletionTokens: u.TotalTokenCount - u.PromptTokenCount,
+		TotalTokens: u.TotalTokenCount}
+}
+
+func responseID(resp gemini.GenerateContentResponse) string {
+	if resp.ResponseID != "" {
+		return "chatcmpl-" + resp.ResponseID
+	}
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return "chatcmpl-" + hex.EncodeToString(b)
+}
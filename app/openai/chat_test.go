@@ -0,0 +1,146 @@
+package openai
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/theshamuel/gemini-proxy/app/gemini"
+)
+
+func TestChatRequest_ToGemini(t *testing.T) {
+	body := `{
+		"model": "models/gemini-2.5-flash",
+		"messages": [
+			{"role": "system", "content": "be brief"},
+			{"role": "user", "content": [{"type": "text", "text": "what is on image?"},
+				{"type": "image_url", "image_url": {"url": "data:image/png;base64,AAAA"}}]},
+			{"role": "assistant", "content": null, "tool_calls": [{"id": "c1", "type": "function",
+				"function": {"name": "lookup", "arguments": "{\"q\":\"cat\"}"}}]},
+			{"role": "tool", "tool_call_id": "c1", "content": "a cat"},
+			{"role": "user", "content": "thanks"}
+		],
+		"temperature": 0.2,
+		"max_tokens": 100,
+		"stop": "END",
+		"tools": [{"type": "function", "function": {"name": "lookup", "parameters": {"type": "object"}}}],
+		"tool_choice": {"type": "function", "function": {"name": "lookup"}},
+		"response_format": {"type": "json_object"}
+	}`
+	var req ChatRequest
+	require.NoError(t, json.Unmarshal([]byte(body), &req))
+	assert.Equal(t, "gemini-2.5-flash", req.GeminiModel())
+
+	res, err := req.ToGemini()
+	require.NoError(t, err)
+	b, err := json.Marshal(res)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"systemInstruction": {"parts": [{"text": "be brief"}]},
+		"contents": [
+			{"role": "user", "parts": [{"text": "what is on image?"}, {"inlineData": {"mimeType": "image/png", "data": "AAAA"}}]},
+			{"role": "model", "parts": [{"functionCall": {"name": "lookup", "args": {"q": "cat"}}}]},
+			{"role": "user", "parts": [{"functionResponse": {"name": "lookup", "response": {"content": "a cat"}}},
+				{"text": "thanks"}]}
+		],
+		"tools": [{"functionDeclarations": [{"name": "lookup", "parametersJsonSchema": {"type": "object"}}]}],
+		"toolConfig": {"functionCallingConfig": {"mode": "ANY", "allowedFunctionNames": ["lookup"]}},
+		"generationConfig": {"temperature": 0.2, "maxOutputTokens": 100, "stopSequences": ["END"],
+			"responseMimeType": "application/json"}
+	}`, string(b))
+}
+
+func TestChatRequest_ToGeminiErrors(t *testing.T) {
+	tbl := []struct {
+		body string
+		err  string
+	}{
+		{`{"messages": [{"role": "user", "content": "hi"}]}`, "model is required"},
+		{`{"model": "m", "messages": []}`, "messages are required"},
+		{`{"model": "m", "messages": [{"role": "robot", "content": "hi"}]}`, `message 0: role "robot" is not supported`},
+		{`{"model": "m", "messages": [{"role": "tool", "tool_call_id": "x", "content": "hi"}]}`, `message 0: tool call "x" is not found`},
+		{`{"model": "m", "messages": [{"role": "user", "content": [{"type": "audio"}]}]}`, `message 0: content part "audio" is not supported`},
+		{`{"model": "m", "messages": [{"role": "user", "content": [{"type": "image_url",
+			"image_url": {"url": "https://example.com/cat.png"}}]}]}`, "message 0: image_url should be base64 data URL, " +
+			"e.g. data:image/png;base64,{data}, http URLs are not supported"},
+		{`{"model": "m", "messages": [{"role": "user", "content": [{"type": "image_url",
+			"image_url": {"url": "data:,AAAA"}}]}]}`, "message 0: image_url should be base64 data URL, " +
+			"e.g. data:image/png;base64,{data}, http URLs are not supported"},
+		{`{"model": "m", "messages": [{"role": "user", "content": "hi"}], "tool_choice": "sometimes"}`, `tool_choice "sometimes" is not supported`},
+		{`{"model": "m", "messages": [{"role": "user", "content": "hi"}], "response_format": {"type": "json_schema"}}`,
+			"response_format json_schema requires schema"},
+	}
+	for _, tt := range tbl {
+		var req ChatRequest
+		require.NoError(t, json.Unmarshal([]byte(tt.body), &req))
+		_, err := req.ToGemini()
+		assert.EqualError(t, err, tt.err, tt.body)
+	}
+
+	var req ChatRequest
+	assert.Error(t, json.Unmarshal([]byte(`{"messages": [{"role": "user", "content": 1}]}`), &req))
+}
+
+func TestFromGemini(t *testing.T) {
+	resp := gemini.GenerateContentResponse{
+		ResponseID: "r1",
+		Candidates: []gemini.Candidate{
+			{Content: gemini.Content{Role: "model", Parts: []gemini.Part{{Text: "hello"}}}, FinishReason: "MAX_TOKENS"},
+			{Index: 1, Content: gemini.Content{Role: "model", Parts: []gemini.Part{
+				{FunctionCall: &gemini.FunctionCall{Name: "lookup", Args: json.RawMessage(`{"q":"x"}`)}}}}, FinishReason: "STOP"},
+			{Index: 2, FinishReason: "SAFETY"},
+		},
+		UsageMetadata: &gemini.UsageMetadata{PromptTokenCount: 5, CandidatesTokenCount: 7, TotalTokenCount: 14},
+	}
+	res := FromGemini(resp, "gemini-2.5-pro")
+	res.Created = 0
+	b, err := json.Marshal(res)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"id": "chatcmpl-r1", "object": "chat.completion", "created": 0, "model": "gemini-2.5-pro",
+		"choices": [
+			{"index": 0, "message": {"role": "assistant", "content": "hello"}, "finish_reason": "length"},
+			{"index": 1, "message": {"role": "assistant", "tool_calls": [{"id": "call_0", "type": "function",
+				"function": {"name": "lookup", "arguments": "{\"q\":\"x\"}"}}]}, "finish_reason": "tool_calls"},
+			{"index": 2, "message": {"role": "assistant", "content": ""}, "finish_reason": "content_filter"}
+		],
+		"usage": {"prompt_tokens": 5, "completion_tokens": 9, "total_tokens": 14}}`, string(b))
+
+	blocked := FromGemini(gemini.GenerateContentResponse{PromptFeedback: &gemini.PromptFeedback{BlockReason: "SAFETY"}}, "m")
+	require.Len(t, blocked.Choices, 1)
+	assert.Equal(t, FinishContentFilter, blocked.Choices[0].FinishReason)
+}
+
+func TestChunkWriter(t *testing.T) {
+	cw := &ChunkWriter{Model: "gemini-2.5-pro", IncludeUsage: true}
+	event := func(parts []gemini.Part, finish string) gemini.GenerateContentResponse {
+		return gemini.GenerateContentResponse{ResponseID: "r1", Candidates: []gemini.Candidate{
+			{Content: gemini.Content{Role: "model", Parts: parts}, FinishReason: finish}}}
+	}
+
+	chunks := cw.Chunks(event([]gemini.Part{{Text: "Hel"}}, ""))
+	require.Len(t, chunks, 1)
+	assert.Equal(t, "chatcmpl-r1", chunks[0].ID)
+	assert.Equal(t, "chat.completion.chunk", chunks[0].Object)
+	assert.Equal(t, "assistant", chunks[0].Choices[0].Delta.Role)
+	assert.Equal(t, "Hel", *chunks[0].Choices[0].Delta.Content)
+	assert.Nil(t, chunks[0].Choices[0].FinishReason)
+
+	assert.Empty(t, cw.Chunks(event([]gemini.Part{{Text: "hmm", Thought: true}}, "")), "thoughts are skipped")
+
+	chunks = cw.Chunks(event([]gemini.Part{{FunctionCall: &gemini.FunctionCall{Name: "f", Args: json.RawMessage(`{}`)}}}, "STOP"))
+	require.Len(t, chunks, 1)
+	assert.Empty(t, chunks[0].Choices[0].Delta.Role)
+	require.Len(t, chunks[0].Choices[0].Delta.ToolCalls, 1)
+	assert.Equal(t, 0, *chunks[0].Choices[0].Delta.ToolCalls[0].Index)
+	assert.Equal(t, FinishToolCalls, *chunks[0].Choices[0].FinishReason)
+
+	_, ok := cw.Final()
+	assert.False(t, ok, "no usage in stream")
+	cw.Chunks(gemini.GenerateContentResponse{UsageMetadata: &gemini.UsageMetadata{PromptTokenCount: 1, TotalTokenCount: 3}})
+	final, ok := cw.Final()
+	require.True(t, ok)
+	assert.Empty(t, final.Choices)
+	assert.Equal(t, &Usage{PromptTokens: 1, CompletionTokens: 2, TotalTokens: 3}, final.Usage)
+}
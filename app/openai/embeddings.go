@@ -0,0 +1,146 @@
+package openai
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/theshamuel/gemini-proxy/app/gemini"
+)
+
+// EmbeddingRequest is body of embeddings request, see https://platform.openai.com/docs/api-reference/embeddings
+type EmbeddingRequest struct {
+	Model          string         `json:"model"`
+	Input          EmbeddingInput `json:"input"`
+	Dimensions     *int           `json:"dimensions,omitempty"`
+	EncodingFormat string         `json:"encoding_format,omitempty"`
+}
+
+// EmbeddingInput is text or list of texts, token arrays are not supported by Gemini
+type EmbeddingInput struct {
+	Texts  []string
+	Single bool
+}
+
+// EmbeddingResponse is list of embeddings in order of input
+type EmbeddingResponse struct {
+	Object string      `json:"object"`
+	Data   []Embedding `json:"data"`
+	Model  string      `json:"model"`
+	Usage  Usage       `json:"usage"`
+}
+
+// Embedding is embedding vector, it's list of floats or base64 of little endian float32 values
+type Embedding struct {
+	Object    string `json:"object"`
+	Index     int    `json:"index"`
+	Embedding any    `json:"embedding"`
+}
+
+// UnmarshalJSON accepts single string or list of strings
+func (in *EmbeddingInput) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*in = EmbeddingInput{Texts: []string{text}, Single: true}
+		return nil
+	}
+	var texts []string
+	if err := json.Unmarshal(data, &texts); err != nil {
+		return errors.New("input should be string or list of strings")
+	}
+	*in = EmbeddingInput{Texts: texts}
+	return nil
+}
+
+// GeminiModel returns Gemini model of request, models/ prefix is removed
+func (r EmbeddingRequest) GeminiModel() string {
+	return strings.TrimPrefix(r.Model, "models/")
+}
+
+// Method returns Gemini method for request, embedContent for single text and batchEmbedContents for list
+func (r EmbeddingRequest) Method() string {
+	if r.Input.Single {
+		return "embedContent"
+	}
+	return "batchEmbedContents"
+}
+
+// ToGemini translates request into body of Gemini method returned by Method, dimensions become outputDimensionality
+func (r EmbeddingRequest) ToGemini() (any, error) {
+	if r.Model == "" {
+		return nil, errors.New("model is required")
+	}
+	if len(r.Input.Texts) == 0 {
+		return nil, errors.New("input is required")
+	}
+	if r.EncodingFormat != "" && r.EncodingFormat != "float" && r.EncodingFormat != "base64" {
+		return nil, fmt.Errorf("encoding_format %q is not supported", r.EncodingFormat)
+	}
+	if r.Input.Single {
+		return gemini.EmbedContentRequest{Content: textContent(r.Input.Texts[0]), OutputDimensionality: r.Dimensions}, nil
+	}
+	res := gemini.BatchEmbedContentsRequest{Requests: make([]gemini.EmbedContentRequest, 0, len(r.Input.Texts))}
+	for _, text := range r.Input.Texts {
+		res.Requests = append(res.Requests, gemini.EmbedContentRequest{Model: "models/" + r.GeminiModel(),
+			Content: textContent(text), OutputDimensionality: r.Dimensions})
+	}
+	return res, nil
+}
+
+// FromGemini translates response of Gemini method returned by Method. Gemini may not report usage for embeddings,
+// then prompt tokens are estimated as 4 bytes of input per token
+func (r EmbeddingRequest) FromGemini(body []byte) (EmbeddingResponse, error) {
+	var vectors []gemini.ContentEmbedding
+	var usage *gemini.UsageMetadata
+	if r.Input.Single {
+		var resp gemini.EmbedContentResponse
+		if err := json.Unmarshal(body, &resp); err != nil {
+			return EmbeddingResponse{}, fmt.Errorf("can not decode embedContent response: %w", err)
+		}
+		vectors, usage = []gemini.ContentEmbedding{resp.Embedding}, resp.UsageMetadata
+	} else {
+		var resp gemini.BatchEmbedContentsResponse
+		if err := json.Unmarshal(body, &resp); err != nil {
+			return EmbeddingResponse{}, fmt.Errorf("can not decode batchEmbedContents response: %w", err)
+		}
+		vectors, usage = resp.Embeddings, resp.UsageMetadata
+	}
+	if len(vectors) != len(r.Input.Texts) {
+		return EmbeddingResponse{}, fmt.Errorf("got %d embeddings for %d inputs", len(vectors), len(r.Input.Texts))
+	}
+
+	res := EmbeddingResponse{Object: "list", Data: make([]Embedding, 0, len(vectors)), Model: r.Model}
+	for i, v := range vectors {
+		var embedding any = v.Values
+		if r.EncodingFormat == "base64" {
+			embedding = encodeFloats(v.Values)
+		}
+		res.Data = append(res.Data, Embedding{Object: "embedding", Index: i, Embedding: embedding})
+	}
+	if usage != nil {
+		res.Usage = Usage{PromptTokens: usage.PromptTokenCount, TotalTokens: usage.PromptTokenCount}
+	} else {
+		for _, text := range r.Input.Texts {
+			res.Usage.PromptTokens += (len(text) + 3) / 4
+		}
+		res.Usage.TotalTokens = res.Usage.PromptTokens
+	}
+	return res, nil
+}
+
+func textContent(text string) gemini.Content {
+	return gemini.Content{Parts: []gemini.Part{{Text: text}}}
+}
+
+// encodeFloats encodes values as base64 of little endian float32, the way OpenAI sends base64 embeddings
+func encodeFloats(values []float64) string {
+	buf := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(float32(v)))
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
@@ -0,0 +1,78 @@
+package openai
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbeddingRequest_Single(t *testing.T) {
+	var req EmbeddingRequest
+	require.NoError(t, json.Unmarshal([]byte(`{"model":"gemini-embedding-001","input":"hello","dimensions":3}`), &req))
+	assert.Equal(t, "embedContent", req.Method())
+
+	geminiReq, err := req.ToGemini()
+	require.NoError(t, err)
+	b, err := json.Marshal(geminiReq)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"content":{"parts":[{"text":"hello"}]},"outputDimensionality":3}`, string(b))
+
+	resp, err := req.FromGemini([]byte(`{"embedding":{"values":[0.1,0.2,0.3]}}`))
+	require.NoError(t, err)
+	b, err = json.Marshal(resp)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"object":"list","model":"gemini-embedding-001",
+		"data":[{"object":"embedding","index":0,"embedding":[0.1,0.2,0.3]}],
+		"usage":{"prompt_tokens":2,"completion_tokens":0,"total_tokens":2}}`, string(b))
+}
+
+func TestEmbeddingRequest_Batch(t *testing.T) {
+	var req EmbeddingRequest
+	require.NoError(t, json.Unmarshal([]byte(`{"model":"models/gemini-embedding-001","input":["a","b"],
+		"encoding_format":"base64"}`), &req))
+	assert.Equal(t, "batchEmbedContents", req.Method())
+	assert.Equal(t, "gemini-embedding-001", req.GeminiModel())
+
+	geminiReq, err := req.ToGemini()
+	require.NoError(t, err)
+	b, err := json.Marshal(geminiReq)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"requests":[
+		{"model":"models/gemini-embedding-001","content":{"parts":[{"text":"a"}]}},
+		{"model":"models/gemini-embedding-001","content":{"parts":[{"text":"b"}]}}]}`, string(b))
+
+	resp, err := req.FromGemini([]byte(`{"embeddings":[{"values":[1]},{"values":[-2]}],` +
+		`"usageMetadata":{"promptTokenCount":4,"totalTokenCount":4}}`))
+	require.NoError(t, err)
+	require.Len(t, resp.Data, 2)
+	assert.Equal(t, "AACAPw==", resp.Data[0].Embedding, "1.0 as little endian float32")
+	assert.Equal(t, "AAAAwA==", resp.Data[1].Embedding)
+	assert.Equal(t, 1, resp.Data[1].Index)
+	assert.Equal(t, Usage{PromptTokens: 4, TotalTokens: 4}, resp.Usage)
+
+	_, err = req.FromGemini([]byte(`{"embeddings":[{"values":[1]}]}`))
+	assert.EqualError(t, err, "got 1 embeddings for 2 inputs")
+}
+
+func TestEmbeddingRequest_Errors(t *testing.T) {
+	tbl := []struct {
+		body string
+		err  string
+	}{
+		{`{"input":"a"}`, "model is required"},
+		{`{"model":"m","input":[]}`, "input is required"},
+		{`{"model":"m","input":"a","encoding_format":"int8"}`, `encoding_format "int8" is not supported`},
+	}
+	for _, tt := range tbl {
+		var req EmbeddingRequest
+		require.NoError(t, json.Unmarshal([]byte(tt.body), &req))
+		_, err := req.ToGemini()
+		assert.EqualError(t, err, tt.err, tt.body)
+	}
+
+	var req EmbeddingRequest
+	assert.EqualError(t, json.Unmarshal([]byte(`{"model":"m","input":[[1,2]]}`), &req),
+		"input should be string or list of strings")
+}
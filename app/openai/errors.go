@@ -0,0 +1,36 @@
+package openai
+
+import "net/http"
+
+// ErrorResponse is error body of OpenAI API
+type ErrorResponse struct {
+	Error Error `json:"error"`
+}
+
+// Error describes failed request, type is derived from http status
+type Error struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
+// NewError makes error body for http status
+func NewError(status int, message string) ErrorResponse {
+	return ErrorResponse{Error: Error{Message: message, Type: errorType(status)}}
+}
+
+func errorType(status int) string {
+	switch status {
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return "invalid_request_error"
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusForbidden:
+		return "permission_error"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	default:
+		return "api_error"
+	}
+}
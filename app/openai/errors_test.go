@@ -0,0 +1,18 @@
+package openai
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewError(t *testing.T) {
+	b, err := json.Marshal(NewError(http.StatusTooManyRequests, "slow down"))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"error":{"message":"slow down","type":"rate_limit_error","param":null,"code":null}}`, string(b))
+	assert.Equal(t, "invalid_request_error", NewError(http.StatusNotFound, "").Error.Type)
+	assert.Equal(t, "api_error", NewError(http.StatusBadGateway, "").Error.Type)
+}
@@ -0,0 +1,159 @@
+// Package quota implements per-client budgets of requests and Gemini tokens per day or month
+package quota
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Period is accounting window of limits
+type Period string
+
+// nolint:revive
+const (
+	Day   Period = "day"
+	Month Period = "month"
+)
+
+// Usage is amount of requests and tokens spent by client in accounting window
+type Usage struct {
+	Requests        int64 `json:"requests"`
+	PromptTokens    int64 `json:"prompt_tokens"`
+	CandidateTokens int64 `json:"candidate_tokens"`
+}
+
+func (u Usage) add(delta Usage) Usage {
+	return Usage{
+		Requests:        u.Requests + delta.Requests,
+		PromptTokens:    u.PromptTokens + delta.PromptTokens,
+		CandidateTokens: u.CandidateTokens + delta.CandidateTokens,
+	}
+}
+
+// Limits of client usage per period, zero value means no limit
+type Limits struct {
+	Period          Period `json:"period"`
+	Requests        int64  `json:"requests,omitempty"`
+	PromptTokens    int64  `json:"prompt_tokens,omitempty"`
+	CandidateTokens int64  `json:"candidate_tokens,omitempty"`
+}
+
+// ExceededError is returned when client is over budget
+type ExceededError struct {
+	Client  string
+	Limit   string
+	Used    int64
+	Max     int64
+	ResetAt time.Time
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("quota of %s is exceeded for client %s: %d/%d", e.Limit, e.Client, e.Used, e.Max)
+}
+
+// ClientUsage is report of client usage in current window
+type ClientUsage struct {
+	Client  string    `json:"client"`
+	Window  string    `json:"window"`
+	ResetAt time.Time `json:"reset_at"`
+	Usage   Usage     `json:"usage"`
+	Limits  Limits    `json:"limits"`
+}
+
+// Manager checks and accounts client usage, clients without limits are not accounted.
+// Limits could be replaced with SetLimits, usage is kept
+type Manager struct {
+	Store  Store
+	Limits map[string]Limits
+	lock   sync.Mutex
+	now    func() time.Time
+}
+
+// SetLimits replaces limits of clients, e.g. on reload of config. Usage of current windows is kept,
+// so client with changed limit is checked against the usage it already has
+func (m *Manager) SetLimits(limits map[string]Limits) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.Limits = limits
+}
+
+// Allow checks client is within budget and counts the request
+func (m *Manager) Allow(client string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	l, ok := m.Limits[client]
+	if !ok {
+		return nil
+	}
+	window, resetAt := m.window(l.Period)
+	u, err := m.Store.Get(client + "/" + window)
+	if err != nil {
+		return fmt.Errorf("can't get usage of client %s: %w", client, err)
+	}
+	for _, c := range []struct {
+		name      string
+		used, max int64
+	}{
+		{"requests", u.Requests, l.Requests},
+		{"prompt-tokens", u.PromptTokens, l.PromptTokens},
+		{"candidate-tokens", u.CandidateTokens, l.CandidateTokens},
+	} {
+		if c.max > 0 && c.used >= c.max {
+			return &ExceededError{Client: client, Limit: c.name, Used: c.used, Max: c.max, ResetAt: resetAt}
+		}
+	}
+	if _, err = m.Store.Add(client+"/"+window, Usage{Requests: 1}); err != nil {
+		return fmt.Errorf("can't count request of client %s: %w", client, err)
+	}
+	return nil
+}
+
+// Record adds tokens spent by client
+func (m *Manager) Record(client string, promptTokens, candidateTokens int64) error {
+	m.lock.Lock()
+	l, ok := m.Limits[client]
+	m.lock.Unlock()
+	if !ok || (promptTokens == 0 && candidateTokens == 0) {
+		return nil
+	}
+	window, _ := m.window(l.Period)
+	if _, err := m.Store.Add(client+"/"+window, Usage{PromptTokens: promptTokens, CandidateTokens: candidateTokens}); err != nil {
+		return fmt.Errorf("can't record tokens of client %s: %w", client, err)
+	}
+	return nil
+}
+
+// Report returns usage of all clients with limits in current window
+func (m *Manager) Report() ([]ClientUsage, error) {
+	m.lock.Lock()
+	limits := m.Limits
+	m.lock.Unlock()
+	res := make([]ClientUsage, 0, len(limits))
+	for client, l := range limits {
+		window, resetAt := m.window(l.Period)
+		u, err := m.Store.Get(client + "/" + window)
+		if err != nil {
+			return nil, fmt.Errorf("can't get usage of client %s: %w", client, err)
+		}
+		res = append(res, ClientUsage{Client: client, Window: window, ResetAt: resetAt, Usage: u, Limits: l})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Client < res[j].Client })
+	return res, nil
+}
+
+// window returns id of current accounting window and time when the next one starts, windows are in UTC
+func (m *Manager) window(p Period) (id string, resetAt time.Time) {
+	now := time.Now
+	if m.now != nil {
+		now = m.now
+	}
+	t := now().UTC()
+	if p == Month {
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start.Format("2006-01"), start.AddDate(0, 1, 0)
+	}
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return start.Format("2006-01-02"), start.AddDate(0, 0, 1)
+}
@@ -0,0 +1,72 @@
+package quota
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManager_Allow(t *testing.T) {
+	now := time.Date(2025, 3, 17, 23, 59, 0, 0, time.UTC)
+	m := &Manager{
+		Store:  NewMemStore(),
+		Limits: map[string]Limits{"web": {Period: Day, Requests: 2, PromptTokens: 100}},
+		now:    func() time.Time { return now },
+	}
+
+	require.NoError(t, m.Allow("web"))
+	require.NoError(t, m.Allow("web"))
+	err := m.Allow("web")
+	var exceeded *ExceededError
+	require.ErrorAs(t, err, &exceeded)
+	assert.Equal(t, "requests", exceeded.Limit)
+	assert.Equal(t, time.Date(2025, 3, 18, 0, 0, 0, 0, time.UTC), exceeded.ResetAt)
+	assert.EqualError(t, err, "quota of requests is exceeded for client web: 2/2")
+
+	assert.NoError(t, m.Allow("unlimited"), "client without limits is always allowed")
+
+	now = now.Add(time.Minute)
+	require.NoError(t, m.Allow("web"), "new day resets usage")
+	require.NoError(t, m.Record("web", 100, 20))
+	err = m.Allow("web")
+	require.ErrorAs(t, err, &exceeded)
+	assert.Equal(t, "prompt-tokens", exceeded.Limit)
+}
+
+func TestManager_SetLimits(t *testing.T) {
+	now := time.Date(2025, 3, 17, 10, 0, 0, 0, time.UTC)
+	m := &Manager{Store: NewMemStore(), Limits: map[string]Limits{"web": {Period: Day, Requests: 1}},
+		now: func() time.Time { return now }}
+	require.NoError(t, m.Allow("web"))
+	assert.Error(t, m.Allow("web"))
+
+	m.SetLimits(map[string]Limits{"web": {Period: Day, Requests: 2}, "bot": {Period: Day, Requests: 1}})
+	require.NoError(t, m.Allow("web"), "raised limit is applied")
+	assert.Error(t, m.Allow("web"), "usage is kept")
+	require.NoError(t, m.Allow("bot"))
+	assert.Error(t, m.Allow("bot"))
+}
+
+func TestManager_Report(t *testing.T) {
+	m := &Manager{
+		Store: NewMemStore(),
+		Limits: map[string]Limits{
+			"web": {Period: Month, CandidateTokens: 1000},
+			"bot": {Period: Day, Requests: 10},
+		},
+		now: func() time.Time { return time.Date(2025, 12, 31, 10, 0, 0, 0, time.UTC) },
+	}
+	require.NoError(t, m.Allow("web"))
+	require.NoError(t, m.Record("web", 10, 20))
+
+	report, err := m.Report()
+	require.NoError(t, err)
+	assert.Equal(t, []ClientUsage{
+		{Client: "bot", Window: "2025-12-31", ResetAt: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+			Limits: Limits{Period: Day, Requests: 10}},
+		{Client: "web", Window: "2025-12", ResetAt: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+			Usage: Usage{Requests: 1, PromptTokens: 10, CandidateTokens: 20}, Limits: Limits{Period: Month, CandidateTokens: 1000}},
+	}, report)
+}
@@ -0,0 +1,182 @@
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store keeps usage counters, key is client and accounting window, e.g. web/2025-03-17
+type Store interface {
+	Get(key string) (Usage, error)
+	Add(key string, delta Usage) (Usage, error)
+}
+
+// MemStore keeps usage in memory, counters are lost on restart
+type MemStore struct {
+	lock   sync.Mutex
+	usage  map[string]Usage
+	pruned string // day of the last removal of ended windows
+}
+
+// NewMemStore makes empty in-memory store
+func NewMemStore() *MemStore {
+	return &MemStore{usage: map[string]Usage{}}
+}
+
+// Get returns usage by key, zero usage for unknown key
+func (s *MemStore) Get(key string) (Usage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.usage[key], nil
+}
+
+// Add increments usage by key and returns updated value, counters of ended windows are removed once a day
+func (s *MemStore) Add(key string, delta Usage) (Usage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pruned = pruneEnded(s.usage, s.pruned, time.Now())
+	u := s.usage[key].add(delta)
+	s.usage[key] = u
+	return u, nil
+}
+
+// FileStore keeps usage in memory and persists it to local JSON file by Flush, see Run
+type FileStore struct {
+	path   string
+	lock   sync.Mutex
+	usage  map[string]Usage
+	dirty  bool   // usage is changed since the last write
+	pruned string // day of the last removal of ended windows
+	now    func() time.Time
+}
+
+// NewFileStore makes store backed by file, existing counters are loaded from it, counters of ended windows are dropped
+func NewFileStore(path string) (*FileStore, error) {
+	res := &FileStore{path: path, usage: map[string]Usage{}, now: time.Now}
+	data, err := os.ReadFile(path) // nolint:gosec
+	if errors.Is(err, os.ErrNotExist) {
+		return res, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read usage file %s: %w", path, err)
+	}
+	if err = json.Unmarshal(data, &res.usage); err != nil {
+		return nil, fmt.Errorf("can't parse usage file %s: %w", path, err)
+	}
+	size := len(res.usage)
+	res.pruned = pruneEnded(res.usage, "", res.now())
+	res.dirty = len(res.usage) != size
+	return res, nil
+}
+
+// Get returns usage by key, zero usage for unknown key
+func (s *FileStore) Get(key string) (Usage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.usage[key], nil
+}
+
+// Add increments usage by key and returns updated value, counters of ended windows are removed once a day.
+// Change is written to file by the next Flush
+func (s *FileStore) Add(key string, delta Usage) (Usage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pruned = pruneEnded(s.usage, s.pruned, s.now())
+	u := s.usage[key].add(delta)
+	s.usage[key] = u
+	s.dirty = true
+	return u, nil
+}
+
+// Flush writes counters to file if they are changed since the last write
+func (s *FileStore) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	if err := s.save(); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// Run flushes counters to file every interval until ctx is done, failed writes are logged and repeated next time.
+// Counters added after ctx is done should be written by Flush
+func (s *FileStore) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.Flush(); err != nil {
+			log.Printf("[WARN] can't write usage: %v", err)
+		}
+	}
+}
+
+// pruneEnded removes counters of windows which have ended before now, it's done once per day.
+// It returns day of the last removal
+func pruneEnded(usage map[string]Usage, pruned string, now time.Time) string {
+	now = now.UTC()
+	day := now.Format("2006-01-02")
+	if day == pruned {
+		return pruned
+	}
+	for key := range usage {
+		window := key[strings.LastIndex(key, "/")+1:]
+		if end, ok := windowEnd(window); ok && !end.After(now) {
+			delete(usage, key)
+		}
+	}
+	return day
+}
+
+// windowEnd returns time when accounting window ends, window is day 2006-01-02 or month 2006-01
+func windowEnd(window string) (time.Time, bool) {
+	if t, err := time.Parse("2006-01-02", window); err == nil {
+		return t.AddDate(0, 0, 1), true
+	}
+	if t, err := time.Parse("2006-01", window); err == nil {
+		return t.AddDate(0, 1, 0), true
+	}
+	return time.Time{}, false
+}
+
+// save writes counters to temp file and renames it to keep usage file consistent on crash
+func (s *FileStore) save() error {
+	data, err := json.Marshal(s.usage)
+	if err != nil {
+		return fmt.Errorf("can't marshal usage: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("can't create temp usage file: %w", err)
+	}
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("can't write usage file: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("can't close usage file: %w", err)
+	}
+	if err = os.Rename(tmp.Name(), s.path); err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("can't replace usage file %s: %w", s.path, err)
+	}
+	return nil
+}
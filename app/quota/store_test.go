@@ -0,0 +1,110 @@
+package quota
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+
+	s, err := NewFileStore(path)
+	require.NoError(t, err)
+	u, err := s.Add("web/2999-03-17", Usage{Requests: 1})
+	require.NoError(t, err)
+	assert.Equal(t, Usage{Requests: 1}, u)
+	u, err = s.Add("web/2999-03-17", Usage{PromptTokens: 10, CandidateTokens: 5})
+	require.NoError(t, err)
+	assert.Equal(t, Usage{Requests: 1, PromptTokens: 10, CandidateTokens: 5}, u)
+
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "usage is written by flush only")
+	require.NoError(t, s.Flush())
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(path))
+	require.NoError(t, s.Flush())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "unchanged usage is not written again")
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+
+	s, err = NewFileStore(path)
+	require.NoError(t, err, "usage is loaded from file")
+	u, err = s.Get("web/2999-03-17")
+	require.NoError(t, err)
+	assert.Equal(t, Usage{Requests: 1, PromptTokens: 10, CandidateTokens: 5}, u)
+
+	require.NoError(t, os.WriteFile(path, []byte("broken"), 0o600))
+	_, err = NewFileStore(path)
+	assert.Error(t, err)
+}
+
+func TestFileStore_PruneEnded(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"web/2020-01-01":{"requests":1},"web/2020-01":{"requests":2},`+
+		`"web/2999-01-01":{"requests":3},"web/2999-01":{"requests":4}}`), 0o600))
+	s, err := NewFileStore(path)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]Usage{"web/2999-01-01": {Requests: 3}, "web/2999-01": {Requests: 4}}, s.usage,
+		"ended windows are dropped on load")
+
+	now := time.Date(2025, 3, 17, 23, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	s.usage = map[string]Usage{}
+	s.pruned = ""
+	_, err = s.Add("web/2025-03-17", Usage{Requests: 1})
+	require.NoError(t, err)
+	_, err = s.Add("mobile/2025-03", Usage{Requests: 1})
+	require.NoError(t, err)
+
+	now = now.Add(2 * time.Hour)
+	_, err = s.Add("web/2025-03-18", Usage{Requests: 1})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]Usage{"mobile/2025-03": {Requests: 1}, "web/2025-03-18": {Requests: 1}}, s.usage,
+		"day window is dropped when day is changed")
+
+	require.NoError(t, s.Flush())
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"mobile/2025-03":{"requests":1,"prompt_tokens":0,"candidate_tokens":0},`+
+		`"web/2025-03-18":{"requests":1,"prompt_tokens":0,"candidate_tokens":0}}`, string(data))
+}
+
+func TestFileStore_Run(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	s, err := NewFileStore(path)
+	require.NoError(t, err)
+	_, err = s.Add("web/2999-01", Usage{Requests: 1})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, time.Second, 10*time.Millisecond, "usage is written periodically")
+	cancel()
+	<-done
+}
+
+func TestMemStore(t *testing.T) {
+	s := NewMemStore()
+	u, err := s.Get("web/2025-03")
+	require.NoError(t, err)
+	assert.Equal(t, Usage{}, u)
+	_, err = s.Add("web/2025-03", Usage{Requests: 1, CandidateTokens: 3})
+	require.NoError(t, err)
+	u, err = s.Add("web/2025-03", Usage{Requests: 1})
+	require.NoError(t, err)
+	assert.Equal(t, Usage{Requests: 2, CandidateTokens: 3}, u)
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/render"
+
+	"github.com/theshamuel/gemini-proxy/app/anthropic"
+	"github.com/theshamuel/gemini-proxy/app/gemini"
+	"github.com/theshamuel/gemini-proxy/app/service"
+)
+
+// anthropicError makes error body of Anthropic api
+func anthropicError(status int, message string) any {
+	return anthropic.NewError(status, message)
+}
+
+// messagesHandler serves Anthropic messages with generateContent of Gemini model named in request,
+// streaming request is served with streamGenerateContent as Anthropic event sequence
+func (s *Rest) messagesHandler(w http.ResponseWriter, r *http.Request) {
+	var req anthropic.MessagesRequest
+	if err := DecodeJSON(r.Body, &req); err != nil {
+		sendAPIError(w, r, decodeStatus(err), fmt.Errorf("can not decode request: %w", err), anthropicError)
+		return
+	}
+	geminiReq, err := req.ToGemini()
+	if err != nil {
+		sendAPIError(w, r, http.StatusBadRequest, err, anthropicError)
+		return
+	}
+	if !s.validateTranslated(w, r, geminiReq, anthropicError) {
+		return
+	}
+	body, err := json.Marshal(geminiReq)
+	if err != nil {
+		sendAPIError(w, r, http.StatusInternalServerError, err, anthropicError)
+		return
+	}
+	model := req.GeminiModel()
+	target := service.Target{Model: model, Method: "generateContent"}
+	if req.Stream {
+		target.Method = "streamGenerateContent"
+	}
+	s.labelRequest(r, target)
+	log.Printf("[DEBUG] client %q calls messages of %s", clientLabel(r), model)
+	if !s.allowQuota(w, r) {
+		return
+	}
+
+	if req.Stream {
+		s.translateStream(w, r, target, body, anthropicStream{&anthropic.Streamer{Model: req.Model}}, anthropicError)
+		return
+	}
+
+	raw, ok := s.translateSend(w, r, target, body, anthropicError)
+	if !ok {
+		return
+	}
+	if usage, ok := service.ParseUsage(raw); ok {
+		s.recordUsage(r, usage)
+	}
+	var resp gemini.GenerateContentResponse
+	if err = json.Unmarshal(raw, &resp); err != nil {
+		sendAPIError(w, r, http.StatusBadGateway, fmt.Errorf("can not decode Gemini response: %w", err), anthropicError)
+		return
+	}
+	render.JSON(w, r, anthropic.FromGemini(resp, req.Model))
+}
+
+// anthropicStream sends Anthropic events named by their type
+type anthropicStream struct {
+	streamer *anthropic.Streamer
+}
+
+func (a anthropicStream) Events(resp gemini.GenerateContentResponse) []sseEvent {
+	return a.sseEvents(a.streamer.Events(resp))
+}
+
+func (a anthropicStream) Final() []sseEvent {
+	return a.sseEvents(a.streamer.Final())
+}
+
+func (a anthropicStream) sseEvents(events []anthropic.Event) []sseEvent {
+	res := make([]sseEvent, 0, len(events))
+	for _, e := range events {
+		res = append(res, sseEvent{Name: e.Type, Data: e.Data})
+	}
+	return res
+}
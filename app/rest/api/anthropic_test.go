@@ -0,0 +1,84 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/theshamuel/gemini-proxy/app/service"
+)
+
+func TestRest_Messages(t *testing.T) {
+	gemini := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/models/gemini-2.5-pro:generateContent", r.URL.Path)
+		_, _ = w.Write([]byte(`{"responseId":"r1","candidates":[{"content":{"role":"model","parts":[{"text":"hi"}]},` +
+			`"finishReason":"MAX_TOKENS"}],"usageMetadata":{"promptTokenCount":3,"candidatesTokenCount":2,"totalTokenCount":5}}`))
+	}))
+	defer gemini.Close()
+
+	ts, srv, teardown := startHTTPServer()
+	defer teardown()
+	srv.Service = &service.GeminiProxy{BaseURL: gemini.URL, APIKey: "key"}
+	srv.Auth, _ = NewAuth([]Client{{Name: "agent", KeyHash: HashKey("agent-key")}})
+	ts.Config.Handler = srv.routes()
+
+	req, err := http.NewRequest("POST", ts.URL+"/v1/messages",
+		strings.NewReader(`{"model":"gemini-2.5-pro","max_tokens":2,"messages":[{"role":"user","content":"hello"}]}`))
+	require.NoError(t, err)
+	req.Header.Set("x-api-key", "agent-key")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(b))
+	assert.JSONEq(t, `{"id":"msg_r1","type":"message","role":"assistant","model":"gemini-2.5-pro",
+		"content":[{"type":"text","text":"hi"}],"stop_reason":"max_tokens","stop_sequence":null,
+		"usage":{"input_tokens":3,"output_tokens":2}}`, string(b))
+
+	req, err = http.NewRequest("POST", ts.URL+"/v1/messages", strings.NewReader(`{"model":"gemini-2.5-pro"}`))
+	require.NoError(t, err)
+	req.Header.Set("x-api-key", "agent-key")
+	resp2, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp2.Body.Close()
+	b, err = io.ReadAll(resp2.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp2.StatusCode)
+	assert.JSONEq(t, `{"type":"error","error":{"type":"invalid_request_error","message":"max_tokens should be positive"}}`, string(b))
+}
+
+func TestRest_MessagesStreaming(t *testing.T) {
+	gemini := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/models/gemini-2.5-pro:streamGenerateContent", r.URL.Path)
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: {\"candidates\":[{\"content\":{\"role\":\"model\",\"parts\":[{\"text\":\"Hi\"}]},\"finishReason\":\"STOP\"}]," +
+			"\"usageMetadata\":{\"promptTokenCount\":1,\"candidatesTokenCount\":1,\"totalTokenCount\":2}}\r\n\r\n"))
+	}))
+	defer gemini.Close()
+
+	ts, srv, teardown := startHTTPServer()
+	defer teardown()
+	srv.Service = &service.GeminiProxy{BaseURL: gemini.URL, APIKey: "key"}
+	ts.Config.Handler = srv.routes()
+
+	body, code := postRequest(t, ts.URL+"/v1/messages",
+		`{"model":"gemini-2.5-pro","max_tokens":10,"stream":true,"messages":[{"role":"user","content":"hello"}]}`)
+	require.Equal(t, http.StatusOK, code, body)
+	var names []string
+	for _, line := range strings.Split(body, "\n") {
+		if name, ok := strings.CutPrefix(line, "event: "); ok {
+			names = append(names, name)
+		}
+	}
+	assert.Equal(t, []string{"message_start", "content_block_start", "content_block_delta", "content_block_stop",
+		"message_delta", "message_stop"}, names)
+	assert.Contains(t, body, "event: content_block_delta\ndata: {\"delta\":{\"text\":\"Hi\",\"type\":\"text_delta\"},"+
+		"\"index\":0,\"type\":\"content_block_delta\"}\n\n")
+	assert.Contains(t, body, `"stop_reason":"end_turn"`)
+}
@@ -0,0 +1,183 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/theshamuel/gemini-proxy/app/rest"
+	"github.com/theshamuel/gemini-proxy/app/service"
+)
+
+const keyHashPrefix = "sha256:"
+
+// certIdentityKinds are prefixes of client certificate identities, see certIdentities
+var certIdentityKinds = []string{"subject:", "cn:", "dns:", "uri:", "email:"}
+
+// Client represents API consumer identified by its proxy key, only hash of the key is stored,
+// or by its TLS certificate matching any of CertIdentities, e.g. cn:billing or uri:spiffe://prod/billing.
+// Client with Origins is browser app, its requests are accepted from these origins only, see CORSPolicy
+type Client struct {
+	Name           string
+	KeyHash        string
+	CertIdentities []string
+	Origins        []string
+}
+
+// Auth checks verified TLS client certificate and proxy keys passed in Authorization: Bearer, x-goog-api-key
+// or x-api-key header
+type Auth struct {
+	clients map[string]string          // key hash -> client name
+	certs   map[string]string          // certificate identity -> client name
+	origins map[string][]originPattern // client name -> allowed origins
+}
+
+// NewAuth makes Auth for given clients, key hash should be in format sha256:{hex}, see HashKey.
+// Client could have certificate identities instead of key
+func NewAuth(clients []Client) (*Auth, error) {
+	res := &Auth{clients: make(map[string]string, len(clients)), certs: map[string]string{},
+		origins: map[string][]originPattern{}}
+	for _, c := range clients {
+		if c.Name == "" {
+			return nil, errors.New("client name is empty")
+		}
+		for _, o := range c.Origins {
+			pattern, err := parseOrigin(o)
+			if err != nil {
+				return nil, fmt.Errorf("client %s: %w", c.Name, err)
+			}
+			res.origins[c.Name] = append(res.origins[c.Name], pattern)
+		}
+		for _, id := range c.CertIdentities {
+			if strings.HasPrefix(id, "dns:") {
+				id = strings.ToLower(id)
+			}
+			if !validCertIdentity(id) {
+				return nil, fmt.Errorf("certificate identity %q of client %s should start with %s", id, c.Name,
+					strings.Join(certIdentityKinds, ", "))
+			}
+			if name, ok := res.certs[id]; ok {
+				return nil, fmt.Errorf("clients %s and %s have the same certificate identity %s", name, c.Name, id)
+			}
+			res.certs[id] = c.Name
+		}
+		if c.KeyHash == "" && len(c.CertIdentities) > 0 {
+			continue
+		}
+		hash := strings.ToLower(c.KeyHash)
+		if !strings.HasPrefix(hash, keyHashPrefix) {
+			return nil, fmt.Errorf("key hash of client %s should start with %s", c.Name, keyHashPrefix)
+		}
+		if b, err := hex.DecodeString(strings.TrimPrefix(hash, keyHashPrefix)); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("key hash of client %s is not valid sha256 hex", c.Name)
+		}
+		if name, ok := res.clients[hash]; ok {
+			return nil, fmt.Errorf("clients %s and %s have the same key", name, c.Name)
+		}
+		res.clients[hash] = c.Name
+	}
+	return res, nil
+}
+
+// HashKey returns hash of proxy key in format stored in config
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return keyHashPrefix + hex.EncodeToString(sum[:])
+}
+
+// Middleware rejects requests without valid proxy key and puts client name into request context.
+// Client with verified TLS certificate matching its identities doesn't need the key.
+// Requests of client with origins are rejected unless their Origin header matches one of them
+func (a *Auth) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := a.certClient(r)
+		if !ok {
+			key := requestKey(r)
+			if key == "" {
+				details := "pass key in Authorization: Bearer, x-goog-api-key or x-api-key header"
+				if len(a.certs) > 0 {
+					details += " or use client certificate"
+				}
+				rest.SendErrorJSON(w, r, http.StatusUnauthorized, errors.New("proxy key is required"),
+					rest.ErrUnauthorized, details)
+				return
+			}
+			if name, ok = a.clients[HashKey(key)]; !ok {
+				rest.SendErrorJSON(w, r, http.StatusUnauthorized, errors.New("proxy key is not valid"),
+					rest.ErrUnauthorized, "")
+				return
+			}
+		}
+		if origins, restricted := a.origins[name]; restricted && !matchOrigin(origins, r.Header.Get("Origin")) {
+			rest.SendErrorJSON(w, r, http.StatusForbidden, fmt.Errorf("origin %q is not allowed for client %s",
+				r.Header.Get("Origin"), name), rest.ErrOriginDenied, "key of the client works from its origins only")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(service.WithClient(r.Context(), name)))
+	})
+}
+
+// ClientFromContext returns name of authenticated client or empty string for anonymous access
+func ClientFromContext(ctx context.Context) string {
+	return service.ClientFromContext(ctx)
+}
+
+// certClient returns client with identity of verified TLS client certificate, the first matching identity
+// in order of certIdentities wins
+func (a *Auth) certClient(r *http.Request) (string, bool) {
+	if len(a.certs) == 0 || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	for _, id := range certIdentities(r.TLS.VerifiedChains[0][0]) {
+		if name, ok := a.certs[id]; ok {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// certIdentities returns identities of certificate: full subject, common name and SANs, e.g.
+// subject:CN=billing,O=Acme, cn:billing, dns:billing.internal, uri:spiffe://prod/billing, email:ops@acme.com
+func certIdentities(cert *x509.Certificate) []string {
+	res := []string{"subject:" + cert.Subject.String()}
+	if cert.Subject.CommonName != "" {
+		res = append(res, "cn:"+cert.Subject.CommonName)
+	}
+	for _, name := range cert.DNSNames {
+		res = append(res, "dns:"+strings.ToLower(name))
+	}
+	for _, u := range cert.URIs {
+		res = append(res, "uri:"+u.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		res = append(res, "email:"+email)
+	}
+	return res
+}
+
+func validCertIdentity(id string) bool {
+	for _, kind := range certIdentityKinds {
+		if strings.HasPrefix(id, kind) && len(id) > len(kind) {
+			return true
+		}
+	}
+	return false
+}
+
+func requestKey(r *http.Request) string {
+	if key := r.Header.Get("x-goog-api-key"); key != "" {
+		return key
+	}
+	if key := r.Header.Get("x-api-key"); key != "" {
+		return key
+	}
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
@@ -0,0 +1,205 @@
+package api
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/theshamuel/gemini-proxy/app/service"
+)
+
+func TestNewAuth(t *testing.T) {
+	_, err := NewAuth([]Client{{Name: "web", KeyHash: HashKey("k1")}, {Name: "bot", KeyHash: HashKey("k2")}})
+	assert.NoError(t, err)
+
+	_, err = NewAuth([]Client{{Name: "web", KeyHash: "k1"}})
+	assert.EqualError(t, err, "key hash of client web should start with sha256:")
+
+	_, err = NewAuth([]Client{{Name: "web", KeyHash: "sha256:abc"}})
+	assert.EqualError(t, err, "key hash of client web is not valid sha256 hex")
+
+	_, err = NewAuth([]Client{{Name: "web", KeyHash: HashKey("k1")}, {Name: "bot", KeyHash: HashKey("k1")}})
+	assert.EqualError(t, err, "clients web and bot have the same key")
+
+	_, err = NewAuth([]Client{{KeyHash: HashKey("k1")}})
+	assert.EqualError(t, err, "client name is empty")
+
+	_, err = NewAuth([]Client{{Name: "billing", CertIdentities: []string{"cn:billing", "dns:billing.internal"}}})
+	assert.NoError(t, err, "key is not required for client with certificate identities")
+
+	_, err = NewAuth([]Client{{Name: "billing", CertIdentities: []string{"billing"}}})
+	assert.EqualError(t, err, `certificate identity "billing" of client billing should start with subject:, cn:, `+
+		"dns:, uri:, email:")
+
+	_, err = NewAuth([]Client{{Name: "billing", CertIdentities: []string{"dns:Billing.internal"}},
+		{Name: "bot", CertIdentities: []string{"dns:billing.internal"}}})
+	assert.EqualError(t, err, "clients billing and bot have the same certificate identity dns:billing.internal")
+
+	_, err = NewAuth([]Client{{Name: "web", KeyHash: HashKey("k1"), Origins: []string{"app.example.com"}}})
+	assert.EqualError(t, err, `client web: origin "app.example.com" should be scheme://host[:port], `+
+		"e.g. https://app.example.com")
+}
+
+func TestAuth_Middleware(t *testing.T) {
+	auth, err := NewAuth([]Client{{Name: "web", KeyHash: HashKey("k1")}})
+	require.NoError(t, err)
+
+	var client string
+	h := auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client = ClientFromContext(r.Context())
+	}))
+
+	tbl := []struct {
+		name   string
+		header string
+		value  string
+		status int
+		client string
+	}{
+		{"bearer", "Authorization", "Bearer k1", http.StatusOK, "web"},
+		{"goog header", "x-goog-api-key", "k1", http.StatusOK, "web"},
+		{"anthropic header", "x-api-key", "k1", http.StatusOK, "web"},
+		{"wrong key", "Authorization", "Bearer k2", http.StatusUnauthorized, ""},
+		{"basic auth", "Authorization", "Basic k1", http.StatusUnauthorized, ""},
+		{"no key", "", "", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			client = ""
+			req := httptest.NewRequest("POST", "/api/models/m:generateContent", http.NoBody)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			assert.Equal(t, tt.status, rr.Code)
+			assert.Equal(t, tt.client, client)
+		})
+	}
+}
+
+func TestAuth_MiddlewareCertificate(t *testing.T) {
+	auth, err := NewAuth([]Client{
+		{Name: "web", KeyHash: HashKey("k1")},
+		{Name: "billing", CertIdentities: []string{"dns:billing.internal"}},
+		{Name: "reports", CertIdentities: []string{"uri:spiffe://prod/reports", "subject:CN=reports,O=Acme"}},
+	})
+	require.NoError(t, err)
+
+	var client string
+	h := auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client = ClientFromContext(r.Context())
+	}))
+
+	spiffe, err := url.Parse("spiffe://prod/reports")
+	require.NoError(t, err)
+	tbl := []struct {
+		name   string
+		cert   *x509.Certificate
+		key    string
+		status int
+		client string
+	}{
+		{"dns SAN", &x509.Certificate{DNSNames: []string{"Billing.Internal"}}, "", http.StatusOK, "billing"},
+		{"uri SAN", &x509.Certificate{URIs: []*url.URL{spiffe}}, "", http.StatusOK, "reports"},
+		{"subject", &x509.Certificate{Subject: pkix.Name{CommonName: "reports", Organization: []string{"Acme"}}}, "",
+			http.StatusOK, "reports"},
+		{"unknown certificate", &x509.Certificate{Subject: pkix.Name{CommonName: "billing"}}, "",
+			http.StatusUnauthorized, ""},
+		{"unknown certificate with key", &x509.Certificate{Subject: pkix.Name{CommonName: "billing"}}, "k1",
+			http.StatusOK, "web"},
+		{"no certificate", nil, "", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			client = ""
+			req := httptest.NewRequest("POST", "https://localhost/api/models/m:generateContent", http.NoBody)
+			if tt.cert != nil {
+				req.TLS.VerifiedChains = [][]*x509.Certificate{{tt.cert}}
+			}
+			if tt.key != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.key)
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			assert.Equal(t, tt.status, rr.Code)
+			assert.Equal(t, tt.client, client)
+			if tt.status == http.StatusUnauthorized {
+				assert.Contains(t, rr.Body.String(), "or use client certificate")
+			}
+		})
+	}
+
+	req := httptest.NewRequest("POST", "https://localhost/api/models/m:generateContent", http.NoBody)
+	req.TLS.PeerCertificates = []*x509.Certificate{{DNSNames: []string{"billing.internal"}}}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code, "certificate which is not verified is ignored")
+}
+
+func TestAuth_MiddlewareOrigin(t *testing.T) {
+	auth, err := NewAuth([]Client{
+		{Name: "browser", KeyHash: HashKey("k1"), Origins: []string{"https://app.example.com", "https://*.example.org"}},
+		{Name: "backend", KeyHash: HashKey("k2")},
+	})
+	require.NoError(t, err)
+	h := auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tbl := []struct {
+		key, origin string
+		status      int
+	}{
+		{"k1", "https://app.example.com", http.StatusOK},
+		{"k1", "https://chat.example.org", http.StatusOK},
+		{"k1", "https://evil.com", http.StatusForbidden},
+		{"k1", "", http.StatusForbidden},
+		{"k2", "https://evil.com", http.StatusOK},
+		{"k2", "", http.StatusOK},
+	}
+	for _, tt := range tbl {
+		req := httptest.NewRequest("POST", "/api/models/m:generateContent", http.NoBody)
+		req.Header.Set("x-goog-api-key", tt.key)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		assert.Equal(t, tt.status, rr.Code, "key %s from %q", tt.key, tt.origin)
+		if tt.status == http.StatusForbidden {
+			assert.Contains(t, rr.Body.String(), `"code":9`)
+		}
+	}
+}
+
+func TestRest_SendWithAuth(t *testing.T) {
+	gemini := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "gemini-key", r.Header.Get("x-goog-api-key"))
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer gemini.Close()
+
+	ts, rest, teardown := startHTTPServer()
+	defer teardown()
+	rest.Service = &service.GeminiProxy{BaseURL: gemini.URL, APIKey: "gemini-key"}
+	auth, err := NewAuth([]Client{{Name: "web", KeyHash: HashKey("proxy-key")}})
+	require.NoError(t, err)
+	rest.Auth = auth
+	ts.Config.Handler = rest.routes()
+
+	_, code := postRequest(t, ts.URL+"/api/models/gemini-2.5-pro:generateContent", `{}`)
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	req, err := http.NewRequest("POST", ts.URL+"/api/models/gemini-2.5-pro:generateContent", strings.NewReader(testBody))
+	require.NoError(t, err)
+	req.Header.Set("x-goog-api-key", "proxy-key")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
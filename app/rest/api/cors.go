@@ -0,0 +1,144 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-chi/cors"
+)
+
+// DefaultCORSHeaders are request headers allowed when policy doesn't list them, they carry proxy key and body type
+var DefaultCORSHeaders = []string{"Accept", "Content-Type", "Cache-Control", "Authorization", "X-Goog-Api-Key",
+	"X-Api-Key", "Anthropic-Version"}
+
+// CORSPolicy allows cross-origin requests of browsers to route group. Origin could have wildcard subdomain,
+// e.g. https://*.example.com matches https://app.example.com, but not https://example.com
+type CORSPolicy struct {
+	AllowedOrigins   []string // origins of clients if empty, see Client.Origins
+	AllowedMethods   []string // GET, POST and HEAD if empty
+	AllowedHeaders   []string // DefaultCORSHeaders if empty
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration // how long browser caches result of preflight request
+}
+
+// CORS is set of CORS policies by route group, group without policy doesn't allow cross-origin requests
+type CORS struct {
+	groups map[string]*cors.Cors
+}
+
+// NewCORS makes CORS of route groups, clientOrigins are allowed to groups which don't list their origins
+func NewCORS(policies map[string]CORSPolicy, clientOrigins []string) (*CORS, error) {
+	res := &CORS{groups: make(map[string]*cors.Cors, len(policies))}
+	for group, p := range policies {
+		if !slices.Contains(RouteGroups, group) {
+			return nil, fmt.Errorf("CORS group should be one of %s, got %q", strings.Join(RouteGroups, ", "), group)
+		}
+		origins := p.AllowedOrigins
+		if len(origins) == 0 {
+			origins = clientOrigins
+		}
+		if len(origins) == 0 {
+			return nil, fmt.Errorf("CORS policy of %s group has no allowed origins and clients have no origins", group)
+		}
+		patterns := make([]originPattern, 0, len(origins))
+		for _, o := range origins {
+			pattern, err := parseOrigin(o)
+			if err != nil {
+				return nil, fmt.Errorf("CORS policy of %s group: %w", group, err)
+			}
+			if pattern.any && p.AllowCredentials {
+				return nil, fmt.Errorf("CORS policy of %s group allows credentials, origin * is not allowed with them",
+					group)
+			}
+			patterns = append(patterns, pattern)
+		}
+		headers := p.AllowedHeaders
+		if len(headers) == 0 {
+			headers = DefaultCORSHeaders
+		}
+		opts := cors.Options{
+			AllowOriginFunc:  func(_ *http.Request, origin string) bool { return matchOrigin(patterns, origin) },
+			AllowedMethods:   p.AllowedMethods,
+			AllowedHeaders:   headers,
+			ExposedHeaders:   p.ExposedHeaders,
+			AllowCredentials: p.AllowCredentials,
+			MaxAge:           int(p.MaxAge / time.Second),
+		}
+		if slices.ContainsFunc(patterns, func(p originPattern) bool { return p.any }) {
+			// Access-Control-Allow-Origin: * instead of echo of origin
+			opts.AllowOriginFunc, opts.AllowedOrigins = nil, []string{"*"}
+		}
+		res.groups[group] = cors.New(opts)
+	}
+	return res, nil
+}
+
+// corsHandler applies current CORS policy of route group, requests of group without policy are passed as is
+func (s *Rest) corsHandler(group string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c := s.settings().CORS
+			if c == nil || c.groups[group] == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			c.groups[group].Handler(next).ServeHTTP(w, r)
+		})
+	}
+}
+
+// originPattern is allowed origin, e.g. https://app.example.com, https://*.example.com or *
+type originPattern struct {
+	scheme     string
+	host       string // host with port, parent domain for wildcard subdomain
+	subdomains bool
+	any        bool
+}
+
+func parseOrigin(origin string) (originPattern, error) {
+	if origin == "*" {
+		return originPattern{any: true}, nil
+	}
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" ||
+		u.User != nil {
+		return originPattern{}, fmt.Errorf("origin %q should be scheme://host[:port], e.g. https://app.example.com", origin)
+	}
+	res := originPattern{scheme: u.Scheme, host: u.Host}
+	if strings.HasPrefix(res.host, "*.") {
+		res.host, res.subdomains = strings.TrimPrefix(res.host, "*."), true
+	}
+	if strings.Contains(res.host, "*") {
+		return originPattern{}, fmt.Errorf("origin %q should have wildcard as the first label of host only, "+
+			"e.g. https://*.example.com", origin)
+	}
+	return res, nil
+}
+
+func (p originPattern) match(origin string) bool {
+	if p.any {
+		return true
+	}
+	scheme, host, ok := strings.Cut(strings.ToLower(origin), "://")
+	if !ok || scheme != p.scheme {
+		return false
+	}
+	if p.subdomains {
+		return strings.HasSuffix(host, "."+p.host) && len(host) > len(p.host)+1
+	}
+	return host == p.host
+}
+
+func matchOrigin(patterns []originPattern, origin string) bool {
+	for _, p := range patterns {
+		if p.match(origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOriginPattern(t *testing.T) {
+	tbl := []struct {
+		pattern, origin string
+		match           bool
+	}{
+		{"https://app.example.com", "https://app.example.com", true},
+		{"https://app.example.com", "https://App.Example.com", true},
+		{"https://app.example.com/", "https://app.example.com", true},
+		{"https://app.example.com", "http://app.example.com", false},
+		{"https://app.example.com", "https://app.example.com:8443", false},
+		{"http://localhost:3000", "http://localhost:3000", true},
+		{"https://*.example.com", "https://app.example.com", true},
+		{"https://*.example.com", "https://a.b.example.com", true},
+		{"https://*.example.com", "https://example.com", false},
+		{"https://*.example.com", "https://evilexample.com", false},
+		{"https://*.example.com", "https://app.example.com.evil.com", false},
+		{"https://*.example.com:8443", "https://app.example.com:8443", true},
+		{"*", "https://any.site", true},
+		{"https://app.example.com", "", false},
+	}
+	for _, tt := range tbl {
+		p, err := parseOrigin(tt.pattern)
+		require.NoError(t, err, tt.pattern)
+		assert.Equal(t, tt.match, p.match(tt.origin), "%s matches %s", tt.pattern, tt.origin)
+	}
+
+	for _, origin := range []string{"app.example.com", "https://app.example.com/path", "https://app.*.com",
+		"https://user@app.example.com", "https://app.example.com?x=1"} {
+		_, err := parseOrigin(origin)
+		assert.Error(t, err, origin)
+	}
+}
+
+func TestNewCORS(t *testing.T) {
+	_, err := NewCORS(map[string]CORSPolicy{"web": {AllowedOrigins: []string{"*"}}}, nil)
+	assert.EqualError(t, err, `CORS group should be one of root, api, v1, admin, got "web"`)
+
+	_, err = NewCORS(map[string]CORSPolicy{GroupAPI: {}}, nil)
+	assert.EqualError(t, err, "CORS policy of api group has no allowed origins and clients have no origins")
+
+	_, err = NewCORS(map[string]CORSPolicy{GroupAPI: {AllowedOrigins: []string{"*"}, AllowCredentials: true}}, nil)
+	assert.EqualError(t, err, "CORS policy of api group allows credentials, origin * is not allowed with them")
+
+	_, err = NewCORS(map[string]CORSPolicy{GroupV1: {AllowedOrigins: []string{"app.example.com"}}}, nil)
+	assert.EqualError(t, err, `CORS policy of v1 group: origin "app.example.com" should be scheme://host[:port], `+
+		"e.g. https://app.example.com")
+
+	c, err := NewCORS(map[string]CORSPolicy{GroupAPI: {}}, []string{"https://app.example.com"})
+	require.NoError(t, err)
+	assert.Len(t, c.groups, 1, "origins of clients are used")
+}
+
+func TestRest_CORS(t *testing.T) {
+	ts, rest, teardown := startHTTPServer()
+	defer teardown()
+
+	c, err := NewCORS(map[string]CORSPolicy{
+		GroupAPI: {AllowedOrigins: []string{"https://*.example.com"}, AllowedMethods: []string{"GET", "POST"},
+			ExposedHeaders: []string{"X-Cache"}, AllowCredentials: true, MaxAge: 10 * time.Minute},
+		GroupRoot: {AllowedOrigins: []string{"*"}},
+	}, nil)
+	require.NoError(t, err)
+	rest.CORS = c
+
+	request := func(method, path, origin string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, http.NoBody)
+		require.NoError(t, err)
+		req.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", "POST")
+			req.Header.Set("Access-Control-Request-Headers", "authorization,content-type")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp
+	}
+
+	resp := request(http.MethodOptions, "/api/models/gemini-2.5-pro:generateContent", "https://app.example.com")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "POST", resp.Header.Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Authorization, Content-Type", resp.Header.Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "true", resp.Header.Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "600", resp.Header.Get("Access-Control-Max-Age"))
+
+	resp = request(http.MethodOptions, "/api/models/gemini-2.5-pro:generateContent", "https://evil.com")
+	assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"), "origin is not allowed")
+
+	resp = request(http.MethodGet, "/api/models", "https://app.example.com")
+	assert.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "X-Cache", resp.Header.Get("Access-Control-Expose-Headers"))
+
+	resp = request(http.MethodGet, "/ping", "https://any.site")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
+
+	resp = request(http.MethodOptions, "/v1/chat/completions", "https://app.example.com")
+	assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"), "group without policy")
+
+	// reloaded policies are applied to the next requests
+	c, err = NewCORS(map[string]CORSPolicy{GroupV1: {AllowedOrigins: []string{"https://app.example.com"}}}, nil)
+	require.NoError(t, err)
+	rest.Reload(Settings{CORS: c})
+	resp = request(http.MethodOptions, "/v1/chat/completions", "https://app.example.com")
+	assert.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "Authorization, Content-Type", resp.Header.Get("Access-Control-Allow-Headers"),
+		"headers with proxy key are allowed by default")
+	resp = request(http.MethodGet, "/api/models", "https://app.example.com")
+	assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+}
@@ -0,0 +1,317 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/didip/tollbooth/v7"
+	"github.com/didip/tollbooth/v7/limiter"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+
+	"github.com/theshamuel/gemini-proxy/app/rest"
+	"github.com/theshamuel/gemini-proxy/app/service"
+)
+
+// writeDeadlineMargin is added to request timeout, so response with timeout error is written before write deadline
+const writeDeadlineMargin = 5 * time.Second
+
+// ServerOptions are timeouts of http server and limit of requests handled at once, zero values are unlimited
+type ServerOptions struct {
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration // requests with timeout get their own write deadline, see RouteLimits
+	IdleTimeout       time.Duration
+	Throttle          int
+}
+
+// RouteLimits are timeouts and rate limit of requests to route group, zero values are unlimited.
+// Rate limit is applied to every client, client without key or certificate is identified by IP.
+// Before authentication the same rate limit is applied to every IP
+type RouteLimits struct {
+	Timeout       time.Duration // handling of non-streaming request
+	StreamTimeout time.Duration // streaming request, response is cut when it's over
+	RateLimit     float64       // requests per second
+	Burst         int           // requests over rate limit allowed at once, rate limit rounded up if zero
+}
+
+// DefaultRouteLimits are limits of route groups which are not configured
+var DefaultRouteLimits = map[string]RouteLimits{
+	GroupRoot:  {RateLimit: 5},
+	GroupAPI:   {Timeout: 30 * time.Second, RateLimit: 50},
+	GroupV1:    {Timeout: 30 * time.Second, RateLimit: 50},
+	GroupAdmin: {RateLimit: 5},
+}
+
+// ModelLimits override limits of route groups for requests to models, nil fields keep limits of group
+type ModelLimits struct {
+	Groups        []string // api and v1 if empty
+	Models        []string // glob patterns, e.g. gemini-2.5-pro*
+	Timeout       *time.Duration
+	StreamTimeout *time.Duration
+	RateLimit     *float64
+	Burst         *int
+}
+
+// routeLimiter applies limits of route groups and models, it keeps token buckets of clients
+type routeLimiter struct {
+	groups   map[string]RouteLimits
+	models   []ModelLimits
+	limiters map[string]*limiter.Limiter // by group or model limits index
+	rates    map[string]rateLimit        // limits of limiters
+}
+
+type rateLimit struct {
+	rate  float64
+	burst int
+}
+
+// ValidateLimits checks groups of route limits and model limits
+func ValidateLimits(groups map[string]RouteLimits, models []ModelLimits) error {
+	for group := range groups {
+		if !slices.Contains(RouteGroups, group) {
+			return fmt.Errorf("route group should be one of %s, got %q", strings.Join(RouteGroups, ", "), group)
+		}
+	}
+	for i, m := range models {
+		if len(m.Models) == 0 {
+			return fmt.Errorf("model limits %d have no models", i)
+		}
+		for _, group := range m.Groups {
+			if group != GroupAPI && group != GroupV1 {
+				return fmt.Errorf("model limits %d should have groups api or v1, got %q", i, group)
+			}
+		}
+		for _, pattern := range m.Models {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("model limits %d have invalid pattern %q: %w", i, pattern, err)
+			}
+		}
+		if m.Burst != nil && m.RateLimit == nil {
+			return fmt.Errorf("model limits %d set burst without rate limit", i)
+		}
+	}
+	return nil
+}
+
+// newRouteLimiter makes limiter of route groups and models. Token buckets of previous limiter with the same
+// rate limit are kept, so reload of limits doesn't reset budgets of clients
+func newRouteLimiter(groups map[string]RouteLimits, models []ModelLimits, prev *routeLimiter) *routeLimiter {
+	res := &routeLimiter{groups: map[string]RouteLimits{}, models: models, limiters: map[string]*limiter.Limiter{},
+		rates: map[string]rateLimit{}}
+	for _, group := range RouteGroups {
+		limits, ok := groups[group]
+		if !ok {
+			limits = DefaultRouteLimits[group]
+		}
+		res.groups[group] = limits
+		res.add(prev, group, rateLimit{rate: limits.RateLimit, burst: limits.Burst})
+		res.add(prev, ipLimiterKey(group), rateLimit{rate: limits.RateLimit, burst: limits.Burst})
+	}
+	for i, m := range models {
+		if m.RateLimit != nil {
+			burst := 0
+			if m.Burst != nil {
+				burst = *m.Burst
+			}
+			res.add(prev, fmt.Sprintf("model-%d", i), rateLimit{rate: *m.RateLimit, burst: burst})
+		}
+	}
+	return res
+}
+
+// add makes rate limiter with key or takes it from previous limiter if its limits are the same
+func (l *routeLimiter) add(prev *routeLimiter, key string, limits rateLimit) {
+	l.rates[key] = limits
+	if prev != nil {
+		if prevLimits, ok := prev.rates[key]; ok && prevLimits == limits {
+			l.limiters[key] = prev.limiters[key]
+			return
+		}
+	}
+	l.limiters[key] = newRateLimiter(limits.rate, limits.burst)
+}
+
+func newRateLimiter(rate float64, burst int) *limiter.Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	// token buckets of clients gone for an hour are dropped
+	res := tollbooth.NewLimiter(rate, &limiter.ExpirableOptions{DefaultExpirationTTL: time.Hour})
+	if burst > 0 {
+		res.SetBurst(burst)
+	}
+	return res
+}
+
+// limits returns limits of request to model in route group and key of its rate limiter
+func (l *routeLimiter) limits(group, model string) (res RouteLimits, limiterKey string) {
+	res, limiterKey = l.groups[group], group
+	if model == "" {
+		return res, limiterKey
+	}
+	for i, m := range l.models {
+		if (len(m.Groups) == 0 && group != GroupAPI && group != GroupV1) ||
+			(len(m.Groups) > 0 && !slices.Contains(m.Groups, group)) || !matchModel(m.Models, model) {
+			continue
+		}
+		if m.Timeout != nil {
+			res.Timeout = *m.Timeout
+		}
+		if m.StreamTimeout != nil {
+			res.StreamTimeout = *m.StreamTimeout
+		}
+		if m.RateLimit != nil {
+			res.RateLimit, limiterKey = *m.RateLimit, fmt.Sprintf("model-%d", i)
+			if m.Burst != nil {
+				res.Burst = *m.Burst
+			}
+		}
+		return res, limiterKey
+	}
+	return res, limiterKey
+}
+
+func matchModel(patterns []string, model string) bool {
+	for _, p := range patterns {
+		if ok, err := path.Match(p, model); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// routeLimiter returns current limiter of routes, it's made of RouteLimits and ModelLimits until the first Reload
+func (s *Rest) routeLimiter() *routeLimiter {
+	if res := s.limiter.Load(); res != nil {
+		return res
+	}
+	settings := s.settings()
+	s.limiter.CompareAndSwap(nil, newRouteLimiter(settings.RouteLimits, settings.ModelLimits, nil))
+	return s.limiter.Load()
+}
+
+// limitRoute applies rate limit and timeouts of route group and requested model. It should follow authentication,
+// so rate limit is counted per client
+func (s *Rest) limitRoute(group string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			l := s.routeLimiter()
+			model, streaming := requestModel(r, group)
+			limits, limiterKey := l.limits(group, model)
+			if lmt := l.limiters[limiterKey]; lmt != nil && lmt.LimitReached(rateKey(r)) {
+				rest.SendErrorJSON(w, r, http.StatusTooManyRequests, errors.New("rate limit is exceeded"),
+					rest.ErrRateLimited, fmt.Sprintf("%v requests per second are allowed", limits.RateLimit))
+				return
+			}
+
+			timeout := limits.Timeout
+			if streaming {
+				timeout = limits.StreamTimeout
+			}
+			if timeout <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			// write deadline of server is replaced by the one of request, so long requests are not cut by server
+			err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + writeDeadlineMargin))
+			if err != nil && !errors.Is(err, http.ErrNotSupported) {
+				log.Printf("[WARN] can not set write deadline: %v", err)
+			}
+			if streaming {
+				// stream is cut when timeout is over, its status is already sent
+				ctx, cancel := context.WithTimeout(r.Context(), timeout)
+				defer cancel()
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+			middleware.Timeout(timeout)(next).ServeHTTP(w, r)
+		})
+	}
+}
+
+// limitIP applies rate limit of route group to requests from every IP. It should precede authentication,
+// so requests with invalid keys are limited too and keys can't be guessed faster than the limit
+func (s *Rest) limitIP(group string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			l := s.routeLimiter()
+			if lmt := l.limiters[ipLimiterKey(group)]; lmt != nil && lmt.LimitReached(ipKey(r)) {
+				rest.SendErrorJSON(w, r, http.StatusTooManyRequests, errors.New("rate limit is exceeded"),
+					rest.ErrRateLimited, fmt.Sprintf("%v requests per second are allowed from IP", l.groups[group].RateLimit))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ipLimiterKey is key of rate limiter of route group counting requests by IP
+func ipLimiterKey(group string) string {
+	return "ip-" + group
+}
+
+// rateKey identifies client of request for rate limit, anonymous clients are identified by IP
+func rateKey(r *http.Request) string {
+	if client := service.ClientFromContext(r.Context()); client != "" {
+		return "client:" + client
+	}
+	return ipKey(r)
+}
+
+// ipKey identifies IP of request for rate limit
+func ipKey(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr // RemoteAddr is set by RealIP from headers
+	}
+	return "ip:" + ip
+}
+
+// requestModel returns model of request and tells if it's streaming. Model of native api is taken from path,
+// model of OpenAI and Anthropic compatible api is taken from body, the body is kept for handler
+func requestModel(r *http.Request, group string) (model string, streaming bool) {
+	switch group {
+	case GroupAPI:
+		target, err := service.ParseTarget(chi.URLParam(r, "*"))
+		if err != nil {
+			return "", false
+		}
+		return target.Model, service.IsStreaming(target.Path())
+	case GroupV1:
+		if r.Body == nil || r.Method != http.MethodPost {
+			return "", false
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			// handler gets the same error, e.g. body is too large
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), errReader{err}))
+			return "", false
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var req struct {
+			Model  string `json:"model"`
+			Stream bool   `json:"stream"`
+		}
+		if json.Unmarshal(body, &req) != nil {
+			return "", false // invalid body is reported by handler
+		}
+		return strings.TrimPrefix(req.Model, "models/"), req.Stream
+	}
+	return "", false
+}
+
+// errReader fails every read with err
+type errReader struct{ err error }
+
+func (e errReader) Read([]byte) (int, error) { return 0, e.err }
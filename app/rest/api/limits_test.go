@@ -0,0 +1,187 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/theshamuel/gemini-proxy/app/rest"
+	"github.com/theshamuel/gemini-proxy/app/service"
+)
+
+func TestValidateLimits(t *testing.T) {
+	rate, burst := 1.0, 5
+	tbl := []struct {
+		name   string
+		groups map[string]RouteLimits
+		models []ModelLimits
+		err    string
+	}{
+		{"valid", DefaultRouteLimits, []ModelLimits{{Groups: []string{GroupV1}, Models: []string{"gemini-*"},
+			RateLimit: &rate, Burst: &burst}}, ""},
+		{"unknown group", map[string]RouteLimits{"web": {}}, nil,
+			`route group should be one of root, api, v1, admin, got "web"`},
+		{"no models", nil, []ModelLimits{{RateLimit: &rate}}, "model limits 0 have no models"},
+		{"admin models", nil, []ModelLimits{{Groups: []string{GroupAdmin}, Models: []string{"m"}}},
+			`model limits 0 should have groups api or v1, got "admin"`},
+		{"bad pattern", nil, []ModelLimits{{Models: []string{"gemini-["}}},
+			`model limits 0 have invalid pattern "gemini-[": syntax error in pattern`},
+		{"burst only", nil, []ModelLimits{{Models: []string{"m"}, Burst: &burst}},
+			"model limits 0 set burst without rate limit"},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateLimits(tt.groups, tt.models)
+			if tt.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tt.err)
+		})
+	}
+}
+
+func TestRouteLimiter_Limits(t *testing.T) {
+	timeout, rate := 5*time.Minute, 1.0
+	l := newRouteLimiter(map[string]RouteLimits{GroupAPI: {Timeout: time.Minute, RateLimit: 10}}, []ModelLimits{
+		{Groups: []string{GroupV1}, Models: []string{"gemini-2.5-flash"}, RateLimit: &rate},
+		{Models: []string{"gemini-2.5-pro*"}, Timeout: &timeout},
+	}, nil)
+
+	limits, key := l.limits(GroupAPI, "")
+	assert.Equal(t, RouteLimits{Timeout: time.Minute, RateLimit: 10}, limits)
+	assert.Equal(t, GroupAPI, key)
+
+	limits, key = l.limits(GroupAPI, "gemini-2.5-pro-preview")
+	assert.Equal(t, RouteLimits{Timeout: 5 * time.Minute, RateLimit: 10}, limits, "timeout of model")
+	assert.Equal(t, GroupAPI, key, "rate limit of group is shared")
+
+	limits, key = l.limits(GroupAPI, "gemini-2.5-flash")
+	assert.Equal(t, RouteLimits{Timeout: time.Minute, RateLimit: 10}, limits, "model limits of other group")
+	assert.Equal(t, GroupAPI, key)
+
+	limits, key = l.limits(GroupV1, "gemini-2.5-flash")
+	assert.Equal(t, RouteLimits{Timeout: 30 * time.Second, RateLimit: 1}, limits, "default limits of group")
+	assert.Equal(t, "model-0", key)
+	assert.NotNil(t, l.limiters[key])
+
+	limits, _ = l.limits(GroupRoot, "gemini-2.5-pro")
+	assert.Equal(t, DefaultRouteLimits[GroupRoot], limits)
+}
+
+func TestRest_LimitRoute(t *testing.T) {
+	timeout, rate := 50*time.Millisecond, 1.0
+	srv := &Rest{RouteLimits: map[string]RouteLimits{GroupV1: {Timeout: time.Minute}},
+		ModelLimits: []ModelLimits{{Models: []string{"slow"}, Timeout: &timeout},
+			{Models: []string{"limited"}, RateLimit: &rate}}}
+
+	var deadline time.Duration
+	var body string
+	h := srv.limitRoute(GroupV1)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline = 0
+		if d, ok := r.Context().Deadline(); ok {
+			deadline = time.Until(d)
+		}
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		body = string(b)
+		if strings.Contains(body, "slow") {
+			<-r.Context().Done()
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	send := func(client, reqBody string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(reqBody))
+		req = req.WithContext(service.WithClient(req.Context(), client))
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send("web", `{"model":"fast"}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `{"model":"fast"}`, body, "body is kept for handler")
+	assert.InDelta(t, time.Minute, deadline, float64(time.Second), "timeout of group")
+
+	rr = send("web", `{"model":"fast","stream":true}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Zero(t, deadline, "stream is not limited by default")
+
+	rr = send("web", `{"model":"slow"}`)
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code, "timeout of model")
+
+	assert.Equal(t, http.StatusOK, send("web", `{"model":"limited"}`).Code)
+	rr = send("web", `{"model":"limited"}`)
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	var resp struct {
+		Code int `json:"code"`
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Equal(t, rest.ErrRateLimited, resp.Code)
+	assert.Equal(t, http.StatusOK, send("mobile", `{"model":"limited"}`).Code, "rate limit is counted per client")
+
+	// read error of body is kept for handler
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", io.NopCloser(errReader{errors.New("too large")}))
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+}
+
+func TestRest_RateLimit(t *testing.T) {
+	rest := &Rest{Version: "test", Service: &service.GeminiProxy{},
+		RouteLimits: map[string]RouteLimits{GroupRoot: {RateLimit: 1}}}
+	ts := httptest.NewServer(rest.routes())
+	defer ts.Close()
+
+	get := func() int {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, ts.URL+"/ping", http.NoBody)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, get())
+	assert.Equal(t, http.StatusTooManyRequests, get())
+
+	rest.Reload(Settings{RouteLimits: map[string]RouteLimits{GroupRoot: {RateLimit: 1}}})
+	assert.Equal(t, http.StatusTooManyRequests, get(), "budget of the same rate limit is kept on reload")
+	rest.Reload(Settings{RouteLimits: map[string]RouteLimits{GroupRoot: {RateLimit: 100, Burst: 10}}})
+	assert.Equal(t, http.StatusOK, get(), "changed rate limit is applied on reload")
+	assert.Equal(t, http.StatusOK, get())
+}
+
+func TestRest_RateLimitBeforeAuth(t *testing.T) {
+	auth, err := NewAuth([]Client{{Name: "web", KeyHash: HashKey("secret")}})
+	require.NoError(t, err)
+	rest := &Rest{Version: "test", Service: &service.GeminiProxy{}, Auth: auth,
+		RouteLimits: map[string]RouteLimits{GroupAPI: {RateLimit: 1}}}
+	ts := httptest.NewServer(rest.routes())
+	defer ts.Close()
+
+	get := func(key string) int {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, ts.URL+"/api/models", http.NoBody)
+		require.NoError(t, err)
+		req.Header.Set("x-api-key", key)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusUnauthorized, get("guess-1"))
+	assert.Equal(t, http.StatusTooManyRequests, get("guess-2"), "invalid keys are rate limited by IP")
+	assert.Equal(t, http.StatusTooManyRequests, get("secret"), "IP over the limit is rejected before authentication")
+}
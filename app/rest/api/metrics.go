@@ -0,0 +1,61 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+
+	"github.com/theshamuel/gemini-proxy/app/service"
+)
+
+type requestLabelsKey struct{}
+
+// requestLabels are filled by handlers for request metrics, client and model are known after routing only
+type requestLabels struct {
+	model  string
+	client string
+}
+
+// metricsMiddleware records count and duration of requests by route pattern, model, client and status
+func (s *Rest) metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		done := s.Metrics.RequestStarted()
+		defer done()
+		labels := &requestLabels{}
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		start := time.Now()
+		next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), requestLabelsKey{}, labels)))
+
+		route := "none"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		s.Metrics.ObserveRequest(route, labels.model, labels.client, status, time.Since(start))
+	})
+}
+
+// otherModel is model label of requests to invalid or not allowed models, so random names don't make new series
+const otherModel = "other"
+
+// labelRequest sets model and client of request for metrics, model is resolved from alias and checked by allowlist
+func (s *Rest) labelRequest(r *http.Request, target service.Target) {
+	labels, ok := r.Context().Value(requestLabelsKey{}).(*requestLabels)
+	if !ok {
+		return
+	}
+	labels.client = ClientFromContext(r.Context())
+	labels.model = otherModel
+	if _, err := service.ParseTarget(target.Path()); err != nil {
+		return
+	}
+	if model, allowed := s.Service.AllowedModel(target); allowed {
+		labels.model = model
+	}
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/theshamuel/gemini-proxy/app/metrics"
+	"github.com/theshamuel/gemini-proxy/app/service"
+)
+
+func TestRest_Metrics(t *testing.T) {
+	gemini := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"usageMetadata":{"promptTokenCount":3,"candidatesTokenCount":5,"totalTokenCount":8}}`))
+	}))
+	defer gemini.Close()
+
+	ts, srv, teardown := startHTTPServer()
+	defer teardown()
+	srv.Metrics = metrics.New()
+	srv.Service = &service.GeminiProxy{BaseURL: gemini.URL, APIKey: "key", Metrics: srv.Metrics,
+		AllowedModels: []string{"gemini-2.5-*"}}
+	srv.Auth, _ = NewAuth([]Client{{Name: "alice", KeyHash: HashKey("alice-key")}})
+	ts.Config.Handler = srv.routes()
+
+	req, err := http.NewRequest("POST", ts.URL+"/api/models/gemini-2.5-pro:generateContent", strings.NewReader(testBody))
+	require.NoError(t, err)
+	req.Header.Set("x-goog-api-key", "alice-key")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, code := postRequest(t, ts.URL+"/api/models/gemini-2.5-pro:generateContent", "{}")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	for _, model := range []string{"random-1", "random-2", "%2e%2e"} {
+		req, err = http.NewRequest("POST", ts.URL+"/api/models/"+model+":generateContent", strings.NewReader(testBody))
+		require.NoError(t, err)
+		req.Header.Set("x-goog-api-key", "alice-key")
+		resp, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		assert.NotEqual(t, http.StatusOK, resp.StatusCode)
+	}
+
+	body, code := getRequest(t, ts.URL+"/metrics", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `gemini_proxy_requests_total{route="/api/*",model="gemini-2.5-pro",client="alice",status="200"} 1`)
+	assert.Contains(t, body, `gemini_proxy_requests_total{route="/api/*",model="",client="anonymous",status="401"} 1`)
+	assert.Contains(t, body, `gemini_proxy_requests_total{route="/api/*",model="other",client="alice",status="403"} 2`,
+		"models which are not allowed share label")
+	assert.Contains(t, body, `gemini_proxy_requests_total{route="/api/*",model="other",client="alice",status="404"} 1`)
+	assert.NotContains(t, body, "random-")
+	assert.Contains(t, body, `gemini_proxy_upstream_duration_seconds_count{model="gemini-2.5-pro",method="generateContent",status="200"} 1`)
+	assert.Contains(t, body, `gemini_proxy_tokens_total{model="gemini-2.5-pro",client="alice",type="candidates"} 5`)
+
+	srv.MetricsListen = "127.0.0.1:0"
+	ts.Config.Handler = srv.routes()
+	_, code = getRequest(t, ts.URL+"/metrics", "")
+	assert.Equal(t, http.StatusNotFound, code, "metrics are on separate listener")
+	body, code = getRequest(t, ts.URL+"/ping", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "pong\n", body)
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/render"
+
+	"github.com/theshamuel/gemini-proxy/app/gemini"
+	"github.com/theshamuel/gemini-proxy/app/openai"
+	"github.com/theshamuel/gemini-proxy/app/service"
+)
+
+// openaiError makes error body of OpenAI api
+func openaiError(status int, message string) any {
+	return openai.NewError(status, message)
+}
+
+// chatCompletionsHandler serves OpenAI chat/completions with generateContent of Gemini model named in request,
+// streaming request is served with streamGenerateContent and finished with [DONE] event
+func (s *Rest) chatCompletionsHandler(w http.ResponseWriter, r *http.Request) {
+	var req openai.ChatRequest
+	if err := DecodeJSON(r.Body, &req); err != nil {
+		sendAPIError(w, r, decodeStatus(err), fmt.Errorf("can not decode request: %w", err), openaiError)
+		return
+	}
+	geminiReq, err := req.ToGemini()
+	if err != nil {
+		sendAPIError(w, r, http.StatusBadRequest, err, openaiError)
+		return
+	}
+	if !s.validateTranslated(w, r, geminiReq, openaiError) {
+		return
+	}
+	body, err := json.Marshal(geminiReq)
+	if err != nil {
+		sendAPIError(w, r, http.StatusInternalServerError, err, openaiError)
+		return
+	}
+	model := req.GeminiModel()
+	target := service.Target{Model: model, Method: "generateContent"}
+	if req.Stream {
+		target.Method = "streamGenerateContent"
+	}
+	s.labelRequest(r, target)
+	log.Printf("[DEBUG] client %q calls chat completions of %s", clientLabel(r), model)
+	if !s.allowQuota(w, r) {
+		return
+	}
+
+	if req.Stream {
+		chunks := &openai.ChunkWriter{Model: req.Model, IncludeUsage: req.StreamOptions != nil && req.StreamOptions.IncludeUsage}
+		s.translateStream(w, r, target, body, openaiStream{chunks}, openaiError)
+		return
+	}
+
+	raw, ok := s.translateSend(w, r, target, body, openaiError)
+	if !ok {
+		return
+	}
+	if usage, ok := service.ParseUsage(raw); ok {
+		s.recordUsage(r, usage)
+	}
+	var resp gemini.GenerateContentResponse
+	if err = json.Unmarshal(raw, &resp); err != nil {
+		sendAPIError(w, r, http.StatusBadGateway, fmt.Errorf("can not decode Gemini response: %w", err), openaiError)
+		return
+	}
+	render.JSON(w, r, openai.FromGemini(resp, req.Model))
+}
+
+// embeddingsHandler serves OpenAI embeddings with embedContent for single input or batchEmbedContents for list
+func (s *Rest) embeddingsHandler(w http.ResponseWriter, r *http.Request) {
+	var req openai.EmbeddingRequest
+	if err := DecodeJSON(r.Body, &req); err != nil {
+		sendAPIError(w, r, decodeStatus(err), fmt.Errorf("can not decode request: %w", err), openaiError)
+		return
+	}
+	geminiReq, err := req.ToGemini()
+	if err != nil {
+		sendAPIError(w, r, http.StatusBadRequest, err, openaiError)
+		return
+	}
+	if !s.validateTranslated(w, r, geminiReq, openaiError) {
+		return
+	}
+	body, err := json.Marshal(geminiReq)
+	if err != nil {
+		sendAPIError(w, r, http.StatusInternalServerError, err, openaiError)
+		return
+	}
+	model := req.GeminiModel()
+	target := service.Target{Model: model, Method: req.Method()}
+	s.labelRequest(r, target)
+	log.Printf("[DEBUG] client %q calls embeddings of %s", clientLabel(r), model)
+	if !s.allowQuota(w, r) {
+		return
+	}
+
+	raw, ok := s.translateSend(w, r, target, body, openaiError)
+	if !ok {
+		return
+	}
+	resp, err := req.FromGemini(raw)
+	if err != nil {
+		sendAPIError(w, r, http.StatusBadGateway, err, openaiError)
+		return
+	}
+	s.recordUsage(r, service.Usage{PromptTokens: int64(resp.Usage.PromptTokens), TotalTokens: int64(resp.Usage.TotalTokens)})
+	render.JSON(w, r, resp)
+}
+
+// openaiStream sends chat.completion.chunk objects and [DONE] at the end
+type openaiStream struct {
+	chunks *openai.ChunkWriter
+}
+
+func (o openaiStream) Events(resp gemini.GenerateContentResponse) []sseEvent {
+	res := []sseEvent{}
+	for _, c := range o.chunks.Chunks(resp) {
+		res = append(res, sseEvent{Data: c})
+	}
+	return res
+}
+
+func (o openaiStream) Final() []sseEvent {
+	if c, ok := o.chunks.Final(); ok {
+		return []sseEvent{{Data: c}, {Data: "[DONE]"}}
+	}
+	return []sseEvent{{Data: "[DONE]"}}
+}
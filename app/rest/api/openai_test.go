@@ -0,0 +1,209 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/theshamuel/gemini-proxy/app/service"
+)
+
+func TestRest_ChatCompletions(t *testing.T) {
+	var geminiPath, geminiBody string
+	gemini := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		geminiPath = r.URL.Path
+		b, _ := io.ReadAll(r.Body)
+		geminiBody = string(b)
+		_, _ = w.Write([]byte(`{"responseId":"r1","candidates":[{"content":{"role":"model","parts":[{"text":"hi there"}]},` +
+			`"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":3,"candidatesTokenCount":2,"totalTokenCount":5}}`))
+	}))
+	defer gemini.Close()
+
+	ts, srv, teardown := startHTTPServer()
+	defer teardown()
+	srv.Service = &service.GeminiProxy{BaseURL: gemini.URL, APIKey: "key"}
+	ts.Config.Handler = srv.routes()
+
+	body, code := postRequest(t, ts.URL+"/v1/chat/completions",
+		`{"model":"gemini-2.5-flash","messages":[{"role":"user","content":"hello"}],"temperature":0}`)
+	require.Equal(t, http.StatusOK, code, body)
+	assert.Equal(t, "/models/gemini-2.5-flash:generateContent", geminiPath)
+	assert.JSONEq(t, `{"contents":[{"role":"user","parts":[{"text":"hello"}]}],"generationConfig":{"temperature":0}}`, geminiBody)
+
+	var resp struct {
+		ID      string `json:"id"`
+		Choices []struct {
+			Message      struct{ Content string } `json:"message"`
+			FinishReason string                   `json:"finish_reason"`
+		} `json:"choices"`
+		Usage struct {
+			TotalTokens int `json:"total_tokens"`
+		} `json:"usage"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &resp))
+	assert.Equal(t, "chatcmpl-r1", resp.ID)
+	require.Len(t, resp.Choices, 1)
+	assert.Equal(t, "hi there", resp.Choices[0].Message.Content)
+	assert.Equal(t, "stop", resp.Choices[0].FinishReason)
+	assert.Equal(t, 5, resp.Usage.TotalTokens)
+
+	body, code = postRequest(t, ts.URL+"/v1/chat/completions", `{"model":"gemini-2.5-flash","messages":[]}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.JSONEq(t, `{"error":{"message":"messages are required","type":"invalid_request_error","param":null,"code":null}}`, body)
+
+	body, code = postRequest(t, ts.URL+"/v1/chat/completions", `{"model":"gemini-2.5-flash","messages":[{"role":"user",
+		"content":[{"type":"image_url","image_url":{"url":"https://example.com/cat.png"}}]}]}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.JSONEq(t, `{"error":{"message":"message 0: image_url should be base64 data URL, e.g. data:image/png;base64,{data}, `+
+		`http URLs are not supported","type":"invalid_request_error","param":null,"code":null}}`, body)
+}
+
+func TestRest_ChatCompletionsUpstreamError(t *testing.T) {
+	gemini := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte(`{"error":{"code":429,"message":"quota exceeded","status":"RESOURCE_EXHAUSTED"}}`))
+	}))
+	defer gemini.Close()
+
+	ts, srv, teardown := startHTTPServer()
+	defer teardown()
+	srv.Service = &service.GeminiProxy{BaseURL: gemini.URL, APIKey: "key"}
+	ts.Config.Handler = srv.routes()
+
+	resp, err := http.Post(ts.URL+"/v1/chat/completions", "application/json",
+		strings.NewReader(`{"model":"gemini-2.5-flash","messages":[{"role":"user","content":"hello"}]}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "7", resp.Header.Get("Retry-After"))
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `"type":"rate_limit_error"`)
+}
+
+func TestRest_ChatCompletionsFilteredToolResult(t *testing.T) {
+	var geminiBody string
+	gemini := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		geminiBody = string(b)
+		_, _ = w.Write([]byte(`{"candidates":[{"content":{"role":"model","parts":[{"functionCall":{"name":"send_mail",` +
+			`"args":{"to":"[EMAIL_1]"}}}]},"finishReason":"STOP"}]}`))
+	}))
+	defer gemini.Close()
+
+	f, err := service.NewRegexFilter([]service.FilterRule{
+		{Name: "card", Pattern: regexp.MustCompile(`\b(?:\d[ -]?){13,15}\d\b`), Action: service.FilterReject},
+		{Name: "email", Pattern: regexp.MustCompile(`[\w.+-]+@[\w-]+\.[\w.]+`), Action: service.FilterTokenize},
+		{Name: "phone", Pattern: regexp.MustCompile(`\+\d{3}(\d{6})(\d{2})`), Action: service.FilterMask, Mask: "+***${2}"},
+	}, true)
+	require.NoError(t, err)
+	ts, srv, teardown := startHTTPServer()
+	defer teardown()
+	srv.Service = &service.GeminiProxy{BaseURL: gemini.URL, APIKey: "key", Filters: []service.ContentFilter{f}}
+	ts.Config.Handler = srv.routes()
+
+	request := func(toolResult string) string {
+		return `{"model":"gemini-2.5-flash","messages":[{"role":"user","content":"mail the owner"},` +
+			`{"role":"assistant","content":null,"tool_calls":[{"id":"c1","type":"function",` +
+			`"function":{"name":"find_owner","arguments":"{}"}}]},` +
+			`{"role":"tool","tool_call_id":"c1","content":` + strconv.Quote(toolResult) + `}]}`
+	}
+	body, code := postRequest(t, ts.URL+"/v1/chat/completions",
+		request(`{"email":"bob@example.com","phone":"+35712345678"}`))
+	require.Equal(t, http.StatusOK, code, body)
+	assert.NotContains(t, geminiBody, "bob@example.com")
+	assert.NotContains(t, geminiBody, "12345678")
+	assert.Contains(t, geminiBody, `"functionResponse":{"name":"find_owner","response":{"email":"[EMAIL_1]","phone":"+***78"}}`)
+	assert.Contains(t, body, `"arguments":"{\"to\":\"bob@example.com\"}"`, "token in function call is restored")
+
+	geminiBody = ""
+	body, code = postRequest(t, ts.URL+"/v1/chat/completions", request("card 4111 1111 1111 1111"))
+	assert.Equal(t, http.StatusBadRequest, code, body)
+	assert.Empty(t, geminiBody, "rejected tool result is not sent")
+}
+
+func TestRest_ChatCompletionsStreaming(t *testing.T) {
+	gemini := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/models/gemini-2.5-flash:streamGenerateContent", r.URL.Path)
+		assert.Equal(t, "sse", r.URL.Query().Get("alt"))
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: {\"responseId\":\"r1\",\"candidates\":[{\"content\":{\"role\":\"model\",\"parts\":[{\"text\":\"Hel\"}]}}]}\r\n\r\n" +
+			"data: {\"responseId\":\"r1\",\"candidates\":[{\"content\":{\"role\":\"model\",\"parts\":[{\"text\":\"lo\"}]},\"finishReason\":\"STOP\"}]," +
+			"\"usageMetadata\":{\"promptTokenCount\":1,\"candidatesTokenCount\":2,\"totalTokenCount\":3}}\r\n\r\n"))
+	}))
+	defer gemini.Close()
+
+	ts, srv, teardown := startHTTPServer()
+	defer teardown()
+	srv.Service = &service.GeminiProxy{BaseURL: gemini.URL, APIKey: "key"}
+	ts.Config.Handler = srv.routes()
+
+	resp, err := http.Post(ts.URL+"/v1/chat/completions", "application/json",
+		strings.NewReader(`{"model":"gemini-2.5-flash","messages":[{"role":"user","content":"hello"}],"stream":true,`+
+			`"stream_options":{"include_usage":true}}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	events := strings.Split(strings.TrimSuffix(string(b), "\n\n"), "\n\n")
+	require.Len(t, events, 4, string(b))
+	assert.Contains(t, events[0], `"delta":{"role":"assistant","content":"Hel"}`)
+	assert.Contains(t, events[1], `"delta":{"content":"lo"},"finish_reason":"stop"`)
+	assert.Contains(t, events[2], `"choices":[],"usage":{"prompt_tokens":1,"completion_tokens":2,"total_tokens":3}`)
+	assert.Equal(t, "data: [DONE]", events[3])
+}
+
+func TestRest_Embeddings(t *testing.T) {
+	var geminiPath, geminiBody string
+	gemini := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		geminiPath = r.URL.Path
+		b, _ := io.ReadAll(r.Body)
+		geminiBody = string(b)
+		if strings.HasSuffix(r.URL.Path, ":embedContent") {
+			_, _ = w.Write([]byte(`{"embedding":{"values":[0.5,0.25]}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"embeddings":[{"values":[1]},{"values":[2]}]}`))
+	}))
+	defer gemini.Close()
+
+	ts, srv, teardown := startHTTPServer()
+	defer teardown()
+	catalog, err := service.NewModelCatalog([]service.ModelAlias{{Name: "embed", Model: "gemini-embedding-001"}})
+	require.NoError(t, err)
+	srv.Service = &service.GeminiProxy{BaseURL: gemini.URL, APIKey: "key", Catalog: catalog}
+	ts.Config.Handler = srv.routes()
+
+	body, code := postRequest(t, ts.URL+"/v1/embeddings", `{"model":"gemini-embedding-001","input":"hello"}`)
+	require.Equal(t, http.StatusOK, code, body)
+	assert.Equal(t, "/models/gemini-embedding-001:embedContent", geminiPath)
+	assert.JSONEq(t, `{"object":"list","model":"gemini-embedding-001",
+		"data":[{"object":"embedding","index":0,"embedding":[0.5,0.25]}],
+		"usage":{"prompt_tokens":2,"completion_tokens":0,"total_tokens":2}}`, body)
+
+	body, code = postRequest(t, ts.URL+"/v1/embeddings", `{"model":"gemini-embedding-001","input":["a","b"]}`)
+	require.Equal(t, http.StatusOK, code, body)
+	assert.Equal(t, "/models/gemini-embedding-001:batchEmbedContents", geminiPath)
+	assert.Contains(t, body, `{"object":"embedding","index":1,"embedding":[2]}`)
+
+	body, code = postRequest(t, ts.URL+"/v1/embeddings", `{"model":"embed","input":["a","b"]}`)
+	require.Equal(t, http.StatusOK, code, body)
+	assert.Equal(t, "/models/gemini-embedding-001:batchEmbedContents", geminiPath)
+	assert.NotContains(t, geminiBody, "models/embed\"", "alias of batch requests is resolved")
+	assert.Equal(t, 2, strings.Count(geminiBody, `"model":"models/gemini-embedding-001"`))
+
+	_, code = postRequest(t, ts.URL+"/v1/embeddings", `{"model":"gemini-embedding-001","input":[[1,2]]}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
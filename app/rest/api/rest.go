@@ -1,48 +1,122 @@
 package api
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/didip/tollbooth/v7"
-	"github.com/didip/tollbooth_chi"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/go-chi/cors"
+	"github.com/go-chi/render"
+	"github.com/theshamuel/gemini-proxy/app/acme"
+	"github.com/theshamuel/gemini-proxy/app/gemini"
+	"github.com/theshamuel/gemini-proxy/app/metrics"
+	"github.com/theshamuel/gemini-proxy/app/quota"
 	"github.com/theshamuel/gemini-proxy/app/rest"
+	"github.com/theshamuel/gemini-proxy/app/service"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Route groups with their own CORS policy and limits
+const (
+	GroupRoot  = "root"  // /ping and /metrics
+	GroupAPI   = "api"   // native Gemini api
+	GroupV1    = "v1"    // OpenAI and Anthropic compatible api
+	GroupAdmin = "admin" // admin api
+)
+
+// RouteGroups are names of route groups in order of routes
+var RouteGroups = []string{GroupRoot, GroupAPI, GroupV1, GroupAdmin}
+
 // Rest structure represents abstraction contains http server, exposed interface and version
 type Rest struct {
-	Service        restInterface
-	Version        string
-	httpServer     *http.Server
-	DelayRequests  int
-	TLSEnabled     bool
-	CertPath       string
-	PrivateKeyPath string
-	lock           sync.Mutex
+	Service             restInterface
+	Auth                *Auth
+	AdminAuth           *Auth
+	Quota               *quota.Manager
+	Keys                *service.KeyPool
+	Cache               *service.ResponseCache // purged by admin api, requests are cached by Service
+	Limits              gemini.Limits
+	CORS                *CORS // policies of route groups, cross-origin requests are not allowed if nil
+	Metrics             *metrics.Metrics
+	MetricsListen       string // separate address of /metrics, empty to serve it on the main port
+	Version             string
+	httpServer          *http.Server
+	metricsServer       *http.Server
+	RelayUpstreamErrors bool
+	TLSEnabled          bool
+	CertPath            string
+	PrivateKeyPath      string
+	TLSMinVersion       uint16        // TLS 1.2 if zero
+	TLSCipherSuites     []uint16      // Go defaults if empty
+	ACME                *acme.Manager // certificate is issued by ACME instead of loaded from files if set
+	ACMEListen          string        // address of http-01 challenge, e.g. :80, no challenge server if empty
+	ClientAuth          *ClientAuth   // verification of client certificates, disabled if nil
+	Server              ServerOptions
+	RouteLimits         map[string]RouteLimits // by route group, DefaultRouteLimits for groups missing here
+	ModelLimits         []ModelLimits          // overrides of route limits for models, the first match wins
+	acmeServer          *http.Server
+	lock                sync.Mutex
+	live                atomic.Pointer[Settings]
+	limiter             atomic.Pointer[routeLimiter]
+	cert                atomic.Pointer[Certificate]
+	crl                 atomic.Pointer[RevocationList]
 }
 
 type restInterface interface {
-	Send(request io.ReadCloser) ([]byte, error)
-	GetMutex() *sync.Mutex
+	Send(ctx context.Context, targetPath string, request io.ReadCloser) ([]byte, error)
+	SendCached(ctx context.Context, targetPath string, request io.ReadCloser, cc service.CacheControl) ([]byte, string,
+		error)
+	Stream(ctx context.Context, targetPath string, request io.ReadCloser, w service.StreamWriter) error
+	Models() []service.Model
+	ApplyPolicy(ctx context.Context, target service.Target, body []byte) ([]byte, error)
+	AllowedModel(target service.Target) (string, bool)
 }
 
 // Run http server
 func (s *Rest) Run(port int) {
 	log.Printf("[INFO] Run http server on port %d", port)
+	if s.TLSEnabled && s.ACME == nil && s.cert.Load() == nil {
+		cert, err := LoadCertificate(s.CertPath, s.PrivateKeyPath)
+		if err != nil {
+			log.Printf("[ERROR] Run http server on port %d failed: %v", port, err)
+			return
+		}
+		s.cert.Store(cert)
+	}
 	s.lock.Lock()
 	s.httpServer = s.buildHTTPServer(port, s.routes())
+	if s.Metrics != nil && s.MetricsListen != "" {
+		s.metricsServer = &http.Server{
+			Addr:              s.MetricsListen,
+			Handler:           s.metricsRoutes(),
+			ReadHeaderTimeout: 5 * time.Second,
+			WriteTimeout:      10 * time.Second,
+		}
+		go s.runMetrics(s.metricsServer)
+	}
+	if s.TLSEnabled && s.ACME != nil && s.ACMEListen != "" {
+		s.acmeServer = &http.Server{
+			Addr:              s.ACMEListen,
+			Handler:           s.ACME.HTTPHandler(nil),
+			ReadHeaderTimeout: 5 * time.Second,
+			WriteTimeout:      10 * time.Second,
+		}
+		go s.runACME(s.acmeServer)
+	}
 	s.lock.Unlock()
 	var err error
 	if s.TLSEnabled {
-		err = s.httpServer.ListenAndServeTLS(s.CertPath, s.PrivateKeyPath)
+		s.httpServer.TLSConfig = s.tlsConfig()
+		err = s.httpServer.ListenAndServeTLS("", "")
 	} else {
 		err = s.httpServer.ListenAndServe()
 	}
@@ -65,36 +139,58 @@ func (s *Rest) Shutdown() {
 		}
 		log.Println("[DEBUG] shutdown http server completed")
 	}
+	if s.metricsServer != nil {
+		if err := s.metricsServer.Shutdown(ctx); err != nil {
+			log.Printf("[ERROR] metrics http shutdown error, %s", err)
+		}
+	}
+	if s.acmeServer != nil {
+		if err := s.acmeServer.Shutdown(ctx); err != nil {
+			log.Printf("[ERROR] ACME challenge http shutdown error, %s", err)
+		}
+	}
 	s.lock.Unlock()
 }
 
+func (s *Rest) runMetrics(srv *http.Server) {
+	log.Printf("[INFO] Run metrics http server on %s", srv.Addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("[ERROR] Run metrics http server on %s failed: %v", srv.Addr, err)
+	}
+}
+
+func (s *Rest) runACME(srv *http.Server) {
+	log.Printf("[INFO] Run ACME challenge http server on %s", srv.Addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("[ERROR] Run ACME challenge http server on %s failed: %v", srv.Addr, err)
+	}
+}
+
 func (s *Rest) buildHTTPServer(port int, router http.Handler) *http.Server {
 	return &http.Server{
 		Addr:              fmt.Sprintf(":%d", port),
 		Handler:           router,
-		ReadHeaderTimeout: 5 * time.Second,
-		WriteTimeout:      120 * time.Second,
-		IdleTimeout:       30 * time.Second,
+		ReadHeaderTimeout: s.Server.ReadHeaderTimeout,
+		WriteTimeout:      s.Server.WriteTimeout,
+		IdleTimeout:       s.Server.IdleTimeout,
 	}
 }
 
 func (s *Rest) routes() chi.Router {
 	router := chi.NewRouter()
-	router.Use(middleware.Throttle(1000), middleware.RealIP, middleware.Recoverer, middleware.Logger)
-
-	//corsMiddleware := cors.New(cors.Options{
-	//	AllowedOrigins: []string{"*"},
-	//	AllowedMethods: []string{"GET", "POST", "OPTIONS"},
-	//	AllowedHeaders: []string{"Accept", "Authorization", "Content-Type"},
-	//	MaxAge:         300,
-	//})
-
-	corsMiddleware := cors.AllowAll()
+	if s.Server.Throttle > 0 {
+		router.Use(middleware.Throttle(s.Server.Throttle))
+	}
+	router.Use(middleware.RealIP)
+	if s.Metrics != nil {
+		router.Use(s.metricsMiddleware)
+	}
+	router.Use(middleware.Recoverer, middleware.Logger)
 
 	//health check api
-	router.Use(corsMiddleware.Handler)
 	router.Route("/", func(api chi.Router) {
-		api.Use(tollbooth_chi.LimitHandler(tollbooth.NewLimiter(5, nil)))
+		api.Use(s.corsHandler(GroupRoot))
+		api.Use(s.limitRoute(GroupRoot))
 		// nolint:revive
 		api.Get("/ping", func(w http.ResponseWriter, r *http.Request) {
 			_, err := w.Write([]byte(fmt.Sprintln("pong")))
@@ -102,39 +198,86 @@ func (s *Rest) routes() chi.Router {
 				log.Printf("[ERROR] cannot write response: #%v", err)
 			}
 		})
+		if s.Metrics != nil && s.MetricsListen == "" {
+			api.Get("/metrics", s.Metrics.ServeHTTP)
+		}
 	})
 
 	router.Route("/api/", func(rapi chi.Router) {
+		rapi.Use(s.corsHandler(GroupAPI))
 		//app api
 		rapi.Group(func(api chi.Router) {
-			api.Use(middleware.Timeout(30 * time.Second))
-			api.Use(tollbooth_chi.LimitHandler(tollbooth.NewLimiter(50, nil)))
-			api.Use(middleware.NoCache)
+			api.Use(s.limitIP(GroupAPI), s.authenticate, middleware.NoCache, s.limitBody,
+				s.limitRoute(GroupAPI))
+			api.Get("/models", s.modelsHandler)
 			api.Post("/*", s.sendHandler)
 		})
 	})
 
+	router.Route("/v1/", func(rapi chi.Router) {
+		rapi.Use(s.corsHandler(GroupV1))
+		// OpenAI and Anthropic compatible api
+		rapi.Group(func(api chi.Router) {
+			api.Use(s.limitIP(GroupV1), s.authenticate, middleware.NoCache, s.limitBody,
+				s.limitRoute(GroupV1))
+			api.Post("/chat/completions", s.chatCompletionsHandler)
+			api.Post("/embeddings", s.embeddingsHandler)
+			api.Post("/messages", s.messagesHandler)
+		})
+	})
+
+	if s.AdminAuth != nil {
+		router.Route("/admin/", func(rapi chi.Router) {
+			rapi.Use(s.corsHandler(GroupAdmin))
+			rapi.Use(s.limitIP(GroupAdmin))
+			rapi.Use(s.AdminAuth.Middleware)
+			rapi.Use(s.limitRoute(GroupAdmin))
+			rapi.Use(middleware.NoCache)
+			rapi.Get("/usage", s.usageHandler)
+			rapi.Get("/keys", s.keysHandler)
+			rapi.Delete("/cache", s.purgeCacheHandler)
+		})
+	}
+
+	return router
+}
+
+// metricsRoutes serves /metrics only, it's used for separate metrics listener
+func (s *Rest) metricsRoutes() chi.Router {
+	router := chi.NewRouter()
+	router.Use(middleware.Recoverer)
+	router.Get("/metrics", s.Metrics.ServeHTTP)
 	return router
 }
 
 // nolint:dupl
 func (s *Rest) sendHandler(w http.ResponseWriter, r *http.Request) {
 
-	if s.DelayRequests > 0 {
-		s.Service.GetMutex().Lock()
-		defer s.Service.GetMutex().Unlock()
-		time.Sleep(1 * time.Second)
+	log.Printf("[DEBUG] client %q calls %s", clientLabel(r), chi.URLParam(r, "*"))
+	target, errTarget := service.ParseTarget(chi.URLParam(r, "*"))
+	s.labelRequest(r, target)
+	if errTarget == nil && (!s.validateRequest(w, r, target) || !s.applyPolicy(w, r, target)) {
+		return
+	}
+	if !s.allowQuota(w, r) {
+		return
 	}
 
-	resp, err := s.Service.Send(r.Body)
+	if service.IsStreaming(chi.URLParam(r, "*")) {
+		s.streamHandler(w, r)
+		return
+	}
 
+	resp, cached, err := s.send(w, r)
 	if err != nil {
-		log.Printf("[ERROR] can not calculate min with error: %s", err.Error())
-		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, rest.ErrServerInternal, "")
+		s.sendProxyError(w, r, err)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
+	if usage, ok := service.ParseUsage(resp); ok && !cached {
+		s.recordUsage(r, usage)
+	}
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 	_, err = w.Write(resp)
 	if err != nil {
 		log.Printf("[ERROR] can not write response")
@@ -142,6 +285,252 @@ func (s *Rest) sendHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// applyPolicy replaces request body with the one changed by prompt policies of client and model
+func (s *Rest) applyPolicy(w http.ResponseWriter, r *http.Request, target service.Target) bool {
+	body, err := io.ReadAll(r.Body)
+	if err == nil {
+		body, err = s.Service.ApplyPolicy(r.Context(), target, body)
+	}
+	if err != nil {
+		s.sendProxyError(w, r, err)
+		return false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return true
+}
+
+// send proxies request to Gemini through response cache. X-Cache header tells if response is taken from cache,
+// Cache-Control: no-cache of the request skips cache lookup and no-store prevents caching of the response
+func (s *Rest) send(w http.ResponseWriter, r *http.Request) (resp []byte, cached bool, err error) {
+	cacheControl := strings.ToLower(r.Header.Get("Cache-Control"))
+	resp, cacheResult, err := s.Service.SendCached(r.Context(), chi.URLParam(r, "*"), r.Body, service.CacheControl{
+		NoCache: strings.Contains(cacheControl, "no-cache"), NoStore: strings.Contains(cacheControl, "no-store")})
+	if cacheResult != "" {
+		w.Header().Set("X-Cache", cacheResult)
+	}
+	return resp, cacheResult == service.CacheHit, err
+}
+
+// streamHandler proxies SSE stream
+func (s *Rest) streamHandler(w http.ResponseWriter, r *http.Request) {
+	sw := newSSEWriter(w)
+
+	err := s.Service.Stream(r.Context(), chi.URLParam(r, "*"), r.Body, sw)
+	if sw.hasUsage {
+		s.recordUsage(r, sw.usage)
+	}
+
+	switch {
+	case err == nil:
+		return
+	case sw.started:
+		// headers are already sent, the only option is to break the stream
+		log.Printf("[WARN] stream %s of client %q is interrupted: %v", chi.URLParam(r, "*"), clientLabel(r), err)
+	default:
+		s.sendProxyError(w, r, err)
+	}
+}
+
+// sendProxyError responds with error of proxied request. Gemini errors are mapped to status and code
+// telling the client whether it's its fault, a quota issue or Gemini outage
+func (s *Rest) sendProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	status, code := proxyErrorStatus(err)
+	if ra := retryAfter(err); ra != "" {
+		w.Header().Set("Retry-After", ra)
+	}
+	details := ""
+	var upstreamErr *service.UpstreamError
+	switch {
+	case errors.As(err, &upstreamErr):
+		log.Printf("[WARN] Gemini rejected request of client %q: %v", clientLabel(r), err)
+		if s.RelayUpstreamErrors && json.Valid(upstreamErr.Body) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			if _, errWrite := w.Write(upstreamErr.Body); errWrite != nil {
+				log.Printf("[ERROR] can not write response")
+			}
+			return
+		}
+		details = upstreamErr.Status
+	case code == rest.ErrBadTarget:
+		details = chi.URLParam(r, "*")
+	case code == rest.ErrServerInternal:
+		log.Printf("[ERROR] can not proxy request of client %q with error: %s", clientLabel(r), err.Error())
+	}
+	rest.SendErrorJSON(w, r, status, err, code, details)
+}
+
+// proxyErrorStatus maps error of proxied request to response status and error code
+func proxyErrorStatus(err error) (status, code int) {
+	var upstreamErr *service.UpstreamError
+	switch {
+	case errors.Is(err, service.ErrBadTarget):
+		return http.StatusNotFound, rest.ErrBadTarget
+	case errors.Is(err, service.ErrBadRequest):
+		return http.StatusBadRequest, rest.ErrJSONDecode
+	case errors.Is(err, service.ErrNotAllowed):
+		return http.StatusForbidden, rest.ErrNotAllowed
+	case errors.Is(err, service.ErrRejected):
+		return http.StatusBadRequest, rest.ErrRejected
+	case errors.Is(err, service.ErrQueueFull), errors.Is(err, service.ErrQueueTimeout):
+		return http.StatusServiceUnavailable, rest.ErrOverloaded
+	case errors.As(err, &upstreamErr):
+		return upstreamStatus(upstreamErr)
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, rest.ErrUpstreamUnavailable
+	default:
+		return http.StatusInternalServerError, rest.ErrServerInternal
+	}
+}
+
+// retryAfter returns Retry-After for error of proxied request, Gemini value is passed through
+// and full queue is worth retrying in a second
+func retryAfter(err error) string {
+	var upstreamErr *service.UpstreamError
+	switch {
+	case errors.Is(err, service.ErrQueueFull), errors.Is(err, service.ErrQueueTimeout):
+		return "1"
+	case errors.As(err, &upstreamErr):
+		return upstreamErr.Header.Get("Retry-After")
+	}
+	return ""
+}
+
+// upstreamStatus maps Gemini error to response status and error code. Auth errors of Gemini are caused by
+// proxy api key rather than the client, so they are reported as bad gateway
+func upstreamStatus(e *service.UpstreamError) (status, code int) {
+	switch e.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return e.StatusCode, rest.ErrUpstreamBadRequest
+	case http.StatusNotFound:
+		return http.StatusNotFound, rest.ErrUpstreamNotFound
+	case http.StatusTooManyRequests:
+		return http.StatusTooManyRequests, rest.ErrUpstreamRateLimit
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return http.StatusBadGateway, rest.ErrUpstreamAuth
+	case http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return e.StatusCode, rest.ErrUpstreamUnavailable
+	default:
+		return http.StatusBadGateway, rest.ErrUpstream
+	}
+}
+
+// clientLabel returns client name used in logs, requests are anonymous when auth is not configured
+func clientLabel(r *http.Request) string {
+	if name := ClientFromContext(r.Context()); name != "" {
+		return name
+	}
+	return "anonymous"
+}
+
+// allowQuota checks client budget and responds with 429 if it's exhausted
+func (s *Rest) allowQuota(w http.ResponseWriter, r *http.Request) bool {
+	if s.Quota == nil {
+		return true
+	}
+	err := s.Quota.Allow(ClientFromContext(r.Context()))
+	if err == nil {
+		return true
+	}
+	var exceeded *quota.ExceededError
+	if errors.As(err, &exceeded) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(exceeded.ResetAt).Seconds())+1))
+		rest.SendErrorJSON(w, r, http.StatusTooManyRequests, err, rest.ErrQuotaExceeded,
+			fmt.Sprintf("%s limit is %d, resets at %s", exceeded.Limit, exceeded.Max, exceeded.ResetAt.Format(time.RFC3339)))
+		return false
+	}
+	rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, rest.ErrServerInternal, "can't check quota")
+	return false
+}
+
+func (s *Rest) recordUsage(r *http.Request, usage service.Usage) {
+	if s.Quota == nil {
+		return
+	}
+	if err := s.Quota.Record(ClientFromContext(r.Context()), usage.PromptTokens, usage.CandidatesTokens); err != nil {
+		log.Printf("[WARN] can not record usage of client %q: %v", clientLabel(r), err)
+	}
+}
+
+// modelsHandler lists model aliases and Gemini models clients are allowed to use
+func (s *Rest) modelsHandler(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, map[string]interface{}{"models": s.Service.Models()})
+}
+
+// usageHandler reports usage of clients with quota in current window
+func (s *Rest) usageHandler(w http.ResponseWriter, r *http.Request) {
+	if s.Quota == nil {
+		render.JSON(w, r, []quota.ClientUsage{})
+		return
+	}
+	report, err := s.Quota.Report()
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, rest.ErrServerInternal, "can't get usage")
+		return
+	}
+	render.JSON(w, r, report)
+}
+
+// keysHandler reports health of Gemini API keys, keys are identified by fingerprints only
+func (s *Rest) keysHandler(w http.ResponseWriter, r *http.Request) {
+	keys := s.settings().Keys
+	if keys == nil {
+		render.JSON(w, r, []service.KeyHealth{})
+		return
+	}
+	render.JSON(w, r, keys.Health())
+}
+
+// purgeCacheHandler removes all cached responses
+func (s *Rest) purgeCacheHandler(w http.ResponseWriter, r *http.Request) {
+	purged := 0
+	if s.Cache != nil {
+		purged = s.Cache.Purge()
+		log.Printf("[INFO] %d cached responses are purged", purged)
+	}
+	render.JSON(w, r, map[string]interface{}{"purged": purged})
+}
+
+// sseWriter writes SSE headers on the first event and flushes every event down to the client.
+// It keeps the last usageMetadata seen in the stream
+type sseWriter struct {
+	http.ResponseWriter
+	rc       *http.ResponseController
+	started  bool
+	usage    service.Usage
+	hasUsage bool
+}
+
+// newSSEWriter makes sseWriter, write deadline of http server is lifted as the stream could be long
+func newSSEWriter(w http.ResponseWriter) *sseWriter {
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("[DEBUG] can not reset write deadline for stream: %v", err)
+	}
+	return &sseWriter{ResponseWriter: w, rc: rc}
+}
+
+func (sw *sseWriter) Write(p []byte) (int, error) {
+	if u, ok := service.ParseEventUsage(p); ok {
+		sw.usage, sw.hasUsage = u, true
+	}
+	if !sw.started {
+		sw.started = true
+		sw.Header().Set("Content-Type", "text/event-stream")
+		sw.Header().Set("Cache-Control", "no-cache")
+		sw.Header().Set("X-Accel-Buffering", "no")
+		sw.WriteHeader(http.StatusOK)
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+func (sw *sseWriter) Flush() error {
+	if !sw.started {
+		return nil
+	}
+	return sw.rc.Flush()
+}
+
 // DecodeJSON decodes a given reader into an interface using the json decoder.
 func DecodeJSON(r io.Reader, v interface{}) error {
 	defer io.Copy(io.Discard, r) //nolint:errcheck
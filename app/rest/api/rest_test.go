@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/theshamuel/gemini-proxy/app/quota"
+	"github.com/theshamuel/gemini-proxy/app/rest"
 	"github.com/theshamuel/gemini-proxy/app/service"
 	"go.uber.org/goleak"
 	"io"
@@ -11,6 +13,8 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -60,6 +64,198 @@ func TestRest_Ping(t *testing.T) {
 	assert.Equal(t, http.StatusOK, code)
 }
 
+func TestRest_SendRouting(t *testing.T) {
+	gemini := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"path":"` + r.URL.Path + `"}`))
+	}))
+	defer gemini.Close()
+
+	ts, rest, teardown := startHTTPServer()
+	defer teardown()
+	rest.Service = &service.GeminiProxy{
+		BaseURL:        gemini.URL + "/v1beta",
+		APIKey:         "key",
+		AllowedModels:  []string{"gemini-2.5-pro"},
+		AllowedMethods: []string{"generateContent", "countTokens"},
+	}
+
+	res, code := postRequest(t, ts.URL+"/api/models/gemini-2.5-pro:countTokens", `{}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"path":"/v1beta/models/gemini-2.5-pro:countTokens"}`, res)
+
+	_, code = postRequest(t, ts.URL+"/api/models/gemini-2.0-flash:generateContent", testBody)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	_, code = postRequest(t, ts.URL+"/api/files", `{}`)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestRest_SendStreaming(t *testing.T) {
+	gemini := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "sse", r.URL.Query().Get("alt"))
+		_, _ = w.Write([]byte("data: {\"n\":1}\n\n"))
+		w.(http.Flusher).Flush()
+		_, _ = w.Write([]byte("data: {\"n\":2}\n\n"))
+	}))
+	defer gemini.Close()
+
+	ts, rest, teardown := startHTTPServer()
+	defer teardown()
+	rest.Service = &service.GeminiProxy{BaseURL: gemini.URL, APIKey: "key"}
+
+	resp, err := http.Post(ts.URL+"/api/models/gemini-2.5-pro:streamGenerateContent?alt=sse", "application/json",
+		strings.NewReader(testBody))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "data: {\"n\":1}\n\ndata: {\"n\":2}\n\n", string(body))
+}
+
+func TestRest_Quota(t *testing.T) {
+	gemini := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"usageMetadata":{"promptTokenCount":4,"candidatesTokenCount":6}}`))
+	}))
+	defer gemini.Close()
+
+	ts, rest, teardown := startHTTPServer()
+	defer teardown()
+	rest.Service = &service.GeminiProxy{BaseURL: gemini.URL, APIKey: "gemini-key"}
+	rest.Auth, _ = NewAuth([]Client{{Name: "web", KeyHash: HashKey("proxy-key")}})
+	rest.AdminAuth, _ = NewAuth([]Client{{Name: "admin", KeyHash: HashKey("admin-key")}})
+	rest.Quota = &quota.Manager{Store: quota.NewMemStore(), Limits: map[string]quota.Limits{"web": {Period: quota.Day, CandidateTokens: 10}}}
+	ts.Config.Handler = rest.routes()
+
+	send := func(url, key string) (string, *http.Response) {
+		req, err := http.NewRequest("GET", url, nil)
+		if strings.Contains(url, "/api/") {
+			req, err = http.NewRequest("POST", url, strings.NewReader(testBody))
+		}
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+key)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return string(body), resp
+	}
+
+	_, resp := send(ts.URL+"/api/models/gemini-2.5-pro:generateContent", "proxy-key")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, resp = send(ts.URL+"/api/models/gemini-2.5-pro:generateContent", "proxy-key")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, resp := send(ts.URL+"/api/models/gemini-2.5-pro:generateContent", "proxy-key")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+	assert.Contains(t, body, `"code":5`)
+
+	_, resp = send(ts.URL+"/admin/usage", "proxy-key")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	body, resp = send(ts.URL+"/admin/usage", "admin-key")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, `"usage":{"requests":2,"prompt_tokens":8,"candidate_tokens":12}`)
+}
+
+func TestRest_SendUpstreamError(t *testing.T) {
+	status := http.StatusBadRequest
+	gemini := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(`{"error":{"code":` + strconv.Itoa(status) + `,"message":"oops","status":"SOME_STATUS"}}`))
+	}))
+	defer gemini.Close()
+
+	ts, srv, teardown := startHTTPServer()
+	defer teardown()
+	srv.Service = &service.GeminiProxy{BaseURL: gemini.URL, APIKey: "key"}
+
+	tbl := []struct {
+		upstream, status, code int
+	}{
+		{http.StatusBadRequest, http.StatusBadRequest, rest.ErrUpstreamBadRequest},
+		{http.StatusNotFound, http.StatusNotFound, rest.ErrUpstreamNotFound},
+		{http.StatusTooManyRequests, http.StatusTooManyRequests, rest.ErrUpstreamRateLimit},
+		{http.StatusForbidden, http.StatusBadGateway, rest.ErrUpstreamAuth},
+		{http.StatusServiceUnavailable, http.StatusServiceUnavailable, rest.ErrUpstreamUnavailable},
+		{http.StatusInternalServerError, http.StatusBadGateway, rest.ErrUpstream},
+	}
+	for _, tt := range tbl {
+		status = tt.upstream
+		body, code := postRequest(t, ts.URL+"/api/models/gemini-2.5-pro:generateContent", testBody)
+		assert.Equal(t, tt.status, code)
+		assert.Contains(t, body, `"code":`+strconv.Itoa(tt.code)+`,"details":"SOME_STATUS"`)
+	}
+
+	srv.RelayUpstreamErrors = true
+	status = http.StatusTooManyRequests
+	body, code := postRequest(t, ts.URL+"/api/models/gemini-2.5-pro:generateContent", testBody)
+	assert.Equal(t, http.StatusTooManyRequests, code)
+	assert.Equal(t, `{"error":{"code":429,"message":"oops","status":"SOME_STATUS"}}`, body)
+}
+
+func TestRest_SendCached(t *testing.T) {
+	calls := 0
+	gemini := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		_, _ = w.Write([]byte(`{"n":` + strconv.Itoa(calls) + `}`))
+	}))
+	defer gemini.Close()
+
+	ts, srv, teardown := startHTTPServer()
+	defer teardown()
+	srv.Cache = service.NewResponseCache(time.Minute, 10, 0, false)
+	srv.Service = &service.GeminiProxy{BaseURL: gemini.URL, APIKey: "key", Cache: srv.Cache}
+	srv.AdminAuth, _ = NewAuth([]Client{{Name: "admin", KeyHash: HashKey("admin-key")}})
+	ts.Config.Handler = srv.routes()
+
+	send := func(body, cacheControl string) (string, string) {
+		req, err := http.NewRequest("POST", ts.URL+"/api/models/gemini-2.5-pro:generateContent", strings.NewReader(body))
+		require.NoError(t, err)
+		if cacheControl != "" {
+			req.Header.Set("Cache-Control", cacheControl)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(b), resp.Header.Get("X-Cache")
+	}
+
+	deterministic := `{"contents":[{"parts":[{"text":"hi"}]}],"generationConfig":{"temperature":0}}`
+	body, cache := send(deterministic, "")
+	assert.Equal(t, `{"n":1}`, body)
+	assert.Equal(t, "MISS", cache)
+	body, cache = send(deterministic, "")
+	assert.Equal(t, `{"n":1}`, body)
+	assert.Equal(t, "HIT", cache)
+	body, cache = send(deterministic, "no-cache")
+	assert.Equal(t, `{"n":2}`, body)
+	assert.Equal(t, "MISS", cache)
+	body, cache = send(testBody, "")
+	assert.Equal(t, `{"n":3}`, body)
+	assert.Empty(t, cache, "non-deterministic request is not cached")
+
+	req, err := http.NewRequest("DELETE", ts.URL+"/admin/cache", nil)
+	require.NoError(t, err)
+	req.Header.Set("x-goog-api-key", "admin-key")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, `{"purged":1}`+"\n", string(b))
+
+	body, cache = send(deterministic, "")
+	assert.Equal(t, `{"n":4}`, body)
+	assert.Equal(t, "MISS", cache)
+}
+
+// testBody is minimal valid generateContent request
+const testBody = `{"contents":[{"parts":[{"text":"hi"}]}]}`
+
 func startHTTPServer() (ts *httptest.Server, rest *Rest, gracefulTeardown func()) {
 	rest = &Rest{
 		Version: "test",
@@ -110,6 +306,80 @@ func getRequest(t *testing.T, url string, rBody string) (data string, statusCode
 	return string(body), resp.StatusCode
 }
 
+func postRequest(t *testing.T, url string, rBody string) (data string, statusCode int) {
+	resp, err := http.Post(url, "application/json", strings.NewReader(rBody))
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	return string(body), resp.StatusCode
+}
+
 func TestMain(m *testing.M) {
 	goleak.VerifyTestMain(m)
 }
+
+func TestRest_Models(t *testing.T) {
+	ts, srv, teardown := startHTTPServer()
+	defer teardown()
+	catalog, err := service.NewModelCatalog([]service.ModelAlias{{Name: "fast", Model: "gemini-2.5-flash"}})
+	require.NoError(t, err)
+	srv.Service = &service.GeminiProxy{AllowedModels: []string{"gemini-2.5-pro"}, Catalog: catalog}
+	ts.Config.Handler = srv.routes()
+
+	body, code := getRequest(t, ts.URL+"/api/models", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"models":[{"name":"fast","model":"gemini-2.5-flash","alias":true},
+		{"name":"gemini-2.5-pro","model":"gemini-2.5-pro","alias":false}]}`, body)
+}
+
+func TestRest_Policy(t *testing.T) {
+	var bodies []string
+	gemini := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		_, _ = w.Write([]byte(`{"candidates":[{"content":{"role":"model","parts":[{"text":"ok"}]},"finishReason":"STOP"}]}`))
+	}))
+	defer gemini.Close()
+
+	policies, err := service.NewPolicySet([]service.PromptPolicy{{Name: "company", SystemInstruction: "You work for ACME.",
+		MaxOutputTokens: 100, Strip: []string{"tools"}}})
+	require.NoError(t, err)
+	ts, srv, teardown := startHTTPServer()
+	defer teardown()
+	srv.Service = &service.GeminiProxy{BaseURL: gemini.URL, APIKey: "key", Policies: policies}
+
+	_, code := postRequest(t, ts.URL+"/api/models/gemini-2.5-pro:generateContent",
+		`{"contents":[{"parts":[{"text":"hi"}]}],"tools":[{}],"generationConfig":{"maxOutputTokens":500}}`)
+	assert.Equal(t, http.StatusOK, code)
+	_, code = postRequest(t, ts.URL+"/v1/chat/completions", `{"model":"gemini-2.5-pro","messages":[{"role":"user","content":"hi"}]}`)
+	assert.Equal(t, http.StatusOK, code)
+
+	require.Len(t, bodies, 2)
+	assert.JSONEq(t, `{"contents":[{"parts":[{"text":"hi"}]}],"generationConfig":{"maxOutputTokens":100},
+		"systemInstruction":{"parts":[{"text":"You work for ACME."}]}}`, bodies[0])
+	assert.JSONEq(t, `{"contents":[{"role":"user","parts":[{"text":"hi"}]}],"generationConfig":{"maxOutputTokens":100},
+		"systemInstruction":{"parts":[{"text":"You work for ACME."}]}}`, bodies[1])
+}
+
+func TestRest_ContentFilter(t *testing.T) {
+	gemini := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer gemini.Close()
+
+	filter, err := service.NewRegexFilter([]service.FilterRule{{Name: "card", Pattern: regexp.MustCompile(`\d{16}`),
+		Action: service.FilterReject}}, false)
+	require.NoError(t, err)
+	ts, srv, teardown := startHTTPServer()
+	defer teardown()
+	srv.Service = &service.GeminiProxy{BaseURL: gemini.URL, APIKey: "key", Filters: []service.ContentFilter{filter}}
+
+	body, code := postRequest(t, ts.URL+"/api/models/gemini-2.5-pro:generateContent",
+		`{"contents":[{"parts":[{"text":"card 4111111111111111"}]}]}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, `{"code":8,"details":"","error":"request is rejected by content filter, rule card"}`+"\n", body)
+
+	_, code = postRequest(t, ts.URL+"/api/models/gemini-2.5-pro:generateContent", testBody)
+	assert.Equal(t, http.StatusOK, code)
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/theshamuel/gemini-proxy/app/gemini"
+	"github.com/theshamuel/gemini-proxy/app/service"
+)
+
+// Settings are parts of Rest configuration which could be changed without restart, see Rest.Reload
+type Settings struct {
+	Auth        *Auth
+	Keys        *service.KeyPool
+	Limits      gemini.Limits
+	CORS        *CORS        // cross-origin requests are not allowed if nil
+	Certificate *Certificate // TLS certificate, the current one is kept if nil
+	RouteLimits map[string]RouteLimits
+	ModelLimits []ModelLimits
+}
+
+// Reload replaces settings at once, requests in flight finish with settings they started with
+func (s *Rest) Reload(settings Settings) {
+	if settings.Certificate != nil {
+		s.cert.Store(settings.Certificate)
+	}
+	settings.Certificate = nil // certificate is kept apart, it's reloaded by WatchTLS too
+	s.live.Store(&settings)
+	s.limiter.Store(newRouteLimiter(settings.RouteLimits, settings.ModelLimits, s.limiter.Load()))
+}
+
+// settings returns current settings, they are taken from fields of Rest until the first Reload
+func (s *Rest) settings() Settings {
+	if res := s.live.Load(); res != nil {
+		return *res
+	}
+	return Settings{Auth: s.Auth, Keys: s.Keys, Limits: s.Limits, CORS: s.CORS, RouteLimits: s.RouteLimits,
+		ModelLimits: s.ModelLimits}
+}
+
+// authenticate checks proxy key with current clients, everyone is allowed if no clients are configured
+func (s *Rest) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := s.settings().Auth
+		if auth == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		auth.Middleware(next).ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/theshamuel/gemini-proxy/app/gemini"
+	"github.com/theshamuel/gemini-proxy/app/service"
+)
+
+func TestRest_Reload(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	ts, rest, teardown := startHTTPServer()
+	defer teardown()
+	rest.Service = &service.GeminiProxy{BaseURL: upstream.URL, APIKey: "gemini-key"}
+
+	_, code := postRequest(t, ts.URL+"/api/models/gemini-2.5-pro:generateContent", testBody)
+	assert.Equal(t, http.StatusOK, code, "no clients are configured")
+
+	auth, err := NewAuth([]Client{{Name: "web", KeyHash: HashKey("proxy-key")}})
+	require.NoError(t, err)
+	rest.Reload(Settings{Auth: auth, Limits: gemini.Limits{MaxBodySize: 50}})
+
+	_, code = postRequest(t, ts.URL+"/api/models/gemini-2.5-pro:generateContent", testBody)
+	assert.Equal(t, http.StatusUnauthorized, code, "reloaded clients are checked")
+
+	send := func(body string) int {
+		req, err := http.NewRequest("POST", ts.URL+"/api/models/gemini-2.5-pro:generateContent", strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("x-goog-api-key", "proxy-key")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, send(testBody))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, send(`{"contents":[{"parts":[{"text":"`+strings.Repeat("a", 50)+`"}]}]}`),
+		"reloaded limits are applied")
+}
+
+func TestRest_ReloadCertificate(t *testing.T) {
+	rest := &Rest{}
+	_, err := rest.getCertificate(nil)
+	assert.EqualError(t, err, "TLS certificate is not loaded")
+
+	_, err = LoadCertificate("no.crt", "no.key")
+	require.Error(t, err)
+
+	certPath, keyPath := writeTestCertificate(t, "first")
+	cert, err := LoadCertificate(certPath, keyPath)
+	require.NoError(t, err)
+	rest.Reload(Settings{Certificate: cert})
+	got, err := rest.getCertificate(nil)
+	require.NoError(t, err)
+	assert.Same(t, &cert.Certificate, got)
+
+	rest.Reload(Settings{})
+	got, err = rest.getCertificate(nil)
+	require.NoError(t, err)
+	assert.Same(t, &cert.Certificate, got, "certificate is kept if it's not reloaded")
+}
+
+// writeTestCertificate writes self-signed certificate and its key to temp dir
+func writeTestCertificate(t *testing.T, name string) (certPath, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certPath, keyPath = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+	return certPath, keyPath
+}
@@ -0,0 +1,343 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/theshamuel/gemini-proxy/app/acme"
+)
+
+// clientAuthModes are names of TLS client certificate verification modes in config
+var clientAuthModes = map[string]tls.ClientAuthType{
+	"none":     tls.NoClientCert,
+	"optional": tls.VerifyClientCertIfGiven,
+	"require":  tls.RequireAndVerifyClientCert,
+}
+
+// ClientAuth is verification of TLS client certificates (mTLS), verified certificate identifies client, see Client
+type ClientAuth struct {
+	Mode tls.ClientAuthType // optional or required verification
+	CAs  []*x509.Certificate
+	CRL  *RevocationList // revoked client certificates, nil if not checked
+}
+
+// RevocationList is set of revoked certificates read from CRL file, file is loaded again by WatchTLS when it's changed
+type RevocationList struct {
+	path       string
+	stamp      fileStamp
+	issuers    []*x509.Certificate
+	revoked    map[string]bool // raw issuer + serial number
+	NextUpdate time.Time       // the earliest next update of CRLs in the file
+}
+
+// tlsVersions are names of TLS versions in config
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Certificate is TLS certificate with files it's loaded from, changed files are loaded again by WatchTLS
+type Certificate struct {
+	tls.Certificate
+	certPath, keyPath   string
+	certStamp, keyStamp fileStamp
+}
+
+// fileStamp is modification time and size of file, file is considered changed when any of them is changed
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func stampOf(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// LoadCertificate reads TLS certificate and private key pair
+func LoadCertificate(certPath, keyPath string) (*Certificate, error) {
+	res := &Certificate{certPath: certPath, keyPath: keyPath}
+	// files are stamped before reading, so change made while they are read is noticed by the next check
+	res.certStamp, _ = stampOf(certPath)
+	res.keyStamp, _ = stampOf(keyPath)
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("can not load TLS certificate %s: %w", certPath, err)
+	}
+	res.Certificate = cert
+	return res, nil
+}
+
+// changed tells if certificate or private key file is changed since the certificate is loaded
+func (c *Certificate) changed() bool {
+	certStamp, certErr := stampOf(c.certPath)
+	keyStamp, keyErr := stampOf(c.keyPath)
+	if certErr != nil || keyErr != nil {
+		return false // file is being replaced or removed, the current certificate is kept
+	}
+	return certStamp != c.certStamp || keyStamp != c.keyStamp
+}
+
+// ParseTLSVersion returns TLS version by name, e.g. 1.2, empty name means 1.2
+func ParseTLSVersion(name string) (uint16, error) {
+	if name == "" {
+		return tls.VersionTLS12, nil
+	}
+	if res, ok := tlsVersions[name]; ok {
+		return res, nil
+	}
+	return 0, fmt.Errorf("TLS version should be 1.0, 1.1, 1.2 or 1.3, got %q", name)
+}
+
+// ParseCipherSuites returns ids of cipher suites by names, e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256.
+// Insecure suites are rejected, nil means Go defaults
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := map[string]uint16{}
+	for _, c := range tls.CipherSuites() {
+		known[c.Name] = c.ID
+	}
+	insecure := map[string]bool{}
+	for _, c := range tls.InsecureCipherSuites() {
+		insecure[c.Name] = true
+	}
+	res := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		switch {
+		case insecure[name]:
+			return nil, fmt.Errorf("cipher suite %s is insecure", name)
+		case !ok:
+			return nil, fmt.Errorf("cipher suite %s is unknown", name)
+		}
+		res = append(res, id)
+	}
+	return res, nil
+}
+
+// ParseClientAuth returns TLS client certificate verification mode by name: none, optional or require
+func ParseClientAuth(name string) (tls.ClientAuthType, error) {
+	if name == "" {
+		return tls.NoClientCert, nil
+	}
+	if res, ok := clientAuthModes[name]; ok {
+		return res, nil
+	}
+	return 0, fmt.Errorf("TLS client auth should be none, optional or require, got %q", name)
+}
+
+// LoadCertificates reads PEM bundle of certificates, e.g. CA of clients
+func LoadCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path) // nolint:gosec
+	if err != nil {
+		return nil, fmt.Errorf("can not read certificates: %w", err)
+	}
+	var res []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("can not parse certificate in %s: %w", path, err)
+		}
+		res = append(res, cert)
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("no certificates in %s", path)
+	}
+	return res, nil
+}
+
+// LoadRevocationList reads CRLs in PEM or DER from file, every CRL should be signed by one of issuers
+func LoadRevocationList(path string, issuers []*x509.Certificate) (*RevocationList, error) {
+	res := &RevocationList{path: path, issuers: issuers, revoked: map[string]bool{}}
+	res.stamp, _ = stampOf(path)
+	data, err := os.ReadFile(path) // nolint:gosec
+	if err != nil {
+		return nil, fmt.Errorf("can not read CRL: %w", err)
+	}
+	var ders [][]byte
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		ders = [][]byte{data} // DER encoded CRL
+	}
+
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return nil, fmt.Errorf("can not parse CRL %s: %w", path, err)
+		}
+		if err = checkCRLIssuer(crl, issuers); err != nil {
+			return nil, fmt.Errorf("CRL %s is not valid: %w", path, err)
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			res.revoked[string(crl.RawIssuer)+entry.SerialNumber.String()] = true
+		}
+		if res.NextUpdate.IsZero() || (!crl.NextUpdate.IsZero() && crl.NextUpdate.Before(res.NextUpdate)) {
+			res.NextUpdate = crl.NextUpdate
+		}
+	}
+	if !res.NextUpdate.IsZero() && res.NextUpdate.Before(time.Now()) {
+		log.Printf("[WARN] CRL %s is outdated, its next update was at %s", path, res.NextUpdate.Format(time.RFC3339))
+	}
+	return res, nil
+}
+
+func checkCRLIssuer(crl *x509.RevocationList, issuers []*x509.Certificate) error {
+	for _, issuer := range issuers {
+		if bytes.Equal(issuer.RawSubject, crl.RawIssuer) {
+			return crl.CheckSignatureFrom(issuer)
+		}
+	}
+	return fmt.Errorf("issuer %s is not client CA", crl.Issuer)
+}
+
+// Revoked returns revoked certificate of chain, nil if none of them is revoked
+func (l *RevocationList) Revoked(chain []*x509.Certificate) *x509.Certificate {
+	for _, cert := range chain {
+		if l.revoked[string(cert.RawIssuer)+cert.SerialNumber.String()] {
+			return cert
+		}
+	}
+	return nil
+}
+
+// revocationList returns current CRL of client certificates
+func (s *Rest) revocationList() *RevocationList {
+	if res := s.crl.Load(); res != nil {
+		return res
+	}
+	if s.ClientAuth != nil {
+		return s.ClientAuth.CRL
+	}
+	return nil
+}
+
+// verifyConnection rejects client certificate revoked by current CRL
+func (s *Rest) verifyConnection(cs tls.ConnectionState) error {
+	crl := s.revocationList()
+	if crl == nil {
+		return nil
+	}
+	for _, chain := range cs.VerifiedChains {
+		if cert := crl.Revoked(chain); cert != nil {
+			return fmt.Errorf("client certificate %s (serial %s) is revoked", cert.Subject, cert.SerialNumber)
+		}
+	}
+	return nil
+}
+
+// tlsConfig makes config of https server, certificate is taken from ACME or loaded from files.
+// Client certificates are verified with ClientAuth if it's set, except for tls-alpn-01 challenge of ACME server
+// which has no client certificate
+func (s *Rest) tlsConfig() *tls.Config {
+	res := &tls.Config{
+		MinVersion:     s.TLSMinVersion,
+		CipherSuites:   s.TLSCipherSuites,
+		GetCertificate: s.getCertificate,
+	}
+	if res.MinVersion == 0 {
+		res.MinVersion = tls.VersionTLS12
+	}
+	if s.ACME != nil {
+		res.GetCertificate = s.ACME.GetCertificate
+		res.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+	}
+	if s.ClientAuth != nil && s.ClientAuth.Mode != tls.NoClientCert {
+		res.ClientAuth = s.ClientAuth.Mode
+		res.ClientCAs = x509.NewCertPool()
+		for _, ca := range s.ClientAuth.CAs {
+			res.ClientCAs.AddCert(ca)
+		}
+		res.VerifyConnection = s.verifyConnection
+	}
+	if s.ACME != nil && res.ClientAuth != tls.NoClientCert {
+		challenge := res.Clone()
+		challenge.ClientAuth, challenge.ClientCAs, challenge.VerifyConnection = tls.NoClientCert, nil, nil
+		res.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if acme.IsChallenge(hello) {
+				return challenge, nil
+			}
+			return nil, nil
+		}
+	}
+	return res
+}
+
+// getCertificate returns current TLS certificate, so reloaded certificate is used by new connections
+func (s *Rest) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := s.cert.Load(); cert != nil {
+		return &cert.Certificate, nil
+	}
+	return nil, errors.New("TLS certificate is not loaded")
+}
+
+// WatchTLS checks files of current TLS certificate and CRL of client certificates every interval and loads them
+// again when they are changed, e.g. renewed by certbot. Files which can't be loaded are logged and the current ones
+// are kept. It returns when ctx is done
+func (s *Rest) WatchTLS(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.reloadCertificate()
+		s.reloadRevocationList()
+	}
+}
+
+func (s *Rest) reloadCertificate() {
+	current := s.cert.Load()
+	if current == nil || !current.changed() {
+		return
+	}
+	next, err := LoadCertificate(current.certPath, current.keyPath)
+	if err != nil {
+		log.Printf("[WARN] TLS certificate is changed, but it's not loaded: %v", err)
+		return
+	}
+	// certificate could be replaced by config reload meanwhile, it's not overwritten then
+	if s.cert.CompareAndSwap(current, next) {
+		log.Printf("[INFO] TLS certificate %s is reloaded", next.certPath)
+	}
+}
+
+func (s *Rest) reloadRevocationList() {
+	current := s.revocationList()
+	if current == nil {
+		return
+	}
+	if stamp, err := stampOf(current.path); err != nil || stamp == current.stamp {
+		return
+	}
+	next, err := LoadRevocationList(current.path, current.issuers)
+	if err != nil {
+		log.Printf("[WARN] CRL is changed, but it's not loaded: %v", err)
+		return
+	}
+	s.crl.Store(next)
+	log.Printf("[INFO] CRL %s is reloaded, %d certificates are revoked", next.path, len(next.revoked))
+}
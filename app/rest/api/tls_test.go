@@ -0,0 +1,335 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/theshamuel/gemini-proxy/app/acme"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	v, err := ParseTLSVersion("")
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), v)
+	v, err = ParseTLSVersion("1.3")
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), v)
+	_, err = ParseTLSVersion("1.4")
+	assert.EqualError(t, err, `TLS version should be 1.0, 1.1, 1.2 or 1.3, got "1.4"`)
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	res, err := ParseCipherSuites(nil)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+
+	res, err = ParseCipherSuites([]string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"})
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}, res)
+
+	_, err = ParseCipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"})
+	assert.EqualError(t, err, "cipher suite TLS_RSA_WITH_RC4_128_SHA is insecure")
+	_, err = ParseCipherSuites([]string{"TLS_ECDHE_WITH_MAGIC"})
+	assert.EqualError(t, err, "cipher suite TLS_ECDHE_WITH_MAGIC is unknown")
+}
+
+func TestParseClientAuth(t *testing.T) {
+	mode, err := ParseClientAuth("")
+	require.NoError(t, err)
+	assert.Equal(t, tls.NoClientCert, mode)
+	mode, err = ParseClientAuth("optional")
+	require.NoError(t, err)
+	assert.Equal(t, tls.VerifyClientCertIfGiven, mode)
+	mode, err = ParseClientAuth("require")
+	require.NoError(t, err)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, mode)
+	_, err = ParseClientAuth("always")
+	assert.EqualError(t, err, `TLS client auth should be none, optional or require, got "always"`)
+}
+
+func TestLoadRevocationList(t *testing.T) {
+	ca := newTestCA(t, "clients")
+	other := newTestCA(t, "others")
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "clients.crl")
+	ca.writeCRL(t, path, 2, 3)
+	crl, err := LoadRevocationList(path, []*x509.Certificate{other.cert, ca.cert})
+	require.NoError(t, err)
+	assert.NotNil(t, crl.Revoked([]*x509.Certificate{ca.issue(t, "billing", 2), ca.cert}))
+	assert.Nil(t, crl.Revoked([]*x509.Certificate{ca.issue(t, "billing", 4), ca.cert}))
+	assert.Nil(t, crl.Revoked([]*x509.Certificate{other.issue(t, "billing", 2), other.cert}),
+		"serial is revoked by another CA")
+
+	_, err = LoadRevocationList(path, []*x509.Certificate{other.cert})
+	assert.EqualError(t, err, "CRL "+path+" is not valid: issuer CN=clients is not client CA")
+
+	// CRL of another CA with the same name isn't trusted
+	fake := newTestCA(t, "clients")
+	fake.writeCRL(t, path)
+	_, err = LoadRevocationList(path, []*x509.Certificate{ca.cert})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "is not valid")
+
+	require.NoError(t, os.WriteFile(path, []byte("not a crl"), 0o600))
+	_, err = LoadRevocationList(path, []*x509.Certificate{ca.cert})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can not parse CRL")
+
+	certs, err := LoadCertificates(ca.write(t, dir))
+	require.NoError(t, err)
+	assert.Equal(t, []*x509.Certificate{ca.cert}, certs)
+	_, err = LoadCertificates(path)
+	assert.EqualError(t, err, "no certificates in "+path)
+}
+
+func TestRest_ClientAuth(t *testing.T) {
+	ca := newTestCA(t, "clients")
+	crlPath := filepath.Join(t.TempDir(), "clients.crl")
+	ca.writeCRL(t, crlPath, 2)
+	crl, err := LoadRevocationList(crlPath, []*x509.Certificate{ca.cert})
+	require.NoError(t, err)
+
+	auth, err := NewAuth([]Client{{Name: "billing", CertIdentities: []string{"cn:billing"}}})
+	require.NoError(t, err)
+	rest := &Rest{Auth: auth, ClientAuth: &ClientAuth{Mode: tls.VerifyClientCertIfGiven,
+		CAs: []*x509.Certificate{ca.cert}, CRL: crl}}
+	certPath, keyPath := writeTestCertificate(t, "server")
+	cert, err := LoadCertificate(certPath, keyPath)
+	require.NoError(t, err)
+	rest.Reload(Settings{Certificate: cert})
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", rest.tlsConfig())
+	require.NoError(t, err)
+	srv := &http.Server{ReadHeaderTimeout: time.Second, Handler: auth.Middleware(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) { _, _ = io.WriteString(w, ClientFromContext(r.Context())) }))}
+	go func() { _ = srv.Serve(ln) }()
+	defer srv.Close()
+
+	call := func(clientCert *tls.Certificate) (string, error) {
+		cfg := &tls.Config{InsecureSkipVerify: true} // nolint:gosec // self-signed test certificate
+		if clientCert != nil {
+			cfg.Certificates = []tls.Certificate{*clientCert}
+		}
+		client := http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+		resp, err := client.Get("https://" + ln.Addr().String() + "/api/models")
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return resp.Status + " " + string(body), err
+	}
+
+	got, err := call(ca.issueTLS(t, "billing", 1))
+	require.NoError(t, err)
+	assert.Equal(t, "200 OK billing", got, "client is identified by certificate")
+
+	got, err = call(nil)
+	require.NoError(t, err)
+	assert.Contains(t, got, "401 Unauthorized", "certificate is optional, key is required without it")
+
+	_, err = call(ca.issueTLS(t, "billing", 2))
+	assert.Error(t, err, "revoked certificate is rejected")
+
+	_, err = call(newTestCA(t, "clients").issueTLS(t, "billing", 1))
+	assert.Error(t, err, "certificate of unknown CA is rejected")
+
+	// updated CRL is loaded by watcher
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go rest.WatchTLS(ctx, 10*time.Millisecond)
+	ca.writeCRL(t, crlPath, 1, 2)
+	mtime := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(crlPath, mtime, mtime))
+	assert.Eventually(t, func() bool {
+		_, err := call(ca.issueTLS(t, "billing", 1))
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// testCA is CA issuing client certificates and CRLs in tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) issueTLS(t *testing.T, name string, serial int64) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func (ca *testCA) issue(t *testing.T, name string, serial int64) *x509.Certificate {
+	return ca.issueTLS(t, name, serial).Leaf
+}
+
+func (ca *testCA) write(t *testing.T, dir string) string {
+	path := filepath.Join(dir, ca.cert.Subject.CommonName+".pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600))
+	return path
+}
+
+func (ca *testCA) writeCRL(t *testing.T, path string, serials ...int64) {
+	tmpl := &x509.RevocationList{Number: big.NewInt(time.Now().UnixNano()), ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour)}
+	for _, serial := range serials {
+		tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries,
+			x509.RevocationListEntry{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, ca.cert, ca.key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0o600))
+}
+
+func TestRest_TLSConfig(t *testing.T) {
+	certPath, keyPath := writeTestCertificate(t, "first")
+	rest := &Rest{TLSEnabled: true, CertPath: certPath, PrivateKeyPath: keyPath, TLSMinVersion: tls.VersionTLS13}
+	cert, err := LoadCertificate(certPath, keyPath)
+	require.NoError(t, err)
+	rest.Reload(Settings{Certificate: cert})
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", rest.tlsConfig())
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			_ = conn.Close()
+		}
+	}()
+
+	dial := func(maxVersion uint16) error {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: "localhost", MaxVersion: maxVersion,
+			InsecureSkipVerify: true}) // nolint:gosec // self-signed test certificate
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	require.NoError(t, dial(tls.VersionTLS13))
+	assert.Error(t, dial(tls.VersionTLS12), "TLS 1.2 is rejected")
+
+	rest = &Rest{TLSCipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}}
+	cfg := rest.tlsConfig()
+	assert.Equal(t, uint16(tls.VersionTLS12), cfg.MinVersion, "TLS 1.2 by default")
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, cfg.CipherSuites)
+	assert.Empty(t, cfg.NextProtos)
+
+	rest.ACME, err = acme.NewManager(acme.Options{Domains: []string{"example.com"}, Challenge: acme.ChallengeTLSALPN01,
+		CacheDir: t.TempDir()})
+	require.NoError(t, err)
+	cfg = rest.tlsConfig()
+	assert.Contains(t, cfg.NextProtos, acme.ALPNProto)
+	_, err = cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	assert.EqualError(t, err, "ACME certificate is not issued yet", "certificate is taken from ACME")
+	assert.Nil(t, cfg.GetConfigForClient, "no client auth")
+
+	rest.ClientAuth = &ClientAuth{Mode: tls.RequireAndVerifyClientCert}
+	cfg = rest.tlsConfig()
+	assert.Equal(t, tls.RequireAndVerifyClientCert, cfg.ClientAuth)
+	challenge, err := cfg.GetConfigForClient(&tls.ClientHelloInfo{SupportedProtos: []string{acme.ALPNProto}})
+	require.NoError(t, err)
+	require.NotNil(t, challenge)
+	assert.Equal(t, tls.NoClientCert, challenge.ClientAuth, "ACME challenge doesn't require client certificate")
+	assert.Nil(t, challenge.VerifyConnection)
+	challenge, err = cfg.GetConfigForClient(&tls.ClientHelloInfo{SupportedProtos: []string{"h2", acme.ALPNProto}})
+	require.NoError(t, err)
+	assert.Nil(t, challenge, "other connections use config with client auth")
+}
+
+func TestRest_WatchTLS(t *testing.T) {
+	certPath, keyPath := writeTestCertificate(t, "first")
+	rest := &Rest{}
+	cert, err := LoadCertificate(certPath, keyPath)
+	require.NoError(t, err)
+	rest.Reload(Settings{Certificate: cert})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go rest.WatchTLS(ctx, 10*time.Millisecond)
+
+	commonName := func() string {
+		got, err := rest.getCertificate(nil)
+		require.NoError(t, err)
+		return got.Leaf.Subject.CommonName
+	}
+	replace := func(src, dst string) {
+		data, err := os.ReadFile(src) // nolint:gosec
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(dst, data, 0o600))
+		// modification time is moved forward, so quick rewrite is noticed
+		mtime := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(dst, mtime, mtime))
+	}
+
+	// renewed certificate is written over the old files
+	nextCert, nextKey := writeTestCertificate(t, "second")
+	replace(nextCert, certPath)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "first", commonName(), "certificate doesn't match key, the old one is kept")
+	replace(nextKey, keyPath)
+	assert.Eventually(t, func() bool { return commonName() == "second" }, 5*time.Second, 10*time.Millisecond)
+
+	// certificate reloaded from config is watched after that
+	thirdCert, thirdKey := writeTestCertificate(t, "third")
+	cert, err = LoadCertificate(thirdCert, thirdKey)
+	require.NoError(t, err)
+	rest.Reload(Settings{Certificate: cert})
+	assert.Equal(t, "third", commonName())
+	fourthCert, fourthKey := writeTestCertificate(t, "fourth")
+	replace(fourthKey, thirdKey)
+	replace(fourthCert, thirdCert)
+	assert.Eventually(t, func() bool { return commonName() == "fourth" }, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/render"
+
+	"github.com/theshamuel/gemini-proxy/app/gemini"
+	"github.com/theshamuel/gemini-proxy/app/service"
+)
+
+// translateSend sends translated request to Gemini, on failure it responds with error in format of the api
+func (s *Rest) translateSend(w http.ResponseWriter, r *http.Request, target service.Target, body []byte,
+	apiErr apiErrorFunc) ([]byte, bool) {
+	ctx := r.Context()
+	body, err := s.Service.ApplyPolicy(ctx, target, body)
+	if err != nil {
+		sendAPIProxyError(w, r, err, apiErr)
+		return nil, false
+	}
+	raw, err := s.Service.Send(ctx, target.Path(), io.NopCloser(bytes.NewReader(body)))
+	if err != nil {
+		sendAPIProxyError(w, r, err, apiErr)
+		return nil, false
+	}
+	return raw, true
+}
+
+// translateStream streams translated request to Gemini, every Gemini event is converted to events of other api,
+// final events are sent when Gemini stream is done
+func (s *Rest) translateStream(w http.ResponseWriter, r *http.Request, target service.Target, body []byte,
+	translator streamTranslator, apiErr apiErrorFunc) {
+	body, err := s.Service.ApplyPolicy(r.Context(), target, body)
+	if err != nil {
+		sendAPIProxyError(w, r, err, apiErr)
+		return
+	}
+	sw := newSSEWriter(w)
+	tw := &translatingWriter{out: sw, translator: translator}
+	err = s.Service.Stream(r.Context(), target.Path(), io.NopCloser(bytes.NewReader(body)), tw)
+	if tw.hasUsage {
+		s.recordUsage(r, tw.usage)
+	}
+	if err == nil {
+		if err = tw.writeEvents(translator.Final()); err == nil {
+			err = sw.Flush()
+		}
+	}
+
+	switch {
+	case err == nil:
+		return
+	case sw.started:
+		log.Printf("[WARN] stream %s of client %q is interrupted: %v", target.Path(), clientLabel(r), err)
+	default:
+		sendAPIProxyError(w, r, err, apiErr)
+	}
+}
+
+// apiErrorFunc makes error body in format of translated api
+type apiErrorFunc func(status int, message string) any
+
+// sendAPIProxyError responds with error of proxied request in format of translated api
+func sendAPIProxyError(w http.ResponseWriter, r *http.Request, err error, apiErr apiErrorFunc) {
+	status, _ := proxyErrorStatus(err)
+	if ra := retryAfter(err); ra != "" {
+		w.Header().Set("Retry-After", ra)
+	}
+	sendAPIError(w, r, status, err, apiErr)
+}
+
+func sendAPIError(w http.ResponseWriter, r *http.Request, status int, err error, apiErr apiErrorFunc) {
+	log.Printf("[WARN] %d, %v", status, err)
+	render.Status(r, status)
+	render.JSON(w, r, apiErr(status, err.Error()))
+}
+
+// sseEvent is event of translated stream, data is json encoded unless it's a string
+type sseEvent struct {
+	Name string
+	Data any
+}
+
+// streamTranslator converts Gemini stream events into events of other api
+type streamTranslator interface {
+	Events(resp gemini.GenerateContentResponse) []sseEvent
+	Final() []sseEvent
+}
+
+// translatingWriter is StreamWriter which translates Gemini events and writes them to the client.
+// It keeps the last usage seen in the stream
+type translatingWriter struct {
+	out        *sseWriter
+	translator streamTranslator
+	usage      service.Usage
+	hasUsage   bool
+}
+
+func (tw *translatingWriter) Write(line []byte) (int, error) {
+	if u, ok := service.ParseEventUsage(line); ok {
+		tw.usage, tw.hasUsage = u, true
+	}
+	if resp, ok := gemini.ParseEvent(line); ok {
+		if err := tw.writeEvents(tw.translator.Events(resp)); err != nil {
+			return 0, err
+		}
+	}
+	return len(line), nil
+}
+
+func (tw *translatingWriter) Flush() error {
+	return tw.out.Flush()
+}
+
+func (tw *translatingWriter) writeEvents(events []sseEvent) error {
+	var buf bytes.Buffer
+	for _, e := range events {
+		data, ok := e.Data.(string)
+		if !ok {
+			b, err := json.Marshal(e.Data)
+			if err != nil {
+				return fmt.Errorf("can not encode event: %w", err)
+			}
+			data = string(b)
+		}
+		if e.Name != "" {
+			buf.WriteString("event: " + e.Name + "\n")
+		}
+		buf.WriteString("data: " + data + "\n\n")
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	_, err := tw.out.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/theshamuel/gemini-proxy/app/gemini"
+	"github.com/theshamuel/gemini-proxy/app/rest"
+	"github.com/theshamuel/gemini-proxy/app/service"
+)
+
+// errInvalidRequest is reported with field errors of request in details
+var errInvalidRequest = errors.New("request is not valid")
+
+// limitBody rejects request body larger than MaxBodySize limit once it's read
+func (s *Rest) limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limits := s.settings().Limits; limits.MaxBodySize > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, limits.MaxBodySize)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validateRequest reads body of proxied request and checks it against typed Gemini request of target method.
+// Valid body is put back to request as is, so fields unknown to proxy are passed to Gemini
+func (s *Rest) validateRequest(w http.ResponseWriter, r *http.Request, target service.Target) bool {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		if status := decodeStatus(err); status == http.StatusRequestEntityTooLarge {
+			rest.SendErrorJSON(w, r, status, err, rest.ErrTooLarge, "")
+			return false
+		}
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, rest.ErrJSONDecode, "can not read request body")
+		return false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	if err = validateBody(target.Method, body, s.settings().Limits); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, errInvalidRequest, rest.ErrJSONDecode, err.Error())
+		return false
+	}
+	return true
+}
+
+// validateTranslated checks Gemini request translated from other api, mostly against limits,
+// as translation can't produce request Gemini rejects otherwise
+func (s *Rest) validateTranslated(w http.ResponseWriter, r *http.Request, req any, apiErr apiErrorFunc) bool {
+	v, ok := req.(interface{ Validate(gemini.Limits) error })
+	if !ok {
+		return true
+	}
+	if err := v.Validate(s.settings().Limits); err != nil {
+		sendAPIError(w, r, http.StatusBadRequest, fmt.Errorf("%w: %v", errInvalidRequest, err), apiErr)
+		return false
+	}
+	return true
+}
+
+// validateBody decodes body into request type of Gemini method and validates it,
+// body of other methods should be json object
+func validateBody(method string, body []byte, limits gemini.Limits) error {
+	var req interface{ Validate(gemini.Limits) error }
+	switch method {
+	case "generateContent", "streamGenerateContent":
+		req = &gemini.GenerateContentRequest{}
+	case "embedContent":
+		req = &gemini.EmbedContentRequest{}
+	case "batchEmbedContents":
+		req = &gemini.BatchEmbedContentsRequest{}
+	default:
+		var obj map[string]json.RawMessage
+		if err := DecodeJSON(bytes.NewReader(body), &obj); err != nil {
+			return decodeError(err)
+		}
+		return nil
+	}
+	if err := DecodeJSON(bytes.NewReader(body), req); err != nil {
+		return decodeError(err)
+	}
+	return req.Validate(limits)
+}
+
+// decodeError converts json decoding error to field error
+func decodeError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.Is(err, io.EOF):
+		return gemini.ValidationError{{Field: "body", Message: "is empty"}}
+	case errors.As(err, &typeErr):
+		field := typeErr.Field
+		if field == "" {
+			field = "body"
+		}
+		return gemini.ValidationError{{Field: field, Message: fmt.Sprintf("can not be %s", typeErr.Value)}}
+	case errors.As(err, &syntaxErr):
+		return gemini.ValidationError{{Field: "body", Message: fmt.Sprintf("malformed json at offset %d", syntaxErr.Offset)}}
+	default:
+		return gemini.ValidationError{{Field: "body", Message: err.Error()}}
+	}
+}
+
+// decodeStatus is status of failed request body reading, 413 if body is over the size limit
+func decodeStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
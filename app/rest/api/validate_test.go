@@ -0,0 +1,80 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/theshamuel/gemini-proxy/app/gemini"
+	"github.com/theshamuel/gemini-proxy/app/service"
+)
+
+func TestRest_SendValidation(t *testing.T) {
+	calls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	ts, srv, teardown := startHTTPServer()
+	defer teardown()
+	srv.Service = &service.GeminiProxy{BaseURL: upstream.URL, APIKey: "key"}
+	srv.Limits = gemini.Limits{MaxBodySize: 200, MaxParts: 2}
+
+	tbl := []struct {
+		name, path, body string
+		status           int
+		resp             string
+	}{
+		{name: "empty", path: "gemini-2.5-pro:generateContent", body: "", status: http.StatusBadRequest,
+			resp: `{"code":1,"details":"body: is empty","error":"request is not valid"}`},
+		{name: "malformed", path: "gemini-2.5-pro:generateContent", body: `{"contents":`, status: http.StatusBadRequest,
+			resp: `{"code":1,"details":"body: unexpected EOF","error":"request is not valid"}`},
+		{name: "wrong type", path: "gemini-2.5-pro:generateContent", body: `{"contents":[],"generationConfig":{"temperature":"hot"}}`,
+			status: http.StatusBadRequest,
+			resp:   `{"code":1,"details":"generationConfig.temperature: can not be string","error":"request is not valid"}`},
+		{name: "invalid fields", path: "gemini-2.5-pro:streamGenerateContent", body: `{"contents":[{"role":"bot","parts":[]}]}`,
+			status: http.StatusBadRequest,
+			resp: `{"code":1,"details":"contents[0].role: should be user or model, got \"bot\"; contents[0].parts: is required",` +
+				`"error":"request is not valid"}`},
+		{name: "too many parts", path: "gemini-2.5-pro:generateContent", body: `{"contents":[{"parts":[{"text":"a"},{"text":"b"},{"text":"c"}]}]}`,
+			status: http.StatusBadRequest,
+			resp:   `{"code":1,"details":"contents: has 3 parts, limit is 2","error":"request is not valid"}`},
+		{name: "too large", path: "gemini-2.5-pro:generateContent", body: `{"contents":[{"parts":[{"text":"` + strings.Repeat("a", 200) + `"}]}]}`,
+			status: http.StatusRequestEntityTooLarge, resp: `{"code":7,"details":"","error":"http: request body too large"}`},
+		{name: "not object", path: "gemini-2.5-pro:countTokens", body: `[1]`, status: http.StatusBadRequest,
+			resp: `{"code":1,"details":"body: can not be array","error":"request is not valid"}`},
+		{name: "embed", path: "text-embedding-004:embedContent", body: `{"content":{"parts":[{"text":"a"}]}}`, status: http.StatusOK,
+			resp: `{}`},
+		{name: "count tokens", path: "gemini-2.5-pro:countTokens", body: `{"contents":[]}`, status: http.StatusOK, resp: `{}`},
+		{name: "generate", path: "gemini-2.5-pro:generateContent", body: `{"contents":[{"parts":[{"text":"a"}]}],"unknown":1}`,
+			status: http.StatusOK, resp: `{}`},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			body, code := postRequest(t, ts.URL+"/api/models/"+tt.path, tt.body)
+			assert.Equal(t, tt.status, code)
+			assert.Equal(t, tt.resp, strings.TrimSpace(body))
+		})
+	}
+	assert.Equal(t, 3, calls, "only valid requests are sent to Gemini")
+}
+
+func TestRest_TranslatedValidation(t *testing.T) {
+	ts, srv, teardown := startHTTPServer()
+	defer teardown()
+	srv.Limits = gemini.Limits{MaxBodySize: 150, MaxParts: 1}
+
+	body, code := postRequest(t, ts.URL+"/v1/chat/completions",
+		`{"model":"gemini-2.5-pro","messages":[{"role":"system","content":"be brief"},{"role":"user","content":"hi"}]}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, body, `"message":"request is not valid: contents: has 2 parts, limit is 1"`)
+
+	_, code = postRequest(t, ts.URL+"/v1/messages", `{"model":"gemini-2.5-pro","max_tokens":10,"messages":[{"role":"user","content":"`+
+		strings.Repeat("a", 150)+`"}]}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+}
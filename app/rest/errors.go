@@ -10,6 +10,23 @@ import (
 const (
 	ErrServerInternal = 0 // server internal error
 	ErrJSONDecode     = 1 // failed unmarshalling incoming request
+	ErrNotAllowed     = 2 // model or method is not in allowlist
+	ErrBadTarget      = 3 // proxied path doesn't address model method
+	ErrUnauthorized   = 4 // proxy key is missing or not valid
+	ErrQuotaExceeded  = 5 // client is over its budget
+	ErrOverloaded     = 6 // proxy has no capacity to call Gemini
+	ErrTooLarge       = 7 // request body is over the size limit
+	ErrRejected       = 8 // request is rejected by content filter
+	ErrOriginDenied   = 9 // client key is used from origin it's not registered for
+
+	ErrUpstream            = 10 // Gemini failed with unexpected error
+	ErrUpstreamBadRequest  = 11 // Gemini rejected request as invalid
+	ErrUpstreamNotFound    = 12 // Gemini model or method is not found
+	ErrUpstreamRateLimit   = 13 // Gemini quota or rate limit is exhausted
+	ErrUpstreamAuth        = 14 // Gemini rejected proxy api key
+	ErrUpstreamUnavailable = 15 // Gemini is overloaded or timed out
+
+	ErrRateLimited = 16 // client is over rate limit of proxy route
 )
 
 // SendErrorJSON create response JSON in schema  {error: err, details: more details, code: 1} json body and responds with error code
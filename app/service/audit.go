@@ -0,0 +1,76 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/theshamuel/gemini-proxy/app/audit"
+)
+
+// auditExchange sends record of exchange with Gemini to audit log. Prompt and response are the ones Gemini
+// got and returned, i.e. after content filter and before restore of tokenized values
+func (r *GeminiProxy) auditExchange(ctx context.Context, target Target, body, resp []byte, usage Usage,
+	start time.Time, err error, cached bool) {
+	client := ClientFromContext(ctx)
+	if !r.Audit.Enabled(client) {
+		return
+	}
+	rec := audit.Record{
+		Time:             start,
+		Client:           client,
+		Model:            target.Model,
+		Method:           target.Method,
+		Request:          body,
+		PromptTokens:     usage.PromptTokens,
+		CandidatesTokens: usage.CandidatesTokens,
+		TotalTokens:      usage.TotalTokens,
+		Latency:          time.Since(start),
+		Error:            errorClass(err),
+		Cached:           cached,
+	}
+	if r.Audit.Content() {
+		rec.Response = resp
+	}
+	var upstreamErr *UpstreamError
+	switch {
+	case err == nil:
+		rec.Status = http.StatusOK
+	case errors.As(err, &upstreamErr):
+		rec.Status = upstreamErr.StatusCode
+	}
+	r.Audit.Log(rec)
+}
+
+// eventCollector keeps data of stream events to be written to audit log as json array
+type eventCollector struct {
+	enabled bool
+	buf     bytes.Buffer
+}
+
+// Add keeps data of "data:" line
+func (c *eventCollector) Add(line []byte) {
+	if !c.enabled {
+		return
+	}
+	data, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:"))
+	if !ok {
+		return
+	}
+	if c.buf.Len() == 0 {
+		c.buf.WriteByte('[')
+	} else {
+		c.buf.WriteByte(',')
+	}
+	c.buf.Write(bytes.TrimSpace(data))
+}
+
+// JSON returns json array of collected events, nil if there are none
+func (c *eventCollector) JSON() []byte {
+	if c.buf.Len() == 0 {
+		return nil
+	}
+	return append(c.buf.Bytes(), ']')
+}
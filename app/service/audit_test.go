@@ -0,0 +1,76 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/theshamuel/gemini-proxy/app/audit"
+)
+
+type auditBuffer struct {
+	bytes.Buffer
+}
+
+func (b *auditBuffer) Close() error { return nil }
+
+func TestGeminiProxy_Audit(t *testing.T) {
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		if strings.Contains(r.URL.Path, "stream") {
+			_, _ = w.Write([]byte("data: {\"n\":1}\r\n\r\ndata: {\"n\":2,\"usageMetadata\":{\"totalTokenCount\":7}}\r\n\r\n"))
+			return
+		}
+		_, _ = w.Write([]byte(`{"usageMetadata":{"promptTokenCount":2,"candidatesTokenCount":3,"totalTokenCount":5}}`))
+	}))
+	defer ts.Close()
+
+	buf := &auditBuffer{}
+	auditLog := audit.New(buf, audit.Options{Content: audit.ContentFull, OptOut: []string{"bot"}})
+	p := &GeminiProxy{BaseURL: ts.URL, APIKey: "key", Audit: auditLog}
+	ctx := WithClient(context.Background(), "web")
+
+	_, err := p.Send(ctx, "models/gemini-2.5-pro:generateContent", io.NopCloser(strings.NewReader(`{"contents":[]}`)))
+	require.NoError(t, err)
+	err = p.Stream(ctx, "models/gemini-2.5-pro:streamGenerateContent", io.NopCloser(strings.NewReader(`{"contents":[]}`)),
+		&mockStreamWriter{})
+	require.NoError(t, err)
+	_, err = p.Send(WithClient(context.Background(), "bot"), "models/gemini-2.5-pro:generateContent",
+		io.NopCloser(strings.NewReader(`{"contents":[]}`)))
+	require.NoError(t, err)
+	status = http.StatusTooManyRequests
+	_, err = p.Send(ctx, "models/gemini-2.5-pro:generateContent", io.NopCloser(strings.NewReader(`{"contents":[]}`)))
+	require.Error(t, err)
+	require.NoError(t, auditLog.Close())
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 3, "opted out client is not audited")
+	var recs []map[string]any
+	for _, l := range lines {
+		var rec map[string]any
+		require.NoError(t, json.Unmarshal([]byte(l), &rec))
+		assert.Equal(t, "web", rec["client"])
+		assert.Equal(t, "gemini-2.5-pro", rec["model"])
+		assert.Equal(t, map[string]any{"contents": []any{}}, rec["prompt"])
+		recs = append(recs, rec)
+	}
+	assert.Equal(t, "generateContent", recs[0]["method"])
+	assert.EqualValues(t, 200, recs[0]["upstream_status"])
+	assert.EqualValues(t, 5, recs[0]["total_tokens"])
+	assert.Equal(t, "streamGenerateContent", recs[1]["method"])
+	assert.Equal(t, []any{map[string]any{"n": 1.0}, map[string]any{"n": 2.0, "usageMetadata": map[string]any{"totalTokenCount": 7.0}}},
+		recs[1]["response"])
+	assert.EqualValues(t, 7, recs[1]["total_tokens"])
+	assert.EqualValues(t, 429, recs[2]["upstream_status"])
+	assert.Equal(t, "rate_limit", recs[2]["error"])
+	assert.Nil(t, recs[2]["response"])
+}
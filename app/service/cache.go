@@ -0,0 +1,120 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	cache "github.com/go-pkgz/expirable-cache/v3"
+)
+
+// ResponseCache keeps Gemini responses of identical deterministic requests. Generation requests are cached only
+// with temperature 0 unless AnyTemperature is set, other methods (countTokens, embedContent) are always deterministic
+type ResponseCache struct {
+	MaxBytes       int64 // total size of cached responses, zero is unlimited
+	AnyTemperature bool  // cache generation requests regardless of temperature
+
+	lock  sync.Mutex
+	size  int64
+	cache cache.Cache[string, []byte]
+}
+
+// CacheStats is current state of response cache
+type CacheStats struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+	Hits    int   `json:"hits"`
+	Misses  int   `json:"misses"`
+}
+
+// NewResponseCache makes cache with ttl of entries and limit of entries number, zero maxEntries is unlimited
+func NewResponseCache(ttl time.Duration, maxEntries int, maxBytes int64, anyTemperature bool) *ResponseCache {
+	res := &ResponseCache{MaxBytes: maxBytes, AnyTemperature: anyTemperature}
+	res.cache = cache.NewCache[string, []byte]().WithTTL(ttl).WithMaxKeys(maxEntries).WithLRU().
+		WithOnEvicted(func(_ string, v []byte) { res.size -= int64(len(v)) })
+	return res
+}
+
+// Key returns cache key of request as hash of target and canonical request json,
+// false if the request is not cacheable
+func (c *ResponseCache) Key(t Target, body []byte) (string, bool) {
+	if t.Method == streamMethod {
+		return "", false
+	}
+	var req interface{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return "", false
+	}
+	if t.Method == "generateContent" && !c.AnyTemperature && !zeroTemperature(req) {
+		return "", false
+	}
+	// json.Marshal sorts map keys, so the same request with different formatting and order of fields has the same key
+	canonical, err := json.Marshal(req)
+	if err != nil {
+		return "", false
+	}
+	h := sha256.New()
+	h.Write([]byte(t.Path() + "\n"))
+	h.Write(canonical)
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// Get returns cached response
+func (c *ResponseCache) Get(key string) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.cache.Get(key)
+}
+
+// Set caches response, the oldest entries are evicted to fit into MaxBytes. Response bigger than MaxBytes is skipped
+func (c *ResponseCache) Set(key string, resp []byte) {
+	if c.MaxBytes > 0 && int64(len(resp)) > c.MaxBytes {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cache.Remove(key)
+	if c.MaxBytes > 0 && c.size+int64(len(resp)) > c.MaxBytes {
+		c.cache.DeleteExpired()
+	}
+	for c.MaxBytes > 0 && c.size+int64(len(resp)) > c.MaxBytes {
+		if _, _, ok := c.cache.RemoveOldest(); !ok {
+			break
+		}
+	}
+	c.cache.Add(key, resp)
+	c.size += int64(len(resp))
+}
+
+// Purge removes all entries and returns number of removed ones
+func (c *ResponseCache) Purge() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n := c.cache.Len()
+	c.cache.Purge()
+	return n
+}
+
+// Stats returns size and effectiveness of cache
+func (c *ResponseCache) Stats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	st := c.cache.Stat()
+	return CacheStats{Entries: c.cache.Len(), Bytes: c.size, Hits: st.Hits, Misses: st.Misses}
+}
+
+// zeroTemperature checks generationConfig.temperature is explicitly set to 0
+func zeroTemperature(req interface{}) bool {
+	m, ok := req.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	gc, ok := m["generationConfig"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	t, ok := gc["temperature"].(float64)
+	return ok && t == 0
+}
@@ -0,0 +1,125 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/theshamuel/gemini-proxy/app/audit"
+	"github.com/theshamuel/gemini-proxy/app/metrics"
+)
+
+func TestResponseCache_Key(t *testing.T) {
+	c := NewResponseCache(time.Minute, 10, 0, false)
+	gen := Target{Model: "gemini-2.5-pro", Method: "generateContent"}
+
+	k1, ok := c.Key(gen, []byte(`{"contents":[{"parts":[{"text":"hi"}]}],"generationConfig":{"temperature":0}}`))
+	require.True(t, ok)
+	k2, ok := c.Key(gen, []byte(`{"generationConfig": {"temperature": 0.0}, "contents": [{"parts": [{"text": "hi"}]}]}`))
+	require.True(t, ok)
+	assert.Equal(t, k1, k2, "formatting and order of fields don't matter")
+
+	k3, ok := c.Key(Target{Model: "gemini-2.0-flash", Method: "generateContent"},
+		[]byte(`{"contents":[{"parts":[{"text":"hi"}]}],"generationConfig":{"temperature":0}}`))
+	require.True(t, ok)
+	assert.NotEqual(t, k1, k3, "model is part of the key")
+
+	_, ok = c.Key(gen, []byte(`{"contents":[],"generationConfig":{"temperature":0.7}}`))
+	assert.False(t, ok, "non-deterministic request")
+	_, ok = c.Key(gen, []byte(`{"contents":[]}`))
+	assert.False(t, ok, "default temperature is not 0")
+	_, ok = c.Key(Target{Model: "m", Method: "streamGenerateContent"}, []byte(`{"generationConfig":{"temperature":0}}`))
+	assert.False(t, ok, "stream is not cached")
+	_, ok = c.Key(gen, []byte(`not json`))
+	assert.False(t, ok)
+	_, ok = c.Key(Target{Model: "text-embedding-004", Method: "embedContent"}, []byte(`{"content":{}}`))
+	assert.True(t, ok, "embeddings are deterministic")
+
+	c.AnyTemperature = true
+	_, ok = c.Key(gen, []byte(`{"contents":[]}`))
+	assert.True(t, ok)
+}
+
+func TestResponseCache_MaxBytes(t *testing.T) {
+	c := NewResponseCache(time.Minute, 10, 10, false)
+	c.Set("k1", []byte("12345"))
+	c.Set("k2", []byte("12345"))
+	assert.Equal(t, CacheStats{Entries: 2, Bytes: 10}, c.Stats())
+
+	c.Set("k3", []byte("123"))
+	_, ok := c.Get("k1")
+	assert.False(t, ok, "the oldest entry is evicted to fit into max bytes")
+	resp, ok := c.Get("k3")
+	assert.True(t, ok)
+	assert.Equal(t, "123", string(resp))
+
+	c.Set("k2", []byte("1"))
+	c.Set("big", []byte("12345678901"))
+	_, ok = c.Get("big")
+	assert.False(t, ok, "response bigger than max bytes is not cached")
+	assert.Equal(t, CacheStats{Entries: 2, Bytes: 4, Hits: 1, Misses: 2}, c.Stats())
+
+	assert.Equal(t, 2, c.Purge())
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 2}, c.Stats())
+}
+
+func TestGeminiProxy_SendCached(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		_, _ = w.Write([]byte(`{"usageMetadata":{"promptTokenCount":2,"candidatesTokenCount":3,"totalTokenCount":5}}`))
+	}))
+	defer ts.Close()
+
+	buf := &auditBuffer{}
+	auditLog := audit.New(buf, audit.Options{})
+	m := metrics.New()
+	p := &GeminiProxy{BaseURL: ts.URL, APIKey: "key", Audit: auditLog, Metrics: m,
+		Cache: NewResponseCache(time.Minute, 10, 0, false)}
+	ctx := WithClient(context.Background(), "web")
+	send := func(cc CacheControl) (string, error) {
+		_, res, err := p.SendCached(ctx, "models/gemini-2.5-pro:generateContent",
+			io.NopCloser(strings.NewReader(`{"contents":[],"generationConfig":{"temperature":0}}`)), cc)
+		return res, err
+	}
+
+	res, err := send(CacheControl{})
+	require.NoError(t, err)
+	assert.Equal(t, CacheMiss, res)
+	res, err = send(CacheControl{})
+	require.NoError(t, err)
+	assert.Equal(t, CacheHit, res)
+	assert.Equal(t, 1, calls)
+	exposed := &bytes.Buffer{}
+	require.NoError(t, m.Expose(exposed))
+	assert.Contains(t, exposed.String(),
+		`gemini_proxy_tokens_total{model="gemini-2.5-pro",client="web",type="prompt"} 2`+"\n", "hit doesn't count tokens")
+	res, err = send(CacheControl{NoCache: true})
+	require.NoError(t, err)
+	assert.Equal(t, CacheMiss, res)
+	assert.Equal(t, 2, calls)
+
+	p.Reload(Settings{APIKey: "key", AllowedModels: []string{"gemini-2.0-*"}})
+	_, err = send(CacheControl{})
+	assert.ErrorIs(t, err, ErrNotAllowed, "cached response of model out of allowlist is not returned")
+	require.NoError(t, auditLog.Close())
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 3, "cache hit is audited")
+	var rec map[string]any
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &rec))
+	assert.Equal(t, true, rec["cached"])
+	assert.Equal(t, float64(http.StatusOK), rec["upstream_status"])
+	assert.Equal(t, "web", rec["client"])
+	assert.Equal(t, float64(5), rec["total_tokens"])
+	assert.NotContains(t, lines[0], "cached")
+}
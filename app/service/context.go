@@ -0,0 +1,18 @@
+package service
+
+import "context"
+
+type ctxKey int
+
+const clientCtxKey ctxKey = iota
+
+// WithClient returns context carrying name of authenticated client
+func WithClient(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, clientCtxKey, client)
+}
+
+// ClientFromContext returns name of authenticated client or empty string for anonymous access
+func ClientFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(clientCtxKey).(string)
+	return name
+}
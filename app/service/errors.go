@@ -0,0 +1,89 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// maxErrorBody limits size of upstream error body kept in UpstreamError
+const maxErrorBody = 64 * 1024
+
+// UpstreamError is non-200 response of Gemini API
+type UpstreamError struct {
+	StatusCode int               // http status of Gemini response
+	Status     string            // google status, e.g. INVALID_ARGUMENT or RESOURCE_EXHAUSTED
+	Message    string            // error message from Gemini
+	Details    []json.RawMessage // google error details, e.g. RetryInfo or QuotaFailure
+	Header     http.Header       // headers of Gemini response
+	Body       []byte            // original error body
+}
+
+func (e *UpstreamError) Error() string {
+	if e.Status == "" && e.Message == "" {
+		return fmt.Sprintf("response from Gemini is not 200: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("response from Gemini is not 200: %d %s: %s", e.StatusCode, e.Status, e.Message)
+}
+
+// newUpstreamError makes UpstreamError from Gemini response, body is read but not closed
+func newUpstreamError(resp *http.Response) *UpstreamError {
+	res := &UpstreamError{StatusCode: resp.StatusCode, Header: resp.Header}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	if err != nil {
+		return res
+	}
+	res.Body = body
+
+	// google api error format, https://cloud.google.com/apis/design/errors#http_mapping
+	var gErr struct {
+		Error struct {
+			Code    int               `json:"code"`
+			Message string            `json:"message"`
+			Status  string            `json:"status"`
+			Details []json.RawMessage `json:"details"`
+		} `json:"error"`
+	}
+	if err = json.Unmarshal(body, &gErr); err != nil {
+		return res
+	}
+	res.Status, res.Message, res.Details = gErr.Error.Status, gErr.Error.Message, gErr.Error.Details
+	return res
+}
+
+// errorClass groups errors of Gemini calls for metrics, it returns empty string for nil error
+func errorClass(err error) string {
+	var upstreamErr *UpstreamError
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &upstreamErr):
+		switch code := upstreamErr.StatusCode; {
+		case code == http.StatusTooManyRequests:
+			return "rate_limit"
+		case code == http.StatusUnauthorized || code == http.StatusForbidden:
+			return "auth"
+		case code == http.StatusNotFound:
+			return "not_found"
+		case code < 500:
+			return "bad_request"
+		case code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout:
+			return "unavailable"
+		default:
+			return "server"
+		}
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	return "network"
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeminiProxy_SendUpstreamError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte(`{"error":{"code":429,"message":"Resource has been exhausted","status":"RESOURCE_EXHAUSTED",` +
+			`"details":[{"@type":"type.googleapis.com/google.rpc.RetryInfo","retryDelay":"7s"}]}}`))
+	}))
+	defer ts.Close()
+
+	proxy := &GeminiProxy{BaseURL: ts.URL, APIKey: "secret"}
+	_, err := proxy.Send(context.Background(), "models/gemini-2.5-pro:generateContent", io.NopCloser(strings.NewReader(`{}`)))
+	var upstreamErr *UpstreamError
+	require.ErrorAs(t, err, &upstreamErr)
+	assert.Equal(t, http.StatusTooManyRequests, upstreamErr.StatusCode)
+	assert.Equal(t, "RESOURCE_EXHAUSTED", upstreamErr.Status)
+	assert.Equal(t, "Resource has been exhausted", upstreamErr.Message)
+	require.Len(t, upstreamErr.Details, 1)
+	assert.JSONEq(t, `{"@type":"type.googleapis.com/google.rpc.RetryInfo","retryDelay":"7s"}`, string(upstreamErr.Details[0]))
+	assert.EqualError(t, err, "response from Gemini is not 200: 429 RESOURCE_EXHAUSTED: Resource has been exhausted")
+}
+
+func TestGeminiProxy_SendUpstreamErrorNotJSON(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	proxy := &GeminiProxy{BaseURL: ts.URL, APIKey: "secret"}
+	_, err := proxy.Send(context.Background(), "models/gemini-2.5-pro:generateContent", io.NopCloser(strings.NewReader(`{}`)))
+	var upstreamErr *UpstreamError
+	require.ErrorAs(t, err, &upstreamErr)
+	assert.Equal(t, "bad gateway\n", string(upstreamErr.Body))
+	assert.EqualError(t, err, "response from Gemini is not 200: 502 Bad Gateway")
+}
+
+func TestErrorClass(t *testing.T) {
+	tbl := []struct {
+		err  error
+		want string
+	}{
+		{nil, ""},
+		{&UpstreamError{StatusCode: http.StatusTooManyRequests}, "rate_limit"},
+		{&UpstreamError{StatusCode: http.StatusForbidden}, "auth"},
+		{&UpstreamError{StatusCode: http.StatusNotFound}, "not_found"},
+		{fmt.Errorf("wrapped: %w", &UpstreamError{StatusCode: http.StatusBadRequest}), "bad_request"},
+		{&UpstreamError{StatusCode: http.StatusServiceUnavailable}, "unavailable"},
+		{&UpstreamError{StatusCode: http.StatusInternalServerError}, "server"},
+		{context.DeadlineExceeded, "timeout"},
+		{context.Canceled, "canceled"},
+		{errors.New("connection refused"), "network"},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.want, errorClass(tt.err), "%v", tt.err)
+	}
+}
@@ -0,0 +1,355 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ErrRejected is returned when request has text rejected by content filter
+var ErrRejected = errors.New("request is rejected by content filter")
+
+// Actions of filter rule
+const (
+	FilterMask     = "mask"     // replace matched text with mask
+	FilterReject   = "reject"   // reject the whole request
+	FilterTokenize = "tokenize" // replace matched text with token which could be restored in response
+)
+
+// ContentFilter changes text of request parts before it's sent to Gemini and text of response parts before it's
+// returned to the client. Redactions keep state of one request, e.g. tokenized values to restore in response
+type ContentFilter interface {
+	FilterRequest(text string, red *Redactions) (string, error)
+	FilterResponse(text string, red *Redactions) string
+}
+
+// Redactions is state of content filtering of one request: tokenized values and counts of fired rules
+type Redactions struct {
+	tokens map[string]string // token to value
+	values map[string]string // value to token
+	fired  map[string]int
+}
+
+// NewRedactions makes empty state of request filtering
+func NewRedactions() *Redactions {
+	return &Redactions{tokens: map[string]string{}, values: map[string]string{}, fired: map[string]int{}}
+}
+
+// Fire counts match of rule
+func (r *Redactions) Fire(rule string) {
+	r.fired[rule]++
+}
+
+// Tokenize returns token of value like [EMAIL_1], the same value gets the same token
+func (r *Redactions) Tokenize(rule, value string) string {
+	if t, ok := r.values[value]; ok {
+		return t
+	}
+	t := fmt.Sprintf("[%s_%d]", strings.ToUpper(rule), len(r.tokens)+1)
+	r.tokens[t], r.values[value] = value, t
+	return t
+}
+
+// Restore replaces tokens in text with their values
+func (r *Redactions) Restore(text string) string {
+	if len(r.tokens) == 0 || !strings.Contains(text, "[") {
+		return text
+	}
+	pairs := make([]string, 0, 2*len(r.tokens))
+	for t, v := range r.tokens {
+		pairs = append(pairs, t, v)
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
+
+// report returns fired rules like "email:2, phone:1" and resets counts
+func (r *Redactions) report() string {
+	if len(r.fired) == 0 {
+		return ""
+	}
+	res := make([]string, 0, len(r.fired))
+	for rule, n := range r.fired {
+		res = append(res, fmt.Sprintf("%s:%d", rule, n))
+	}
+	sort.Strings(res)
+	r.fired = map[string]int{}
+	return strings.Join(res, ", ")
+}
+
+// FilterRule is regex detector of sensitive text
+type FilterRule struct {
+	Name      string
+	Pattern   *regexp.Regexp
+	Action    string
+	Mask      string // replacement of mask action, ${1} refers to group of pattern, [REDACTED] by default
+	Responses bool   // mask matches in response too
+}
+
+// RegexFilter applies rules to text in order, tokenized values are restored in response with Restore
+type RegexFilter struct {
+	rules   []FilterRule
+	restore bool
+}
+
+// NewRegexFilter makes filter of rules, every rule requires name, pattern and known action
+func NewRegexFilter(rules []FilterRule, restore bool) (*RegexFilter, error) {
+	res := &RegexFilter{restore: restore}
+	for _, r := range rules {
+		if r.Name == "" || r.Pattern == nil {
+			return nil, errors.New("filter rule requires name and pattern")
+		}
+		switch r.Action {
+		case FilterMask, FilterReject, FilterTokenize:
+		default:
+			return nil, fmt.Errorf("action of filter rule %s should be %s, %s or %s", r.Name, FilterMask, FilterReject,
+				FilterTokenize)
+		}
+		if r.Mask == "" {
+			r.Mask = "[REDACTED]"
+		}
+		res.rules = append(res.rules, r)
+	}
+	return res, nil
+}
+
+// FilterRequest applies rules to text of request, the first match of reject rule fails the request
+func (f *RegexFilter) FilterRequest(text string, red *Redactions) (string, error) {
+	for _, rule := range f.rules {
+		matches := rule.Pattern.FindAllStringIndex(text, -1)
+		if len(matches) == 0 {
+			continue
+		}
+		for range matches {
+			red.Fire(rule.Name)
+		}
+		switch rule.Action {
+		case FilterReject:
+			return "", fmt.Errorf("%w, rule %s", ErrRejected, rule.Name)
+		case FilterMask:
+			text = rule.Pattern.ReplaceAllString(text, rule.Mask)
+		case FilterTokenize:
+			text = rule.Pattern.ReplaceAllStringFunc(text, func(v string) string { return red.Tokenize(rule.Name, v) })
+		}
+	}
+	return text, nil
+}
+
+// FilterResponse masks matches of response rules and restores tokenized values
+func (f *RegexFilter) FilterResponse(text string, red *Redactions) string {
+	for _, rule := range f.rules {
+		if !rule.Responses {
+			continue
+		}
+		text = rule.Pattern.ReplaceAllStringFunc(text, func(v string) string {
+			red.Fire(rule.Name)
+			return rule.Pattern.ReplaceAllString(v, rule.Mask)
+		})
+	}
+	if f.restore {
+		text = red.Restore(text)
+	}
+	return text
+}
+
+// filterRequest applies content filters to strings in parts of request body. Fired rules are logged without the text
+func (r *GeminiProxy) filterRequest(ctx context.Context, target Target, body []byte) ([]byte, *Redactions, error) {
+	filters := r.Settings().Filters
+	if len(filters) == 0 {
+		return body, nil, nil
+	}
+	red := NewRedactions()
+	var req interface{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	changed, err := walkText(req, func(text string) (string, error) {
+		var err error
+		for _, f := range filters {
+			if text, err = f.FilterRequest(text, red); err != nil {
+				return "", err
+			}
+		}
+		return text, nil
+	})
+	if fired := red.report(); fired != "" {
+		log.Printf("[INFO] content filter rules fired in request of client %q to %s: %s", ClientFromContext(ctx),
+			target.Path(), fired)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if !changed {
+		return body, red, nil
+	}
+	body, err = json.Marshal(req)
+	return body, red, err
+}
+
+// filterResponse applies content filters to strings in parts of response body, body is returned as is
+// if it can't be parsed
+func (r *GeminiProxy) filterResponse(body []byte, red *Redactions) []byte {
+	if red == nil {
+		return body
+	}
+	var resp interface{}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return body
+	}
+	filters := r.Settings().Filters
+	changed, _ := walkText(resp, func(text string) (string, error) {
+		for _, f := range filters {
+			text = f.FilterResponse(text, red)
+		}
+		return text, nil
+	})
+	if !changed {
+		return body
+	}
+	res, err := json.Marshal(resp)
+	if err != nil {
+		return body
+	}
+	return res
+}
+
+// filterEvent applies content filters to "data:" line of SSE stream, line ending is kept.
+// Token split between events can't be restored
+func (r *GeminiProxy) filterEvent(line []byte, red *Redactions) []byte {
+	if red == nil {
+		return line
+	}
+	data, ok := bytes.CutPrefix(line, []byte("data:"))
+	if !ok {
+		return line
+	}
+	trimmed := bytes.TrimRight(data, "\r\n")
+	filtered := r.filterResponse(bytes.TrimSpace(trimmed), red)
+	if bytes.Equal(filtered, bytes.TrimSpace(trimmed)) {
+		return line
+	}
+	res := append([]byte("data: "), filtered...)
+	return append(res, data[len(trimmed):]...)
+}
+
+// logResponseRedactions logs rules fired in response
+func logResponseRedactions(ctx context.Context, target Target, red *Redactions) {
+	if red == nil {
+		return
+	}
+	if fired := red.report(); fired != "" {
+		log.Printf("[INFO] content filter rules fired in response to client %q from %s: %s", ClientFromContext(ctx),
+			target.Path(), fired)
+	}
+}
+
+// walkText calls fn for every string in parts of "parts" lists of json value, e.g. in contents, systemInstruction
+// and candidates, and replaces the string with result. Besides text it covers args of function calls and function
+// responses, inline data and file references are skipped. It reports if any string is changed
+func walkText(v interface{}, fn func(string) (string, error)) (bool, error) {
+	changed := false
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for _, k := range sortedKeys(val) {
+			child := val[k]
+			if parts, ok := child.([]interface{}); ok && k == "parts" {
+				for _, p := range parts {
+					part, ok := p.(map[string]interface{})
+					if !ok {
+						continue
+					}
+					c, err := walkPart(part, fn)
+					if err != nil {
+						return false, err
+					}
+					changed = changed || c
+				}
+				continue
+			}
+			c, err := walkText(child, fn)
+			if err != nil {
+				return false, err
+			}
+			changed = changed || c
+		}
+	case []interface{}:
+		for _, child := range val {
+			c, err := walkText(child, fn)
+			if err != nil {
+				return false, err
+			}
+			changed = changed || c
+		}
+	}
+	return changed, nil
+}
+
+// opaqueFields of part are not text, filters would break base64 data, URIs and signatures
+var opaqueFields = map[string]bool{"inlineData": true, "fileData": true, "thoughtSignature": true}
+
+// walkPart calls fn for every string value of part except opaque fields
+func walkPart(part map[string]interface{}, fn func(string) (string, error)) (bool, error) {
+	changed := false
+	for _, k := range sortedKeys(part) {
+		if opaqueFields[k] {
+			continue
+		}
+		res, c, err := walkStrings(part[k], fn)
+		if err != nil {
+			return false, err
+		}
+		if c {
+			part[k], changed = res, true
+		}
+	}
+	return changed, nil
+}
+
+// walkStrings calls fn for every string in json value and returns value with results
+func walkStrings(v interface{}, fn func(string) (string, error)) (interface{}, bool, error) {
+	changed := false
+	switch val := v.(type) {
+	case string:
+		res, err := fn(val)
+		if err != nil {
+			return nil, false, err
+		}
+		return res, res != val, nil
+	case map[string]interface{}:
+		for _, k := range sortedKeys(val) {
+			res, c, err := walkStrings(val[k], fn)
+			if err != nil {
+				return nil, false, err
+			}
+			if c {
+				val[k], changed = res, true
+			}
+		}
+	case []interface{}:
+		for i, child := range val {
+			res, c, err := walkStrings(child, fn)
+			if err != nil {
+				return nil, false, err
+			}
+			if c {
+				val[i], changed = res, true
+			}
+		}
+	}
+	return v, changed, nil
+}
+
+// sortedKeys returns keys of json object sorted to tokenize values in the same order every time
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
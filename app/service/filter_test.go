@@ -0,0 +1,120 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testRules = []FilterRule{
+	{Name: "card", Pattern: regexp.MustCompile(`\b(?:\d[ -]?){13,15}\d\b`), Action: FilterReject},
+	{Name: "email", Pattern: regexp.MustCompile(`[\w.+-]+@[\w-]+\.[\w.]+`), Action: FilterTokenize},
+	{Name: "phone", Pattern: regexp.MustCompile(`\+\d{3}(\d{6})(\d{2})`), Action: FilterMask, Mask: "+***${2}", Responses: true},
+}
+
+func TestNewRegexFilter(t *testing.T) {
+	_, err := NewRegexFilter([]FilterRule{{Name: "r"}}, false)
+	assert.EqualError(t, err, "filter rule requires name and pattern")
+	_, err = NewRegexFilter([]FilterRule{{Name: "r", Pattern: regexp.MustCompile("a"), Action: "drop"}}, false)
+	assert.EqualError(t, err, "action of filter rule r should be mask, reject or tokenize")
+	f, err := NewRegexFilter([]FilterRule{{Name: "r", Pattern: regexp.MustCompile("a"), Action: FilterMask}}, false)
+	require.NoError(t, err)
+	assert.Equal(t, "[REDACTED]", f.rules[0].Mask)
+}
+
+func TestRegexFilter(t *testing.T) {
+	f, err := NewRegexFilter(testRules, true)
+	require.NoError(t, err)
+
+	red := NewRedactions()
+	res, err := f.FilterRequest("mail bob@example.com or call +35712345678, cc alice@example.com and bob@example.com", red)
+	require.NoError(t, err)
+	assert.Equal(t, "mail [EMAIL_1] or call +***78, cc [EMAIL_2] and [EMAIL_1]", res)
+	assert.Equal(t, "email:3, phone:1", red.report())
+
+	_, err = f.FilterRequest("my card is 4111 1111 1111 1111", red)
+	assert.ErrorIs(t, err, ErrRejected)
+	assert.EqualError(t, err, "request is rejected by content filter, rule card")
+
+	res = f.FilterResponse("Sent to [EMAIL_2] and [EMAIL_1], call +35798765432", red)
+	assert.Equal(t, "Sent to alice@example.com and bob@example.com, call +***32", res)
+
+	noRestore, err := NewRegexFilter(testRules, false)
+	require.NoError(t, err)
+	assert.Equal(t, "Sent to [EMAIL_2]", noRestore.FilterResponse("Sent to [EMAIL_2]", red))
+}
+
+func TestGeminiProxy_SendFiltered(t *testing.T) {
+	var gotBody string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		gotBody = string(b)
+		_, _ = w.Write([]byte(`{"candidates":[{"content":{"role":"model","parts":[{"text":"Hello [EMAIL_1]"}]}}]}`))
+	}))
+	defer ts.Close()
+
+	f, err := NewRegexFilter(testRules, true)
+	require.NoError(t, err)
+	p := &GeminiProxy{BaseURL: ts.URL, APIKey: "key", Filters: []ContentFilter{f}}
+
+	resp, err := p.Send(context.Background(), "models/gemini-2.5-pro:generateContent", io.NopCloser(strings.NewReader(
+		`{"systemInstruction":{"parts":[{"text":"support@acme.com"}]},"contents":[{"parts":[{"text":"I'm bob@example.com"}]}]}`)))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"systemInstruction":{"parts":[{"text":"[EMAIL_2]"}]},"contents":[{"parts":[{"text":"I'm [EMAIL_1]"}]}]}`,
+		gotBody, "contents are walked before system instruction")
+	assert.JSONEq(t, `{"candidates":[{"content":{"role":"model","parts":[{"text":"Hello bob@example.com"}]}}]}`, string(resp))
+
+	gotBody = ""
+	_, err = p.Send(context.Background(), "models/gemini-2.5-pro:generateContent",
+		io.NopCloser(strings.NewReader(`{"contents":[{"parts":[{"text":"card 4111-1111-1111-1111"}]}]}`)))
+	assert.ErrorIs(t, err, ErrRejected)
+	assert.Empty(t, gotBody, "rejected request is not sent")
+
+	body := `{"contents":[{"parts":[{"text":"nothing to hide"}]}],"generationConfig":{"temperature":0}}`
+	_, err = p.Send(context.Background(), "models/gemini-2.5-pro:generateContent", io.NopCloser(strings.NewReader(body)))
+	require.NoError(t, err)
+	assert.Equal(t, body, gotBody, "body without matches is sent as is")
+}
+
+func TestGeminiProxy_StreamFiltered(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		assert.Contains(t, string(b), "[EMAIL_1]")
+		_, _ = w.Write([]byte("data: {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"Hi [EMAIL_1]\"}]}}]}\r\n\r\n"))
+		_, _ = w.Write([]byte("data: {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"!\"}]}}]}\n\n"))
+	}))
+	defer ts.Close()
+
+	f, err := NewRegexFilter(testRules, true)
+	require.NoError(t, err)
+	p := &GeminiProxy{BaseURL: ts.URL, APIKey: "key", Filters: []ContentFilter{f}}
+
+	w := &mockStreamWriter{}
+	err = p.Stream(context.Background(), "models/gemini-2.5-pro:streamGenerateContent",
+		io.NopCloser(strings.NewReader(`{"contents":[{"parts":[{"text":"I'm bob@example.com"}]}]}`)), w)
+	require.NoError(t, err)
+	assert.Equal(t, "data: {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"Hi bob@example.com\"}]}}]}\r\n\r\n"+
+		"data: {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"!\"}]}}]}\n\n", w.String())
+}
+
+func TestWalkText(t *testing.T) {
+	var v interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{"contents":[{"parts":[{"text":"a"},{"inlineData":{"data":"a"}},`+
+		`{"functionResponse":{"name":"a","response":{"list":["a",1,{"a":"a"}]}}}],"role":"a"}]}`), &v))
+	changed, err := walkText(v, func(s string) (string, error) { return s + "!", nil })
+	require.NoError(t, err)
+	assert.True(t, changed)
+	res, err := json.Marshal(v)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"contents":[{"parts":[{"text":"a!"},{"inlineData":{"data":"a"}},`+
+		`{"functionResponse":{"name":"a!","response":{"list":["a!",1,{"a":"a!"}]}}}],"role":"a"}]}`, string(res),
+		"strings of parts are walked except inline data")
+}
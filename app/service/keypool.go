@@ -0,0 +1,207 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// KeyStrategy defines how KeyPool selects the next key
+type KeyStrategy string
+
+// nolint:revive
+const (
+	RoundRobin     KeyStrategy = "round-robin"
+	LeastThrottled KeyStrategy = "least-throttled"
+)
+
+// DefaultKeyCooldown is time key rests after Gemini throttled it, unless Gemini asked for specific delay
+const DefaultKeyCooldown = time.Minute
+
+// KeyPool rotates Gemini API keys. Key rejected by Gemini with 429 or 403 is put in cooldown and skipped
+// until cooldown ends. Keys are never logged or reported, only their fingerprints
+type KeyPool struct {
+	Strategy KeyStrategy
+	Cooldown time.Duration
+
+	lock sync.Mutex
+	keys []*poolKey
+	next int
+	now  func() time.Time
+}
+
+// KeyHealth is state of pool key
+type KeyHealth struct {
+	Fingerprint   string    `json:"fingerprint"`
+	Available     bool      `json:"available"`
+	CooldownUntil time.Time `json:"cooldown_until,omitzero"`
+	LastThrottled time.Time `json:"last_throttled,omitzero"`
+	LastStatus    int       `json:"last_status,omitempty"`
+	Requests      int64     `json:"requests"`
+	Throttled     int64     `json:"throttled"`
+}
+
+type poolKey struct {
+	key string
+	KeyHealth
+}
+
+// NewKeyPool makes pool of unique keys
+func NewKeyPool(keys []string, strategy KeyStrategy, cooldown time.Duration) (*KeyPool, error) {
+	if strategy == "" {
+		strategy = RoundRobin
+	}
+	if strategy != RoundRobin && strategy != LeastThrottled {
+		return nil, fmt.Errorf("unknown key strategy %q", strategy)
+	}
+	if cooldown <= 0 {
+		cooldown = DefaultKeyCooldown
+	}
+	res := &KeyPool{Strategy: strategy, Cooldown: cooldown}
+	seen := map[string]bool{}
+	for _, k := range keys {
+		if k == "" || seen[k] {
+			continue
+		}
+		seen[k] = true
+		res.keys = append(res.keys, &poolKey{key: k, KeyHealth: KeyHealth{Fingerprint: Fingerprint(k)}})
+	}
+	if len(res.keys) == 0 {
+		return nil, errors.New("no Gemini API keys in pool")
+	}
+	return res, nil
+}
+
+// Inherit takes state of keys from previous pool, e.g. on reload of config, so keys in cooldown are not picked
+// right away. Keys missing in previous pool start fresh. It's no-op on nil pool
+func (p *KeyPool) Inherit(prev *KeyPool) {
+	if p == nil || prev == nil || prev == p {
+		return
+	}
+	prev.lock.Lock()
+	health := make(map[string]KeyHealth, len(prev.keys))
+	for _, k := range prev.keys {
+		health[k.key] = k.KeyHealth
+	}
+	prev.lock.Unlock()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, k := range p.keys {
+		if h, ok := health[k.key]; ok {
+			k.KeyHealth = h
+		}
+	}
+}
+
+// Fingerprint returns short hash of the key safe to be logged
+func Fingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:4])
+}
+
+// Pick returns the next key. If all keys are in cooldown the one which cools down first is returned
+func (p *KeyPool) Pick() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := p.timeNow()
+
+	var picked, soonest *poolKey
+	pickedIdx := 0
+	for i := 0; i < len(p.keys); i++ {
+		idx := (p.next + i) % len(p.keys)
+		k := p.keys[idx]
+		if soonest == nil || k.CooldownUntil.Before(soonest.CooldownUntil) {
+			soonest = k
+		}
+		if now.Before(k.CooldownUntil) {
+			continue
+		}
+		if picked == nil || (p.Strategy == LeastThrottled && k.LastThrottled.Before(picked.LastThrottled)) {
+			picked, pickedIdx = k, idx
+		}
+		if p.Strategy == RoundRobin {
+			break
+		}
+	}
+	if picked == nil {
+		picked = soonest
+		for i, k := range p.keys {
+			if k == soonest {
+				pickedIdx = i
+			}
+		}
+	}
+	p.next = (pickedIdx + 1) % len(p.keys)
+	picked.Requests++
+	return picked.key
+}
+
+// Report accounts result of Gemini call made with the key and returns true if key was put in cooldown
+func (p *KeyPool) Report(key string, err error) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var k *poolKey
+	for _, pk := range p.keys {
+		if pk.key == key {
+			k = pk
+		}
+	}
+	if k == nil {
+		return false
+	}
+
+	var upstreamErr *UpstreamError
+	if !errors.As(err, &upstreamErr) {
+		if err == nil {
+			k.LastStatus = http.StatusOK
+		}
+		return false
+	}
+	k.LastStatus = upstreamErr.StatusCode
+	if upstreamErr.StatusCode != http.StatusTooManyRequests && upstreamErr.StatusCode != http.StatusForbidden {
+		return false
+	}
+	cooldown := upstreamErr.RetryDelay()
+	if cooldown <= 0 {
+		cooldown = p.Cooldown
+	}
+	now := p.timeNow()
+	k.Throttled++
+	k.LastThrottled = now
+	k.CooldownUntil = now.Add(cooldown)
+	return true
+}
+
+// Size returns number of keys in pool
+func (p *KeyPool) Size() int {
+	return len(p.keys)
+}
+
+// Health returns state of all keys
+func (p *KeyPool) Health() []KeyHealth {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := p.timeNow()
+	res := make([]KeyHealth, 0, len(p.keys))
+	for _, k := range p.keys {
+		h := k.KeyHealth
+		h.Available = !now.Before(k.CooldownUntil)
+		if h.Available {
+			h.CooldownUntil = time.Time{}
+		}
+		res = append(res, h)
+	}
+	return res
+}
+
+func (p *KeyPool) timeNow() time.Time {
+	if p.now != nil {
+		return p.now()
+	}
+	return time.Now()
+}
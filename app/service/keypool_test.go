@@ -0,0 +1,118 @@
+package service
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyPool_RoundRobin(t *testing.T) {
+	now := time.Date(2025, 3, 17, 10, 0, 0, 0, time.UTC)
+	p, err := NewKeyPool([]string{"k1", "k2", "k3", "k2", ""}, RoundRobin, time.Minute)
+	require.NoError(t, err)
+	p.now = func() time.Time { return now }
+	assert.Equal(t, 3, p.Size())
+
+	assert.Equal(t, []string{"k1", "k2", "k3", "k1"}, []string{p.Pick(), p.Pick(), p.Pick(), p.Pick()})
+
+	assert.True(t, p.Report("k2", &UpstreamError{StatusCode: http.StatusTooManyRequests}))
+	assert.False(t, p.Report("k3", &UpstreamError{StatusCode: http.StatusBadRequest}))
+	assert.Equal(t, []string{"k3", "k1", "k3"}, []string{p.Pick(), p.Pick(), p.Pick()}, "k2 is in cooldown")
+
+	now = now.Add(time.Minute)
+	assert.Equal(t, []string{"k1", "k2"}, []string{p.Pick(), p.Pick()}, "k2 is back after cooldown")
+}
+
+func TestKeyPool_Inherit(t *testing.T) {
+	now := time.Date(2025, 3, 17, 10, 0, 0, 0, time.UTC)
+	prev, err := NewKeyPool([]string{"k1", "k2"}, RoundRobin, time.Minute)
+	require.NoError(t, err)
+	prev.now = func() time.Time { return now }
+	prev.Pick()
+	prev.Report("k1", &UpstreamError{StatusCode: http.StatusTooManyRequests})
+
+	p, err := NewKeyPool([]string{"k1", "k3"}, RoundRobin, time.Minute)
+	require.NoError(t, err)
+	p.now = func() time.Time { return now }
+	p.Inherit(prev)
+	(*KeyPool)(nil).Inherit(prev)
+
+	assert.Equal(t, []string{"k3", "k3"}, []string{p.Pick(), p.Pick()}, "k1 stays in cooldown")
+	health := p.Health()
+	require.Len(t, health, 2)
+	assert.Equal(t, KeyHealth{Fingerprint: Fingerprint("k1"), CooldownUntil: now.Add(time.Minute), LastThrottled: now,
+		LastStatus: http.StatusTooManyRequests, Requests: 1, Throttled: 1}, health[0])
+	assert.Equal(t, int64(2), health[1].Requests, "new key starts fresh")
+}
+
+func TestKeyPool_AllInCooldown(t *testing.T) {
+	now := time.Date(2025, 3, 17, 10, 0, 0, 0, time.UTC)
+	p, err := NewKeyPool([]string{"k1", "k2"}, RoundRobin, time.Minute)
+	require.NoError(t, err)
+	p.now = func() time.Time { return now }
+
+	p.Report("k1", &UpstreamError{StatusCode: http.StatusTooManyRequests})
+	p.Report("k2", &UpstreamError{StatusCode: http.StatusForbidden, Header: http.Header{"Retry-After": {"10"}}})
+	assert.Equal(t, "k2", p.Pick(), "key which cools down first is used")
+
+	health := p.Health()
+	require.Len(t, health, 2)
+	assert.Equal(t, KeyHealth{Fingerprint: Fingerprint("k2"), CooldownUntil: now.Add(10 * time.Second),
+		LastThrottled: now, LastStatus: http.StatusForbidden, Requests: 1, Throttled: 1}, health[1])
+	assert.NotContains(t, health[0].Fingerprint, "k1")
+	assert.Len(t, health[0].Fingerprint, 8)
+}
+
+func TestKeyPool_LeastThrottled(t *testing.T) {
+	now := time.Date(2025, 3, 17, 10, 0, 0, 0, time.UTC)
+	p, err := NewKeyPool([]string{"k1", "k2", "k3"}, LeastThrottled, time.Second)
+	require.NoError(t, err)
+	p.now = func() time.Time { return now }
+
+	p.Report("k1", &UpstreamError{StatusCode: http.StatusTooManyRequests})
+	now = now.Add(time.Second)
+	p.Report("k2", &UpstreamError{StatusCode: http.StatusTooManyRequests})
+	now = now.Add(time.Second)
+	assert.Equal(t, "k3", p.Pick(), "never throttled key goes first")
+	assert.Equal(t, "k3", p.Pick())
+	p.Report("k3", &UpstreamError{StatusCode: http.StatusTooManyRequests})
+	now = now.Add(time.Second)
+	assert.Equal(t, "k1", p.Pick(), "key throttled long ago is preferred")
+}
+
+func TestNewKeyPool(t *testing.T) {
+	_, err := NewKeyPool([]string{""}, RoundRobin, 0)
+	assert.EqualError(t, err, "no Gemini API keys in pool")
+	_, err = NewKeyPool([]string{"k1"}, "random", 0)
+	assert.EqualError(t, err, `unknown key strategy "random"`)
+}
+
+func TestGeminiProxy_SendKeyFailover(t *testing.T) {
+	var keys []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("x-goog-api-key"))
+		if r.Header.Get("x-goog-api-key") == "exhausted" {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+
+	pool, err := NewKeyPool([]string{"exhausted", "fresh"}, RoundRobin, time.Minute)
+	require.NoError(t, err)
+	proxy := &GeminiProxy{BaseURL: ts.URL, Keys: pool}
+
+	for i := 0; i < 3; i++ {
+		_, err = proxy.Send(context.Background(), "models/m:generateContent", io.NopCloser(strings.NewReader(`{}`)))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{"exhausted", "fresh", "fresh", "fresh"}, keys)
+}
@@ -0,0 +1,305 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrBadRequest is returned when request body can't be processed by proxy
+var ErrBadRequest = errors.New("request body is not valid")
+
+// ModelAlias is friendly name of Gemini model, defaults are merged into generation requests to the alias,
+// values of the request take precedence
+type ModelAlias struct {
+	Name        string
+	Model       string
+	Description string
+	Defaults    json.RawMessage // json object like generateContent request, e.g. generationConfig and safetySettings
+}
+
+// Model is model available to clients, either alias or Gemini model allowed by proxy
+type Model struct {
+	Name             string   `json:"name"`
+	Model            string   `json:"model"`
+	Alias            bool     `json:"alias"`
+	DisplayName      string   `json:"display_name,omitempty"`
+	Description      string   `json:"description,omitempty"`
+	InputTokenLimit  int      `json:"input_token_limit,omitempty"`
+	OutputTokenLimit int      `json:"output_token_limit,omitempty"`
+	Methods          []string `json:"methods,omitempty"`
+}
+
+// ModelCatalog keeps model aliases and models reported by Gemini models.list
+type ModelCatalog struct {
+	lock     sync.RWMutex
+	aliases  []ModelAlias
+	byName   map[string]int
+	upstream []Model // nil until refreshed
+}
+
+// NewModelCatalog makes catalog of aliases, alias names should be unique and defaults should be json objects
+func NewModelCatalog(aliases []ModelAlias) (*ModelCatalog, error) {
+	res := &ModelCatalog{byName: make(map[string]int, len(aliases))}
+	for _, a := range aliases {
+		if a.Name == "" || a.Model == "" {
+			return nil, errors.New("model alias requires name and model")
+		}
+		if strings.ContainsAny(a.Name, "/:") {
+			return nil, fmt.Errorf("model alias %s should not contain / or :", a.Name)
+		}
+		if _, ok := res.byName[a.Name]; ok {
+			return nil, fmt.Errorf("model alias %s is duplicated", a.Name)
+		}
+		if len(a.Defaults) > 0 {
+			var obj map[string]interface{}
+			if err := json.Unmarshal(a.Defaults, &obj); err != nil {
+				return nil, fmt.Errorf("defaults of model alias %s should be json object: %w", a.Name, err)
+			}
+		}
+		res.byName[a.Name] = len(res.aliases)
+		res.aliases = append(res.aliases, a)
+	}
+	return res, nil
+}
+
+// Resolve returns alias by name, false if the name isn't an alias
+func (c *ModelCatalog) Resolve(name string) (ModelAlias, bool) {
+	if c == nil {
+		return ModelAlias{}, false
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	i, ok := c.byName[name]
+	if !ok {
+		return ModelAlias{}, false
+	}
+	return c.aliases[i], true
+}
+
+// SetUpstream replaces models reported by Gemini
+func (c *ModelCatalog) SetUpstream(models []Model) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.upstream = models
+}
+
+func (c *ModelCatalog) snapshot() (aliases []ModelAlias, upstream []Model) {
+	if c == nil {
+		return nil, nil
+	}
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.aliases, c.upstream
+}
+
+// Models returns aliases and Gemini models allowed by proxy. Gemini models are taken from models.list
+// if catalog is refreshed, otherwise allowlist entries without glob patterns are listed
+func (r *GeminiProxy) Models() []Model {
+	aliases, upstream := r.Catalog.snapshot()
+	known := make(map[string]Model, len(upstream))
+	for _, m := range upstream {
+		known[m.Model] = m
+	}
+
+	res := make([]Model, 0, len(aliases)+len(upstream))
+	for _, a := range aliases {
+		m := known[a.Model]
+		m.Name, m.Model, m.Alias = a.Name, a.Model, true
+		if a.Description != "" {
+			m.Description = a.Description
+		}
+		res = append(res, m)
+	}
+
+	allowed := r.Settings().AllowedModels
+	var models []Model
+	if upstream != nil {
+		for _, m := range upstream {
+			if matchAny(allowed, m.Model) {
+				models = append(models, m)
+			}
+		}
+	} else {
+		for _, p := range allowed {
+			if !strings.ContainsAny(p, "*?[") {
+				models = append(models, Model{Name: p, Model: p})
+			}
+		}
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].Name < models[j].Name })
+	return append(res, models...)
+}
+
+// ListUpstreamModels calls Gemini models.list and returns all pages of models
+func (r *GeminiProxy) ListUpstreamModels(ctx context.Context) ([]Model, error) {
+	if s := r.Settings(); s.APIKey == "" && s.Keys == nil {
+		return nil, fmt.Errorf("gemini API key is not found")
+	}
+	var res []Model
+	pageToken := ""
+	for {
+		query := url.Values{"pageSize": {"1000"}}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		page, err := r.listModelsPage(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range page.Models {
+			id := strings.TrimPrefix(m.Name, "models/")
+			res = append(res, Model{Name: id, Model: id, DisplayName: m.DisplayName, Description: m.Description,
+				InputTokenLimit: m.InputTokenLimit, OutputTokenLimit: m.OutputTokenLimit,
+				Methods: m.SupportedGenerationMethods})
+		}
+		if page.NextPageToken == "" {
+			return res, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+type modelsPage struct {
+	Models []struct {
+		Name                       string   `json:"name"`
+		DisplayName                string   `json:"displayName"`
+		Description                string   `json:"description"`
+		InputTokenLimit            int      `json:"inputTokenLimit"`
+		OutputTokenLimit           int      `json:"outputTokenLimit"`
+		SupportedGenerationMethods []string `json:"supportedGenerationMethods"`
+	} `json:"models"`
+	NextPageToken string `json:"nextPageToken"`
+}
+
+func (r *GeminiProxy) listModelsPage(ctx context.Context, query url.Values) (modelsPage, error) {
+	reqURL := strings.TrimSuffix(r.BaseURL, "/") + "/models?" + query.Encode()
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", reqURL, http.NoBody)
+	if err != nil {
+		return modelsPage{}, err
+	}
+	settings := r.Settings()
+	key := settings.pickKey()
+	httpReq.Header.Add("x-goog-api-key", key)
+	httpResp, err := r.Client.Do(httpReq)
+	if err != nil {
+		return modelsPage{}, fmt.Errorf("can not list Gemini models: %w", err)
+	}
+	defer closeBody(httpResp)
+	if httpResp.StatusCode != http.StatusOK {
+		err = newUpstreamError(httpResp)
+		if settings.Keys != nil {
+			settings.Keys.Report(key, err)
+		}
+		return modelsPage{}, err
+	}
+	var page modelsPage
+	if err = json.NewDecoder(io.LimitReader(httpResp.Body, 16<<20)).Decode(&page); err != nil {
+		return modelsPage{}, fmt.Errorf("can not decode Gemini models: %w", err)
+	}
+	return page, nil
+}
+
+// RefreshModels refreshes catalog from Gemini models.list right away and then every interval until ctx is done.
+// Failed refresh keeps models of the previous one
+func (r *GeminiProxy) RefreshModels(ctx context.Context, interval time.Duration) {
+	if r.Catalog == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if models, err := r.ListUpstreamModels(ctx); err != nil {
+			log.Printf("[WARN] can not refresh Gemini models: %v", err)
+		} else {
+			r.Catalog.SetUpstream(models)
+			log.Printf("[DEBUG] %d Gemini models are listed", len(models))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// resolveAlias replaces alias in target with Gemini model, alias defaults are merged by ApplyPolicy.
+// Alias in models of batchEmbedContents requests is replaced too, Gemini expects them to match the target
+func (r *GeminiProxy) resolveAlias(target Target, body []byte) (Target, []byte, bool, error) {
+	alias, ok := r.Catalog.Resolve(target.Model)
+	if !ok {
+		return target, body, false, nil
+	}
+	target.Model = alias.Model
+	if target.Method != "batchEmbedContents" {
+		return target, body, true, nil
+	}
+	resolved, err := resolveBatchModels(alias, body)
+	if err != nil {
+		return Target{}, nil, true, err
+	}
+	return target, resolved, true, nil
+}
+
+// resolveBatchModels replaces alias in model of every request in batch with Gemini model
+func resolveBatchModels(alias ModelAlias, body []byte) ([]byte, error) {
+	var batch map[string]interface{}
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	requests, _ := batch["requests"].([]interface{})
+	changed := false
+	for _, r := range requests {
+		req, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if m, _ := req["model"].(string); m == alias.Name || m == "models/"+alias.Name {
+			req["model"], changed = "models/"+alias.Model, true
+		}
+	}
+	if !changed {
+		return body, nil
+	}
+	return json.Marshal(batch)
+}
+
+// mergeDefaults merges json objects, values of body take precedence, nested objects are merged recursively
+func mergeDefaults(defaults, body []byte) ([]byte, error) {
+	var d, b map[string]interface{}
+	if err := json.Unmarshal(defaults, &d); err != nil {
+		return nil, fmt.Errorf("can not decode defaults: %w", err)
+	}
+	if len(strings.TrimSpace(string(body))) == 0 {
+		body = []byte("{}")
+	}
+	if err := json.Unmarshal(body, &b); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	return json.Marshal(mergeObjects(d, b))
+}
+
+func mergeObjects(defaults, values map[string]interface{}) map[string]interface{} {
+	for k, dv := range defaults {
+		v, ok := values[k]
+		if !ok {
+			values[k] = dv
+			continue
+		}
+		dObj, dIsObj := dv.(map[string]interface{})
+		vObj, vIsObj := v.(map[string]interface{})
+		if dIsObj && vIsObj {
+			values[k] = mergeObjects(dObj, vObj)
+		}
+	}
+	return values
+}
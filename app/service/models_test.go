@@ -0,0 +1,142 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewModelCatalog(t *testing.T) {
+	_, err := NewModelCatalog([]ModelAlias{{Name: "fast", Model: "gemini-2.5-flash"}, {Name: "fast", Model: "x"}})
+	assert.EqualError(t, err, "model alias fast is duplicated")
+	_, err = NewModelCatalog([]ModelAlias{{Name: "fast"}})
+	assert.EqualError(t, err, "model alias requires name and model")
+	_, err = NewModelCatalog([]ModelAlias{{Name: "a:b", Model: "m"}})
+	assert.EqualError(t, err, "model alias a:b should not contain / or :")
+	_, err = NewModelCatalog([]ModelAlias{{Name: "fast", Model: "m", Defaults: json.RawMessage(`[1]`)}})
+	assert.ErrorContains(t, err, "defaults of model alias fast should be json object")
+
+	c, err := NewModelCatalog([]ModelAlias{{Name: "fast", Model: "gemini-2.5-flash"}})
+	require.NoError(t, err)
+	a, ok := c.Resolve("fast")
+	assert.True(t, ok)
+	assert.Equal(t, "gemini-2.5-flash", a.Model)
+	_, ok = c.Resolve("gemini-2.5-flash")
+	assert.False(t, ok)
+}
+
+func TestGeminiProxy_SendAlias(t *testing.T) {
+	var gotPath, gotBody string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		b, _ := io.ReadAll(r.Body)
+		gotBody = string(b)
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+
+	catalog, err := NewModelCatalog([]ModelAlias{{Name: "fast", Model: "gemini-2.5-flash",
+		Defaults: json.RawMessage(`{"generationConfig":{"temperature":0.2,"topK":10},"safetySettings":[{"category":"c","threshold":"t"}]}`)}})
+	require.NoError(t, err)
+	p := &GeminiProxy{BaseURL: ts.URL, APIKey: "key", AllowedModels: []string{"gemini-2.5-pro"}, Catalog: catalog}
+
+	target := Target{Model: "fast", Method: "generateContent"}
+	body, err := p.ApplyPolicy(context.Background(), target, []byte(`{"contents":[],"generationConfig":{"temperature":1}}`))
+	require.NoError(t, err)
+	_, err = p.Send(context.Background(), target.Path(), io.NopCloser(bytes.NewReader(body)))
+	require.NoError(t, err)
+	assert.Equal(t, "/models/gemini-2.5-flash:generateContent", gotPath, "alias model is allowed")
+	assert.JSONEq(t, `{"contents":[],"generationConfig":{"temperature":1,"topK":10},
+		"safetySettings":[{"category":"c","threshold":"t"}]}`, gotBody)
+
+	_, err = p.Send(context.Background(), "models/fast:countTokens", io.NopCloser(strings.NewReader(`{"contents":[]}`)))
+	require.NoError(t, err)
+	assert.Equal(t, "/models/gemini-2.5-flash:countTokens", gotPath)
+	assert.JSONEq(t, `{"contents":[]}`, gotBody, "defaults are merged into generation requests only")
+
+	_, err = p.Send(context.Background(), "models/fast:batchEmbedContents", io.NopCloser(strings.NewReader(
+		`{"requests":[{"model":"models/fast","content":{"parts":[{"text":"a"}]}},{"model":"models/gemini-2.5-flash"}]}`)))
+	require.NoError(t, err)
+	assert.Equal(t, "/models/gemini-2.5-flash:batchEmbedContents", gotPath)
+	assert.JSONEq(t, `{"requests":[{"model":"models/gemini-2.5-flash","content":{"parts":[{"text":"a"}]}},`+
+		`{"model":"models/gemini-2.5-flash"}]}`, gotBody, "alias of batch requests is resolved")
+
+	_, err = p.ApplyPolicy(context.Background(), target, []byte(`not json`))
+	assert.ErrorIs(t, err, ErrBadRequest)
+
+	_, err = p.Send(context.Background(), "models/gemini-2.5-flash:generateContent", io.NopCloser(strings.NewReader(`{}`)))
+	assert.ErrorIs(t, err, ErrNotAllowed, "model itself is not in allowlist")
+}
+
+func TestGeminiProxy_Models(t *testing.T) {
+	catalog, err := NewModelCatalog([]ModelAlias{{Name: "smart", Model: "gemini-2.5-pro", Description: "the best"}})
+	require.NoError(t, err)
+	p := &GeminiProxy{AllowedModels: []string{"gemini-2.5-pro", "gemini-2.5-flash", "gemma-*"}, Catalog: catalog}
+	assert.Equal(t, []Model{
+		{Name: "smart", Model: "gemini-2.5-pro", Alias: true, Description: "the best"},
+		{Name: "gemini-2.5-flash", Model: "gemini-2.5-flash"},
+		{Name: "gemini-2.5-pro", Model: "gemini-2.5-pro"},
+	}, p.Models(), "glob patterns are not listed without upstream models")
+
+	catalog.SetUpstream([]Model{
+		{Name: "gemini-2.5-pro", Model: "gemini-2.5-pro", DisplayName: "Gemini 2.5 Pro", InputTokenLimit: 100},
+		{Name: "gemma-3", Model: "gemma-3"},
+		{Name: "veo-3", Model: "veo-3"},
+	})
+	assert.Equal(t, []Model{
+		{Name: "smart", Model: "gemini-2.5-pro", Alias: true, DisplayName: "Gemini 2.5 Pro", Description: "the best",
+			InputTokenLimit: 100},
+		{Name: "gemini-2.5-pro", Model: "gemini-2.5-pro", DisplayName: "Gemini 2.5 Pro", InputTokenLimit: 100},
+		{Name: "gemma-3", Model: "gemma-3"},
+	}, p.Models())
+
+	assert.Empty(t, (&GeminiProxy{}).Models())
+}
+
+func TestGeminiProxy_RefreshModels(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		assert.Equal(t, "/models", r.URL.Path)
+		assert.Equal(t, "key", r.Header.Get("x-goog-api-key"))
+		if r.URL.Query().Get("pageToken") == "" {
+			_, _ = w.Write([]byte(`{"models":[{"name":"models/gemini-2.5-pro","displayName":"Gemini 2.5 Pro",` +
+				`"supportedGenerationMethods":["generateContent"]}],"nextPageToken":"p2"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"models":[{"name":"models/gemini-2.5-flash","outputTokenLimit":64}]}`))
+	}))
+	defer ts.Close()
+
+	catalog, err := NewModelCatalog(nil)
+	require.NoError(t, err)
+	p := &GeminiProxy{BaseURL: ts.URL, APIKey: "key", Catalog: catalog}
+
+	models, err := p.ListUpstreamModels(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []Model{
+		{Name: "gemini-2.5-pro", Model: "gemini-2.5-pro", DisplayName: "Gemini 2.5 Pro", Methods: []string{"generateContent"}},
+		{Name: "gemini-2.5-flash", Model: "gemini-2.5-flash", OutputTokenLimit: 64},
+	}, models)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.RefreshModels(ctx, time.Hour)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool { return len(p.Models()) == 2 }, time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+}
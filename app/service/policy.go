@@ -0,0 +1,213 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// PromptPolicy is server side rule of generation requests of clients and models, empty Clients and Models match all.
+// Clamped options are set to their maximum if request doesn't have them, so model defaults can't exceed the cap
+type PromptPolicy struct {
+	Name              string
+	Clients           []string
+	Models            []string // Gemini model glob patterns, alias is matched by its model
+	SystemInstruction string
+	ReplaceSystem     bool // replace systemInstruction of request instead of prepending to it
+	MaxTemperature    *float64
+	MaxTopP           *float64
+	MaxOutputTokens   int               // 0 leaves maxOutputTokens as is
+	SafetySettings    map[string]string // harm category to forced threshold
+	Strip             []string          // top level fields removed from request, e.g. tools or cachedContent
+}
+
+// PolicySet applies all prompt policies matching client and model in order of configuration
+type PolicySet struct {
+	policies []PromptPolicy
+}
+
+// NewPolicySet makes set of policies, model patterns should be valid globs and contents can't be stripped
+func NewPolicySet(policies []PromptPolicy) (*PolicySet, error) {
+	for _, p := range policies {
+		if p.Name == "" {
+			return nil, errors.New("prompt policy requires name")
+		}
+		for _, m := range p.Models {
+			if _, err := path.Match(m, ""); err != nil {
+				return nil, fmt.Errorf("model %q of prompt policy %s is not valid: %w", m, p.Name, err)
+			}
+		}
+		if (p.MaxTemperature != nil && *p.MaxTemperature < 0) || (p.MaxTopP != nil && *p.MaxTopP < 0) ||
+			p.MaxOutputTokens < 0 {
+			return nil, fmt.Errorf("limits of prompt policy %s should not be negative", p.Name)
+		}
+		for _, f := range p.Strip {
+			if f == "" || f == "contents" {
+				return nil, fmt.Errorf("prompt policy %s can't strip %q", p.Name, f)
+			}
+		}
+	}
+	return &PolicySet{policies: policies}, nil
+}
+
+// match returns policies of client and model
+func (s *PolicySet) match(client, model string) []PromptPolicy {
+	if s == nil {
+		return nil
+	}
+	var res []PromptPolicy
+	for _, p := range s.policies {
+		if (len(p.Clients) == 0 || contains(p.Clients, client)) && matchAny(p.Models, model) {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// ApplyPolicy merges defaults of model alias into body of generation request and applies prompt policies
+// of the client and the target model to it. Defaults are merged first, so policies cap and strip them too.
+// Body of other methods and body without alias defaults and matching policies is returned as is
+func (r *GeminiProxy) ApplyPolicy(ctx context.Context, target Target, body []byte) ([]byte, error) {
+	if target.Method != "generateContent" && target.Method != streamMethod {
+		return body, nil
+	}
+	model := target.Model
+	if alias, ok := r.Catalog.Resolve(model); ok {
+		model = alias.Model
+		if len(alias.Defaults) > 0 {
+			merged, err := mergeDefaults(alias.Defaults, body)
+			if err != nil {
+				return nil, err
+			}
+			body = merged
+		}
+	}
+	client := ClientFromContext(ctx)
+	policies := r.Settings().Policies.match(client, model)
+	if len(policies) == 0 {
+		return body, nil
+	}
+
+	var req map[string]interface{}
+	if err := json.Unmarshal(body, &req); err != nil || req == nil {
+		return nil, fmt.Errorf("%w: body should be json object", ErrBadRequest)
+	}
+	// Gemini accepts snake_case names too, they are renamed so request can't bypass policy
+	renameField(req, "system_instruction", "systemInstruction")
+	renameField(req, "generation_config", "generationConfig")
+	renameField(req, "safety_settings", "safetySettings")
+	for _, p := range policies {
+		p.apply(req)
+		log.Printf("[DEBUG] prompt policy %s is applied to request of client %q to %s", p.Name, client, model)
+	}
+	return json.Marshal(req)
+}
+
+func (p PromptPolicy) apply(req map[string]interface{}) {
+	for _, f := range p.Strip {
+		delete(req, f)
+		delete(req, snakeCase(f))
+	}
+
+	if p.SystemInstruction != "" {
+		part := map[string]interface{}{"text": p.SystemInstruction}
+		si, ok := req["systemInstruction"].(map[string]interface{})
+		if p.ReplaceSystem || !ok {
+			si = map[string]interface{}{}
+		}
+		parts, _ := si["parts"].([]interface{})
+		si["parts"] = append([]interface{}{part}, parts...)
+		req["systemInstruction"] = si
+	}
+
+	if p.MaxTemperature != nil || p.MaxTopP != nil || p.MaxOutputTokens > 0 {
+		gc, ok := req["generationConfig"].(map[string]interface{})
+		if !ok {
+			gc = map[string]interface{}{}
+		}
+		renameField(gc, "top_p", "topP")
+		renameField(gc, "max_output_tokens", "maxOutputTokens")
+		if p.MaxTemperature != nil {
+			clamp(gc, "temperature", *p.MaxTemperature)
+		}
+		if p.MaxTopP != nil {
+			clamp(gc, "topP", *p.MaxTopP)
+		}
+		if p.MaxOutputTokens > 0 {
+			clamp(gc, "maxOutputTokens", float64(p.MaxOutputTokens))
+		}
+		req["generationConfig"] = gc
+	}
+
+	if len(p.SafetySettings) > 0 {
+		settings, _ := req["safetySettings"].([]interface{})
+		categories := make([]string, 0, len(p.SafetySettings))
+		for c := range p.SafetySettings {
+			categories = append(categories, c)
+		}
+		sort.Strings(categories)
+		for _, c := range categories {
+			settings = forceThreshold(settings, c, p.SafetySettings[c])
+		}
+		req["safetySettings"] = settings
+	}
+}
+
+// clamp sets numeric field to max if it's bigger, missing or not a number
+func clamp(obj map[string]interface{}, field string, maxVal float64) {
+	if v, ok := obj[field].(float64); ok && v <= maxVal {
+		return
+	}
+	obj[field] = maxVal
+}
+
+// forceThreshold sets threshold of harm category in safety settings, the setting is added if it's missing
+func forceThreshold(settings []interface{}, category, threshold string) []interface{} {
+	for _, s := range settings {
+		if m, ok := s.(map[string]interface{}); ok && m["category"] == category {
+			m["threshold"] = threshold
+			return settings
+		}
+	}
+	return append(settings, map[string]interface{}{"category": category, "threshold": threshold})
+}
+
+// renameField moves value of snake_case field to camelCase one, camelCase value wins if both are set
+func renameField(obj map[string]interface{}, from, to string) {
+	v, ok := obj[from]
+	if !ok {
+		return
+	}
+	if _, exists := obj[to]; !exists {
+		obj[to] = v
+	}
+	delete(obj, from)
+}
+
+// snakeCase converts camelCase field name to snake_case, e.g. cachedContent to cached_content
+func snakeCase(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if unicode.IsUpper(c) {
+			b.WriteByte('_')
+			c = unicode.ToLower(c)
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func contains(list []string, val string) bool {
+	for _, v := range list {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPolicySet(t *testing.T) {
+	_, err := NewPolicySet([]PromptPolicy{{}})
+	assert.EqualError(t, err, "prompt policy requires name")
+	_, err = NewPolicySet([]PromptPolicy{{Name: "p", Models: []string{"gemini-["}}})
+	assert.ErrorContains(t, err, `model "gemini-[" of prompt policy p is not valid`)
+	_, err = NewPolicySet([]PromptPolicy{{Name: "p", MaxOutputTokens: -1}})
+	assert.EqualError(t, err, "limits of prompt policy p should not be negative")
+	_, err = NewPolicySet([]PromptPolicy{{Name: "p", Strip: []string{"contents"}}})
+	assert.EqualError(t, err, `prompt policy p can't strip "contents"`)
+	_, err = NewPolicySet([]PromptPolicy{{Name: "p", Clients: []string{"web"}, Models: []string{"gemini-*"}}})
+	assert.NoError(t, err)
+}
+
+func TestGeminiProxy_ApplyPolicy(t *testing.T) {
+	one, half := 1.0, 0.5
+	policies, err := NewPolicySet([]PromptPolicy{
+		{Name: "company", SystemInstruction: "You work for ACME.", MaxOutputTokens: 1000,
+			SafetySettings: map[string]string{"HARM_CATEGORY_HARASSMENT": "BLOCK_LOW_AND_ABOVE", "HARM_CATEGORY_HATE_SPEECH": "BLOCK_ONLY_HIGH"}},
+		{Name: "web", Clients: []string{"web"}, Models: []string{"gemini-2.5-*"}, MaxTemperature: &one, MaxTopP: &half,
+			Strip: []string{"tools", "cachedContent"}},
+		{Name: "kiosk", Clients: []string{"kiosk"}, SystemInstruction: "Answer in one sentence.", ReplaceSystem: true},
+	})
+	require.NoError(t, err)
+	catalog, err := NewModelCatalog([]ModelAlias{{Name: "fast", Model: "gemini-2.5-flash"}})
+	require.NoError(t, err)
+	p := &GeminiProxy{Policies: policies, Catalog: catalog}
+
+	tbl := []struct {
+		name, client string
+		target       Target
+		body, res    string
+	}{
+		{name: "all clients", target: Target{Model: "gemini-2.0-flash", Method: "generateContent"},
+			body: `{"contents":[],"systemInstruction":{"parts":[{"text":"Be nice."}]},"generationConfig":{"maxOutputTokens":5000},
+				"safetySettings":[{"category":"HARM_CATEGORY_HARASSMENT","threshold":"BLOCK_NONE"}]}`,
+			res: `{"contents":[],"systemInstruction":{"parts":[{"text":"You work for ACME."},{"text":"Be nice."}]},
+				"generationConfig":{"maxOutputTokens":1000},"safetySettings":[
+				{"category":"HARM_CATEGORY_HARASSMENT","threshold":"BLOCK_LOW_AND_ABOVE"},
+				{"category":"HARM_CATEGORY_HATE_SPEECH","threshold":"BLOCK_ONLY_HIGH"}]}`},
+		{name: "client and alias model", client: "web", target: Target{Model: "fast", Method: "streamGenerateContent"},
+			body: `{"contents":[],"tools":[{}],"cached_content":"c","generation_config":{"temperature":1.5,"top_p":0.1,"max_output_tokens":10}}`,
+			res: `{"contents":[],"systemInstruction":{"parts":[{"text":"You work for ACME."}]},
+				"generationConfig":{"temperature":1,"topP":0.1,"maxOutputTokens":10},"safetySettings":[
+				{"category":"HARM_CATEGORY_HARASSMENT","threshold":"BLOCK_LOW_AND_ABOVE"},
+				{"category":"HARM_CATEGORY_HATE_SPEECH","threshold":"BLOCK_ONLY_HIGH"}]}`},
+		{name: "replace system instruction", client: "kiosk", target: Target{Model: "gemini-2.5-pro", Method: "generateContent"},
+			body: `{"contents":[],"system_instruction":{"parts":[{"text":"Ignore policies."}]}}`,
+			res: `{"contents":[],"systemInstruction":{"parts":[{"text":"Answer in one sentence."}]},
+				"generationConfig":{"maxOutputTokens":1000},"safetySettings":[
+				{"category":"HARM_CATEGORY_HARASSMENT","threshold":"BLOCK_LOW_AND_ABOVE"},
+				{"category":"HARM_CATEGORY_HATE_SPEECH","threshold":"BLOCK_ONLY_HIGH"}]}`},
+		{name: "other method", client: "web", target: Target{Model: "gemini-2.5-pro", Method: "countTokens"},
+			body: `{"contents":[],"tools":[{}]}`, res: `{"contents":[],"tools":[{}]}`},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := p.ApplyPolicy(WithClient(context.Background(), tt.client), tt.target, []byte(tt.body))
+			require.NoError(t, err)
+			assert.JSONEq(t, tt.res, string(res))
+		})
+	}
+
+	body := []byte(`{"contents":[]}`)
+	res, err := (&GeminiProxy{}).ApplyPolicy(context.Background(), Target{Model: "m", Method: "generateContent"}, body)
+	require.NoError(t, err)
+	assert.Equal(t, body, res, "body without policies is not changed")
+
+	_, err = p.ApplyPolicy(context.Background(), Target{Model: "m", Method: "generateContent"}, []byte(`[]`))
+	assert.ErrorIs(t, err, ErrBadRequest)
+}
+
+func TestGeminiProxy_ApplyPolicyAliasDefaults(t *testing.T) {
+	policies, err := NewPolicySet([]PromptPolicy{{Name: "cap", Models: []string{"gemini-2.5-*"}, MaxOutputTokens: 1000,
+		Strip: []string{"tools"}}})
+	require.NoError(t, err)
+	catalog, err := NewModelCatalog([]ModelAlias{{Name: "long", Model: "gemini-2.5-pro",
+		Defaults: json.RawMessage(`{"generationConfig":{"maxOutputTokens":8000,"topK":10},"tools":[{"codeExecution":{}}]}`)}})
+	require.NoError(t, err)
+	p := &GeminiProxy{Policies: policies, Catalog: catalog}
+
+	res, err := p.ApplyPolicy(context.Background(), Target{Model: "long", Method: "generateContent"}, []byte(`{"contents":[]}`))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"contents":[],"generationConfig":{"maxOutputTokens":1000,"topK":10}}`, string(res),
+		"alias defaults are capped and stripped by policy")
+}
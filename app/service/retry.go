@@ -0,0 +1,119 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// nolint:revive
+const (
+	DefaultBaseBackoff = 500 * time.Millisecond
+	DefaultMaxBackoff  = 10 * time.Second
+)
+
+// DefaultRetryStatuses are Gemini response statuses retried when RetryPolicy.Statuses is empty
+var DefaultRetryStatuses = []int{http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+	http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+// RetryPolicy defines retries of transient Gemini failures with exponential backoff.
+// Nil policy or MaxAttempts <= 1 disables retries
+type RetryPolicy struct {
+	MaxAttempts int           // total number of attempts including the first one
+	BaseBackoff time.Duration // delay before the second attempt, doubled on every next one
+	MaxBackoff  time.Duration // upper limit of delay, Gemini asking to wait longer is not retried
+	Jitter      float64       // random part of delay, 0.2 means +-20%
+	Statuses    []int         // retryable Gemini response statuses
+}
+
+// next returns delay before the next attempt and false if failed attempt shouldn't be retried.
+// Delay requested by Gemini in Retry-After header or RetryInfo details is honored
+func (p *RetryPolicy) next(attempt int, err error) (time.Duration, bool) {
+	if p == nil || attempt >= p.MaxAttempts || errors.Is(err, context.Canceled) {
+		return 0, false
+	}
+	maxBackoff := p.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultMaxBackoff
+	}
+
+	var requested time.Duration
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		if !p.retryable(upstreamErr.StatusCode) {
+			return 0, false
+		}
+		requested = upstreamErr.RetryDelay()
+		if requested > maxBackoff {
+			return 0, false
+		}
+	}
+
+	delay := p.BaseBackoff
+	if delay <= 0 {
+		delay = DefaultBaseBackoff
+	}
+	for i := 1; i < attempt && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if p.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(delay)) // nolint:gosec
+	}
+	delay = min(delay, maxBackoff)
+	return max(delay, requested), true
+}
+
+func (p *RetryPolicy) retryable(status int) bool {
+	statuses := p.Statuses
+	if len(statuses) == 0 {
+		statuses = DefaultRetryStatuses
+	}
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryDelay returns delay requested by Gemini in Retry-After header or google.rpc.RetryInfo details,
+// zero if Gemini didn't ask to wait
+func (e *UpstreamError) RetryDelay() time.Duration {
+	if ra := e.Header.Get("Retry-After"); ra != "" {
+		if secs, err := strconv.Atoi(ra); err == nil {
+			return time.Duration(secs) * time.Second
+		}
+		if t, err := http.ParseTime(ra); err == nil {
+			return time.Until(t)
+		}
+	}
+	for _, d := range e.Details {
+		var info struct {
+			Type       string `json:"@type"`
+			RetryDelay string `json:"retryDelay"`
+		}
+		if err := json.Unmarshal(d, &info); err != nil || info.Type != "type.googleapis.com/google.rpc.RetryInfo" {
+			continue
+		}
+		if delay, err := time.ParseDuration(info.RetryDelay); err == nil {
+			return delay
+		}
+	}
+	return 0
+}
+
+// sleep waits for delay or until context is done
+func sleep(ctx context.Context, delay time.Duration) error {
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
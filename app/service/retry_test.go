@@ -0,0 +1,128 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeminiProxy_SendRetry(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, `{"contents":[]}`, string(body), "body is replayed on every attempt")
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+
+	proxy := &GeminiProxy{BaseURL: ts.URL, APIKey: "secret",
+		Retry: &RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}}
+	resp, err := proxy.Send(context.Background(), "models/gemini-2.5-pro:generateContent",
+		io.NopCloser(strings.NewReader(`{"contents":[]}`)))
+	require.NoError(t, err)
+	assert.Equal(t, `{}`, string(resp))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestGeminiProxy_SendRetryGiveUp(t *testing.T) {
+	var calls int32
+	status := http.StatusTooManyRequests
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	proxy := &GeminiProxy{BaseURL: ts.URL, APIKey: "secret",
+		Retry: &RetryPolicy{MaxAttempts: 2, BaseBackoff: time.Millisecond}}
+
+	_, err := proxy.Send(context.Background(), "models/m:generateContent", io.NopCloser(strings.NewReader(`{}`)))
+	var upstreamErr *UpstreamError
+	require.ErrorAs(t, err, &upstreamErr)
+	assert.Equal(t, int32(2), atomic.SwapInt32(&calls, 0), "failed after max attempts")
+
+	status = http.StatusBadRequest
+	_, err = proxy.Send(context.Background(), "models/m:generateContent", io.NopCloser(strings.NewReader(`{}`)))
+	require.ErrorAs(t, err, &upstreamErr)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "bad request is not retried")
+}
+
+func TestGeminiProxy_StreamNotRetriedAfterStart(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Length", "100")
+		_, _ = w.Write([]byte("data: {}\n\n"))
+	}))
+	defer ts.Close()
+
+	proxy := &GeminiProxy{BaseURL: ts.URL, APIKey: "secret", Retry: &RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Millisecond}}
+	err := proxy.Stream(context.Background(), "models/m:streamGenerateContent", io.NopCloser(strings.NewReader(`{}`)),
+		&mockStreamWriter{})
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestRetryPolicy_next(t *testing.T) {
+	p := &RetryPolicy{MaxAttempts: 6, BaseBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	unavailable := &UpstreamError{StatusCode: http.StatusServiceUnavailable}
+
+	tbl := []struct {
+		name    string
+		attempt int
+		err     error
+		delay   time.Duration
+		retry   bool
+	}{
+		{"first retry", 1, unavailable, 100 * time.Millisecond, true},
+		{"exponential", 3, unavailable, 400 * time.Millisecond, true},
+		{"capped", 5, unavailable, time.Second, true},
+		{"attempts exhausted", 6, unavailable, 0, false},
+		{"network error", 1, errors.New("connection reset"), 100 * time.Millisecond, true},
+		{"canceled", 1, context.Canceled, 0, false},
+		{"not retryable", 1, &UpstreamError{StatusCode: http.StatusBadRequest}, 0, false},
+		{"retry-after", 1, &UpstreamError{StatusCode: http.StatusTooManyRequests,
+			Header: http.Header{"Retry-After": {"1"}}}, time.Second, true},
+		{"retry-after too long", 1, &UpstreamError{StatusCode: http.StatusTooManyRequests,
+			Header: http.Header{"Retry-After": {"30"}}}, 0, false},
+		{"retry info", 1, &UpstreamError{StatusCode: http.StatusTooManyRequests,
+			Details: []json.RawMessage{[]byte(`{"@type":"type.googleapis.com/google.rpc.RetryInfo","retryDelay":"0.5s"}`)}},
+			500 * time.Millisecond, true},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			delay, retry := p.next(tt.attempt, tt.err)
+			assert.Equal(t, tt.retry, retry)
+			assert.Equal(t, tt.delay, delay)
+		})
+	}
+
+	var nilPolicy *RetryPolicy
+	_, retry := nilPolicy.next(1, unavailable)
+	assert.False(t, retry)
+}
+
+func TestRetryPolicy_nextJitter(t *testing.T) {
+	p := &RetryPolicy{MaxAttempts: 2, BaseBackoff: 100 * time.Millisecond, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		delay, retry := p.next(1, &UpstreamError{StatusCode: http.StatusServiceUnavailable})
+		require.True(t, retry)
+		require.GreaterOrEqual(t, delay, 50*time.Millisecond)
+		require.LessOrEqual(t, delay, 150*time.Millisecond)
+	}
+}
@@ -0,0 +1,249 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrQueueFull is returned when scheduler queue has no room for the request
+var ErrQueueFull = errors.New("too many requests are waiting for Gemini")
+
+// ErrQueueTimeout is returned when request waited in scheduler queue longer than allowed
+var ErrQueueTimeout = errors.New("request waited for Gemini too long")
+
+// Scheduler limits calls to Gemini by requests and tokens per minute and by number of calls in flight.
+// Requests over the limits wait in bounded queue, waiting clients are served in round-robin order,
+// so one busy client can't starve others. Zero limit means unlimited
+type Scheduler struct {
+	RPM          int           // requests per minute
+	TPM          int64         // tokens per minute, prompt tokens are estimated by request size until response comes
+	MaxInFlight  int           // calls to Gemini at the same time
+	MaxQueue     int           // requests waiting for their turn, zero means no waiting
+	QueueTimeout time.Duration // maximum waiting time, zero means bound by request context only
+
+	lock     sync.Mutex
+	inFlight int
+	queued   int
+	queues   map[string][]*waiter // client -> waiting requests
+	order    []string             // clients with waiting requests in round-robin order
+	window   []*call              // calls started in the last minute
+	timer    *time.Timer
+	now      func() time.Time
+}
+
+// SchedulerStats is current state of scheduler
+type SchedulerStats struct {
+	InFlight int `json:"in_flight"`
+	Queued   int `json:"queued"`
+}
+
+type waiter struct {
+	client  string
+	tokens  int64
+	ready   chan *call
+	granted bool
+}
+
+type call struct {
+	start  time.Time
+	tokens int64
+}
+
+// Release ends the call to Gemini with the actual number of tokens, zero keeps the estimation
+type Release func(tokens int64)
+
+// Acquire waits for the turn of client request with estimated tokens and returns function which must be called
+// when call to Gemini is done
+func (s *Scheduler) Acquire(ctx context.Context, client string, tokens int64) (Release, error) {
+	s.lock.Lock()
+	if len(s.order) == 0 && s.available(tokens) {
+		c := s.start(tokens)
+		s.lock.Unlock()
+		return s.releaser(c), nil
+	}
+	if s.queued >= s.MaxQueue {
+		s.lock.Unlock()
+		return nil, ErrQueueFull
+	}
+	w := &waiter{client: client, tokens: tokens, ready: make(chan *call, 1)}
+	s.enqueue(w)
+	queueTimeout := s.QueueTimeout
+	s.lock.Unlock()
+
+	var timeout <-chan time.Time
+	if queueTimeout > 0 {
+		t := time.NewTimer(queueTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case c := <-w.ready:
+		return s.releaser(c), nil
+	case <-ctx.Done():
+		return nil, s.abandon(w, ctx.Err())
+	case <-timeout:
+		return nil, s.abandon(w, ErrQueueTimeout)
+	}
+}
+
+// SetLimits replaces limits of scheduler, e.g. on reload of config. Calls in flight and waiting requests are kept,
+// waiting requests start right away if new limits allow
+func (s *Scheduler) SetLimits(rpm int, tpm int64, maxInFlight, maxQueue int, queueTimeout time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.RPM, s.TPM, s.MaxInFlight, s.MaxQueue, s.QueueTimeout = rpm, tpm, maxInFlight, maxQueue, queueTimeout
+	s.dispatch()
+}
+
+// Stats returns number of calls in flight and waiting requests
+func (s *Scheduler) Stats() SchedulerStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return SchedulerStats{InFlight: s.inFlight, Queued: s.queued}
+}
+
+// abandon removes waiter from the queue, if the turn came in the meantime it's given back
+func (s *Scheduler) abandon(w *waiter, err error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if w.granted {
+		c := <-w.ready
+		s.inFlight--
+		for i, wc := range s.window {
+			if wc == c {
+				s.window = append(s.window[:i:i], s.window[i+1:]...)
+				break
+			}
+		}
+		s.dispatch()
+		return err
+	}
+	q := s.queues[w.client]
+	for i, qw := range q {
+		if qw == w {
+			s.queues[w.client] = append(q[:i:i], q[i+1:]...)
+			s.queued--
+			break
+		}
+	}
+	if len(s.queues[w.client]) == 0 {
+		s.dropClient(w.client)
+	}
+	s.dispatch()
+	return err
+}
+
+func (s *Scheduler) releaser(c *call) Release {
+	var once sync.Once
+	return func(tokens int64) {
+		once.Do(func() {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			s.inFlight--
+			if tokens > 0 {
+				c.tokens = tokens
+			}
+			s.dispatch()
+		})
+	}
+}
+
+func (s *Scheduler) enqueue(w *waiter) {
+	if s.queues == nil {
+		s.queues = map[string][]*waiter{}
+	}
+	if len(s.queues[w.client]) == 0 {
+		s.order = append(s.order, w.client)
+	}
+	s.queues[w.client] = append(s.queues[w.client], w)
+	s.queued++
+}
+
+func (s *Scheduler) dropClient(client string) {
+	delete(s.queues, client)
+	for i, c := range s.order {
+		if c == client {
+			s.order = append(s.order[:i:i], s.order[i+1:]...)
+			return
+		}
+	}
+}
+
+// dispatch starts waiting requests while limits allow, taking one request per client in turn
+func (s *Scheduler) dispatch() {
+	for len(s.order) > 0 {
+		client := s.order[0]
+		w := s.queues[client][0]
+		if !s.available(w.tokens) {
+			s.wakeLater()
+			return
+		}
+		s.queues[client] = s.queues[client][1:]
+		s.queued--
+		s.order = s.order[1:]
+		if len(s.queues[client]) > 0 {
+			s.order = append(s.order, client)
+		} else {
+			delete(s.queues, client)
+		}
+		w.granted = true
+		w.ready <- s.start(w.tokens)
+	}
+}
+
+func (s *Scheduler) start(tokens int64) *call {
+	c := &call{start: s.timeNow(), tokens: tokens}
+	s.inFlight++
+	s.window = append(s.window, c)
+	return c
+}
+
+// available checks limits for the next call, calls older than a minute are dropped from rate window
+func (s *Scheduler) available(tokens int64) bool {
+	if s.MaxInFlight > 0 && s.inFlight >= s.MaxInFlight {
+		return false
+	}
+	now := s.timeNow()
+	for len(s.window) > 0 && now.Sub(s.window[0].start) >= time.Minute {
+		s.window = s.window[1:]
+	}
+	if s.RPM > 0 && len(s.window) >= s.RPM {
+		return false
+	}
+	if s.TPM > 0 && len(s.window) > 0 {
+		var used int64
+		for _, c := range s.window {
+			used += c.tokens
+		}
+		// request bigger than whole budget is let through on empty window, otherwise it would wait forever
+		if used+tokens > s.TPM {
+			return false
+		}
+	}
+	return true
+}
+
+// wakeLater dispatches queue again when the oldest call leaves rate window.
+// Calls in flight dispatch the queue on release, so timer is needed for rate limits only
+func (s *Scheduler) wakeLater() {
+	if len(s.window) == 0 || s.timer != nil {
+		return
+	}
+	delay := time.Minute - s.timeNow().Sub(s.window[0].start)
+	s.timer = time.AfterFunc(delay, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.timer = nil
+		s.dispatch()
+	})
+}
+
+func (s *Scheduler) timeNow() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
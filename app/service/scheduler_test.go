@@ -0,0 +1,134 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduler_MaxInFlight(t *testing.T) {
+	s := &Scheduler{MaxInFlight: 1, MaxQueue: 1}
+	release, err := s.Acquire(context.Background(), "web", 10)
+	require.NoError(t, err)
+
+	acquired := make(chan Release)
+	go func() {
+		r, e := s.Acquire(context.Background(), "web", 10)
+		assert.NoError(t, e)
+		acquired <- r
+	}()
+	require.Eventually(t, func() bool { return s.Stats().Queued == 1 }, time.Second, time.Millisecond)
+
+	_, err = s.Acquire(context.Background(), "bot", 10)
+	assert.ErrorIs(t, err, ErrQueueFull)
+
+	release(0)
+	release(0) // second release is ignored
+	r := <-acquired
+	assert.Equal(t, SchedulerStats{InFlight: 1}, s.Stats())
+	r(0)
+	assert.Equal(t, SchedulerStats{}, s.Stats())
+}
+
+func TestScheduler_SetLimits(t *testing.T) {
+	s := &Scheduler{MaxInFlight: 1, MaxQueue: 1}
+	release, err := s.Acquire(context.Background(), "web", 0)
+	require.NoError(t, err)
+	defer release(0)
+
+	acquired := make(chan Release)
+	go func() {
+		r, e := s.Acquire(context.Background(), "web", 0)
+		assert.NoError(t, e)
+		acquired <- r
+	}()
+	require.Eventually(t, func() bool { return s.Stats().Queued == 1 }, time.Second, time.Millisecond)
+
+	s.SetLimits(0, 0, 2, 1, 0)
+	r := <-acquired
+	defer r(0)
+	assert.Equal(t, SchedulerStats{InFlight: 2}, s.Stats(), "waiting request starts with raised limit")
+
+	s.SetLimits(0, 0, 2, 0, 0)
+	_, err = s.Acquire(context.Background(), "web", 0)
+	assert.ErrorIs(t, err, ErrQueueFull)
+}
+
+func TestScheduler_QueueTimeout(t *testing.T) {
+	s := &Scheduler{MaxInFlight: 1, MaxQueue: 10, QueueTimeout: 10 * time.Millisecond}
+	release, err := s.Acquire(context.Background(), "web", 0)
+	require.NoError(t, err)
+	defer release(0)
+
+	_, err = s.Acquire(context.Background(), "web", 0)
+	assert.ErrorIs(t, err, ErrQueueTimeout)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = s.Acquire(ctx, "web", 0)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, SchedulerStats{InFlight: 1}, s.Stats())
+}
+
+func TestScheduler_Fairness(t *testing.T) {
+	s := &Scheduler{MaxInFlight: 1, MaxQueue: 10}
+	release, err := s.Acquire(context.Background(), "busy", 0)
+	require.NoError(t, err)
+
+	var lock sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	enqueue := func(client string) {
+		wg.Add(1)
+		queued := s.Stats().Queued
+		go func() {
+			defer wg.Done()
+			r, e := s.Acquire(context.Background(), client, 0)
+			require.NoError(t, e)
+			lock.Lock()
+			order = append(order, client)
+			lock.Unlock()
+			r(0)
+		}()
+		require.Eventually(t, func() bool { return s.Stats().Queued == queued+1 }, time.Second, time.Millisecond)
+	}
+	enqueue("busy")
+	enqueue("busy")
+	enqueue("busy")
+	enqueue("quiet")
+
+	release(0)
+	wg.Wait()
+	assert.Equal(t, []string{"busy", "quiet", "busy", "busy"}, order)
+}
+
+func TestScheduler_RateLimits(t *testing.T) {
+	var lock sync.Mutex
+	now := time.Date(2025, 3, 17, 10, 0, 0, 0, time.UTC)
+	s := &Scheduler{RPM: 2, TPM: 100, now: func() time.Time { lock.Lock(); defer lock.Unlock(); return now }}
+
+	r1, err := s.Acquire(context.Background(), "web", 10)
+	require.NoError(t, err)
+	r1(60)
+	r2, err := s.Acquire(context.Background(), "web", 10)
+	require.NoError(t, err)
+	r2(0)
+	_, err = s.Acquire(context.Background(), "web", 10)
+	assert.ErrorIs(t, err, ErrQueueFull, "rpm is exhausted and waiting is not allowed")
+
+	lock.Lock()
+	now = now.Add(time.Minute)
+	lock.Unlock()
+	r3, err := s.Acquire(context.Background(), "web", 90)
+	require.NoError(t, err)
+	r3(0)
+	_, err = s.Acquire(context.Background(), "web", 20)
+	assert.ErrorIs(t, err, ErrQueueFull, "tpm is exhausted")
+	r4, err := s.Acquire(context.Background(), "web", 10)
+	require.NoError(t, err, "small request fits into tpm")
+	r4(0)
+}
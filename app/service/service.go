@@ -1,30 +1,362 @@
 package service
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"sync"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/theshamuel/gemini-proxy/app/audit"
+	"github.com/theshamuel/gemini-proxy/app/metrics"
 )
 
-// GeminiProxy represents proxy service
+// ErrBadTarget is returned when proxied path doesn't address Gemini model method
+var ErrBadTarget = errors.New("target path should be in format models/{model}:{method}")
+
+// ErrNotAllowed is returned when model or method is not in the allowlist
+var ErrNotAllowed = errors.New("model or method is not allowed")
+
+const streamMethod = "streamGenerateContent"
+
+// GeminiProxy represents proxy service. APIKey, Keys, allowlists, Retry, Policies and Filters are initial
+// settings, they are replaced with Reload
 type GeminiProxy struct {
-	OriginURL string
-	Client    http.Client
-	APIKey    string
-	Lock      sync.Mutex
+	BaseURL        string
+	Client         http.Client
+	APIKey         string
+	Keys           *KeyPool
+	AllowedModels  []string
+	AllowedMethods []string
+	Retry          *RetryPolicy
+	Scheduler      *Scheduler
+	Metrics        *metrics.Metrics
+	Catalog        *ModelCatalog
+	Policies       *PolicySet
+	Filters        []ContentFilter
+	Audit          *audit.Logger
+	ModelTimeouts  []ModelTimeout // override timeout of Client for models, the first match wins
+	Cache          *ResponseCache // cache of SendCached, disabled if nil
+	settings       atomic.Pointer[Settings]
+}
+
+// ModelTimeout is timeout of non-streaming call to Gemini for models matching glob patterns
+type ModelTimeout struct {
+	Models  []string
+	Timeout time.Duration
+}
+
+// Target is Gemini model method addressed by proxied request, e.g. models/gemini-2.5-pro:generateContent
+type Target struct {
+	Model  string
+	Method string
+}
+
+// targetNameRe is allowed model or method name, it keeps encoded bytes, dot segments, query and fragment
+// out of Gemini URL, cache keys, audit and metrics
+var targetNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// ParseTarget parses path like models/gemini-2.5-pro:generateContent into Target
+func ParseTarget(p string) (Target, error) {
+	p = strings.Trim(p, "/")
+	if !strings.HasPrefix(p, "models/") {
+		return Target{}, ErrBadTarget
+	}
+	model, method, ok := strings.Cut(strings.TrimPrefix(p, "models/"), ":")
+	if !ok || !targetNameRe.MatchString(model) || !targetNameRe.MatchString(method) {
+		return Target{}, ErrBadTarget
+	}
+	return Target{Model: model, Method: method}, nil
+}
+
+// Path returns target path relative to Gemini API base URL
+func (t Target) Path() string {
+	return "models/" + t.Model + ":" + t.Method
+}
+
+// StreamWriter is destination of proxied SSE events, Flush is called after every event
+type StreamWriter interface {
+	io.Writer
+	Flush() error
+}
+
+// IsStreaming checks if path addresses streaming method which should be proxied with Stream
+func IsStreaming(targetPath string) bool {
+	t, err := ParseTarget(targetPath)
+	return err == nil && t.Method == streamMethod
+}
+
+// CacheControl tells how request uses response cache, it's set by Cache-Control header of client request
+type CacheControl struct {
+	NoCache bool // cached response is not returned
+	NoStore bool // response is not cached
+}
+
+// Results of cache lookup returned by SendCached
+const (
+	CacheHit  = "HIT"
+	CacheMiss = "MISS"
+)
+
+// Send request to Gemini API model method addressed by path and proxy back the Gemini response
+func (r *GeminiProxy) Send(ctx context.Context, targetPath string, request io.ReadCloser) ([]byte, error) {
+	resp, _, err := r.send(ctx, targetPath, request, nil)
+	return resp, err
+}
+
+// SendCached sends request like Send through response cache, it returns CacheHit or CacheMiss for cacheable request
+// and empty string for others. Cached response is returned after allowlists and content filters like the one of
+// Gemini and it's reported to audit log too
+func (r *GeminiProxy) SendCached(ctx context.Context, targetPath string, request io.ReadCloser,
+	cc CacheControl) (resp []byte, cacheResult string, err error) {
+	return r.send(ctx, targetPath, request, &cc)
+}
+
+// send proxies request to Gemini, response cache is used if cc is set
+func (r *GeminiProxy) send(ctx context.Context, targetPath string, request io.ReadCloser,
+	cc *CacheControl) (resp []byte, cacheResult string, err error) {
+	target, body, err := r.prepare(targetPath, request)
+	if err != nil {
+		return nil, "", err
+	}
+	body, redactions, err := r.filterRequest(ctx, target, body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	cacheKey := ""
+	if cc != nil && r.Cache != nil {
+		if key, ok := r.Cache.Key(target, body); ok {
+			cacheKey, cacheResult = key, CacheMiss
+		}
+	}
+	if cacheKey != "" && !cc.NoCache {
+		if raw, ok := r.Cache.Get(cacheKey); ok {
+			// tokens of cached response are audited but not reported to metrics, Gemini didn't spend them
+			usage, _ := ParseUsage(raw)
+			r.auditExchange(ctx, target, body, raw, usage, time.Now(), nil, true)
+			resp = r.filterResponse(raw, redactions)
+			logResponseRedactions(ctx, target, redactions)
+			return resp, CacheHit, nil
+		}
+	}
+
+	release, err := r.schedule(ctx, body)
+	if err != nil {
+		return nil, cacheResult, err
+	}
+	var usage Usage
+	var raw []byte
+	start := time.Now()
+	defer func() {
+		r.finish(ctx, target, release, usage)
+		r.auditExchange(ctx, target, body, raw, usage, start, err, false)
+	}()
+
+	client := r.clientFor(target.Model)
+	httpResp, err := r.do(ctx, &client, target, nil, body)
+	if err != nil {
+		return nil, cacheResult, err
+	}
+	defer closeBody(httpResp)
+
+	raw, err = io.ReadAll(httpResp.Body)
+	if err != nil {
+		log.Printf("[ERROR] can not read response body %#v", err)
+		return nil, cacheResult, err
+	}
+	if cacheKey != "" && !cc.NoStore {
+		// response is cached as Gemini sent it, filters of the request which gets it are applied on hit
+		r.Cache.Set(cacheKey, raw)
+	}
+	usage, _ = ParseUsage(raw)
+	resp = r.filterResponse(raw, redactions)
+	logResponseRedactions(ctx, target, redactions)
+
+	return resp, cacheResult, nil
+}
+
+// Stream request to Gemini API streaming method addressed by path and write every SSE event to w as soon as
+// it arrives. Client timeout isn't applied, stream is bound by ctx only, i.e. by client connection.
+// Request is retried only until Gemini starts the stream
+func (r *GeminiProxy) Stream(ctx context.Context, targetPath string, request io.ReadCloser, w StreamWriter) (err error) {
+	target, body, err := r.prepare(targetPath, request)
+	if err != nil {
+		return err
+	}
+	body, redactions, err := r.filterRequest(ctx, target, body)
+	if err != nil {
+		return err
+	}
+	defer logResponseRedactions(ctx, target, redactions)
+
+	release, err := r.schedule(ctx, body)
+	if err != nil {
+		return err
+	}
+	var usage Usage
+	events := &eventCollector{enabled: r.Audit.Enabled(ClientFromContext(ctx)) && r.Audit.Content()}
+	start := time.Now()
+	defer func() {
+		r.finish(ctx, target, release, usage)
+		r.auditExchange(ctx, target, body, events.JSON(), usage, start, err, false)
+	}()
+
+	client := r.Client
+	client.Timeout = 0
+	httpResp, err := r.do(ctx, &client, target, url.Values{"alt": {"sse"}}, body)
+	if err != nil {
+		return err
+	}
+	defer closeBody(httpResp)
+
+	reader := bufio.NewReader(httpResp.Body)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			events.Add(line)
+			line = r.filterEvent(line, redactions)
+			if u, ok := ParseEventUsage(line); ok {
+				usage = u
+			}
+			if _, errWrite := w.Write(line); errWrite != nil {
+				return fmt.Errorf("can not write stream event: %w", errWrite)
+			}
+			// blank line terminates SSE event
+			if len(bytes.TrimRight(line, "\r\n")) == 0 {
+				if errFlush := w.Flush(); errFlush != nil {
+					return fmt.Errorf("can not flush stream event: %w", errFlush)
+				}
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return w.Flush()
+		}
+		if err != nil {
+			return fmt.Errorf("can not read stream from Gemini: %w", err)
+		}
+	}
+}
+
+// clientFor returns http client with timeout of the model
+func (r *GeminiProxy) clientFor(model string) http.Client {
+	res := r.Client
+	for _, t := range r.Settings().ModelTimeouts {
+		if len(t.Models) > 0 && matchAny(t.Models, model) {
+			res.Timeout = t.Timeout
+			break
+		}
+	}
+	return res
+}
+
+// prepare reads request body, resolves model alias and checks target against allowlists.
+// Body is buffered to be replayed on retry
+func (r *GeminiProxy) prepare(targetPath string, request io.ReadCloser) (Target, []byte, error) {
+	if s := r.Settings(); s.APIKey == "" && s.Keys == nil {
+		return Target{}, nil, fmt.Errorf("gemini API key is not found")
+	}
+
+	target, err := ParseTarget(targetPath)
+	if err != nil {
+		return Target{}, nil, err
+	}
+
+	body, err := io.ReadAll(request)
+	if err != nil {
+		return Target{}, nil, fmt.Errorf("can not read request body: %w", err)
+	}
+
+	target, body, aliased, err := r.resolveAlias(target, body)
+	if err != nil {
+		return Target{}, nil, err
+	}
+
+	if !r.isAllowed(target, aliased) {
+		return Target{}, nil, fmt.Errorf("%w: %s", ErrNotAllowed, target.Path())
+	}
+	return target, body, nil
+}
+
+// schedule waits for the turn of the call in scheduler, tokens are estimated as 4 bytes of request per token
+func (r *GeminiProxy) schedule(ctx context.Context, body []byte) (Release, error) {
+	if r.Scheduler == nil {
+		return func(int64) {}, nil
+	}
+	return r.Scheduler.Acquire(ctx, ClientFromContext(ctx), int64(len(body)/4))
 }
 
-// Send request to Gemini API and proxy back the Gemini response
-func (r *GeminiProxy) Send(request io.ReadCloser) ([]byte, error) {
-	if r.APIKey == "" {
-		return nil, fmt.Errorf("gemini API key is not found")
+// finish ends the call in scheduler with actual usage and reports tokens to metrics
+func (r *GeminiProxy) finish(ctx context.Context, target Target, release Release, usage Usage) {
+	release(usage.TotalTokens)
+	r.Metrics.Tokens(target.Model, ClientFromContext(ctx), usage.PromptTokens, usage.CandidatesTokens)
+}
+
+// do makes POST request to Gemini model method and returns response with 200 status, caller should close the body
+func (r *GeminiProxy) do(ctx context.Context, client *http.Client, target Target, query url.Values,
+	body []byte) (*http.Response, error) {
+	reqURL := strings.TrimSuffix(r.BaseURL, "/") + "/" + target.Path()
+	if len(query) > 0 {
+		reqURL += "?" + query.Encode()
+	}
+
+	settings := r.Settings()
+	attempt, failovers := 1, 0
+	for {
+		key := settings.pickKey()
+		start := time.Now()
+		httpResp, err := r.post(ctx, client, reqURL, key, body)
+		r.observe(target, httpResp, err, time.Since(start))
+		if settings.Keys != nil && settings.Keys.Report(key, err) {
+			log.Printf("[WARN] Gemini API key %s is put in cooldown: %v", Fingerprint(key), err)
+			// throttled key is replaced with another one right away, it doesn't count as attempt
+			if failovers < settings.Keys.Size()-1 && ctx.Err() == nil {
+				failovers++
+				r.Metrics.Retry(target.Model, "key_failover")
+				continue
+			}
+		}
+		if err == nil {
+			return httpResp, nil
+		}
+		delay, retry := settings.Retry.next(attempt, err)
+		if !retry || ctx.Err() != nil {
+			return nil, err
+		}
+		r.Metrics.Retry(target.Model, errorClass(err))
+		log.Printf("[WARN] attempt %d to call %s failed, retry in %v: %v", attempt, target.Path(), delay, err)
+		if err = sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+		attempt++
 	}
+}
 
-	url := r.OriginURL + r.APIKey
+// observe reports single call to Gemini to metrics
+func (r *GeminiProxy) observe(target Target, httpResp *http.Response, err error, d time.Duration) {
+	status := 0
+	var upstreamErr *UpstreamError
+	switch {
+	case err == nil:
+		status = httpResp.StatusCode
+	case errors.As(err, &upstreamErr):
+		status = upstreamErr.StatusCode
+	}
+	r.Metrics.ObserveUpstream(target.Model, target.Method, status, errorClass(err), d)
+}
 
-	httpReq, err := http.NewRequest("POST", url, request)
+// post makes single POST request to Gemini, non-200 response is returned as UpstreamError
+func (r *GeminiProxy) post(ctx context.Context, client *http.Client, reqURL, key string, body []byte) (*http.Response, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", reqURL, bytes.NewReader(body))
 
 	if err != nil {
 		log.Printf("[ERROR] cannot create POST request: %#v;", err)
@@ -33,32 +365,51 @@ func (r *GeminiProxy) Send(request io.ReadCloser) ([]byte, error) {
 
 	httpReq.Header.Add("Content-Type", "application/json")
 	httpReq.Header.Add("Priority", "u=1, i")
-	httpResp, err := r.Client.Do(httpReq)
+	httpReq.Header.Add("x-goog-api-key", key)
+	httpResp, err := client.Do(httpReq)
 	if err != nil {
 		log.Printf("[ERROR] can not make POST request: %#v", err)
-		if errClose := httpResp.Body.Close(); errClose != nil {
-			log.Printf("[ERROR] can not close response body %#v", errClose)
-		}
 		return nil, err
 	}
 
-	if httpResp == nil {
-		return nil, fmt.Errorf("response from Gemini is nil")
+	if httpResp.StatusCode != http.StatusOK {
+		defer closeBody(httpResp)
+		return nil, newUpstreamError(httpResp)
 	}
 
-	if httpResp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("response from Gemini is not 200: %s", httpResp.Status)
+	return httpResp, nil
+}
+
+func closeBody(httpResp *http.Response) {
+	if err := httpResp.Body.Close(); err != nil {
+		log.Printf("[ERROR] can not close response body %#v", err)
 	}
+}
 
-	byteResp, err := io.ReadAll(httpResp.Body)
-	if err != nil {
-		log.Printf("[ERROR] can not read response body %#v", err)
-		return nil, err
+// AllowedModel returns model of target with alias resolved, false if target is not allowed
+func (r *GeminiProxy) AllowedModel(target Target) (string, bool) {
+	aliased := false
+	if alias, ok := r.Catalog.Resolve(target.Model); ok {
+		target.Model, aliased = alias.Model, true
 	}
+	return target.Model, r.isAllowed(target, aliased)
+}
 
-	return byteResp, nil
+// isAllowed checks target against allowlists, empty allowlist allows everything.
+// Model entries could be glob patterns, e.g. gemini-2.5-*. Models of aliases are allowed by configuration.
+func (r *GeminiProxy) isAllowed(t Target, aliased bool) bool {
+	s := r.Settings()
+	return (aliased || matchAny(s.AllowedModels, t.Model)) && matchAny(s.AllowedMethods, t.Method)
 }
 
-func (r *GeminiProxy) GetMutex() *sync.Mutex {
-	return &r.Lock
+func matchAny(patterns []string, val string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, err := path.Match(p, val); err == nil && ok {
+			return true
+		}
+	}
+	return false
 }
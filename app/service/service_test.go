@@ -1 +1,165 @@
 package service
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTarget(t *testing.T) {
+	tbl := []struct {
+		path string
+		want Target
+		err  error
+	}{
+		{"models/gemini-2.5-pro:generateContent", Target{Model: "gemini-2.5-pro", Method: "generateContent"}, nil},
+		{"/models/text-embedding-004:embedContent", Target{Model: "text-embedding-004", Method: "embedContent"}, nil},
+		{"models/gemini-2.5-pro", Target{}, ErrBadTarget},
+		{"models/:generateContent", Target{}, ErrBadTarget},
+		{"tunedModels/abc:generateContent", Target{}, ErrBadTarget},
+		{"models/../files:generateContent", Target{}, ErrBadTarget},
+		{"models/..:generateContent", Target{}, ErrBadTarget},
+		{"models/%2e%2e:generateContent", Target{}, ErrBadTarget},
+		{"models/gemini%2F..%2Ffiles:generateContent", Target{}, ErrBadTarget},
+		{"models/gemini-2.5-pro:generateContent%3Fkey=x", Target{}, ErrBadTarget},
+		{"models/gemini-2.5-pro?alt=sse:generateContent", Target{}, ErrBadTarget},
+		{"models/gemini-2.5-pro:generateContent#x", Target{}, ErrBadTarget},
+		{"models/gemini 2.5:generateContent", Target{}, ErrBadTarget},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := ParseTarget(tt.path)
+			assert.Equal(t, tt.err, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestGeminiProxy_Send(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1beta/models/gemini-2.5-pro:countTokens", r.URL.Path)
+		assert.Equal(t, "secret", r.Header.Get("x-goog-api-key"))
+		assert.Empty(t, r.URL.Query().Get("key"))
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, `{"contents":[]}`, string(body))
+		_, _ = w.Write([]byte(`{"totalTokens":1}`))
+	}))
+	defer ts.Close()
+
+	proxy := &GeminiProxy{
+		BaseURL:        ts.URL + "/v1beta/",
+		APIKey:         "secret",
+		AllowedModels:  []string{"gemini-2.5-*"},
+		AllowedMethods: []string{"generateContent", "countTokens"},
+	}
+
+	resp, err := proxy.Send(context.Background(), "models/gemini-2.5-pro:countTokens", io.NopCloser(strings.NewReader(`{"contents":[]}`)))
+	require.NoError(t, err)
+	assert.Equal(t, `{"totalTokens":1}`, string(resp))
+
+	_, err = proxy.Send(context.Background(), "models/gemini-1.5-pro:countTokens", io.NopCloser(strings.NewReader(`{}`)))
+	assert.ErrorIs(t, err, ErrNotAllowed)
+
+	_, err = proxy.Send(context.Background(), "models/gemini-2.5-pro:embedContent", io.NopCloser(strings.NewReader(`{}`)))
+	assert.ErrorIs(t, err, ErrNotAllowed)
+
+	_, err = proxy.Send(context.Background(), "files/abc", io.NopCloser(strings.NewReader(`{}`)))
+	assert.ErrorIs(t, err, ErrBadTarget)
+}
+
+func TestGeminiProxy_SendModelTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "gemini-2.5-pro") {
+			time.Sleep(200 * time.Millisecond)
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+
+	proxy := &GeminiProxy{BaseURL: ts.URL, APIKey: "secret", Client: http.Client{Timeout: 50 * time.Millisecond},
+		ModelTimeouts: []ModelTimeout{{Models: []string{"gemini-2.5-pro*"}, Timeout: time.Second}}}
+
+	_, err := proxy.Send(context.Background(), "models/gemini-2.5-pro:generateContent",
+		io.NopCloser(strings.NewReader(`{}`)))
+	assert.NoError(t, err, "timeout of model is used")
+
+	proxy.ModelTimeouts[0].Timeout = 50 * time.Millisecond
+	_, err = proxy.Send(context.Background(), "models/gemini-2.5-pro:generateContent",
+		io.NopCloser(strings.NewReader(`{}`)))
+	assert.Error(t, err)
+
+	_, err = proxy.Send(context.Background(), "models/gemini-2.5-flash:generateContent",
+		io.NopCloser(strings.NewReader(`{}`)))
+	assert.NoError(t, err, "timeout of client is used for other models")
+}
+
+func TestGeminiProxy_Stream(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/models/gemini-2.5-pro:streamGenerateContent", r.URL.Path)
+		assert.Equal(t, "sse", r.URL.Query().Get("alt"))
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: {\"n\":1}\r\n\r\n"))
+		w.(http.Flusher).Flush()
+		_, _ = w.Write([]byte("data: {\"n\":2}\r\n\r\n"))
+	}))
+	defer ts.Close()
+
+	proxy := &GeminiProxy{BaseURL: ts.URL, APIKey: "secret"}
+	sw := &mockStreamWriter{}
+	err := proxy.Stream(context.Background(), "models/gemini-2.5-pro:streamGenerateContent",
+		io.NopCloser(strings.NewReader(`{}`)), sw)
+	require.NoError(t, err)
+	assert.Equal(t, "data: {\"n\":1}\r\n\r\ndata: {\"n\":2}\r\n\r\n", sw.String())
+	assert.Equal(t, []int{len("data: {\"n\":1}\r\n\r\n"), 2 * len("data: {\"n\":1}\r\n\r\n"), 2 * len("data: {\"n\":1}\r\n\r\n")},
+		sw.flushedAt, "flushed after every event and on the end of stream")
+}
+
+func TestGeminiProxy_StreamCanceled(t *testing.T) {
+	unblock := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("data: {}\n\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-unblock:
+		}
+	}))
+	defer ts.Close()
+	defer close(unblock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	proxy := &GeminiProxy{BaseURL: ts.URL, APIKey: "secret"}
+	sw := &mockStreamWriter{onFlush: cancel}
+	err := proxy.Stream(ctx, "models/gemini-2.5-pro:streamGenerateContent", io.NopCloser(strings.NewReader(`{}`)), sw)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, "data: {}\n\n", sw.String())
+}
+
+func TestIsStreaming(t *testing.T) {
+	assert.True(t, IsStreaming("models/gemini-2.5-pro:streamGenerateContent"))
+	assert.False(t, IsStreaming("models/gemini-2.5-pro:generateContent"))
+	assert.False(t, IsStreaming("streamGenerateContent"))
+}
+
+type mockStreamWriter struct {
+	bytes.Buffer
+	flushedAt []int
+	onFlush   func()
+}
+
+func (m *mockStreamWriter) Flush() error {
+	m.flushedAt = append(m.flushedAt, m.Len())
+	if m.onFlush != nil {
+		m.onFlush()
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package service
+
+// Settings are parts of proxy configuration which could be changed without restart, see GeminiProxy.Reload
+type Settings struct {
+	APIKey         string
+	Keys           *KeyPool
+	AllowedModels  []string
+	AllowedMethods []string
+	Retry          *RetryPolicy
+	Policies       *PolicySet
+	Filters        []ContentFilter
+	ModelTimeouts  []ModelTimeout
+}
+
+// Reload replaces settings of proxy at once, requests in flight finish with settings they started with
+func (r *GeminiProxy) Reload(s Settings) {
+	r.settings.Store(&s)
+}
+
+// Settings returns current settings, they are taken from fields of proxy until the first Reload
+func (r *GeminiProxy) Settings() Settings {
+	if s := r.settings.Load(); s != nil {
+		return *s
+	}
+	return Settings{APIKey: r.APIKey, Keys: r.Keys, AllowedModels: r.AllowedModels, AllowedMethods: r.AllowedMethods,
+		Retry: r.Retry, Policies: r.Policies, Filters: r.Filters, ModelTimeouts: r.ModelTimeouts}
+}
+
+// pickKey returns Gemini API key for the next call, key pool takes precedence over single key
+func (s Settings) pickKey() string {
+	if s.Keys != nil {
+		return s.Keys.Pick()
+	}
+	return s.APIKey
+}
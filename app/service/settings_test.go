@@ -0,0 +1,46 @@
+package service
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeminiProxy_Reload(t *testing.T) {
+	var gotKey string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotKey = r.Header.Get("x-goog-api-key")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+
+	p := &GeminiProxy{BaseURL: ts.URL, APIKey: "k1", AllowedModels: []string{"gemini-2.5-pro"}}
+	assert.Equal(t, "k1", p.Settings().APIKey, "settings are taken from fields before reload")
+	send := func(model string) error {
+		_, err := p.Send(context.Background(), "models/"+model+":generateContent",
+			io.NopCloser(strings.NewReader(`{"contents":[]}`)))
+		return err
+	}
+
+	require.NoError(t, send("gemini-2.5-pro"))
+	assert.Equal(t, "k1", gotKey)
+	assert.ErrorIs(t, send("gemini-2.5-flash"), ErrNotAllowed)
+
+	keys, err := NewKeyPool([]string{"k2", "k3"}, RoundRobin, 0)
+	require.NoError(t, err)
+	p.Reload(Settings{Keys: keys, AllowedModels: []string{"gemini-2.5-*"}})
+	require.NoError(t, send("gemini-2.5-flash"))
+	assert.Equal(t, "k2", gotKey, "key of reloaded pool is used")
+	require.NoError(t, send("gemini-2.5-pro"))
+	assert.Equal(t, "k3", gotKey)
+	assert.Equal(t, "k1", p.APIKey, "fields are not changed")
+
+	p.Reload(Settings{})
+	assert.EqualError(t, send("gemini-2.5-pro"), "gemini API key is not found")
+}
@@ -0,0 +1,34 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Usage is token counts reported by Gemini in usageMetadata of response
+type Usage struct {
+	PromptTokens     int64 `json:"promptTokenCount"`
+	CandidatesTokens int64 `json:"candidatesTokenCount"`
+	TotalTokens      int64 `json:"totalTokenCount"`
+}
+
+// ParseUsage extracts usageMetadata from Gemini response body, it returns false if body has no usage
+func ParseUsage(body []byte) (Usage, bool) {
+	var resp struct {
+		UsageMetadata *Usage `json:"usageMetadata"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || resp.UsageMetadata == nil {
+		return Usage{}, false
+	}
+	return *resp.UsageMetadata, true
+}
+
+// ParseEventUsage extracts usageMetadata from "data:" line of SSE stream. Every streamed chunk reports
+// cumulative usage, so the last one is usage of whole response
+func ParseEventUsage(line []byte) (Usage, bool) {
+	data, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:"))
+	if !ok {
+		return Usage{}, false
+	}
+	return ParseUsage(data)
+}
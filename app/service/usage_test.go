@@ -0,0 +1,28 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUsage(t *testing.T) {
+	u, ok := ParseUsage([]byte(`{"candidates":[],"usageMetadata":{"promptTokenCount":10,"candidatesTokenCount":5,"totalTokenCount":15}}`))
+	assert.True(t, ok)
+	assert.Equal(t, Usage{PromptTokens: 10, CandidatesTokens: 5, TotalTokens: 15}, u)
+
+	_, ok = ParseUsage([]byte(`{"totalTokens":10}`))
+	assert.False(t, ok)
+
+	_, ok = ParseUsage([]byte(`not json`))
+	assert.False(t, ok)
+}
+
+func TestParseEventUsage(t *testing.T) {
+	u, ok := ParseEventUsage([]byte("data: {\"usageMetadata\":{\"promptTokenCount\":3,\"candidatesTokenCount\":7}}\r\n"))
+	assert.True(t, ok)
+	assert.Equal(t, Usage{PromptTokens: 3, CandidatesTokens: 7}, u)
+
+	_, ok = ParseEventUsage([]byte("\r\n"))
+	assert.False(t, ok)
+}